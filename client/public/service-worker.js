@@ -4,6 +4,8 @@ var socket = null;
 var activeTabId = null;
 var currentURL = "";
 var socketInterval = null;
+var socketFailures = 0;
+var polling = false;
 
 function sanitizeSiteUrl(url) {
 	const site = new URL(url);
@@ -48,17 +50,21 @@ function deepParse(obj) {
 	return obj;
 }
 
-function openWebSocket(user_id) {
+function openWebSocket(user_id, access_token) {
+	// Behind proxies that block websockets events keep arriving by long polling
+	if (polling) return;
+
 	if (socket) {
 		socket.close(1000, "Normal closure");
 	}
 
-	socket = new WebSocket(
-		`ws://blablah-live-production.up.railway.app/receive/${user_id}?SiteId=${sanitizeSiteUrl(currentURL)}`
-	);
+	// Websockets cannot set headers, the access token goes in the query
+	const query = new URLSearchParams({ SiteId: sanitizeSiteUrl(currentURL), access_token: access_token });
+	socket = new WebSocket(`ws://blablah-live-production.up.railway.app/receive/${user_id}?${query}`);
 
 	socket.onopen = function (event) {
 		console.log("WebSocket connection opened");
+		socketFailures = 0;
 		clearInterval(socketInterval);
 		if (socket && socket.readyState && socket.readyState === WebSocket.OPEN)
 			socketInterval = setInterval(() => {
@@ -66,9 +72,15 @@ function openWebSocket(user_id) {
 			}, 5000);
 	};
 
+	let restartDelay = 0;
+
 	socket.onmessage = function (event) {
+		const data = deepParse(event.data);
+		// The server is about to close the socket to restart, it says when to come back
+		if (data && data.type === "restarting") restartDelay = data.data.reconnect_in_ms;
+
 		// Broadcast to other parts of the extension
-		chrome.runtime.sendMessage({ action: "WS_MESSAGE", data: deepParse(event.data) });
+		chrome.runtime.sendMessage({ action: "WS_MESSAGE", data: data });
 	};
 
 	socket.onerror = function (error) {
@@ -78,14 +90,55 @@ function openWebSocket(user_id) {
 	socket.onclose = function (event) {
 		console.log("WebSocket closed. Reconnecting...", event);
 		socket = null;
+		if (restartDelay) {
+			setTimeout(() => {
+				openWebSocket(user_id, access_token);
+			}, restartDelay);
+			return;
+		}
 		if (!event.wasClean) {
+			socketFailures++;
+			if (socketFailures >= 3) {
+				pollEvents(user_id, access_token);
+				return;
+			}
 			setTimeout(() => {
-				openWebSocket(user_id);
+				openWebSocket(user_id, access_token);
 			}, 5000); // Attempt to reconnect after 5 seconds
 		}
 	};
 }
 
+// Long poll the same event stream the websocket delivers, resuming after the last event received
+async function pollEvents(user_id, access_token) {
+	if (polling) return;
+	polling = true;
+	console.log("WebSocket unavailable, falling back to long polling");
+
+	let lastEventId = "";
+	while (polling) {
+		const query = new URLSearchParams({ SiteId: sanitizeSiteUrl(currentURL), last_event_id: lastEventId });
+		try {
+			const response = await fetch(`https://blablah-live-production.up.railway.app/v1/poll/${user_id}?${query}`, {
+				headers: { Authorization: `Bearer ${access_token}` }
+			});
+			if (response.status === 404 && lastEventId) {
+				// The session expired, start a new one
+				lastEventId = "";
+				continue;
+			}
+			if (!response.ok) throw new Error(`Poll failed: ${response.statusText}`);
+
+			const { data } = await response.json();
+			data.events.forEach((event) => chrome.runtime.sendMessage({ action: "WS_MESSAGE", data: deepParse(event) }));
+			lastEventId = data.last_event_id;
+		} catch (error) {
+			console.error(error);
+			await new Promise((resolve) => setTimeout(resolve, 5000));
+		}
+	}
+}
+
 chrome.runtime.onConnect.addListener((port) => {
 	console.log("Port connected with name:", port.name);
 
@@ -98,10 +151,10 @@ chrome.runtime.onConnect.addListener((port) => {
 
 			if (!panelClosedCalled) {
 				panelClosedCalled = true;
-				chrome.storage.local.get(["user_id"], (result) => {
+				chrome.storage.local.get(["user_id", "access_token"], (result) => {
 					fetch("https://blablah-live-production.up.railway.app/update/user?IsOnline=false", {
 						method: "POST",
-						headers: { "X-Id": result["user_id"] }
+						headers: { "X-Id": result["user_id"], Authorization: `Bearer ${result["access_token"]}` }
 					})
 						.then((response) => {
 							if (!response.ok) {
@@ -136,8 +189,9 @@ chrome.runtime.onMessage.addListener((message, sender, sendResponse) => {
 	}
 
 	if (message.action === "START_WS_SESSION") {
-		chrome.storage.local.get(["user_id"], (result) => {
-			openWebSocket(result["user_id"]);
+		chrome.storage.local.get(["user_id", "access_token"], (result) => {
+			openWebSocket(result["user_id"], result["access_token"]);
+			subscribePush(result["user_id"], result["access_token"]);
 		});
 	}
 });
@@ -177,3 +231,59 @@ chrome.tabs.onUpdated.addListener((tabId, changeInfo, tab) => {
 chrome.runtime.onInstalled.addListener(() => {
 	chrome.sidePanel.setPanelBehavior({ openPanelOnActionClick: true });
 });
+
+function urlBase64ToUint8Array(value) {
+	const padding = "=".repeat((4 - (value.length % 4)) % 4);
+	const raw = atob((value + padding).replace(/-/g, "+").replace(/_/g, "/"));
+	return Uint8Array.from(raw, (char) => char.charCodeAt(0));
+}
+
+// Register for Web Push so mentions, DMs and replies reach the user while the panel is closed
+async function subscribePush(user_id, access_token) {
+	if (!user_id || !access_token || !self.registration || !self.registration.pushManager) return;
+
+	try {
+		const keyResponse = await fetch("https://blablah-live-production.up.railway.app/v1/push/vapid-key");
+		if (!keyResponse.ok) return; // push is not enabled on the server
+		const { data } = await keyResponse.json();
+
+		let subscription = await self.registration.pushManager.getSubscription();
+		if (!subscription) {
+			subscription = await self.registration.pushManager.subscribe({
+				userVisibleOnly: true,
+				applicationServerKey: urlBase64ToUint8Array(data.public_key)
+			});
+		}
+
+		await fetch("https://blablah-live-production.up.railway.app/v1/push/subscriptions", {
+			method: "POST",
+			headers: { "Content-Type": "application/json", Authorization: `Bearer ${access_token}` },
+			body: JSON.stringify({ ...subscription.toJSON(), device: navigator.userAgent })
+		});
+	} catch (error) {
+		console.error("Push subscription failed: ", error);
+	}
+}
+
+self.addEventListener("push", (event) => {
+	if (!event.data) return;
+
+	const notification = event.data.json();
+	event.waitUntil(
+		self.registration.showNotification(notification.title, {
+			body: notification.body,
+			icon: "logo.png",
+			tag: notification.message_id,
+			data: notification
+		})
+	);
+});
+
+self.addEventListener("notificationclick", (event) => {
+	event.notification.close();
+
+	const notification = event.notification.data || {};
+	if (notification.channel && !notification.channel.startsWith("dm:")) {
+		event.waitUntil(chrome.tabs.create({ url: notification.channel }));
+	}
+});
@@ -2,7 +2,14 @@ import { useEffect, useRef, useState } from "react";
 import { ChatInterface } from "./components/chat-interface";
 import axios from "axios";
 import newMessageSound from "./new-message.mp3";
-import { getItemFromChromeStorage, sanitizeSiteUrl, setItemInChromeStorage, ChatMessage } from "./lib/utils";
+import {
+	getItemFromChromeStorage,
+	sanitizeSiteUrl,
+	setItemInChromeStorage,
+	ChatMessage,
+	WireMessage,
+	toChatMessage
+} from "./lib/utils";
 /// <reference types="chrome"/>
 
 function App() {
@@ -58,19 +65,27 @@ function App() {
 		appReadyRef.current = true;
 
 		if (message.action === "WS_MESSAGE") {
-			let userId = await getItemFromChromeStorage("user_id");
-			let type = message.data.type;
-			let payload: ChatMessage = message.data.doc;
-			if (type === "insert") {
-				if (userId !== payload.from.Id) {
-					var audio = new Audio(newMessageSound);
-					audio.play();
-					setState((prevState) => ({ ...prevState, chat: [...prevState.chat, payload], updateType: "insertDown" }));
+			// Only message events carry a message, presence, typing, session and other events and the "pong" frame do not
+			let type = message.data && message.data.type;
+			switch (type) {
+				case "insert": {
+					let userId = await getItemFromChromeStorage("user_id");
+					let payload: ChatMessage = toChatMessage(message.data.data);
+					if (userId !== payload.from.Id) {
+						var audio = new Audio(newMessageSound);
+						audio.play();
+						setState((prevState) => ({ ...prevState, chat: [...prevState.chat, payload], updateType: "insertDown" }));
+					}
+					break;
+				}
+				case "update":
+					handleUpdateMsg(toChatMessage(message.data.data));
+					break;
+				case "delete": {
+					let payload: ChatMessage = toChatMessage(message.data.data);
+					setState((prevState) => ({ ...prevState, chat: prevState.chat.filter((msg) => msg._id !== payload._id), updateType: "delete" }));
+					break;
 				}
-			}
-
-			if (type === "update") {
-				handleUpdateMsg(payload);
 			}
 		}
 
@@ -122,19 +137,29 @@ function App() {
 		// Register the user
 
 		let userId = await getItemFromChromeStorage("user_id");
+		let accessToken = await getItemFromChromeStorage("access_token");
 
 		try {
 			const headers: { [key: string]: string } = {};
 			if (userId) {
 				// @ts-ignore
 				headers["X-Id"] = userId;
+
+				// Installs from before access tokens only know their id, the server hands them a token once
+				if (!accessToken) {
+					let response = await axios.post(`${import.meta.env.VITE_BASE_URL}/register?SiteId=${url}`, {}, { headers });
+					accessToken = response.data.data.access_token;
+					setItemInChromeStorage("access_token", accessToken);
+				}
+				headers["Authorization"] = `Bearer ${accessToken}`;
 				await axios.post(`${import.meta.env.VITE_BASE_URL}/update/user?IsOnline=true&SiteId=${url}`, {}, { headers });
 			}
 
 			if (!userId) {
 				let response = await axios.post(`${import.meta.env.VITE_BASE_URL}/register?SiteId=${url}`);
 				setItemInChromeStorage("user_id", response.data.id);
-				setItemInChromeStorage("profile", JSON.parse(response.data.data));
+				setItemInChromeStorage("access_token", response.data.data.access_token);
+				setItemInChromeStorage("profile", response.data.data);
 				// Create new socket connection...
 			}
 
@@ -163,19 +188,9 @@ function App() {
 				)
 				.then((resp) => {
 					let chatArray: ChatMessage[] = [];
-					if (Array.isArray(resp.data.data)) {
-						resp.data.data.forEach((msg: any) => {
-							chatArray.push({
-								_id: msg.Id,
-								created_at: msg.CreatedAt,
-								updated_at: msg.UpdatedAt,
-								from: msg.from,
-								flagged: msg.flagged,
-								channel: msg.ChannelId,
-								message: msg.Message,
-								to: msg.to,
-								reactions: msg.reactions
-							});
+					if (Array.isArray(resp.data.data.messages)) {
+						resp.data.data.messages.forEach((msg: WireMessage) => {
+							chatArray.push(toChatMessage(msg));
 						});
 
 						chatArray = chatArray.map((msg: ChatMessage) => {
@@ -204,8 +219,8 @@ function App() {
 
 						setState((prevState) => ({
 							...prevState,
-							hasMoreMessages: resp.data.hasMore,
-							nextBookmark: resp.data.nextBookmark,
+							hasMoreMessages: resp.data.data.has_more,
+							nextBookmark: resp.data.data.next_bookmark,
 							chat: JSON.parse(JSON.stringify(chatArray)),
 							updateType: "insertUp",
 							isChatLoading: false
@@ -1,4 +1,4 @@
-import { ChatMessage, getItemFromChromeStorage } from "@/lib/utils";
+import { ChatMessage, getItemFromChromeStorage, toChatMessage } from "@/lib/utils";
 import axios from "axios";
 import { useEffect, useState } from "react";
 
@@ -23,14 +23,10 @@ function RepliedMessage({ _id, channel }: { _id: string; channel: string | "" })
 				let response = await axios.get(`${import.meta.env.VITE_BASE_URL}/message/${_id}?SiteId=${channel}`, {
 					headers
 				});
-				let msg = response.data.data;
 				setState((prevState) => ({
 					...prevState,
 					isLoading: false,
-					message: {
-						...msg,
-						message: msg.Message
-					}
+					message: toChatMessage(response.data.data)
 				}));
 			}
 		} catch (error) {}
@@ -23,7 +23,7 @@ import {
 	Eye
 } from "lucide-react";
 import axios from "axios";
-import { ChatMessage, getItemFromChromeStorage } from "@/lib/utils";
+import { ChatMessage, getItemFromChromeStorage, toChatMessage } from "@/lib/utils";
 import { Alert, AlertTitle, AlertDescription } from "./ui/alert";
 import { Skeleton } from "./ui/skeleton";
 import { Label } from "./ui/label";
@@ -157,39 +157,23 @@ export function ChatInterface({
 
 	const sendMessage = async () => {
 		let userId = await getItemFromChromeStorage("user_id");
-		let myProfile = await getItemFromChromeStorage("profile");
+		let accessToken = await getItemFromChromeStorage("access_token");
 		try {
 			setMessage("");
 			const headers: { [key: string]: string } = {};
 			if (userId && message.length > 0) {
-				// @ts-ignore
-				headers["X-Id"] = userId;
+				headers["Authorization"] = `Bearer ${accessToken}`;
 				let messageObj = {
-					Timestamp: new Date().toISOString(),
-					// @ts-ignore
-					From: { Id: String(userId), Username: myProfile["Username"] },
-					To: (replyTo && replyTo._id) || "",
-					Reactions: {},
-					Flagged: {},
-					Message: message,
-					ChannelId: currentURL
+					message: message,
+					to: (replyTo && replyTo._id) || "",
+					channel: currentURL
 				};
 				let response = await axios.post(
 					`${import.meta.env.VITE_BASE_URL}/send?SiteId=${currentURL}`,
 					{ ...messageObj },
 					{ headers }
 				);
-				setChat({
-					_id: response.data.MsgId,
-					created_at: messageObj.Timestamp,
-					updated_at: messageObj.Timestamp,
-					from: messageObj.From,
-					flagged: messageObj.Flagged,
-					channel: messageObj.ChannelId,
-					message: messageObj.Message,
-					to: messageObj.To,
-					reactions: messageObj.Reactions
-				});
+				setChat(toChatMessage(response.data.data));
 				setReplyTo(null);
 				scrollToBottom("bottom");
 			}
@@ -213,12 +197,12 @@ export function ChatInterface({
 
 	const handleReaction = async (emoji: string) => {
 		let userId = await getItemFromChromeStorage("user_id");
+		let accessToken = await getItemFromChromeStorage("access_token");
 		try {
 			setHoveredMessage(null);
 			const headers: { [key: string]: string } = {};
 			if (userId && hoveredMessage) {
-				// @ts-ignore
-				headers["X-Id"] = userId;
+				headers["Authorization"] = `Bearer ${accessToken}`;
 				await axios.post(`${import.meta.env.VITE_BASE_URL}/react/${hoveredMessage}`, { emoji }, { headers });
 			}
 		} catch (error) {}
@@ -230,12 +214,12 @@ export function ChatInterface({
 
 	const handleReportMessage = async () => {
 		let userId = await getItemFromChromeStorage("user_id");
+		let accessToken = await getItemFromChromeStorage("access_token");
 		try {
 			setHoveredMessage(null);
 			const headers: { [key: string]: string } = {};
 			if (userId && hoveredMessage) {
-				// @ts-ignore
-				headers["X-Id"] = userId;
+				headers["Authorization"] = `Bearer ${accessToken}`;
 				await axios.post(`${import.meta.env.VITE_BASE_URL}/report/${hoveredMessage}`, {}, { headers });
 			}
 		} catch (error) {}
@@ -349,7 +333,7 @@ export function ChatInterface({
 									>
 										<img
 											className="w-10 h-10 rounded-full bg-muted"
-											src={`https://api.dicebear.com/9.x/thumbs/svg?seed=${msg.from.Username}&radius=50&backgroundColor=0a5b83,1c799f,69d2e7,f1f4dc,f88c49,b6e3f4,c0aede&translateY=15&randomizeIds=true`}
+											src={msg.from.Avatar}
 										></img>
 										<div className="flex-1">
 											<div className="rounded-lg">
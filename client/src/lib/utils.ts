@@ -63,4 +63,42 @@ export interface ChatMessage {
     flagged: string[],
     message: string,
     channel: string,
-}
\ No newline at end of file
+}
+
+// Canonical message shape sent by the server over REST and websocket
+export interface WireMessage {
+    v: number,
+    id: string,
+    channel: string,
+    message: string,
+    to: string,
+    from: {
+        id: string;
+        username: string;
+        avatar: string;
+    },
+    reactions: { [key: string]: string[] },
+    flagged: { [key: string]: string[] },
+    created_at: string,
+    updated_at: string,
+}
+
+export const toChatMessage = (msg: WireMessage): ChatMessage => ({
+    _id: msg.id,
+    created_at: msg.created_at,
+    updated_at: msg.updated_at,
+    from: {
+        Id: msg.from.id,
+        // Avatar links are relative unless the server knows its public URL
+        Avatar: msg.from.avatar && msg.from.avatar.startsWith("/")
+            ? `${import.meta.env.VITE_BASE_URL}${msg.from.avatar}`
+            : msg.from.avatar,
+        Username: msg.from.username,
+    },
+    to: msg.to,
+    reactions: msg.reactions || {},
+    // @ts-ignore
+    flagged: msg.flagged || {},
+    message: msg.message,
+    channel: msg.channel,
+});
@@ -0,0 +1,403 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/url"
+	"strings"
+
+	"server/auth"
+	"server/dto"
+	"server/mail"
+	"server/models"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+var (
+	authProviders = map[string]*auth.OIDCProvider{}
+	mailSender    mail.Sender
+	// magicLinkBase is the public URL of the server magic links point to
+	magicLinkBase string
+	// allowedLoginRedirects are the URL prefixes a finished login may return to
+	allowedLoginRedirects []string
+)
+
+// RegisterAuthProvider enables sign in with provider under /v1/auth/<name>
+func RegisterAuthProvider(provider *auth.OIDCProvider) {
+	authProviders[provider.Name()] = provider
+}
+
+// EnableEmailLogin turns on login with codes sent by sender. Magic links in
+// the emails point to publicURL, they are left out when it is empty.
+func EnableEmailLogin(sender mail.Sender, publicURL string) {
+	mailSender = sender
+	magicLinkBase = strings.TrimRight(publicURL, "/")
+}
+
+// SetAllowedLoginRedirects sets the URL prefixes login may redirect back to,
+// e.g. the chromiumapp.org URL of the extension
+func SetAllowedLoginRedirects(prefixes []string) {
+	allowedLoginRedirects = prefixes
+}
+
+func authProvider(ctx *fiber.Ctx) (*auth.OIDCProvider, error) {
+	provider, ok := authProviders[ctx.Params("provider")]
+	if !ok {
+		return nil, ErrAuthProviderUnknown
+	}
+	return provider, nil
+}
+
+func isAllowedLoginRedirect(redirectURI string) bool {
+	for _, prefix := range allowedLoginRedirects {
+		if prefix != "" && strings.HasPrefix(redirectURI, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// StartLogin returns the provider URL that signs the calling user in.
+// redirect_uri is where the browser lands once signed in.
+func (c *ChatController) StartLogin(ctx *fiber.Ctx) error {
+	provider, err := authProvider(ctx)
+	if err != nil {
+		return err
+	}
+
+	redirectURI := ctx.Query("redirect_uri")
+	if redirectURI != "" && !isAllowedLoginRedirect(redirectURI) {
+		return ErrRedirectNotAllowed
+	}
+
+	state := auth.LoginState{
+		Provider:     provider.Name(),
+		UserId:       authenticatedUser(ctx),
+		Nonce:        auth.RandomToken(),
+		CodeVerifier: auth.RandomToken(),
+		RedirectURI:  redirectURI,
+	}
+	key, err := models.PutLoginState(state)
+	if err != nil {
+		return err
+	}
+
+	return ctx.Status(200).JSON(fiber.Map{
+		"status":  200,
+		"message": "Open auth_url to sign in",
+		"data":    dto.LoginStarted{AuthURL: provider.AuthCodeURL(key, state.Nonce, state.CodeVerifier)},
+	})
+}
+
+// LoginCallback finishes the authorization code flow and links the account
+func (c *ChatController) LoginCallback(ctx *fiber.Ctx) error {
+	provider, err := authProvider(ctx)
+	if err != nil {
+		return err
+	}
+
+	if providerErr := ctx.Query("error"); providerErr != "" {
+		return NewAPIError(fiber.StatusUnauthorized, CodeAuthFailed, "Sign in was not completed: "+providerErr)
+	}
+
+	state, err := models.TakeLoginState(ctx.Query("state"))
+	if errors.Is(err, models.ErrLoginStateInvalid) || (err == nil && state.Provider != provider.Name()) {
+		return ErrAuthStateInvalid
+	}
+	if err != nil {
+		return err
+	}
+
+	identity, err := provider.Exchange(ctx.Context(), ctx.Query("code"), state.CodeVerifier, state.Nonce)
+	if err != nil {
+		requestLogger(ctx).Warn("Sign in failed", "provider", provider.Name(), "err", err)
+		return ErrAuthFailed
+	}
+
+	user, err := linkIdentity(state.UserId, identity)
+	if err != nil {
+		return err
+	}
+
+	return finishLogin(ctx, user, state.RedirectURI)
+}
+
+// finishLogin issues an access token for the signed in user and sends the
+// browser back to redirectURI with it, or answers with the user when there
+// is nowhere to go back to
+func finishLogin(ctx *fiber.Ctx, user *models.UserModel, redirectURI string) error {
+	token, err := models.IssueAccessToken(user.Id)
+	if err != nil {
+		return err
+	}
+
+	if redirectURI != "" {
+		fragment := url.Values{"user_id": {user.Id}, "access_token": {token}}.Encode()
+		return ctx.Redirect(redirectURI+"#"+fragment, fiber.StatusFound)
+	}
+
+	result := user.ToDTO()
+	result.AccessToken = token
+	return ctx.Status(200).JSON(fiber.Map{
+		"status":  200,
+		"message": "Signed in successfully",
+		"data":    result,
+	})
+}
+
+// StartIdTokenLogin issues the nonce the calling user requests an ID token
+// from the provider with, LoginWithIdToken only accepts tokens carrying it
+func (c *ChatController) StartIdTokenLogin(ctx *fiber.Ctx) error {
+	provider, err := authProvider(ctx)
+	if err != nil {
+		return err
+	}
+
+	nonce, err := models.PutLoginNonce(auth.LoginState{
+		Provider: provider.Name(),
+		UserId:   authenticatedUser(ctx),
+	})
+	if err != nil {
+		return err
+	}
+
+	return ctx.Status(200).JSON(fiber.Map{
+		"status":  200,
+		"message": "Request the ID token with this nonce",
+		"data":    dto.LoginNonce{Nonce: nonce, ExpiresIn: int(models.LoginStateTTL.Seconds())},
+	})
+}
+
+// LoginWithIdToken links the account of an ID token the client obtained
+// from the provider itself, with a nonce from StartIdTokenLogin
+func (c *ChatController) LoginWithIdToken(ctx *fiber.Ctx) error {
+	provider, err := authProvider(ctx)
+	if err != nil {
+		return err
+	}
+
+	var request dto.IdTokenLoginRequest
+	if err := ctx.BodyParser(&request); err != nil || request.IdToken == "" || request.Nonce == "" {
+		return ErrInvalidBody
+	}
+
+	state, err := models.TakeLoginState(request.Nonce)
+	if errors.Is(err, models.ErrLoginStateInvalid) || (err == nil && (state.Provider != provider.Name() || state.UserId != authenticatedUser(ctx))) {
+		return ErrAuthStateInvalid
+	}
+	if err != nil {
+		return err
+	}
+
+	identity, err := provider.Verify(ctx.Context(), request.IdToken, state.Nonce)
+	if err != nil {
+		requestLogger(ctx).Warn("Sign in failed", "provider", provider.Name(), "err", err)
+		return ErrAuthFailed
+	}
+
+	user, err := linkIdentity(state.UserId, identity)
+	if err != nil {
+		return err
+	}
+
+	return finishLogin(ctx, user, "")
+}
+
+func linkIdentity(userId string, identity *auth.Identity) (*models.UserModel, error) {
+	email := ""
+	if identity.EmailVerified {
+		email = identity.Email
+	}
+
+	user, err := models.LinkIdentity(userId, models.LinkedIdentity{
+		Provider: identity.Provider,
+		Subject:  identity.Subject,
+		Email:    email,
+	})
+	if errors.Is(err, models.ErrProviderAlreadyLinked) {
+		return nil, ErrProviderAlreadyLinked
+	}
+	return user, err
+}
+
+// StartEmailLogin emails a login code and magic link that link the address
+// to the calling user, who is known by the access token only so nobody can
+// attach their address to another user
+func (c *ChatController) StartEmailLogin(ctx *fiber.Ctx) error {
+	if mailSender == nil {
+		return ErrAuthProviderUnknown
+	}
+
+	userId := authenticatedUser(ctx)
+
+	var request dto.EmailLoginRequest
+	if err := ctx.BodyParser(&request); err != nil {
+		return ErrInvalidBody
+	}
+
+	email, err := auth.NormalizeEmail(request.Email)
+	if err != nil {
+		return ErrInvalidEmail
+	}
+	if request.RedirectURI != "" && !isAllowedLoginRedirect(request.RedirectURI) {
+		return ErrRedirectNotAllowed
+	}
+
+	code, token, err := models.IssueLoginCode(auth.EmailLogin{Email: email, UserId: userId, RedirectURI: request.RedirectURI})
+	if errors.Is(err, auth.ErrTooManyCodes) {
+		ctx.Set(fiber.HeaderRetryAfter, fmt.Sprint(int(models.LoginCodeWindow.Seconds())))
+		return ErrTooManyLoginCodes
+	}
+	if err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("Your Blablah login code is %s\n\nIt expires in %d minutes.\n", code, int(models.LoginCodeTTL.Minutes()))
+	if magicLinkBase != "" {
+		link := magicLinkBase + V1Prefix + "/auth/email/verify?" + url.Values{"token": {token}}.Encode()
+		body += "\nOr sign in by opening this link:\n" + link + "\n"
+	}
+	body += "\nIf you did not ask for this you can ignore this email.\n"
+
+	err = mailSender.Send(ctx.Context(), mail.Message{To: email, Subject: "Your Blablah login code", Body: body})
+	if err != nil {
+		requestLogger(ctx).Error("Sending login email failed", "err", err)
+		return ErrInternal
+	}
+
+	return ctx.Status(200).JSON(fiber.Map{
+		"status":  200,
+		"message": "Login code sent",
+		"data":    dto.EmailLoginStarted{ExpiresIn: int(models.LoginCodeTTL.Seconds())},
+	})
+}
+
+// VerifyEmailCode signs in with the code received by email. Only the user
+// that asked for the code can use it, so others guessing at an address get
+// nowhere near its codes.
+func (c *ChatController) VerifyEmailCode(ctx *fiber.Ctx) error {
+	if mailSender == nil {
+		return ErrAuthProviderUnknown
+	}
+
+	var request dto.EmailCodeRequest
+	if err := ctx.BodyParser(&request); err != nil {
+		return ErrInvalidBody
+	}
+
+	email, err := auth.NormalizeEmail(request.Email)
+	if err != nil {
+		return ErrInvalidEmail
+	}
+
+	login, err := models.VerifyLoginCode(authenticatedUser(ctx), email, strings.TrimSpace(request.Code))
+	if errors.Is(err, auth.ErrCodeLocked) {
+		ctx.Set(fiber.HeaderRetryAfter, fmt.Sprint(int(models.LoginCodeWindow.Seconds())))
+		return ErrLoginCodesLocked
+	}
+	if errors.Is(err, auth.ErrInvalidCode) {
+		return ErrLoginCodeInvalid
+	}
+	if err != nil {
+		return err
+	}
+
+	user, err := linkEmail(login)
+	if err != nil {
+		return err
+	}
+
+	return finishLogin(ctx, user, "")
+}
+
+// ShowMagicLink answers the link received by email with a page asking to
+// confirm the sign in. Opening the link does not use it up, so mail
+// scanners fetching it do not break the login.
+func (c *ChatController) ShowMagicLink(ctx *fiber.Ctx) error {
+	if mailSender == nil {
+		return ErrAuthProviderUnknown
+	}
+
+	token := ctx.Query("token")
+	login, err := models.PeekLoginToken(token)
+	if errors.Is(err, auth.ErrInvalidCode) {
+		return ErrLoginCodeInvalid
+	}
+	if err != nil {
+		return err
+	}
+
+	ctx.Set(fiber.HeaderCacheControl, "no-store")
+	ctx.Set("Referrer-Policy", "no-referrer")
+	ctx.Type("html", "utf-8")
+	return magicLinkPage.Execute(ctx, magicLinkPageData{
+		Email:  login.Email,
+		Action: V1Prefix + "/auth/email/confirm",
+		Token:  token,
+	})
+}
+
+// ConfirmMagicLink signs in with the token of the link received by email,
+// posted by the page ShowMagicLink renders
+func (c *ChatController) ConfirmMagicLink(ctx *fiber.Ctx) error {
+	if mailSender == nil {
+		return ErrAuthProviderUnknown
+	}
+
+	var request dto.MagicLinkRequest
+	if err := ctx.BodyParser(&request); err != nil || request.Token == "" {
+		return ErrInvalidBody
+	}
+
+	login, err := models.TakeLoginToken(request.Token)
+	if errors.Is(err, auth.ErrInvalidCode) {
+		return ErrLoginCodeInvalid
+	}
+	if err != nil {
+		return err
+	}
+
+	user, err := linkEmail(login)
+	if err != nil {
+		return err
+	}
+
+	return finishLogin(ctx, user, login.RedirectURI)
+}
+
+type magicLinkPageData struct {
+	Email  string
+	Action string
+	Token  string
+}
+
+var magicLinkPage = template.Must(template.New("magic-link").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>Sign in to Blablah</title>
+</head>
+<body>
+<form method="post" action="{{.Action}}">
+<p>Sign in to Blablah as <strong>{{.Email}}</strong>?</p>
+<input type="hidden" name="token" value="{{.Token}}">
+<button type="submit">Sign in</button>
+</form>
+</body>
+</html>
+`))
+
+// linkEmail signs the user in with the email, an address already linked to
+// a user gets that user back, e.g. after the extension storage was cleared
+func linkEmail(login auth.EmailLogin) (*models.UserModel, error) {
+	return linkIdentity(login.UserId, &auth.Identity{
+		Provider:      auth.EmailProvider,
+		Subject:       login.Email,
+		Email:         login.Email,
+		EmailVerified: true,
+	})
+}
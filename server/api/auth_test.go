@@ -0,0 +1,338 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"server/auth"
+	"server/dto"
+	"server/mail"
+	"server/models"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func enableTestEmailLogin(t *testing.T) *mail.MemorySender {
+	t.Helper()
+
+	sender := &mail.MemorySender{}
+	EnableEmailLogin(sender, "http://chat.test")
+	t.Cleanup(func() { EnableEmailLogin(nil, "") })
+	return sender
+}
+
+func testEmail(t *testing.T) string {
+	return fmt.Sprintf("%s-%d@example.com", strings.ToLower(t.Name()), time.Now().UnixNano())
+}
+
+func TestStartEmailLoginRequiresAccessToken(t *testing.T) {
+	sender := enableTestEmailLogin(t)
+	app := newTestApp(t)
+
+	body := fmt.Sprintf(`{"email":%q}`, testEmail(t))
+	res := call(t, app, http.MethodPost, "/v1/auth/email/start", body, map[string]string{"X-Id": "someone-else"}, nil)
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("got status %d, want 401", res.StatusCode)
+	}
+	if sent := sender.Sent(); len(sent) != 0 {
+		t.Fatalf("an email was sent for an unauthenticated request: %+v", sent)
+	}
+}
+
+func TestMagicLinkPageDoesNotUseTheLink(t *testing.T) {
+	requireMongo(t)
+	enableTestEmailLogin(t)
+	app := newTestApp(t)
+
+	_, token, err := models.IssueLoginCode(auth.EmailLogin{Email: testEmail(t), UserId: "user-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Mail scanners may open the link any number of times
+	for i := 0; i < 2; i++ {
+		res := call(t, app, http.MethodGet, "/v1/auth/email/verify?token="+url.QueryEscape(token), "", nil, nil)
+		page, _ := io.ReadAll(res.Body)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("got status %d: %s", res.StatusCode, page)
+		}
+		if !strings.HasPrefix(res.Header.Get("Content-Type"), "text/html") {
+			t.Fatalf("got content type %q", res.Header.Get("Content-Type"))
+		}
+		if !strings.Contains(string(page), `method="post" action="/v1/auth/email/confirm"`) || !strings.Contains(string(page), token) {
+			t.Fatalf("page does not post the token:\n%s", page)
+		}
+	}
+
+	if _, err := models.PeekLoginToken(token); err != nil {
+		t.Fatal("showing the page used up the link")
+	}
+
+	res := call(t, app, http.MethodGet, "/v1/auth/email/verify?token=unknown", "", nil, nil)
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unknown token: got status %d, want 401", res.StatusCode)
+	}
+}
+
+var (
+	emailedCode = regexp.MustCompile(`login code is (\d{6})`)
+	emailedLink = regexp.MustCompile(`http://chat\.test(/v1/auth/email/verify\?token=\S+)`)
+)
+
+// registerTestUser registers an anonymous user and returns it with its
+// access token
+func registerTestUser(t *testing.T, app *fiber.App) dto.User {
+	t.Helper()
+
+	var response struct {
+		Data dto.User `json:"data"`
+	}
+	res := call(t, app, http.MethodPost, "/v1/users?SiteId=example.com", "", nil, &response)
+	if res.StatusCode != http.StatusOK || response.Data.AccessToken == "" {
+		t.Fatalf("registering: status %d, user %+v", res.StatusCode, response.Data)
+	}
+	return response.Data
+}
+
+func bearer(user dto.User) map[string]string {
+	return map[string]string{"Authorization": "Bearer " + user.AccessToken}
+}
+
+func TestLegacyUserClaimsItsTokenOnce(t *testing.T) {
+	requireMongo(t)
+	app := newTestApp(t)
+
+	user := registerTestUser(t, app)
+	header := map[string]string{"X-Id": user.Id}
+
+	// A user that was given a token must send it
+	res := call(t, app, http.MethodPost, "/v1/users", "", header, nil)
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("registering again without the token: got status %d, want 401", res.StatusCode)
+	}
+
+	// Users registered before tokens existed have none
+	if err := models.UpdateUser(user.Id, bson.M{"token_issued": false}); err != nil {
+		t.Fatal(err)
+	}
+	var response struct {
+		Data dto.User `json:"data"`
+	}
+	res = call(t, app, http.MethodPost, "/v1/users", "", header, &response)
+	if res.StatusCode != http.StatusOK || response.Data.Id != user.Id || response.Data.AccessToken == "" {
+		t.Fatalf("claiming: status %d, user %+v", res.StatusCode, response.Data)
+	}
+	claimed := response.Data
+
+	res = call(t, app, http.MethodPost, "/v1/users", "", header, nil)
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("claiming twice: got status %d, want 401", res.StatusCode)
+	}
+
+	response.Data = dto.User{}
+	res = call(t, app, http.MethodPost, "/v1/users", "", bearer(claimed), &response)
+	if res.StatusCode != http.StatusOK || response.Data.Id != user.Id || response.Data.AccessToken != "" {
+		t.Fatalf("registering with the claimed token: status %d, user %+v", res.StatusCode, response.Data)
+	}
+}
+
+func TestEmailLoginLinksTheCallingUser(t *testing.T) {
+	requireMongo(t)
+	sender := enableTestEmailLogin(t)
+	app := newTestApp(t)
+
+	user := registerTestUser(t, app)
+	email := testEmail(t)
+
+	res := call(t, app, http.MethodPost, "/v1/auth/email/start", fmt.Sprintf(`{"email":%q}`, email), bearer(user), nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("starting: got status %d", res.StatusCode)
+	}
+	sent := sender.Sent()
+	if len(sent) != 1 || sent[0].To != email {
+		t.Fatalf("sent %+v", sent)
+	}
+	code := emailedCode.FindStringSubmatch(sent[0].Body)
+	if code == nil {
+		t.Fatalf("no code in %q", sent[0].Body)
+	}
+
+	var response struct {
+		Data dto.User `json:"data"`
+	}
+	body := fmt.Sprintf(`{"email":%q,"code":%q}`, email, code[1])
+	res = call(t, app, http.MethodPost, "/v1/auth/email/verify", body, nil, nil)
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("verifying without the access token: got status %d, want 401", res.StatusCode)
+	}
+	res = call(t, app, http.MethodPost, "/v1/auth/email/verify", body, bearer(user), &response)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("verifying: got status %d", res.StatusCode)
+	}
+	if response.Data.Id != user.Id || !response.Data.IsLoggedIn || response.Data.AccessToken == "" {
+		t.Fatalf("signed in as %+v, want %s", response.Data, user.Id)
+	}
+}
+
+func TestMagicLinkSignsInOnConfirm(t *testing.T) {
+	requireMongo(t)
+	sender := enableTestEmailLogin(t)
+	app := newTestApp(t)
+
+	user := registerTestUser(t, app)
+	email := testEmail(t)
+
+	res := call(t, app, http.MethodPost, "/v1/auth/email/start", fmt.Sprintf(`{"email":%q}`, email), bearer(user), nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("starting: got status %d", res.StatusCode)
+	}
+	link := emailedLink.FindStringSubmatch(sender.Sent()[0].Body)
+	if link == nil {
+		t.Fatalf("no link in %q", sender.Sent()[0].Body)
+	}
+	parsed, _ := url.Parse(link[1])
+	token := parsed.Query().Get("token")
+
+	form := url.Values{"token": {token}}.Encode()
+	res = call(t, app, http.MethodPost, "/v1/auth/email/confirm", form, map[string]string{"Content-Type": "application/x-www-form-urlencoded"}, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("confirming: got status %d", res.StatusCode)
+	}
+
+	res = call(t, app, http.MethodPost, "/v1/auth/email/confirm", form, map[string]string{"Content-Type": "application/x-www-form-urlencoded"}, nil)
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("confirming twice: got status %d, want 401", res.StatusCode)
+	}
+}
+
+func TestEmailCodeIsSingleUse(t *testing.T) {
+	requireMongo(t)
+	login := auth.EmailLogin{Email: testEmail(t), UserId: "user-1"}
+
+	code, token, err := models.IssueLoginCode(login)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := models.VerifyLoginCode(login.UserId, login.Email, code)
+	if err != nil || got != login {
+		t.Fatalf("verifying: %+v, %v", got, err)
+	}
+	if _, err := models.VerifyLoginCode(login.UserId, login.Email, code); !errors.Is(err, auth.ErrInvalidCode) {
+		t.Fatalf("code accepted twice: %v", err)
+	}
+	if _, err := models.TakeLoginToken(token); !errors.Is(err, auth.ErrInvalidCode) {
+		t.Fatalf("link of a used code accepted: %v", err)
+	}
+}
+
+// wrongCode returns a code that is not code
+func wrongCode(code string) string {
+	if code == "000000" {
+		return "111111"
+	}
+	return "000000"
+}
+
+func TestEmailCodeBelongsToTheRequestingUser(t *testing.T) {
+	requireMongo(t)
+	victim := auth.EmailLogin{Email: testEmail(t), UserId: "victim"}
+
+	code, _, err := models.IssueLoginCode(victim)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Even the right code does nothing for another user
+	if _, err := models.VerifyLoginCode("attacker", victim.Email, code); !errors.Is(err, auth.ErrInvalidCode) {
+		t.Fatalf("another user used the code: %v", err)
+	}
+
+	// Codes an attacker requests for the address do not use up the quota
+	// of its owner
+	attacker := auth.EmailLogin{Email: victim.Email, UserId: "attacker"}
+	for i := 0; i < 5; i++ {
+		if _, _, err := models.IssueLoginCode(attacker); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := models.IssueLoginCode(attacker); !errors.Is(err, auth.ErrTooManyCodes) {
+		t.Fatalf("code over the limit: got %v, want ErrTooManyCodes", err)
+	}
+	if _, _, err := models.IssueLoginCode(victim); err != nil {
+		t.Fatalf("owner refused a code after another user hit the limit: %v", err)
+	}
+}
+
+func TestEmailCodeStopsAfterWrongGuesses(t *testing.T) {
+	requireMongo(t)
+	login := auth.EmailLogin{Email: testEmail(t), UserId: "user-1"}
+
+	code, _, err := models.IssueLoginCode(login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		models.VerifyLoginCode(login.UserId, login.Email, wrongCode(code))
+	}
+	if _, err := models.VerifyLoginCode(login.UserId, login.Email, code); !errors.Is(err, auth.ErrInvalidCode) {
+		t.Fatalf("code accepted after 5 wrong guesses: %v", err)
+	}
+}
+
+func TestWrongGuessesLockTheAddress(t *testing.T) {
+	requireMongo(t)
+	email := testEmail(t)
+
+	// Guessers spread over many users still lock the address
+	for i := 0; i < 10; i++ {
+		guesser := auth.EmailLogin{Email: email, UserId: fmt.Sprintf("guesser-%d", i)}
+		code, _, err := models.IssueLoginCode(guesser)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := models.VerifyLoginCode(guesser.UserId, email, wrongCode(code)); !errors.Is(err, auth.ErrInvalidCode) {
+			t.Fatalf("wrong guess %d: %v", i, err)
+		}
+	}
+
+	owner := auth.EmailLogin{Email: email, UserId: "owner"}
+	code, token, err := models.IssueLoginCode(owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := models.VerifyLoginCode(owner.UserId, email, code); !errors.Is(err, auth.ErrCodeLocked) {
+		t.Fatalf("code of a locked address: got %v, want ErrCodeLocked", err)
+	}
+	// The link cannot be guessed and keeps working
+	if got, err := models.TakeLoginToken(token); err != nil || got != owner {
+		t.Fatalf("link of a locked address: %+v, %v", got, err)
+	}
+}
+
+func TestLoginStateIsSingleUse(t *testing.T) {
+	requireMongo(t)
+
+	nonce, err := models.PutLoginNonce(auth.LoginState{Provider: "fake", UserId: "user-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := models.TakeLoginState(nonce)
+	if err != nil || state.Nonce != nonce || state.UserId != "user-1" || state.Provider != "fake" {
+		t.Fatalf("took %+v, %v", state, err)
+	}
+	if _, err := models.TakeLoginState(nonce); !errors.Is(err, models.ErrLoginStateInvalid) {
+		t.Fatalf("a nonce was accepted twice: %v", err)
+	}
+	if _, err := models.TakeLoginState(""); !errors.Is(err, models.ErrLoginStateInvalid) {
+		t.Fatalf("empty key: %v", err)
+	}
+}
@@ -7,34 +7,54 @@ import (
 	"github.com/gofiber/websocket/v2"
 )
 
-func SetupRoutes(router fiber.Router) {
-
-	controller := &ChatController{}
+// V1Prefix is the mount point of the versioned API
+const V1Prefix = "/v1"
+
+// SetupRoutes mounts the routes of controller on router
+func SetupRoutes(router fiber.Router, controller *ChatController) {
+
+	// Resolve access tokens before any route, routes with Auth set require one
+	router.Use(Authenticate)
+
+	// Versioned API, described by the OpenAPI document at /v1/openapi.json
+	v1Routes := V1Routes(controller)
+	v1 := router.Group(V1Prefix)
+	for _, route := range v1Routes {
+		handlers := []fiber.Handler{}
+		if route.Auth {
+			handlers = append(handlers, RequireAuth)
+		}
+		handlers = append(append(handlers, route.Middleware...), route.Handler)
+		v1.Add(route.Method, route.Path, handlers...)
+	}
+	openAPIDocument = BuildOpenAPI(V1Prefix, v1Routes)
+
+	// Deprecated unversioned routes, kept as aliases for older extension builds
 
 	// WebSocket to receive messages
-	router.Get("/receive/:id", websocket.New(controller.Ws))
+	router.Get("/receive/:id", Deprecated(V1Prefix+"/socket/:id"), RequireAuth, RefuseWhileDraining, websocket.New(controller.Ws))
 
 	// Retrieve live user counts
-	router.Get("/metadata", RateLimit(C.Tier3, 0), controller.GetChannelMetadata)
+	router.Get("/metadata", Deprecated(V1Prefix+"/channels/:channelId"), RateLimit(C.Tier3, 0), controller.GetChannelMetadata)
 
 	// Send message to a site:channel
-	router.Post("/send", RateLimit(C.Tier3, 0), controller.SendMessage)
+	router.Post("/send", Deprecated(V1Prefix+"/channels/:channelId/messages"), RequireAuth, RateLimit(C.Tier3, 0), controller.SendMessage)
 
 	// Get previous messages of a site:channel, messageId=<> limit=50
-	router.Get("/messages", RateLimit(C.Tier2, 0), controller.GetMessages)
+	router.Get("/messages", Deprecated(V1Prefix+"/channels/:channelId/messages"), RateLimit(C.Tier2, 0), controller.GetMessages)
 
-	router.Get("/message/:_id", RateLimit(C.Tier2, 0), controller.GetMessage)
+	router.Get("/message/:_id", Deprecated(V1Prefix+"/channels/:channelId/messages/:messageId"), RateLimit(C.Tier2, 0), controller.GetMessage)
 
 	// Add reactions/emojis to a message
-	router.Post("/react/:MessageId", RateLimit(C.Tier2, 0), controller.AddRemoveReactions)
+	router.Post("/react/:MessageId", Deprecated(V1Prefix+"/messages/:messageId/reactions"), RequireAuth, RateLimit(C.Tier2, 0), controller.AddRemoveReactions)
 
 	// Report a message
-	router.Post("/report/:MessageId", RateLimit(C.Tier2, 0), controller.ReportMessage)
+	router.Post("/report/:MessageId", Deprecated(V1Prefix+"/messages/:messageId/reports"), RequireAuth, RateLimit(C.Tier2, 0), controller.ReportMessage)
 
 	// Create new user
-	router.Post("/register", RateLimit(C.Tier2, 0), controller.RegisterUser)
+	router.Post("/register", Deprecated(V1Prefix+"/users"), RateLimit(C.Tier2, 0), controller.RegisterUser)
 
 	// Update existing user flags
-	router.Post("/update/user", RateLimit(C.Tier2, 0), controller.UpdateUser)
+	router.Post("/update/user", Deprecated(V1Prefix+"/users/me"), RequireAuth, RateLimit(C.Tier2, 0), controller.UpdateUser)
 
 }
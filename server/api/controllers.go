@@ -1,17 +1,25 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
+	"net"
 	"strconv"
 	"sync"
 	"time"
 
+	"server/avatar"
 	"server/db"
+	"server/dto"
+	"server/e2e"
+	"server/logging"
+	"server/metrics"
 	"server/models"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/log"
 	"github.com/gofiber/websocket/v2"
 	"go.mongodb.org/mongo-driver/bson"
 )
@@ -21,8 +29,25 @@ var channels = make(map[string]bool)
 // Mutex to protect the counter
 var mutex sync.Mutex
 
+// Limits used when the configuration does not set them
+const (
+	DefaultMaxMessageLength = 255
+	DefaultPageSize         = 25
+)
+
 // ChatController implements the Controllers interface
-type ChatController struct{}
+type ChatController struct {
+	// maxMessageLength is the longest message accepted, in bytes
+	maxMessageLength int
+	// pageSize is the number of messages and mentions per page
+	pageSize int
+}
+
+// NewChatController creates the controller with the longest message it
+// accepts and the page size of message and mention listings
+func NewChatController(maxMessageLength int, pageSize int) *ChatController {
+	return &ChatController{maxMessageLength: maxMessageLength, pageSize: pageSize}
+}
 
 // Ws handles WebSocket Connections
 func (c *ChatController) Ws(conn *websocket.Conn) {
@@ -31,68 +56,93 @@ func (c *ChatController) Ws(conn *websocket.Conn) {
 	userId := conn.Params("id")
 	siteId := conn.Query("SiteId")
 	if userId != "" {
-		_, isErr := models.GetUser(userId)
-		if isErr {
+		user, err := models.GetUser(userId)
+		if err != nil {
 			conn.WriteControl(
 				websocket.CloseMessage,
 				websocket.FormatCloseMessage(websocket.CloseNormalClosure, "User not found"),
 				time.Now().Add(time.Second),
 			)
 			conn.Close()
+			return
 		}
 
+		session := openSession(user, siteId, conn.Query("subscribe"), conn)
+		userSocket := session.Socket
+		interval, timeout := models.Heartbeat()
+		logger := socketLogger(conn).With("user_id", userId, "session_id", session.Id, "transport", "websocket")
+
+		// The reader answers text pings while the writer sends events and
+		// pings, writes are serialised so frames never interleave
+		var writeMutex sync.Mutex
+		write := func(messageType int, data []byte) error {
+			writeMutex.Lock()
+			defer writeMutex.Unlock()
+
+			conn.SetWriteDeadline(time.Now().Add(timeout))
+			return conn.WriteMessage(messageType, data)
+		}
+
+		// Any frame, including pongs to the server's pings, extends the read deadline
+		heard := func() {
+			userSocket.Touch()
+			conn.SetReadDeadline(time.Now().Add(timeout))
+		}
+		heard()
+		conn.SetPongHandler(func(string) error {
+			heard()
+			return nil
+		})
+
 		// Setting a close handler
 		conn.SetCloseHandler(func(code int, text string) error {
-			fmt.Printf("Connection closed with code: %d, reason: %s, user: %s", code, text, userId)
-			mutex.Lock()
-			db.Connections[userId].IsActive = false
-			mutex.Unlock()
+			logging.Noisy.Log(context.Background(), logger, slog.LevelDebug, "Websocket closed by client", "code", code, "reason", text)
+			models.Disconnect(userSocket)
 			return nil
 		})
 
-		mutex.Lock()
-		db.Connections[userId] = &db.UserSocket{
-			UserId:     userId,
-			Conn:       conn,
-			IsActive:   true,
-			ActiveSite: siteId,
-			Channel:    make(chan map[string]interface{}),
-		}
-		fmt.Printf("User connected - %s\n", userId)
-		mutex.Unlock()
+		logging.Noisy.Log(context.Background(), logger, slog.LevelInfo, "User connected", "site", siteId)
 
 		defer func() {
-			fmt.Printf("User disconnected - %s\n", userId)
-			conn.Close()
-			mutex.Lock()
-			db.Connections[userId].IsActive = false
-			mutex.Unlock()
+			logging.Noisy.Log(context.Background(), logger, slog.LevelInfo, "User disconnected")
+			session.Close()
 		}()
 
-		// if user != nil && user.ActiveSite != "" {
-		// 	_, ok := channels[user.ActiveSite]
-		// 	if !ok {
-		// 		mutex.Lock()
-		// 		// go models.ListenChannel(user.ActiveSite)
-		// 		channels[user.ActiveSite] = true
-		// 		mutex.Unlock()
-		// 	}
-		// }
-
-		// Goroutine to listen for messages from the channel and send to the WebSocket client
+		// Goroutine to write the events of the session and the server's pings to the WebSocket client
 		go func() {
+			var after uint64
+			nextPing := time.Now().Add(interval)
 			for {
-				message, ok := <-db.Connections[userId].Channel
-				// Wait for a message on the Channel
-				if !ok {
-					// If the channel is closed, stop the goroutine
+				waitCtx, cancel := context.WithDeadline(context.Background(), nextPing)
+				events, last, err := session.Next(waitCtx, after)
+				cancel()
+				if err != nil {
+					// If the socket is closed, stop the goroutine
 					return
 				}
+				after = last
 
-				// Send the message to the WebSocket connection
-				if err := db.Connections[userId].Conn.WriteJSON(message); err != nil {
-					fmt.Printf("Error sending message to user %s: %v", userId, err)
-					return
+				start := time.Now()
+				for _, event := range events {
+					payload, err := json.Marshal(event)
+					if err == nil {
+						err = write(websocket.TextMessage, payload)
+					}
+					if err != nil {
+						logging.Noisy.Log(context.Background(), logger, slog.LevelWarn, "Writing to websocket failed", "err", err)
+						userSocket.Close()
+						return
+					}
+				}
+				session.Written("websocket", events, start)
+				session.Ack(last)
+
+				if !time.Now().Before(nextPing) {
+					if err := write(websocket.PingMessage, nil); err != nil {
+						userSocket.Close()
+						return
+					}
+					nextPing = time.Now().Add(interval)
 				}
 			}
 		}()
@@ -101,12 +151,30 @@ func (c *ChatController) Ws(conn *websocket.Conn) {
 			// Handle incoming ping/pong or other messages
 			_, msg, err := conn.ReadMessage()
 			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					metrics.ReapedSockets.WithLabelValues("read_deadline").Inc()
+					logging.Noisy.Log(context.Background(), logger, slog.LevelInfo, "Closing websocket without heartbeat")
+				}
 				break
 			}
+			heard()
+
+			// Old clients send the text frame "ping" and expect "pong"
+			if string(msg) == dto.FramePing {
+				write(websocket.TextMessage, []byte("pong"))
+				continue
+			}
 
-			if string(msg) == "ping" {
-				conn.WriteMessage(websocket.TextMessage, []byte("pong"))
+			var frame dto.ClientFrame
+			if err := json.Unmarshal(msg, &frame); err != nil {
+				continue
 			}
+			if frame.Type == dto.FramePing {
+				write(websocket.TextMessage, []byte("pong"))
+				continue
+			}
+			handleFrame(userSocket, frame)
 		}
 	}
 }
@@ -114,70 +182,123 @@ func (c *ChatController) Ws(conn *websocket.Conn) {
 // SendMessage handles sending messages
 func (c *ChatController) SendMessage(ctx *fiber.Ctx) error {
 
-	var message models.MessageModel
-	var userId string = ctx.Get("X-Id")
+	var request dto.SendMessageRequest
+	userId := authenticatedUser(ctx)
 
-	if userId == "" {
-		return ctx.Status(400).JSON(fiber.Map{
-			"message": "User id not passed",
-			"status":  400,
-		})
+	user, err := models.GetUser(userId)
+	if err != nil {
+		return err
 	}
 
-	user, isErr := models.GetUser(userId)
-	if isErr {
-		return ctx.Status(500).JSON(fiber.Map{
-			"status":  500,
-			"message": "User not found, for passed user id!",
-			"code":    "USER_NOT_FOUND",
-		})
+	user.ModifiedAt = time.Now()
+
+	// Parse the JSON body into the struct
+	if err := ctx.BodyParser(&request); err != nil {
+		requestLogger(ctx).Debug("Parsing body failed", "err", err)
+		return ErrInvalidBody
 	}
 
-	if user != nil {
-		user.ModifiedAt = time.Now()
+	if len(request.Message) > c.maxMessageLength {
+		return NewAPIError(fiber.StatusBadRequest, CodeMessageTooLong, fmt.Sprintf("Max message length allowed is %d", c.maxMessageLength))
 	}
 
-	// Parse the JSON body into the struct
-	if err := ctx.BodyParser(&message); err != nil {
-		log.Error("err - ", err)
-		return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"status":  fiber.StatusBadRequest,
-			"message": "Failed to parse body",
-		})
+	channel := channelOrDefault(channelParam(ctx), request.Channel)
+	if models.IsDirectChannel(channel) {
+		peerId, ok := models.DirectPeer(channel, userId)
+		if !ok {
+			return models.ErrNotChannelMember
+		}
+		if _, err := models.CheckDirectAllowed(user, peerId); err != nil {
+			return err
+		}
+		if err := models.CheckEncryption(userId, peerId, request.Encrypted); err != nil {
+			return err
+		}
+		request.To = peerId
+	} else if request.Encrypted != nil {
+		return ErrEncryptedPublic
 	}
 
-	if len(message.Message) > 255 {
-		return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"status":  fiber.StatusBadRequest,
-			"message": "Max message length allowed is 255",
-		})
+	var encrypted *models.EncryptedPayload
+	if request.Encrypted != nil {
+		// The server keeps no plaintext next to the ciphertext
+		request.Message = ""
+		encrypted = models.NewEncryptedPayload(*request.Encrypted)
 	}
 
-	msgId := models.WriteMessageToChannel(message)
+	// Mentions are best effort, the message goes out without them
+	mentions, err := models.ResolveMentions(request.Message, channel, user)
+	if err != nil {
+		requestLogger(ctx).Error("Resolving mentions failed", "err", err)
+	}
+
+	message, err := models.WriteMessageToChannel(ctx.UserContext(), models.MessageModel{
+		Message:   request.Message,
+		ChannelId: channel,
+		To:        request.To,
+		From:      user.Author(),
+		Encrypted: encrypted,
+		Mentions:  mentions,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := models.AddToMentionInboxes(message); err != nil {
+		requestLogger(ctx).Error("Filing mentions failed", "err", err)
+	}
+
+	models.Background(func() { models.NotifyOfflineRecipients(message) })
+
+	if models.IsDirectChannel(channel) {
+		if err := models.RecordDirectMessage(message); err != nil {
+			requestLogger(ctx).Error("Updating conversations failed", "err", err)
+		}
+	}
 
 	return ctx.Status(200).JSON(fiber.Map{
 		"message": "Message sent successfully",
 		"status":  200,
-		"MsgId":   msgId,
+		"data":    message.ToDTO(),
 	})
 
 }
 
 func (c *ChatController) GetChannelMetadata(ctx *fiber.Ctx) error {
 
-	siteId := ctx.Query("SiteId")
-	userCount := 0
-	for _, userConn := range db.Connections {
-		if userConn.ActiveSite == siteId && userConn.IsActive {
-			userCount++
-		}
+	siteId := channelParam(ctx)
+	userCount := db.ConnectedUsers(func(socket *db.UserSocket) bool {
+		return socket.ActiveSite == siteId
+	})
+
+	metadata := dto.ChannelMetadata{
+		Live:         userCount,
+		PlatformLive: db.ConnectedUsers(nil),
 	}
 
+	// live and platformLive are kept at the top level for older extension builds
 	return ctx.Status(200).JSON(fiber.Map{
 		"message":      "Meta data sent successfully",
 		"status":       200,
-		"live":         userCount,
-		"platformLive": len(db.Connections),
+		"data":         metadata,
+		"live":         metadata.Live,
+		"platformLive": metadata.PlatformLive,
+	})
+}
+
+// GetPresence lists the visible users currently on a channel
+func (c *ChatController) GetPresence(ctx *fiber.Ctx) error {
+	channel := channelParam(ctx)
+	if models.IsDirectChannel(channel) {
+		if err := checkChannelAccess(ctx, channel, ctx.Get("X-Id")); err != nil {
+			return err
+		}
+	}
+
+	return ctx.Status(200).JSON(fiber.Map{
+		"status":  200,
+		"message": "Presence retrieved successfully",
+		"data":    models.ListPresence(channel),
 	})
 }
 
@@ -185,43 +306,33 @@ func (c *ChatController) GetChannelMetadata(ctx *fiber.Ctx) error {
 func (c *ChatController) GetMessage(ctx *fiber.Ctx) error {
 
 	userId := ctx.Get("X-Id", "")
-	msgId := ctx.Params("_id", "")
-	siteId := ctx.Query("SiteId")
+	msgId := messageIdParam(ctx)
+	siteId := channelParam(ctx)
 
 	if userId == "" {
-		return ctx.Status(400).JSON(fiber.Map{
-			"message": "User id not passed",
-			"status":  400,
-		})
+		return ErrUserIdMissing
 	}
 
 	if msgId == "" {
-		return ctx.Status(400).JSON(fiber.Map{
-			"message": "Message id not passed",
-			"status":  400,
-		})
+		return ErrMessageIdMissing
 	}
 
-	_, isErr := models.GetUser(userId)
-	if isErr {
-		return ctx.Status(500).JSON(fiber.Map{
-			"status":  500,
-			"message": "User not found, for passed user id!",
-			"code":    "USER_NOT_FOUND",
-		})
+	if _, err := models.GetUser(userId); err != nil {
+		return err
 	}
 
-	message, exists := models.GetSingleMessage(msgId, siteId)
-	if !exists {
-		return ctx.Status(500).JSON(fiber.Map{
-			"message": "No message found for the given id",
-			"status":  500,
-		})
+	message, err := models.GetSingleMessage(msgId, siteId)
+	if err != nil {
+		return err
 	}
+	if err := checkChannelAccess(ctx, message.ChannelId, userId); err != nil {
+		return err
+	}
+
 	return ctx.Status(200).JSON(fiber.Map{
 		"message": "Message retrieved successfully",
 		"status":  200,
-		"data":    message,
+		"data":    message.ToDTO(),
 	})
 }
 
@@ -229,70 +340,77 @@ func (c *ChatController) GetMessage(ctx *fiber.Ctx) error {
 func (c *ChatController) GetMessages(ctx *fiber.Ctx) error {
 
 	userId := ctx.Get("X-Id")
-	siteId := ctx.Query("SiteId")
-	bookmark := ctx.Query("Bookmark", "")
+	siteId := channelParam(ctx)
+	bookmark := ctx.Query("bookmark", ctx.Query("Bookmark"))
 
 	if userId == "" {
-		return ctx.Status(400).JSON(fiber.Map{
-			"message": "User id not passed",
-			"status":  400,
-		})
+		return ErrUserIdMissing
 	}
 
-	_, isErr := models.GetUser(userId)
-	if isErr {
-		return ctx.Status(500).JSON(fiber.Map{
-			"status":  500,
-			"message": "User not found, for passed user id!",
-			"code":    "USER_NOT_FOUND",
-		})
+	if _, err := models.GetUser(userId); err != nil {
+		return err
+	}
+	if err := checkChannelAccess(ctx, siteId, userId); err != nil {
+		return err
+	}
+
+	// Reading the latest page of a conversation reads its unread messages
+	if models.IsDirectChannel(siteId) && bookmark == "" {
+		if _, err := models.MarkConversationRead(userId, siteId); err != nil && !errors.Is(err, models.ErrNotChannelMember) {
+			requestLogger(ctx).Error("Marking conversation read failed", "err", err)
+		}
+	}
+
+	// The divider only goes on the first page, later pages are older
+	var divider *dto.UnreadDivider
+	if bookmark == "" {
+		var err error
+		if divider, err = models.UnreadDivider(userId, siteId); err != nil {
+			return err
+		}
 	}
 
-	chatArray, bookmark, hasMoreMessages, retrievalErr := models.GetMessages(25, siteId, bookmark)
+	chatArray, bookmark, hasMoreMessages, retrievalErr := models.GetMessages(int64(c.pageSize), siteId, bookmark)
 	if retrievalErr != nil {
-		return ctx.Status(500).JSON(fiber.Map{
-			"message": retrievalErr,
-			"status":  500,
-		})
+		return retrievalErr
 	}
+
 	return ctx.Status(200).JSON(fiber.Map{
-		"message":      "Messages sent to site successfully",
-		"status":       200,
-		"data":         chatArray,
-		"nextBookmark": bookmark,
-		"hasMore":      hasMoreMessages,
+		"message": "Messages sent to site successfully",
+		"status":  200,
+		"data": dto.MessagePage{
+			Messages:     models.MessagesToDTO(chatArray),
+			NextBookmark: bookmark,
+			HasMore:      hasMoreMessages,
+			Divider:      divider,
+		},
 	})
 }
 
 // AddRemoveReactions handles adding or removing reactions to messages
 func (c *ChatController) AddRemoveReactions(ctx *fiber.Ctx) error {
 
-	userId := ctx.Get("X-Id", "")
-	msgId := ctx.Params("MessageId", "")
+	userId := authenticatedUser(ctx)
+	msgId := messageIdParam(ctx)
 
-	if userId == "" {
-		return ctx.Status(400).JSON(fiber.Map{
-			"message": "User id not passed",
-			"status":  400,
-		})
-	}
-
-	var reaction map[string]string
+	var reaction dto.ReactionRequest
 	// Parse the JSON body into the struct
 	if err := ctx.BodyParser(&reaction); err != nil {
-		log.Error("err - ", err)
-		return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"status":  fiber.StatusBadRequest,
-			"message": "Failed to parse body",
-		})
+		requestLogger(ctx).Debug("Parsing body failed", "err", err)
+		return ErrInvalidBody
+	}
+
+	if reaction.Emoji == "" {
+		return NewAPIError(fiber.StatusBadRequest, CodeInvalidBody, "Reaction emoji not passed")
+	}
+
+	if err := checkMessageAccess(ctx, msgId, userId); err != nil {
+		return err
 	}
 
-	updatedRecord, updateErr := models.AddRemoveReaction(msgId, reaction["emoji"], userId)
+	updatedRecord, updateErr := models.AddRemoveReaction(msgId, reaction.Emoji, userId)
 	if updateErr != nil {
-		return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"status":  fiber.StatusInternalServerError,
-			"message": updateErr,
-		})
+		return updateErr
 	}
 
 	return ctx.Status(200).JSON(fiber.Map{
@@ -305,22 +423,50 @@ func (c *ChatController) AddRemoveReactions(ctx *fiber.Ctx) error {
 // ReportMessage handles reporting a message for inappropriate content
 func (c *ChatController) ReportMessage(ctx *fiber.Ctx) error {
 
-	userId := ctx.Get("X-Id", "")
-	msgId := ctx.Params("MessageId", "")
+	userId := authenticatedUser(ctx)
+	msgId := messageIdParam(ctx)
+
+	if msgId == "" {
+		return ErrMessageIdMissing
+	}
+
+	message, err := models.GetSingleMessage(msgId, "")
+	if err != nil {
+		return err
+	}
+	if err := checkChannelAccess(ctx, message.ChannelId, userId); err != nil {
+		return err
+	}
+
+	// Encrypted messages can only be reported by their recipient, who
+	// forwards the text they decrypted
+	if message.Encrypted != nil {
+		var request dto.ReportRequest
+		if err := ctx.BodyParser(&request); err != nil || request.Plaintext == "" {
+			return NewAPIError(fiber.StatusBadRequest, CodeInvalidBody, "Reports of encrypted messages must carry the decrypted plaintext")
+		}
+		if message.To != userId {
+			return NewAPIError(fiber.StatusForbidden, CodeForbidden, "Only the recipient can report an encrypted message")
+		}
+		if len(request.Plaintext) > e2e.MaxCiphertextSize {
+			return NewAPIError(fiber.StatusBadRequest, CodeMessageTooLong, "Reported plaintext is too long")
+		}
 
-	if userId == "" || msgId == "" {
-		return ctx.Status(400).JSON(fiber.Map{
-			"message": "User id/ Message id not passed",
-			"status":  400,
+		updatedRecord, err := models.ForwardEncryptedReport(message, userId, request.Plaintext)
+		if err != nil {
+			return err
+		}
+
+		return ctx.Status(200).JSON(fiber.Map{
+			"message": "Message reported successfully",
+			"status":  200,
+			"data":    updatedRecord,
 		})
 	}
 
 	updatedRecord, updateErr := models.ReportMessage(msgId, userId)
 	if updateErr != nil {
-		return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"status":  fiber.StatusInternalServerError,
-			"message": updateErr,
-		})
+		return updateErr
 	}
 
 	return ctx.Status(200).JSON(fiber.Map{
@@ -333,149 +479,318 @@ func (c *ChatController) ReportMessage(ctx *fiber.Ctx) error {
 func (c *ChatController) RegisterUser(ctx *fiber.Ctx) error {
 	userId := ctx.Get("X-Id")
 	if userId != "" {
-		_, isErr := models.GetUser(userId)
-		if isErr {
-			return ctx.Status(500).JSON(fiber.Map{
-				"status":  500,
-				"message": "User not found, for passed user id, to create new user don't pass X-Id header",
-			})
+		user, err := models.GetUser(userId)
+		if err != nil {
+			if errors.Is(err, models.ErrUserNotFound) {
+				return NewAPIError(fiber.StatusNotFound, CodeUserNotFound, "User not found, for passed user id, to create new user don't pass X-Id header")
+			}
+			return err
+		}
+
+		// Clients registered before access tokens existed only know their id,
+		// they are given a token once and must send it from then on
+		result := user.ToDTO()
+		if authenticatedUser(ctx) != user.Id {
+			token, err := models.ClaimAccessToken(user.Id)
+			if err != nil {
+				return err
+			}
+			result.AccessToken = token
 		}
 
 		return ctx.Status(200).JSON(fiber.Map{
 			"status":  200,
 			"message": "User already exists",
+			"data":    result,
+			"id":      user.Id,
 		})
 	}
 
+	// Refuse new identities from addresses a banned user was seen on
+	banned, err := models.IsIpBanned(ctx.IP())
+	if err != nil {
+		return err
+	}
+	if banned {
+		return ErrBanned
+	}
+
 	// User id not detected, create new user
-	if user, ok := models.NewUser(ctx); ok {
-		userJSON, err := json.Marshal(user)
-		if err != nil {
-			fmt.Println("Error marshalling to JSON:", err)
-			return ctx.Status(500).JSON(fiber.Map{
-				"status": 500,
-			})
-		}
+	user, ok := models.NewUser(ctx)
+	if !ok {
+		return NewAPIError(fiber.StatusInternalServerError, CodeInternal, "User creation failed")
+	}
 
-		return ctx.Status(200).JSON(fiber.Map{
-			"message": "user created successfully",
-			"status":  200,
-			"data":    string(userJSON),
-			"id":      string(user.Id),
-		})
+	// The token is the only proof of being this user, an existing X-Id above
+	// is only given one when it never had any
+	token, err := models.IssueAccessToken(user.Id)
+	if err != nil {
+		return err
 	}
+	result := user.ToDTO()
+	result.AccessToken = token
 
-	return ctx.Status(500).JSON(fiber.Map{
-		"message": "User creation failed",
-		"status":  500,
+	return ctx.Status(200).JSON(fiber.Map{
+		"message": "user created successfully",
+		"status":  200,
+		"data":    result,
+		"id":      user.Id,
 	})
 
 }
 
-// ConvertUserToBsonM converts a UserModel struct to bson.M
-func convert_UserToBsonM(user models.UserModel) (bson.M, error) {
-	// Step 1: Marshal the UserModel struct into BSON
-	userBson, err := bson.Marshal(user)
+// GetMe returns the calling user
+func (c *ChatController) GetMe(ctx *fiber.Ctx) error {
+	user, err := models.GetUser(authenticatedUser(ctx))
+	if err != nil {
+		return err
+	}
+
+	return ctx.Status(200).JSON(fiber.Map{
+		"status":  200,
+		"message": "User retrieved successfully",
+		"data":    user.ToDTO(),
+	})
+}
+
+// ExportMe returns an archive of everything stored about the calling user
+func (c *ChatController) ExportMe(ctx *fiber.Ctx) error {
+	userId := authenticatedUser(ctx)
+
+	user, err := models.GetUser(userId)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	// Step 2: Unmarshal the BSON into bson.M
-	var userMap bson.M
-	err = bson.Unmarshal(userBson, &userMap)
+	export, err := models.ExportUser(user)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return userMap, nil
+	ctx.Attachment("blablah-export-" + user.Id + ".json")
+	return ctx.Status(200).JSON(export)
 }
 
-func (c *ChatController) UpdateUser(ctx *fiber.Ctx) error {
-	userId := ctx.Get("X-Id")
-	if userId != "" {
-		user, isErr := models.GetUser(userId)
-		if isErr {
-			return ctx.Status(400).JSON(fiber.Map{
-				"status":  400,
-				"message": "User not found",
-			})
+// DeleteMe erases the calling user and closes their sockets
+func (c *ChatController) DeleteMe(ctx *fiber.Ctx) error {
+	userId := authenticatedUser(ctx)
+
+	if err := models.DeleteUser(userId); err != nil {
+		return err
+	}
+
+	closeUserSockets(userId, "Account deleted")
+
+	return ctx.Status(200).JSON(fiber.Map{
+		"status":  200,
+		"message": "User deleted successfully",
+	})
+}
+
+// closeUserSockets disconnects and forgets every socket of a user
+func closeUserSockets(userId string, reason string) {
+	for _, userConn := range db.UserSockets(userId) {
+		models.Disconnect(userConn)
+		// Event streams and long polls have no connection, closing ends them
+		if userConn.Conn != nil {
+			userConn.Conn.WriteControl(
+				websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason),
+				time.Now().Add(time.Second),
+			)
 		}
+		userConn.Close()
+	}
+}
 
-		siteId := ctx.Query("SiteId", "USER_NOT_IN_PLUGIN")
-		isOnline := ctx.Query("IsOnline", "false")
-
-		if user != nil {
-			user.ModifiedAt = time.Now()
-			if val, err := strconv.ParseBool(isOnline); err == nil {
-				if val {
-					user.IsOnline = true
-					user.ActiveSite = siteId
-
-					_, connExists := db.Connections[userId]
-					if connExists {
-						mutex.Lock()
-						db.Connections[userId].ActiveSite = siteId
-						mutex.Unlock()
-					}
+// ChangeUsername renames the calling user
+func (c *ChatController) ChangeUsername(ctx *fiber.Ctx) error {
+	userId := authenticatedUser(ctx)
 
-					_, channelExists := channels[user.ActiveSite]
-					if !channelExists {
-						mutex.Lock()
-						// go models.ListenChannel(user.ActiveSite)
-						channels[user.ActiveSite] = true
-						mutex.Unlock()
-					}
+	var request dto.UsernameRequest
+	if err := ctx.BodyParser(&request); err != nil {
+		return ErrInvalidBody
+	}
 
-				} else {
-					user.IsOnline = false
-					mutex.Lock()
-					db.Connections[userId].ActiveSite = siteId
-					db.Connections[userId].IsActive = false
-					db.Connections[userId].Conn.Close()
-					close(db.Connections[userId].Channel)
-					fmt.Printf("User went offline: %s\n", userId)
-					mutex.Unlock()
-				}
-			}
+	user, err := models.ChangeUsername(userId, request.Username)
+	if err != nil {
+		var cooldownErr *models.UsernameCooldownError
+		if errors.As(err, &cooldownErr) {
+			ctx.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(time.Until(cooldownErr.RetryAt).Seconds())+1))
+		}
+		return err
+	}
 
-			array := []string{}
-			flag := false
-			for _, site := range user.ExploredSites {
-				if site == siteId {
-					flag = true
-				}
-			}
+	return ctx.Status(200).JSON(fiber.Map{
+		"status":  200,
+		"message": "Username changed successfully",
+		"data":    user.ToDTO(),
+	})
+}
 
-			if !flag {
-				array = append(array, siteId)
-				user.ExploredSites = array
-			}
+// GetUsernameHistory lists the previous names of a user, moderators only
+func (c *ChatController) GetUsernameHistory(ctx *fiber.Ctx) error {
+	caller, err := models.GetUser(authenticatedUser(ctx))
+	if err != nil {
+		return err
+	}
+	if !caller.IsModerator() {
+		return ErrForbidden
+	}
 
-			userMap, convertErr := convert_UserToBsonM(*user)
-			if convertErr != nil {
-				log.Fatal("Failed to convert UserModel to bson.M:", convertErr)
-			}
+	user, err := models.GetUser(ctx.Params("userId"))
+	if err != nil {
+		return err
+	}
 
-			err := models.UpdateUser(userId, userMap)
+	history := dto.UsernameHistory{
+		UserId:   user.Id,
+		Username: user.Username,
+		History:  []dto.UsernameEntry{},
+	}
+	for _, change := range user.UsernameHistory {
+		history.History = append(history.History, dto.UsernameEntry{Username: change.Username, ChangedAt: change.ChangedAt})
+	}
 
-			if err != nil {
-				log.Debug(err)
-				return ctx.Status(500).JSON(fiber.Map{
-					"status":  500,
-					"message": err,
-				})
+	return ctx.Status(200).JSON(fiber.Map{
+		"status":  200,
+		"message": "Username history retrieved successfully",
+		"data":    history,
+	})
+}
+
+// GetAvatar renders the identicon of a seed, avatars never change for a
+// seed so they are cached for as long as clients allow
+func (c *ChatController) GetAvatar(ctx *fiber.Ctx) error {
+	seed := ctx.Params("seed")
+	if seed == "" || len(seed) > 64 {
+		return NewAPIError(fiber.StatusBadRequest, CodeBadRequest, "Invalid avatar seed")
+	}
+
+	size := ctx.QueryInt("size", 64)
+	if size < 16 || size > 512 {
+		return NewAPIError(fiber.StatusBadRequest, CodeBadRequest, "Avatar size must be between 16 and 512")
+	}
+
+	etag := avatar.ETag(seed, size)
+	ctx.Set(fiber.HeaderCacheControl, "public, max-age=31536000, immutable")
+	ctx.Set(fiber.HeaderETag, etag)
+	if ctx.Get(fiber.HeaderIfNoneMatch) == etag {
+		return ctx.SendStatus(fiber.StatusNotModified)
+	}
+
+	ctx.Type("svg")
+	return ctx.Status(200).Send(avatar.Identicon(seed, size))
+}
+
+// UpdateUser sets the active channel and online state of the calling user
+func (c *ChatController) UpdateUser(ctx *fiber.Ctx) error {
+	userId := authenticatedUser(ctx)
+	user, err := models.GetUser(userId)
+	if err != nil {
+		return err
+	}
+
+	siteId := ctx.Query("SiteId", models.NoSite)
+	isOnline := ctx.Query("IsOnline", "false")
+
+	// PATCH /v1/users/me takes a JSON body, fields left out keep their value
+	if ctx.Method() == fiber.MethodPatch {
+		var request dto.UpdateUserRequest
+		if err := ctx.BodyParser(&request); err != nil {
+			return ErrInvalidBody
+		}
+
+		siteId = user.ActiveSite
+		if request.ActiveSite != nil {
+			siteId = *request.ActiveSite
+		}
+
+		isOnline = strconv.FormatBool(user.IsOnline)
+		if request.IsOnline != nil {
+			isOnline = strconv.FormatBool(*request.IsOnline)
+		}
+
+		if request.Invisible != nil {
+			user.Invisible = *request.Invisible
+			models.SetInvisible(userId, user.Invisible)
+		}
+	}
+
+	user.ModifiedAt = time.Now()
+	user.IpHash = models.HashIp(ctx.IP())
+	models.RetainRawIp(user, ctx.IP())
+	if val, err := strconv.ParseBool(isOnline); err == nil {
+		if val {
+			user.IsOnline = true
+			user.ActiveSite = siteId
+
+			models.MoveUser(userId, siteId)
+
+			mutex.Lock()
+			if _, channelExists := channels[user.ActiveSite]; !channelExists {
+				// go models.ListenChannel(user.ActiveSite)
+				channels[user.ActiveSite] = true
 			}
+			mutex.Unlock()
 
-			return ctx.Status(200).JSON(fiber.Map{
-				"status":  200,
-				"message": "User updated successfully...",
-			})
+		} else {
+			user.IsOnline = false
+			for _, userConn := range db.UserSockets(userId) {
+				models.Disconnect(userConn)
+				userConn.Close()
+			}
+			requestLogger(ctx).Info("User went offline")
 		}
+	}
 
+	// Only the fields set here are written, a rename, block or sign in that
+	// lands between the read above and this write is kept. Explored sites
+	// only grow and the connected lease belongs to the instances holding
+	// sockets, so neither is written either.
+	userMap := bson.M{
+		"is_online":   user.IsOnline,
+		"active_site": user.ActiveSite,
+		"invisible":   user.Invisible,
+		"modified_at": user.ModifiedAt,
+		"ip_hash":     user.IpHash,
+	}
+	if user.RawIp != "" {
+		userMap["raw_ip"] = user.RawIp
+		userMap["raw_ip_expires_at"] = user.RawIpExpiresAt
 	}
 
-	return ctx.Status(400).JSON(fiber.Map{
-		"status":  400,
-		"message": "User id not passed correctly",
+	if err := models.UpdateUser(userId, userMap); err != nil {
+		return err
+	}
+	// Going offline is not a visit
+	if user.IsOnline {
+		if err := models.AddExploredSite(user, siteId); err != nil {
+			return err
+		}
+	}
+
+	return ctx.Status(200).JSON(fiber.Map{
+		"status":  200,
+		"message": "User updated successfully...",
+		"data":    user.ToDTO(),
 	})
 }
+
+// checkMessageAccess returns ErrNotChannelMember when the message belongs to
+// a channel userId may not read
+func checkMessageAccess(ctx *fiber.Ctx, msgId string, userId string) error {
+	message, err := models.GetSingleMessage(msgId, "")
+	if err != nil {
+		return err
+	}
+	return checkChannelAccess(ctx, message.ChannelId, userId)
+}
+
+// channelOrDefault returns channel, or fallback when the request did not carry one
+func channelOrDefault(channel string, fallback string) string {
+	if channel == "" {
+		return fallback
+	}
+	return channel
+}
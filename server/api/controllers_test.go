@@ -0,0 +1,296 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"server/avatar"
+	"server/dto"
+	"server/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestAccountRoutesRequireAccessToken(t *testing.T) {
+	app := newTestApp(t)
+	caller := map[string]string{"X-Id": "victim"}
+
+	for _, method := range []string{http.MethodGet, http.MethodDelete} {
+		path := "/v1/users/me"
+		if method == http.MethodGet {
+			path += "/export"
+		}
+		res := call(t, app, method, path, "", caller, nil)
+		if res.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s %s with X-Id only: got status %d, want 401", method, path, res.StatusCode)
+		}
+	}
+}
+
+func TestMessageRoutesRequireAccessToken(t *testing.T) {
+	app := newTestApp(t)
+	caller := map[string]string{"X-Id": "victim"}
+
+	paths := []string{
+		"/v1/channels/example.com/messages",
+		"/v1/messages/000000000000000000000000/reactions",
+		"/v1/messages/000000000000000000000000/reports",
+		"/send?SiteId=example.com",
+		"/react/000000000000000000000000",
+		"/report/000000000000000000000000",
+	}
+	for _, path := range paths {
+		var apiErr dto.ErrorResponse
+		res := call(t, app, http.MethodPost, path, `{"message":"hi","emoji":"+1"}`, caller, &apiErr)
+		if res.StatusCode != http.StatusUnauthorized || apiErr.Message != ErrAccessTokenUnclaimed.Message {
+			t.Errorf("POST %s with X-Id only: got status %d, %q, want 401 pointing to the token claim", path, res.StatusCode, apiErr.Message)
+		}
+	}
+}
+
+func TestExportHasConversationsAndInboxes(t *testing.T) {
+	requireMongo(t)
+	app := newTestApp(t)
+
+	alice := registerTestUser(t, app)
+	bob := registerTestUser(t, app)
+
+	res := call(t, app, http.MethodPost, "/v1/dms/"+bob.Id, "", bearer(alice), nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("opening conversation: got status %d", res.StatusCode)
+	}
+
+	var export dto.UserExport
+	res = call(t, app, http.MethodGet, "/v1/users/me/export", "", bearer(alice), &export)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("exporting: got status %d", res.StatusCode)
+	}
+	if len(export.Conversations) != 1 || export.Conversations[0].Peer.Id != bob.Id {
+		t.Fatalf("exported conversations %+v", export.Conversations)
+	}
+	if export.Mentions == nil || export.PushSubscriptions == nil {
+		t.Fatalf("export leaves out the mentions inbox or push subscriptions: %+v", export)
+	}
+}
+
+func TestDeleteMeRevokesAccessTokens(t *testing.T) {
+	requireMongo(t)
+	app := newTestApp(t)
+	user := registerTestUser(t, app)
+
+	res := call(t, app, http.MethodDelete, "/v1/users/me", "", bearer(user), nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("deleting: got status %d", res.StatusCode)
+	}
+	res = call(t, app, http.MethodGet, "/v1/users/me/export", "", bearer(user), nil)
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("token of a deleted user: got status %d, want 401", res.StatusCode)
+	}
+}
+
+func TestDeleteMeLeavesNoIdWithPeers(t *testing.T) {
+	requireMongo(t)
+	app := newTestApp(t)
+	alice := registerTestUser(t, app)
+	bob := registerTestUser(t, app)
+
+	sent := sendDirect(t, app, alice, bob, "hello")
+	call(t, app, http.MethodPut, "/v1/users/me/blocks/"+alice.Id, "", bearer(bob), nil)
+
+	res := call(t, app, http.MethodDelete, "/v1/users/me", "", bearer(alice), nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("deleting: got status %d", res.StatusCode)
+	}
+
+	var response struct {
+		Data []dto.Conversation `json:"data"`
+	}
+	call(t, app, http.MethodGet, "/v1/dms", "", bearer(bob), &response)
+	if len(response.Data) != 1 {
+		t.Fatalf("bob has conversations %+v, want the one with alice kept", response.Data)
+	}
+	conversation := response.Data[0]
+	if strings.Contains(conversation.Channel, alice.Id) || conversation.Peer.Id == alice.Id {
+		t.Fatalf("bob's conversation %+v still names the deleted user", conversation)
+	}
+
+	messages, _, _, err := models.GetMessages(10, conversation.Channel, "")
+	if err != nil || len(messages) != 1 || messages[0].Id.Hex() != sent.Id {
+		t.Fatalf("messages of the renamed channel %+v, %v, want the one sent", messages, err)
+	}
+	if messages[0].To == alice.Id || strings.Contains(messages[0].ChannelId, alice.Id) {
+		t.Fatalf("message %+v still names the deleted user", messages[0])
+	}
+
+	stored, err := models.GetUser(bob.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, blocked := range stored.Blocked {
+		if blocked == alice.Id {
+			t.Fatal("the deleted user was left in bob's blocks")
+		}
+	}
+}
+
+func TestUpdateUserAddsToExploredSites(t *testing.T) {
+	requireMongo(t)
+	app := newTestApp(t)
+	user := registerTestUser(t, app)
+
+	for _, body := range []string{`{"active_site":"other.example","is_online":true}`, `{"active_site":"","is_online":true}`} {
+		res := call(t, app, http.MethodPatch, "/v1/users/me", body, bearer(user), nil)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("updating with %s: got status %d", body, res.StatusCode)
+		}
+	}
+
+	var response struct {
+		Data dto.User `json:"data"`
+	}
+	call(t, app, http.MethodGet, "/v1/users/me", "", bearer(user), &response)
+	explored := response.Data.ExploredSites
+	if len(explored) != 2 || explored[0] != "example.com" || explored[1] != "other.example" {
+		t.Fatalf("explored sites %q, want [example.com other.example]", explored)
+	}
+}
+
+func TestControllerLimits(t *testing.T) {
+	requireMongo(t)
+	app := newTestAppWith(t, NewChatController(10, 2))
+	user := registerTestUser(t, app)
+	channel := fmt.Sprintf("/v1/channels/limits-%d.example/messages", time.Now().UnixNano())
+
+	var apiErr dto.ErrorResponse
+	res := call(t, app, http.MethodPost, channel, `{"message":"eleven char"}`, bearer(user), &apiErr)
+	if res.StatusCode != http.StatusBadRequest || apiErr.Code != CodeMessageTooLong || !strings.Contains(apiErr.Message, "10") {
+		t.Fatalf("message over the limit: status %d, %+v", res.StatusCode, apiErr)
+	}
+
+	for i := 0; i < 3; i++ {
+		res := call(t, app, http.MethodPost, channel, fmt.Sprintf(`{"message":"message %d"}`, i), bearer(user), nil)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("sending: got status %d", res.StatusCode)
+		}
+	}
+
+	var page struct {
+		Data dto.MessagePage `json:"data"`
+	}
+	call(t, app, http.MethodGet, channel, "", bearer(user), &page)
+	if len(page.Data.Messages) != 2 || !page.Data.HasMore {
+		t.Fatalf("page of %d messages (more: %v), want 2 and more", len(page.Data.Messages), page.Data.HasMore)
+	}
+}
+
+func TestExploredSitesSkipThePlaceholderAndOfflineUpdates(t *testing.T) {
+	requireMongo(t)
+	app := newTestApp(t)
+	user := registerTestUser(t, app)
+
+	updates := []string{
+		`{"active_site":"offline.example","is_online":false}`,
+		`{"active_site":"` + models.NoSite + `","is_online":true}`,
+	}
+	for _, body := range updates {
+		res := call(t, app, http.MethodPatch, "/v1/users/me", body, bearer(user), nil)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("updating with %s: got status %d", body, res.StatusCode)
+		}
+	}
+	// The legacy route defaults to the placeholder without a SiteId
+	res := call(t, app, http.MethodPost, "/update/user?IsOnline=true", "", bearer(user), nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("legacy update: got status %d", res.StatusCode)
+	}
+
+	stored, err := models.GetUser(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored.ExploredSites) != 1 || stored.ExploredSites[0] != "example.com" {
+		t.Fatalf("explored sites %q, want [example.com]", stored.ExploredSites)
+	}
+}
+
+func TestConcurrentRenamesPassTheCooldownOnce(t *testing.T) {
+	requireMongo(t)
+	app := newTestApp(t)
+	user := registerTestUser(t, app)
+
+	statuses := make(chan int, 5)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(statuses); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := fmt.Sprintf(`{"username":"racer%d_%d"}`, i, time.Now().UnixNano()%100000)
+			req := httptest.NewRequest(http.MethodPut, "/v1/users/me/username", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+user.AccessToken)
+			res, err := app.Test(req, -1)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			statuses <- res.StatusCode
+		}(i)
+	}
+	wg.Wait()
+	close(statuses)
+
+	renamed := 0
+	for status := range statuses {
+		switch status {
+		case http.StatusOK:
+			renamed++
+		case http.StatusTooManyRequests:
+		default:
+			t.Errorf("unexpected status %d", status)
+		}
+	}
+	if renamed != 1 {
+		t.Fatalf("%d renames passed the cooldown, want 1", renamed)
+	}
+}
+
+func TestUsernameHistoryChecksTheTokenHolder(t *testing.T) {
+	requireMongo(t)
+	app := newTestApp(t)
+	moderator := registerTestUser(t, app)
+	caller := registerTestUser(t, app)
+	if err := models.UpdateUser(moderator.Id, bson.M{"role": "moderator"}); err != nil {
+		t.Fatal(err)
+	}
+
+	path := "/v1/users/" + caller.Id + "/username-history"
+	header := bearer(caller)
+	header["X-Id"] = moderator.Id
+	if res := call(t, app, http.MethodGet, path, "", header, nil); res.StatusCode != http.StatusForbidden {
+		t.Fatalf("caller claiming the moderator's id: got status %d, want 403", res.StatusCode)
+	}
+	if res := call(t, app, http.MethodGet, path, "", bearer(moderator), nil); res.StatusCode != http.StatusOK {
+		t.Fatalf("moderator: got status %d, want 200", res.StatusCode)
+	}
+}
+
+func TestAvatarETag(t *testing.T) {
+	app := newTestApp(t)
+	path := "/v1/avatars/seed-1.svg?size=32"
+
+	res := call(t, app, http.MethodGet, path, "", nil, nil)
+	etag := res.Header.Get("ETag")
+	if res.StatusCode != http.StatusOK || etag != avatar.ETag("seed-1", 32) {
+		t.Fatalf("got status %d and ETag %s", res.StatusCode, etag)
+	}
+
+	res = call(t, app, http.MethodGet, path, "", map[string]string{"If-None-Match": etag}, nil)
+	if res.StatusCode != http.StatusNotModified {
+		t.Fatalf("revalidating: got status %d, want 304", res.StatusCode)
+	}
+}
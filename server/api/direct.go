@@ -0,0 +1,135 @@
+package api
+
+import (
+	"server/dto"
+	"server/models"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ListConversations returns the direct message channels of the calling user
+func (c *ChatController) ListConversations(ctx *fiber.Ctx) error {
+	userId := authenticatedUser(ctx)
+
+	if _, err := models.GetUser(userId); err != nil {
+		return err
+	}
+
+	conversations, err := models.ListConversations(userId)
+	if err != nil {
+		return err
+	}
+
+	result, err := models.ConversationsToDTO(conversations)
+	if err != nil {
+		return err
+	}
+
+	return ctx.Status(200).JSON(fiber.Map{
+		"status":  200,
+		"message": "Conversations retrieved successfully",
+		"data":    result,
+	})
+}
+
+// OpenConversation returns the direct message channel with another user,
+// its messages are read and sent through the channel routes
+func (c *ChatController) OpenConversation(ctx *fiber.Ctx) error {
+	userId := authenticatedUser(ctx)
+
+	user, err := models.GetUser(userId)
+	if err != nil {
+		return err
+	}
+
+	conversation, err := models.OpenConversation(user, ctx.Params("userId"))
+	if err != nil {
+		return err
+	}
+
+	return conversationResponse(ctx, "Conversation opened successfully", conversation)
+}
+
+// MarkConversationRead clears the unread counter of a direct message channel
+func (c *ChatController) MarkConversationRead(ctx *fiber.Ctx) error {
+	userId := authenticatedUser(ctx)
+
+	channel := models.DirectChannelId(userId, ctx.Params("userId"))
+	conversation, err := models.MarkConversationRead(userId, channel)
+	if err != nil {
+		return err
+	}
+
+	return conversationResponse(ctx, "Conversation marked read", conversation)
+}
+
+func conversationResponse(ctx *fiber.Ctx, message string, conversation *models.ConversationModel) error {
+	result, err := models.ConversationsToDTO([]models.ConversationModel{*conversation})
+	if err != nil {
+		return err
+	}
+
+	return ctx.Status(200).JSON(fiber.Map{
+		"status":  200,
+		"message": message,
+		"data":    result[0],
+	})
+}
+
+// GetBlocks lists the users the caller blocked
+func (c *ChatController) GetBlocks(ctx *fiber.Ctx) error {
+	userId := authenticatedUser(ctx)
+
+	user, err := models.GetUser(userId)
+	if err != nil {
+		return err
+	}
+
+	return blockListResponse(ctx, "Blocked users retrieved successfully", user)
+}
+
+// BlockUser stops direct messages between the caller and another user
+func (c *ChatController) BlockUser(ctx *fiber.Ctx) error {
+	userId := authenticatedUser(ctx)
+
+	user, err := models.BlockUser(userId, ctx.Params("userId"))
+	if err != nil {
+		return err
+	}
+
+	return blockListResponse(ctx, "User blocked successfully", user)
+}
+
+// UnblockUser lifts a block
+func (c *ChatController) UnblockUser(ctx *fiber.Ctx) error {
+	userId := authenticatedUser(ctx)
+
+	user, err := models.UnblockUser(userId, ctx.Params("userId"))
+	if err != nil {
+		return err
+	}
+
+	return blockListResponse(ctx, "User unblocked successfully", user)
+}
+
+// checkChannelAccess is models.CheckChannelAccess for requests, direct
+// channels also need the caller's access token since user ids are public
+func checkChannelAccess(ctx *fiber.Ctx, channel string, userId string) error {
+	if models.IsDirectChannel(channel) && authenticatedUser(ctx) != userId {
+		return ErrUnauthenticated
+	}
+	return models.CheckChannelAccess(channel, userId)
+}
+
+func blockListResponse(ctx *fiber.Ctx, message string, user *models.UserModel) error {
+	blocked := user.Blocked
+	if blocked == nil {
+		blocked = []string{}
+	}
+
+	return ctx.Status(200).JSON(fiber.Map{
+		"status":  200,
+		"message": message,
+		"data":    dto.BlockList{UserIds: blocked},
+	})
+}
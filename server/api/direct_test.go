@@ -0,0 +1,117 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"server/models"
+)
+
+func TestDirectRoutesRequireAccessToken(t *testing.T) {
+	app := newTestApp(t)
+	caller := map[string]string{"X-Id": "victim"}
+
+	routes := []struct{ method, path string }{
+		{http.MethodGet, "/v1/dms"},
+		{http.MethodPost, "/v1/dms/other"},
+		{http.MethodPost, "/v1/dms/other/read"},
+		{http.MethodGet, "/v1/users/me/blocks"},
+		{http.MethodPut, "/v1/users/me/blocks/other"},
+		{http.MethodDelete, "/v1/users/me/blocks/other"},
+		{http.MethodGet, "/v1/socket/victim"},
+		{http.MethodGet, "/receive/victim"},
+	}
+	for _, route := range routes {
+		res := call(t, app, route.method, route.path, "", caller, nil)
+		if res.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s %s with X-Id only: got status %d, want 401", route.method, route.path, res.StatusCode)
+		}
+	}
+}
+
+func TestDirectMessagesNeedTheParticipantsToken(t *testing.T) {
+	requireMongo(t)
+	app := newTestApp(t)
+
+	alice := registerTestUser(t, app)
+	bob := registerTestUser(t, app)
+	mallory := registerTestUser(t, app)
+
+	res := call(t, app, http.MethodPost, "/v1/dms/"+bob.Id, "", bearer(alice), nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("opening conversation: got status %d", res.StatusCode)
+	}
+	messages := "/v1/channels/" + url.PathEscape(models.DirectChannelId(alice.Id, bob.Id)) + "/messages"
+
+	res = call(t, app, http.MethodPost, messages, `{"message":"hi"}`, bearer(alice), nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("sending as a participant: got status %d", res.StatusCode)
+	}
+	res = call(t, app, http.MethodGet, messages, "", bearer(bob), nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("reading as a participant: got status %d", res.StatusCode)
+	}
+
+	// Knowing a participant's id is not enough
+	impersonating := map[string]string{"X-Id": alice.Id}
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		res = call(t, app, method, messages, `{"message":"hi"}`, impersonating, nil)
+		if res.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s with X-Id only: got status %d, want 401", method, res.StatusCode)
+		}
+	}
+
+	// Nor is a token of another user
+	withOtherToken := bearer(mallory)
+	withOtherToken["X-Id"] = alice.Id
+	res = call(t, app, http.MethodGet, messages, "", withOtherToken, nil)
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("X-Id of a participant with another token: got status %d, want 403", res.StatusCode)
+	}
+	res = call(t, app, http.MethodGet, fmt.Sprintf("/v1/socket/%s", alice.Id), "", bearer(mallory), nil)
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("socket of a participant with another token: got status %d, want 403", res.StatusCode)
+	}
+	res = call(t, app, http.MethodGet, messages, "", bearer(mallory), nil)
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("reading as an outsider: got status %d, want 403", res.StatusCode)
+	}
+}
+
+func TestRealtimeRoutesRequireAccessToken(t *testing.T) {
+	app := newTestApp(t)
+	caller := map[string]string{"X-Id": "victim"}
+
+	routes := []struct{ method, path, body string }{
+		{http.MethodGet, "/v1/events/victim", ""},
+		{http.MethodGet, "/v1/poll/victim", ""},
+		{http.MethodPost, "/v1/sessions/some-session/frames", `{"type":"ping"}`},
+	}
+	for _, route := range routes {
+		res := call(t, app, route.method, route.path, route.body, caller, nil)
+		if res.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s %s with X-Id only: got status %d, want 401", route.method, route.path, res.StatusCode)
+		}
+	}
+}
+
+func TestRealtimeRoutesRefuseOtherUsers(t *testing.T) {
+	requireMongo(t)
+	app := newTestApp(t)
+
+	alice := registerTestUser(t, app)
+	mallory := registerTestUser(t, app)
+
+	for _, path := range []string{"/v1/events/" + alice.Id, "/v1/poll/" + alice.Id} {
+		res := call(t, app, http.MethodGet, path, "", bearer(mallory), nil)
+		if res.StatusCode != http.StatusForbidden {
+			t.Errorf("%s with another user's token: got status %d, want 403", path, res.StatusCode)
+		}
+		res = call(t, app, http.MethodGet, path+"?access_token="+url.QueryEscape(mallory.AccessToken), "", nil, nil)
+		if res.StatusCode != http.StatusForbidden {
+			t.Errorf("%s with another user's token in the query: got status %d, want 403", path, res.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"server/dto"
+	"server/e2e"
+	"server/models"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
+)
+
+// Stable, machine readable error codes returned in every error body
+const (
+	CodeBadRequest       = "BAD_REQUEST"
+	CodeUserIdMissing    = "USER_ID_MISSING"
+	CodeUserNotFound     = "USER_NOT_FOUND"
+	CodeMessageIdMissing = "MESSAGE_ID_MISSING"
+	CodeInvalidMessageId = "INVALID_MESSAGE_ID"
+	CodeMessageNotFound  = "MESSAGE_NOT_FOUND"
+	CodeInvalidBody      = "INVALID_BODY"
+	CodeMessageTooLong   = "MESSAGE_TOO_LONG"
+	CodeRouteNotFound    = "ROUTE_NOT_FOUND"
+	CodeMethodNotAllowed = "METHOD_NOT_ALLOWED"
+	CodeUpgradeRequired  = "UPGRADE_REQUIRED"
+	CodeRateLimited      = "RATE_LIMITED"
+	CodeBanned           = "BANNED"
+	CodeForbidden        = "FORBIDDEN"
+	CodeUsernameInvalid  = "USERNAME_INVALID"
+	CodeUsernameTaken    = "USERNAME_TAKEN"
+	CodeUsernameReserved = "USERNAME_RESERVED"
+	CodeUsernameCooldown = "USERNAME_COOLDOWN"
+	CodeAuthProvider     = "AUTH_PROVIDER_UNKNOWN"
+	CodeAuthFailed       = "AUTH_FAILED"
+	CodeAuthState        = "AUTH_STATE_INVALID"
+	CodeRedirect         = "REDIRECT_NOT_ALLOWED"
+	CodeAlreadyLinked    = "PROVIDER_ALREADY_LINKED"
+	CodeInvalidEmail     = "INVALID_EMAIL"
+	CodeLoginCode        = "LOGIN_CODE_INVALID"
+	CodeNotMember        = "NOT_A_MEMBER"
+	CodeBlocked          = "BLOCKED"
+	CodeE2EInvalid       = "E2E_INVALID"
+	CodeE2ERequired      = "E2E_REQUIRED"
+	CodeKeysNotFound     = "KEYS_NOT_FOUND"
+	CodeKeysChanged      = "KEYS_CHANGED"
+	CodePushDisabled     = "PUSH_DISABLED"
+	CodePushInvalid      = "PUSH_SUBSCRIPTION_INVALID"
+	CodePushNotFound     = "PUSH_SUBSCRIPTION_NOT_FOUND"
+	CodeTooManySubs      = "TOO_MANY_SUBSCRIPTIONS"
+	CodeSessionNotFound  = "SESSION_NOT_FOUND"
+	CodeRestarting       = "SERVER_RESTARTING"
+	CodeUnauthenticated  = "UNAUTHENTICATED"
+	CodeInternal         = "INTERNAL_ERROR"
+)
+
+// APIError is an error that knows how it should be presented to clients
+type APIError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s (%d): %s", e.Code, e.Status, e.Message)
+}
+
+// NewAPIError creates an error rendered with the given HTTP status and code
+func NewAPIError(status int, code string, message string) *APIError {
+	return &APIError{Status: status, Code: code, Message: message}
+}
+
+var (
+	ErrUserIdMissing            = NewAPIError(fiber.StatusBadRequest, CodeUserIdMissing, "User id not passed")
+	ErrUserNotFound             = NewAPIError(fiber.StatusNotFound, CodeUserNotFound, "User not found, for passed user id!")
+	ErrMessageIdMissing         = NewAPIError(fiber.StatusBadRequest, CodeMessageIdMissing, "Message id not passed")
+	ErrInvalidMessageId         = NewAPIError(fiber.StatusBadRequest, CodeInvalidMessageId, "Message id is not valid")
+	ErrMessageNotFound          = NewAPIError(fiber.StatusNotFound, CodeMessageNotFound, "No message found for the given id")
+	ErrInvalidBody              = NewAPIError(fiber.StatusBadRequest, CodeInvalidBody, "Failed to parse body")
+	ErrRateLimited              = NewAPIError(fiber.StatusTooManyRequests, CodeRateLimited, "Too many requests, please wait before trying again.")
+	ErrBanned                   = NewAPIError(fiber.StatusForbidden, CodeBanned, "You are not allowed to use the chat")
+	ErrForbidden                = NewAPIError(fiber.StatusForbidden, CodeForbidden, "You are not allowed to do this")
+	ErrUsernameTaken            = NewAPIError(fiber.StatusConflict, CodeUsernameTaken, "Username is already taken")
+	ErrUsernameReserved         = NewAPIError(fiber.StatusBadRequest, CodeUsernameReserved, "Username is reserved")
+	ErrAuthProviderUnknown      = NewAPIError(fiber.StatusNotFound, CodeAuthProvider, "Sign in with this provider is not enabled")
+	ErrAuthFailed               = NewAPIError(fiber.StatusUnauthorized, CodeAuthFailed, "Could not verify the sign in")
+	ErrAuthStateInvalid         = NewAPIError(fiber.StatusBadRequest, CodeAuthState, "Sign in expired or was already used, please start again")
+	ErrRedirectNotAllowed       = NewAPIError(fiber.StatusBadRequest, CodeRedirect, "redirect_uri is not allowed")
+	ErrProviderAlreadyLinked    = NewAPIError(fiber.StatusConflict, CodeAlreadyLinked, "User is already signed in with another account of this provider")
+	ErrInvalidEmail             = NewAPIError(fiber.StatusBadRequest, CodeInvalidEmail, "Email address is not valid")
+	ErrLoginCodeInvalid         = NewAPIError(fiber.StatusUnauthorized, CodeLoginCode, "Login code is wrong or expired, please request a new one")
+	ErrTooManyLoginCodes        = NewAPIError(fiber.StatusTooManyRequests, CodeRateLimited, "Too many login codes requested for this address, please wait before trying again.")
+	ErrLoginCodesLocked         = NewAPIError(fiber.StatusTooManyRequests, CodeRateLimited, "Too many wrong login codes for this address, sign in with the emailed link or try again later.")
+	ErrNotChannelMember         = NewAPIError(fiber.StatusForbidden, CodeNotMember, "You are not a member of this channel")
+	ErrBlocked                  = NewAPIError(fiber.StatusForbidden, CodeBlocked, "You cannot message this user")
+	ErrDirectToSelf             = NewAPIError(fiber.StatusBadRequest, CodeBadRequest, "You cannot message yourself")
+	ErrKeyBundleNotFound        = NewAPIError(fiber.StatusNotFound, CodeKeysNotFound, "User has not registered encryption keys")
+	ErrKeyBundleChanged         = NewAPIError(fiber.StatusConflict, CodeKeysChanged, "Keys were changed by another request, load them and try again")
+	ErrEncryptionRequired       = NewAPIError(fiber.StatusBadRequest, CodeE2ERequired, "Both users have encryption keys, direct messages must be encrypted")
+	ErrSenderKeyMismatch        = NewAPIError(fiber.StatusBadRequest, CodeE2EInvalid, "sender_key is not your registered identity key")
+	ErrEncryptedPublic          = NewAPIError(fiber.StatusBadRequest, CodeE2EInvalid, "Only direct messages can be encrypted")
+	ErrPushDisabled             = NewAPIError(fiber.StatusNotFound, CodePushDisabled, "Push notifications are not enabled on this server")
+	ErrPushSubscriptionNotFound = NewAPIError(fiber.StatusNotFound, CodePushNotFound, "Push subscription not found")
+	ErrTooManyPushSubscriptions = NewAPIError(fiber.StatusBadRequest, CodePushInvalid, "Too many devices registered for push, remove one first")
+	ErrTooManySubscriptions     = NewAPIError(fiber.StatusBadRequest, CodeTooManySubs, fmt.Sprintf("A socket can follow at most %d channels besides its active site", models.MaxSubscriptions))
+	ErrChannelMissing           = NewAPIError(fiber.StatusBadRequest, CodeBadRequest, "Channel not passed")
+	ErrSessionNotFound          = NewAPIError(fiber.StatusNotFound, CodeSessionNotFound, "Realtime session expired, reconnect without last_event_id")
+	ErrServerRestarting         = NewAPIError(fiber.StatusServiceUnavailable, CodeRestarting, "Server is restarting, reconnect in a few seconds")
+	ErrUnauthenticated          = NewAPIError(fiber.StatusUnauthorized, CodeUnauthenticated, "Access token required, send the token issued at registration or sign in")
+	ErrAccessTokenInvalid       = NewAPIError(fiber.StatusUnauthorized, CodeUnauthenticated, "Access token is invalid or expired, please sign in again")
+	ErrAccessTokenClaimed       = NewAPIError(fiber.StatusUnauthorized, CodeUnauthenticated, "An access token was already issued for this user, send it or sign in again")
+	ErrAccessTokenUnclaimed     = NewAPIError(fiber.StatusUnauthorized, CodeUnauthenticated, "X-Id alone no longer identifies a user, register once with it to claim an access token")
+	ErrInternal                 = NewAPIError(fiber.StatusInternalServerError, CodeInternal, "Something went wrong, please try again later")
+)
+
+// ErrorHandler is the fiber error handler, every error returned by a handler
+// or middleware (including recovered panics) is rendered here
+func ErrorHandler(ctx *fiber.Ctx, err error) error {
+	apiErr := toAPIError(err)
+	requestId, _ := ctx.Locals(requestid.ConfigDefault.ContextKey).(string)
+
+	if apiErr.Status >= fiber.StatusInternalServerError {
+		requestLogger(ctx).Error("Request failed", "method", ctx.Method(), "path", ctx.Path(), "err", err)
+	}
+
+	return ctx.Status(apiErr.Status).JSON(dto.ErrorResponse{
+		Status:    apiErr.Status,
+		Code:      apiErr.Code,
+		Message:   apiErr.Message,
+		RequestId: requestId,
+	})
+}
+
+// toAPIError maps any error to the API error presented to the client, errors
+// that are not known are hidden behind ErrInternal
+func toAPIError(err error) *APIError {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+
+	switch {
+	case errors.Is(err, models.ErrAccessTokenInvalid):
+		return ErrAccessTokenInvalid
+	case errors.Is(err, models.ErrAccessTokenClaimed):
+		return ErrAccessTokenClaimed
+	case errors.Is(err, models.ErrUserNotFound):
+		return ErrUserNotFound
+	case errors.Is(err, models.ErrMessageNotFound):
+		return ErrMessageNotFound
+	case errors.Is(err, models.ErrInvalidMessageId):
+		return ErrInvalidMessageId
+	case errors.Is(err, models.ErrUsernameTaken):
+		return ErrUsernameTaken
+	case errors.Is(err, models.ErrUsernameReserved):
+		return ErrUsernameReserved
+	case errors.Is(err, models.ErrNotChannelMember):
+		return ErrNotChannelMember
+	case errors.Is(err, models.ErrBlocked):
+		return ErrBlocked
+	case errors.Is(err, models.ErrDirectToSelf):
+		return ErrDirectToSelf
+	case errors.Is(err, models.ErrKeyBundleNotFound):
+		return ErrKeyBundleNotFound
+	case errors.Is(err, models.ErrKeyBundleChanged):
+		return ErrKeyBundleChanged
+	case errors.Is(err, models.ErrEncryptionRequired):
+		return ErrEncryptionRequired
+	case errors.Is(err, models.ErrSenderKeyMismatch):
+		return ErrSenderKeyMismatch
+	case errors.Is(err, models.ErrPushDisabled):
+		return ErrPushDisabled
+	case errors.Is(err, models.ErrPushSubscriptionNotFound):
+		return ErrPushSubscriptionNotFound
+	case errors.Is(err, models.ErrTooManyPushSubscriptions):
+		return ErrTooManyPushSubscriptions
+	case errors.Is(err, models.ErrTooManySubscriptions):
+		return ErrTooManySubscriptions
+	case errors.Is(err, models.ErrChannelMissing):
+		return ErrChannelMissing
+	}
+
+	var pushErr *models.PushSubscriptionInvalidError
+	if errors.As(err, &pushErr) {
+		return NewAPIError(fiber.StatusBadRequest, CodePushInvalid, pushErr.Error())
+	}
+
+	var e2eErr *e2e.InvalidError
+	if errors.As(err, &e2eErr) {
+		return NewAPIError(fiber.StatusBadRequest, CodeE2EInvalid, e2eErr.Error())
+	}
+
+	var invalidErr *models.UsernameInvalidError
+	if errors.As(err, &invalidErr) {
+		return NewAPIError(fiber.StatusBadRequest, CodeUsernameInvalid, "Username "+invalidErr.Reason)
+	}
+
+	var cooldownErr *models.UsernameCooldownError
+	if errors.As(err, &cooldownErr) {
+		return NewAPIError(fiber.StatusTooManyRequests, CodeUsernameCooldown, "Username was changed recently, try again after "+cooldownErr.RetryAt.UTC().Format(time.RFC3339))
+	}
+
+	var fiberErr *fiber.Error
+	if errors.As(err, &fiberErr) {
+		switch fiberErr.Code {
+		case fiber.StatusNotFound:
+			return NewAPIError(fiberErr.Code, CodeRouteNotFound, fiberErr.Message)
+		case fiber.StatusMethodNotAllowed:
+			return NewAPIError(fiberErr.Code, CodeMethodNotAllowed, fiberErr.Message)
+		case fiber.StatusUpgradeRequired:
+			return NewAPIError(fiberErr.Code, CodeUpgradeRequired, fiberErr.Message)
+		case fiber.StatusTooManyRequests:
+			return ErrRateLimited
+		}
+		if fiberErr.Code < fiber.StatusInternalServerError {
+			return NewAPIError(fiberErr.Code, CodeBadRequest, fiberErr.Message)
+		}
+	}
+
+	return ErrInternal
+}
@@ -0,0 +1,101 @@
+package api
+
+import (
+	"server/dto"
+	"server/models"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// PutKeys registers or rotates the public keys of the calling user
+func (c *ChatController) PutKeys(ctx *fiber.Ctx) error {
+	userId := authenticatedUser(ctx)
+
+	if _, err := models.GetUser(userId); err != nil {
+		return err
+	}
+
+	var request dto.KeyBundleRequest
+	if err := ctx.BodyParser(&request); err != nil {
+		return ErrInvalidBody
+	}
+
+	bundle, err := models.PutKeyBundle(userId, request)
+	if err != nil {
+		return err
+	}
+
+	return ctx.Status(200).JSON(fiber.Map{
+		"status":  200,
+		"message": "Keys registered successfully",
+		"data":    bundle.Status(),
+	})
+}
+
+// AddPrekeys uploads more one time prekeys for the calling user
+func (c *ChatController) AddPrekeys(ctx *fiber.Ctx) error {
+	userId := authenticatedUser(ctx)
+
+	var request dto.PrekeysRequest
+	if err := ctx.BodyParser(&request); err != nil {
+		return ErrInvalidBody
+	}
+
+	bundle, err := models.AddPrekeys(userId, request.OneTimePrekeys)
+	if err != nil {
+		return err
+	}
+
+	return ctx.Status(200).JSON(fiber.Map{
+		"status":  200,
+		"message": "Prekeys added successfully",
+		"data":    bundle.Status(),
+	})
+}
+
+// GetMyKeys describes the bundle of the calling user, e.g. to know when to
+// upload more prekeys
+func (c *ChatController) GetMyKeys(ctx *fiber.Ctx) error {
+	userId := authenticatedUser(ctx)
+
+	bundle, err := models.GetKeyBundle(userId)
+	if err != nil {
+		return err
+	}
+
+	return ctx.Status(200).JSON(fiber.Map{
+		"status":  200,
+		"message": "Keys retrieved successfully",
+		"data":    bundle.Status(),
+	})
+}
+
+// GetKeyBundle hands out the bundle of another user to start an encrypted
+// conversation with them, using up one of their one time prekeys at most
+// once a day per caller
+func (c *ChatController) GetKeyBundle(ctx *fiber.Ctx) error {
+	userId := authenticatedUser(ctx)
+
+	user, err := models.GetUser(userId)
+	if err != nil {
+		return err
+	}
+
+	// Fetching the bundle starts the conversation, so prekeys are only
+	// handed out to users allowed to message the peer
+	peerId := ctx.Params("userId")
+	if _, err := models.OpenConversation(user, peerId); err != nil {
+		return err
+	}
+
+	bundle, err := models.TakeKeyBundle(userId, peerId)
+	if err != nil {
+		return err
+	}
+
+	return ctx.Status(200).JSON(fiber.Map{
+		"status":  200,
+		"message": "Key bundle retrieved successfully",
+		"data":    bundle,
+	})
+}
@@ -0,0 +1,141 @@
+package api
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"server/dto"
+)
+
+func TestKeyRoutesRequireAccessToken(t *testing.T) {
+	app := newTestApp(t)
+	caller := map[string]string{"X-Id": "victim"}
+
+	routes := []struct{ method, path, body string }{
+		{http.MethodGet, "/v1/users/me/keys", ""},
+		{http.MethodPut, "/v1/users/me/keys", `{}`},
+		{http.MethodPost, "/v1/users/me/keys/prekeys", `{}`},
+		{http.MethodGet, "/v1/users/victim/keys", ""},
+	}
+	for _, route := range routes {
+		res := call(t, app, route.method, route.path, route.body, caller, nil)
+		if res.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s %s with X-Id only: got status %d, want 401", route.method, route.path, res.StatusCode)
+		}
+	}
+}
+
+func randomKey(t *testing.T) string {
+	t.Helper()
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// testBundle returns a valid bundle for identity with prekeys one time prekeys
+func testBundle(t *testing.T, identity ed25519.PrivateKey, prekeys int) dto.KeyBundleRequest {
+	t.Helper()
+
+	signedPrekey := randomKey(t)
+	decoded, _ := base64.StdEncoding.DecodeString(signedPrekey)
+	bundle := dto.KeyBundleRequest{
+		IdentityKey: base64.StdEncoding.EncodeToString(identity.Public().(ed25519.PublicKey)),
+		SignedPrekey: dto.SignedPrekey{
+			KeyId:     1,
+			PublicKey: signedPrekey,
+			Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(identity, decoded)),
+		},
+	}
+	for i := 0; i < prekeys; i++ {
+		bundle.OneTimePrekeys = append(bundle.OneTimePrekeys, dto.Prekey{KeyId: int64(i + 1), PublicKey: randomKey(t)})
+	}
+	return bundle
+}
+
+func newIdentityKey(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return private
+}
+
+func toJSON(t *testing.T, value interface{}) string {
+	t.Helper()
+
+	body, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestIdentityKeyNeedsSignedRotation(t *testing.T) {
+	requireMongo(t)
+	app := newTestApp(t)
+	user := registerTestUser(t, app)
+
+	current := newIdentityKey(t)
+	res := call(t, app, http.MethodPut, "/v1/users/me/keys", toJSON(t, testBundle(t, current, 5)), bearer(user), nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("registering keys: got status %d", res.StatusCode)
+	}
+
+	next := newIdentityKey(t)
+	rotation := testBundle(t, next, 5)
+	res = call(t, app, http.MethodPut, "/v1/users/me/keys", toJSON(t, rotation), bearer(user), nil)
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("replacing the identity key unsigned: got status %d, want 400", res.StatusCode)
+	}
+
+	nextPublic := next.Public().(ed25519.PublicKey)
+	rotation.RotationSignature = base64.StdEncoding.EncodeToString(ed25519.Sign(current, nextPublic))
+	var response struct {
+		Data dto.KeyBundleStatus `json:"data"`
+	}
+	res = call(t, app, http.MethodPut, "/v1/users/me/keys", toJSON(t, rotation), bearer(user), &response)
+	if res.StatusCode != http.StatusOK || response.Data.IdentityKey != rotation.IdentityKey {
+		t.Fatalf("signed rotation: got status %d, keys %+v", res.StatusCode, response.Data)
+	}
+}
+
+func TestKeyBundleHandsOnePrekeyPerRequester(t *testing.T) {
+	requireMongo(t)
+	app := newTestApp(t)
+	alice := registerTestUser(t, app)
+	bob := registerTestUser(t, app)
+
+	res := call(t, app, http.MethodPut, "/v1/users/me/keys", toJSON(t, testBundle(t, newIdentityKey(t), 3)), bearer(bob), nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("registering keys: got status %d", res.StatusCode)
+	}
+
+	var first, second struct {
+		Data dto.KeyBundle `json:"data"`
+	}
+	call(t, app, http.MethodGet, "/v1/users/"+bob.Id+"/keys", "", bearer(alice), &first)
+	if first.Data.OneTimePrekey == nil {
+		t.Fatalf("first bundle has no one time prekey: %+v", first.Data)
+	}
+	call(t, app, http.MethodGet, "/v1/users/"+bob.Id+"/keys", "", bearer(alice), &second)
+	if second.Data.OneTimePrekey != nil || second.Data.IdentityKey == "" {
+		t.Fatalf("second bundle of the same requester: %+v", second.Data)
+	}
+
+	var status struct {
+		Data dto.KeyBundleStatus `json:"data"`
+	}
+	call(t, app, http.MethodGet, "/v1/users/me/keys", "", bearer(bob), &status)
+	if status.Data.OneTimePrekeys != 2 {
+		t.Fatalf("bob has %d prekeys left, want 2", status.Data.OneTimePrekeys)
+	}
+}
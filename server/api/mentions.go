@@ -0,0 +1,55 @@
+package api
+
+import (
+	"server/dto"
+	"server/models"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetMentions returns a page of the calling user's mentions inbox
+func (c *ChatController) GetMentions(ctx *fiber.Ctx) error {
+	userId := authenticatedUser(ctx)
+
+	if _, err := models.GetUser(userId); err != nil {
+		return err
+	}
+
+	page, err := models.GetMentions(userId, ctx.QueryBool("unread"), int64(c.pageSize), ctx.Query("bookmark"))
+	if err != nil {
+		return err
+	}
+
+	return ctx.Status(200).JSON(fiber.Map{
+		"status":  200,
+		"message": "Mentions retrieved successfully",
+		"data":    page,
+	})
+}
+
+// MarkMentionsRead marks entries of the calling user's inbox read
+func (c *ChatController) MarkMentionsRead(ctx *fiber.Ctx) error {
+	userId := authenticatedUser(ctx)
+
+	var request dto.MentionReadRequest
+	if len(ctx.Body()) > 0 {
+		if err := ctx.BodyParser(&request); err != nil {
+			return ErrInvalidBody
+		}
+	}
+
+	if err := models.MarkMentionsRead(userId, request.MessageIds); err != nil {
+		return err
+	}
+
+	unread, err := models.CountUnreadMentions(userId)
+	if err != nil {
+		return err
+	}
+
+	return ctx.Status(200).JSON(fiber.Map{
+		"status":  200,
+		"message": "Mentions marked read",
+		"data":    dto.MentionCount{Unread: unread},
+	})
+}
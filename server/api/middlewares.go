@@ -1,10 +1,26 @@
 package api
 
 import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
+	"server/logging"
+	"server/metrics"
+	"server/models"
+	"server/realtime"
+	"server/tracing"
+
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/limiter"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
+	"github.com/gofiber/websocket/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func RateLimit(count int, duration time.Duration) fiber.Handler {
@@ -16,17 +32,199 @@ func RateLimit(count int, duration time.Duration) fiber.Handler {
 		Max:        count,
 		Expiration: duration,
 		KeyGenerator: func(c *fiber.Ctx) string {
-			return c.IP() + "_" + c.Path() // Limit each IP to a unique request per path
+			return models.HashIp(c.IP()) + "_" + c.Path() // Limit each IP to a unique request per path, keyed by hash so raw ips are not held
 		},
 		LimitReached: func(ctx *fiber.Ctx) error {
-			// Return a JSON response when rate limit is reached
-			return ctx.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
-				"error":   "Too many requests",
-				"message": "Please wait before trying again.",
-				"status":  fiber.StatusTooManyRequests,
-			})
+			metrics.RateLimited.WithLabelValues(ctx.Route().Path).Inc()
+			// Rendered as a JSON error body by ErrorHandler
+			return ErrRateLimited
 		},
 		SkipFailedRequests:     false,
 		SkipSuccessfulRequests: false,
 	})
 }
+
+// Trace runs every request in a server span, continuing the trace of its
+// traceparent header. Handlers pass ctx.UserContext() on to keep the trace.
+func Trace(ctx *fiber.Ctx) error {
+	parent := tracing.ExtractHeaders(ctx.UserContext(), func(key string) string { return ctx.Get(key) })
+	spanCtx, span := tracing.Tracer.Start(parent, ctx.Method(), trace.WithSpanKind(trace.SpanKindServer))
+	ctx.SetUserContext(spanCtx)
+
+	err := ctx.Next()
+
+	// The route is known once the request was routed
+	status := ctx.Response().StatusCode()
+	if err != nil {
+		status = toAPIError(err).Status
+	}
+	route := ctx.Route().Path
+	span.SetName(ctx.Method() + " " + route)
+	span.SetAttributes(
+		attribute.String("http.request.method", ctx.Method()),
+		attribute.String("http.route", route),
+		attribute.Int("http.response.status_code", status),
+	)
+	// Client errors are the client's, only server errors fail the span
+	if status >= fiber.StatusInternalServerError {
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	span.End()
+	return err
+}
+
+// loggerLocal is the key of the request logger in the locals of a request,
+// which websocket connections keep after the upgrade
+const loggerLocal = "logger"
+
+// RequestLogger tags the logger of every request with its request id and
+// the user id of the X-Id header, handlers get it with requestLogger.
+// Completed requests are logged at debug level.
+func RequestLogger(ctx *fiber.Ctx) error {
+	requestId, _ := ctx.Locals(requestid.ConfigDefault.ContextKey).(string)
+	logger := slog.Default().With("request_id", requestId)
+	if spanContext := trace.SpanContextFromContext(ctx.UserContext()); spanContext.IsValid() {
+		logger = logger.With("trace_id", spanContext.TraceID().String())
+	}
+	if userId := ctx.Get("X-Id"); userId != "" {
+		logger = logger.With("user_id", userId)
+	}
+
+	ctx.Locals(loggerLocal, logger)
+	ctx.SetUserContext(logging.With(ctx.UserContext(), logger))
+
+	start := time.Now()
+	err := ctx.Next()
+
+	status := ctx.Response().StatusCode()
+	if err != nil {
+		status = toAPIError(err).Status
+	}
+	logger.Debug("Request completed",
+		"method", ctx.Method(),
+		"path", ctx.Path(),
+		"status", status,
+		"duration_ms", time.Since(start).Milliseconds(),
+	)
+	return err
+}
+
+// requestLogger returns the logger RequestLogger made for the request
+func requestLogger(ctx *fiber.Ctx) *slog.Logger {
+	return logging.From(ctx.UserContext())
+}
+
+// socketLogger returns the request logger a websocket was upgraded with
+func socketLogger(conn *websocket.Conn) *slog.Logger {
+	if logger, ok := conn.Locals(loggerLocal).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// Instrument records the latency and status of every request by route
+// template, requests matching no route are recorded under "unmatched" so
+// scanners cannot grow the series
+func Instrument(ctx *fiber.Ctx) error {
+	start := time.Now()
+	err := ctx.Next()
+
+	// ErrorHandler has not written the response of a failed request yet
+	status := ctx.Response().StatusCode()
+	if err != nil {
+		status = toAPIError(err).Status
+	}
+
+	route := ctx.Route()
+	path := route.Path
+	if status == fiber.StatusNotFound && isRouteNotFound(err) {
+		path = "unmatched"
+	}
+	metrics.HTTPRequestDuration.WithLabelValues(ctx.Method(), path, strconv.Itoa(status)).Observe(metrics.Since(start))
+	return err
+}
+
+// isRouteNotFound reports whether err is fiber's answer to a path no route
+// matches, as opposed to a handler not finding a resource
+func isRouteNotFound(err error) bool {
+	var fiberErr *fiber.Error
+	return errors.As(err, &fiberErr) && fiberErr.Code == fiber.StatusNotFound
+}
+
+// authUserLocal is the key of the user Authenticate resolved in the locals
+// of a request
+const authUserLocal = "authUserId"
+
+// Authenticate resolves the access token of a request, sent as a bearer
+// token or, by websockets and EventSource which cannot set headers, as the
+// access_token query parameter. Handlers of routes with Auth set read the
+// caller with authenticatedUser, never from the X-Id header; this covers
+// every route acting as the caller, such as sending, reacting and reporting.
+// The token's user also becomes the X-Id of the request, for the read-only
+// public channel routes that still take it, and a token and X-Id naming
+// different users are refused. Requests without a token pass on unauthenticated, routes with
+// Auth set turn them away in RequireAuth.
+func Authenticate(ctx *fiber.Ctx) error {
+	token := accessToken(ctx)
+	if token == "" {
+		return ctx.Next()
+	}
+
+	userId, err := models.AccessTokenUser(token)
+	if err != nil {
+		return err
+	}
+	if claimed := ctx.Get("X-Id"); claimed != "" && claimed != userId {
+		return ErrForbidden
+	}
+
+	ctx.Locals(authUserLocal, userId)
+	ctx.Request().Header.Set("X-Id", userId)
+	return ctx.Next()
+}
+
+func accessToken(ctx *fiber.Ctx) string {
+	header := ctx.Get(fiber.HeaderAuthorization)
+	if token, ok := strings.CutPrefix(header, "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return ctx.Query("access_token")
+}
+
+// RequireAuth refuses requests without a valid access token, and requests
+// whose :id path parameter names another user than the token. Clients from
+// before access tokens, sending X-Id alone, are pointed to ClaimAccessToken
+// through registration.
+func RequireAuth(ctx *fiber.Ctx) error {
+	userId := authenticatedUser(ctx)
+	if userId == "" && ctx.Get("X-Id") != "" {
+		return ErrAccessTokenUnclaimed
+	}
+	if userId == "" {
+		return ErrUnauthenticated
+	}
+	if id := ctx.Params("id"); id != "" && id != userId {
+		return ErrForbidden
+	}
+	return ctx.Next()
+}
+
+// authenticatedUser returns the user the access token of the request was
+// issued to, empty when it carries none
+func authenticatedUser(ctx *fiber.Ctx) string {
+	userId, _ := ctx.Locals(authUserLocal).(string)
+	return userId
+}
+
+// RefuseWhileDraining turns away new realtime connections once the server
+// started shutting down, clients retry after Retry-After seconds
+func RefuseWhileDraining(ctx *fiber.Ctx) error {
+	if realtime.Draining() {
+		ctx.Set(fiber.HeaderRetryAfter, "5")
+		return ErrServerRestarting
+	}
+	return ctx.Next()
+}
@@ -6,18 +6,6 @@ type WebSocketMessage struct {
 	Content string `json:"content"`
 }
 
-// Message representation
-type MessageModel struct {
-	Id        string
-	Timestamp string
-	SiteId    string
-	Message   string
-	To        string
-	From      string
-	Reactions []string
-	Flagged   []string // [{userId: string, Reason}]
-}
-
 // Site data representation
 type SiteMetdataModel struct {
 	Id             string // <:domain:pathname>
@@ -0,0 +1,317 @@
+package api
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"server/dto"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// OpenAPIDocument is the subset of OpenAPI 3 the server generates
+type OpenAPIDocument struct {
+	OpenAPI    string                          `json:"openapi"`
+	Info       OpenAPIInfo                     `json:"info"`
+	Paths      map[string]map[string]Operation `json:"paths"`
+	Components OpenAPIComponents               `json:"components"`
+}
+
+type OpenAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type OpenAPIComponents struct {
+	Schemas         map[string]Schema         `json:"schemas"`
+	SecuritySchemes map[string]SecurityScheme `json:"securitySchemes,omitempty"`
+}
+
+type SecurityScheme struct {
+	Type        string `json:"type"`
+	Scheme      string `json:"scheme,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// bearerAuth names the access token scheme in the document
+const bearerAuth = "bearerAuth"
+
+type Operation struct {
+	OperationId string                `json:"operationId"`
+	Summary     string                `json:"summary,omitempty"`
+	Tags        []string              `json:"tags,omitempty"`
+	Parameters  []Parameter           `json:"parameters,omitempty"`
+	RequestBody *RequestBody          `json:"requestBody,omitempty"`
+	Responses   map[string]Response   `json:"responses"`
+	Security    []map[string][]string `json:"security,omitempty"`
+}
+
+type Parameter struct {
+	Name        string `json:"name"`
+	In          string `json:"in"`
+	Description string `json:"description,omitempty"`
+	Required    bool   `json:"required"`
+	Schema      Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Required bool                 `json:"required"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+type Response struct {
+	Description string               `json:"description"`
+	Content     map[string]MediaType `json:"content,omitempty"`
+}
+
+type MediaType struct {
+	Schema Schema `json:"schema"`
+}
+
+// Schema is a JSON schema object, kept as a map since only a handful of
+// keywords are ever set
+type Schema map[string]interface{}
+
+var openAPIDocument OpenAPIDocument
+
+// OpenAPI returns the document generated by SetupRoutes
+func OpenAPI() OpenAPIDocument {
+	return openAPIDocument
+}
+
+// ServeOpenAPI responds with the generated OpenAPI document
+func ServeOpenAPI(ctx *fiber.Ctx) error {
+	return ctx.Status(200).JSON(openAPIDocument)
+}
+
+// BuildOpenAPI generates the OpenAPI document for routes mounted under prefix
+func BuildOpenAPI(prefix string, routes []Route) OpenAPIDocument {
+	schemas := map[string]Schema{}
+	doc := OpenAPIDocument{
+		OpenAPI: "3.0.3",
+		Info: OpenAPIInfo{
+			Title:   "Blablah live API",
+			Version: fmt.Sprintf("%d", dto.Version),
+		},
+		Paths: map[string]map[string]Operation{},
+		Components: OpenAPIComponents{
+			Schemas: schemas,
+			SecuritySchemes: map[string]SecurityScheme{
+				bearerAuth: {
+					Type:        "http",
+					Scheme:      "bearer",
+					Description: "Access token issued at registration or sign in, websockets and EventSource pass it as the access_token query parameter",
+				},
+			},
+		},
+	}
+
+	errorSchema := schemaOf(reflect.TypeOf(dto.ErrorResponse{}), schemas)
+
+	for _, route := range routes {
+		path := openAPIPath(prefix + route.Path)
+		operation := Operation{
+			OperationId: route.OperationId,
+			Summary:     route.Summary,
+			Responses:   map[string]Response{},
+		}
+
+		if route.Tag != "" {
+			operation.Tags = []string{route.Tag}
+		}
+
+		if route.Auth {
+			operation.Security = []map[string][]string{{bearerAuth: {}}}
+		}
+
+		for _, param := range route.Params {
+			paramType := param.Type
+			if paramType == "" {
+				paramType = "string"
+			}
+			operation.Parameters = append(operation.Parameters, Parameter{
+				Name:        param.Name,
+				In:          param.In,
+				Description: param.Description,
+				Required:    param.Required || param.In == "path",
+				Schema:      Schema{"type": paramType},
+			})
+		}
+
+		if route.Body != nil {
+			operation.RequestBody = &RequestBody{
+				Required: !route.BodyOptional,
+				Content: map[string]MediaType{
+					fiber.MIMEApplicationJSON: {Schema: schemaOf(reflect.TypeOf(route.Body), schemas)},
+				},
+			}
+		}
+
+		switch {
+		case route.Websocket:
+			operation.Responses["101"] = Response{Description: "Switching to the websocket protocol"}
+		case route.Redirect:
+			operation.Responses["302"] = Response{Description: "Redirect to the location header"}
+		case route.Raw:
+			contentType := route.ContentType
+			if contentType == "" {
+				contentType = fiber.MIMEApplicationJSON
+			}
+			operation.Responses["200"] = Response{
+				Description: "OK",
+				Content: map[string]MediaType{
+					contentType: {Schema: schemaOf(reflect.TypeOf(route.Response), schemas)},
+				},
+			}
+		default:
+			operation.Responses["200"] = Response{
+				Description: "OK",
+				Content: map[string]MediaType{
+					fiber.MIMEApplicationJSON: {Schema: envelopeSchema(route.Response, schemas)},
+				},
+			}
+		}
+
+		operation.Responses["default"] = Response{
+			Description: "Error",
+			Content: map[string]MediaType{
+				fiber.MIMEApplicationJSON: {Schema: errorSchema},
+			},
+		}
+
+		if doc.Paths[path] == nil {
+			doc.Paths[path] = map[string]Operation{}
+		}
+		doc.Paths[path][strings.ToLower(route.Method)] = operation
+	}
+
+	return doc
+}
+
+// VerifyOpenAPI checks that every route registered under prefix is described
+// by the document and that every documented operation has a handler
+func VerifyOpenAPI(app *fiber.App, prefix string, doc OpenAPIDocument) error {
+	registered := map[string]bool{}
+	for _, route := range app.GetRoutes(true) {
+		if route.Method == fiber.MethodHead || !strings.HasPrefix(route.Path, prefix+"/") {
+			continue
+		}
+		registered[strings.ToLower(route.Method)+" "+openAPIPath(route.Path)] = true
+	}
+
+	documented := map[string]bool{}
+	for path, operations := range doc.Paths {
+		for method := range operations {
+			documented[method+" "+path] = true
+		}
+	}
+
+	var problems []string
+	for operation := range registered {
+		if !documented[operation] {
+			problems = append(problems, "undocumented route: "+operation)
+		}
+	}
+	for operation := range documented {
+		if !registered[operation] {
+			problems = append(problems, "documented route without handler: "+operation)
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("OpenAPI document and routes diverge:\n%s", strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+var fiberParam = regexp.MustCompile(`:([A-Za-z0-9_]+)\??`)
+
+// openAPIPath converts a fiber path (/messages/:messageId) to OpenAPI form (/messages/{messageId})
+func openAPIPath(path string) string {
+	return fiberParam.ReplaceAllString(path, "{$1}")
+}
+
+// envelopeSchema describes the standard {message, status, data} success body
+func envelopeSchema(data interface{}, schemas map[string]Schema) Schema {
+	properties := map[string]Schema{
+		"message": {"type": "string"},
+		"status":  {"type": "integer"},
+	}
+	if data != nil {
+		properties["data"] = schemaOf(reflect.TypeOf(data), schemas)
+	}
+
+	return Schema{
+		"type":       "object",
+		"properties": properties,
+		"required":   []string{"message", "status"},
+	}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaOf reflects a Go type into a JSON schema, named structs are added
+// to schemas and referenced
+func schemaOf(t reflect.Type, schemas map[string]Schema) Schema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t == timeType {
+		return Schema{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return Schema{"type": "string"}
+	case reflect.Bool:
+		return Schema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return Schema{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return Schema{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return Schema{"type": "array", "items": schemaOf(t.Elem(), schemas)}
+	case reflect.Map:
+		return Schema{"type": "object", "additionalProperties": schemaOf(t.Elem(), schemas)}
+	case reflect.Struct:
+		name := t.Name()
+		if _, exists := schemas[name]; !exists {
+			// Reserve the name first so self referencing types terminate
+			schemas[name] = Schema{}
+			schemas[name] = structSchema(t, schemas)
+		}
+		return Schema{"$ref": "#/components/schemas/" + name}
+	}
+
+	return Schema{}
+}
+
+func structSchema(t reflect.Type, schemas map[string]Schema) Schema {
+	properties := map[string]Schema{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name := field.Name
+		if tag := field.Tag.Get("json"); tag != "" {
+			if tag == "-" {
+				continue
+			}
+			if tagName := strings.Split(tag, ",")[0]; tagName != "" {
+				name = tagName
+			}
+		}
+		properties[name] = schemaOf(field.Type, schemas)
+	}
+
+	return Schema{"type": "object", "properties": properties}
+}
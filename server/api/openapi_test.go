@@ -0,0 +1,257 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"server/dto"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// contract calls the real handlers and checks every response body against
+// the schema the OpenAPI document gives for its status
+type contract struct {
+	t   *testing.T
+	app *fiber.App
+	doc OpenAPIDocument
+}
+
+func newContract(t *testing.T) *contract {
+	app := newTestApp(t)
+	return &contract{t: t, app: app, doc: OpenAPI()}
+}
+
+// operation finds the path and method of an operation in the document
+func (c *contract) operation(operationId string) (string, string, Operation) {
+	c.t.Helper()
+
+	for path, operations := range c.doc.Paths {
+		for method, operation := range operations {
+			if operation.OperationId == operationId {
+				return strings.ToUpper(method), path, operation
+			}
+		}
+	}
+	c.t.Fatalf("operation %s is not documented", operationId)
+	return "", "", Operation{}
+}
+
+// call sends a request to operationId, params fill the path, and returns the
+// decoded body once it matched the documented schema
+func (c *contract) call(operationId string, params map[string]string, query string, body string, header map[string]string, status int) interface{} {
+	c.t.Helper()
+
+	method, path, operation := c.operation(operationId)
+	for name, value := range params {
+		path = strings.ReplaceAll(path, "{"+name+"}", url.PathEscape(value))
+	}
+	if strings.Contains(path, "{") {
+		c.t.Fatalf("%s: path %s has unfilled parameters", operationId, path)
+	}
+	if query != "" {
+		path += "?" + query
+	}
+
+	res := call(c.t, c.app, method, path, body, header, nil)
+	defer res.Body.Close()
+	raw, err := io.ReadAll(res.Body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if res.StatusCode != status {
+		c.t.Fatalf("%s %s: got status %d, want %d: %s", method, path, res.StatusCode, status, raw)
+	}
+
+	response, ok := operation.Responses[strconv.Itoa(res.StatusCode)]
+	if !ok {
+		response = operation.Responses["default"]
+	}
+	media, ok := response.Content[fiber.MIMEApplicationJSON]
+	if !ok {
+		c.t.Fatalf("%s: status %d has no documented JSON body", operationId, res.StatusCode)
+	}
+
+	var decoded interface{}
+	if err := json.Unmarshal(raw, &decoded); err != nil {
+		c.t.Fatalf("%s: body is not JSON: %v: %s", operationId, err, raw)
+	}
+	if problems := c.check(media.Schema, decoded, "body"); len(problems) > 0 {
+		sort.Strings(problems)
+		c.t.Errorf("%s %s does not match the document:\n%s\n%s", method, path, strings.Join(problems, "\n"), raw)
+	}
+	return decoded
+}
+
+// check returns where value departs from schema
+func (c *contract) check(schema Schema, value interface{}, at string) []string {
+	if ref, ok := schema["$ref"].(string); ok {
+		name := strings.TrimPrefix(ref, "#/components/schemas/")
+		resolved, ok := c.doc.Components.Schemas[name]
+		if !ok {
+			return []string{fmt.Sprintf("%s: unknown schema %s", at, name)}
+		}
+		return c.check(resolved, value, at)
+	}
+
+	kind, _ := schema["type"].(string)
+	if kind == "" {
+		return nil
+	}
+	if value == nil {
+		return []string{fmt.Sprintf("%s: null where %s is documented", at, kind)}
+	}
+
+	var problems []string
+	switch kind {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: %T where an object is documented", at, value)}
+		}
+		properties, _ := schema["properties"].(map[string]Schema)
+		additional, hasAdditional := schema["additionalProperties"].(Schema)
+		for key, field := range object {
+			if property, ok := properties[key]; ok {
+				problems = append(problems, c.check(property, field, at+"."+key)...)
+			} else if hasAdditional {
+				problems = append(problems, c.check(additional, field, at+"."+key)...)
+			} else {
+				problems = append(problems, fmt.Sprintf("%s.%s: undocumented field", at, key))
+			}
+		}
+		required, _ := schema["required"].([]string)
+		for _, key := range required {
+			if _, ok := object[key]; !ok {
+				problems = append(problems, fmt.Sprintf("%s.%s: required field missing", at, key))
+			}
+		}
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: %T where an array is documented", at, value)}
+		}
+		itemSchema, _ := schema["items"].(Schema)
+		for i, item := range items {
+			problems = append(problems, c.check(itemSchema, item, fmt.Sprintf("%s[%d]", at, i))...)
+		}
+	case "string":
+		text, ok := value.(string)
+		if !ok {
+			return []string{fmt.Sprintf("%s: %T where a string is documented", at, value)}
+		}
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, text); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %q is not a date-time", at, text))
+			}
+		}
+	case "integer":
+		number, ok := value.(float64)
+		if !ok || number != math.Trunc(number) {
+			problems = append(problems, fmt.Sprintf("%s: %v where an integer is documented", at, value))
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			problems = append(problems, fmt.Sprintf("%s: %T where a number is documented", at, value))
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			problems = append(problems, fmt.Sprintf("%s: %T where a boolean is documented", at, value))
+		}
+	}
+	return problems
+}
+
+// field digs a string out of a decoded body, e.g. field(body, "data", "id")
+func field(value interface{}, path ...string) string {
+	for _, key := range path {
+		object, _ := value.(map[string]interface{})
+		value = object[key]
+	}
+	text, _ := value.(string)
+	return text
+}
+
+func TestErrorsMatchTheContract(t *testing.T) {
+	c := newContract(t)
+	caller := map[string]string{"X-Id": "someone"}
+
+	c.call("getMe", nil, "", "", nil, http.StatusUnauthorized)
+	c.call("getMe", nil, "", "", caller, http.StatusUnauthorized)
+	c.call("updateMe", nil, "", `{"is_online":false}`, caller, http.StatusUnauthorized)
+	c.call("exportMe", nil, "", "", caller, http.StatusUnauthorized)
+	c.call("listConversations", nil, "", "", caller, http.StatusUnauthorized)
+	c.call("putKeys", nil, "", "{}", caller, http.StatusUnauthorized)
+	c.call("streamEvents", map[string]string{"id": "someone"}, "", "", caller, http.StatusUnauthorized)
+	c.call("getMentions", nil, "", "", caller, http.StatusUnauthorized)
+	c.call("getUnreadCounts", nil, "", "", caller, http.StatusUnauthorized)
+	c.call("markChannelRead", map[string]string{"channelId": "contract.example"}, "", `{"message_id":"ffffffffffffffffffffffff"}`, caller, http.StatusUnauthorized)
+	c.call("markMentionsRead", nil, "", "", caller, http.StatusUnauthorized)
+	c.call("changeUsername", nil, "", `{"username":"taken_over"}`, caller, http.StatusUnauthorized)
+	c.call("getUsernameHistory", map[string]string{"userId": "someone"}, "", "", caller, http.StatusUnauthorized)
+	c.call("verifyEmailCode", nil, "", `{"email":"a@example.com","code":"000000"}`, caller, http.StatusUnauthorized)
+}
+
+func TestResponsesMatchTheContract(t *testing.T) {
+	requireMongo(t)
+	c := newContract(t)
+
+	register := func() (string, map[string]string) {
+		body := c.call("registerUser", nil, "SiteId=contract.example", "", nil, http.StatusOK)
+		return field(body, "data", "id"), map[string]string{"Authorization": "Bearer " + field(body, "data", "access_token")}
+	}
+	alice, asAlice := register()
+	bob, asBob := register()
+
+	channel := map[string]string{"channelId": "contract.example"}
+	c.call("getMe", nil, "", "", map[string]string{"Authorization": "Bearer not-a-token"}, http.StatusUnauthorized)
+	c.call("getMe", nil, "", "", asAlice, http.StatusOK)
+	c.call("updateMe", nil, "", `{"active_site":"contract.example","is_online":true}`, asAlice, http.StatusOK)
+	c.call("getChannel", channel, "", "", nil, http.StatusOK)
+	c.call("getPresence", channel, "", "", asAlice, http.StatusOK)
+
+	sent := c.call("sendMessage", channel, "", fmt.Sprintf(`{"message":"hello @%s"}`, field(c.call("getMe", nil, "", "", asBob, http.StatusOK), "data", "username")), asAlice, http.StatusOK)
+	message := map[string]string{"channelId": "contract.example", "messageId": field(sent, "data", "id")}
+	c.call("listMessages", channel, "", "", asAlice, http.StatusOK)
+	c.call("getMessage", message, "", "", asAlice, http.StatusOK)
+	c.call("toggleReaction", message, "", `{"emoji":"👍"}`, asBob, http.StatusOK)
+	c.call("toggleReport", message, "", "", asBob, http.StatusOK)
+	c.call("markChannelRead", channel, "", fmt.Sprintf(`{"message_id":%q}`, message["messageId"]), asBob, http.StatusOK)
+	c.call("getMessage", map[string]string{"channelId": "contract.example", "messageId": "ffffffffffffffffffffffff"}, "", "", asAlice, http.StatusNotFound)
+
+	c.call("getMentions", nil, "", "", asBob, http.StatusOK)
+	c.call("getUnreadCounts", nil, "", "", asBob, http.StatusOK)
+	c.call("markMentionsRead", nil, "", `{"message_ids":[]}`, asBob, http.StatusOK)
+
+	c.call("changeUsername", nil, "", fmt.Sprintf(`{"username":"contract_%d"}`, time.Now().UnixNano()%100000), asAlice, http.StatusOK)
+	c.call("getUsernameHistory", map[string]string{"userId": alice}, "", "", asBob, http.StatusOK)
+
+	peer := map[string]string{"userId": bob}
+	c.call("listConversations", nil, "", "", asAlice, http.StatusOK)
+	c.call("openConversation", peer, "", "", asAlice, http.StatusOK)
+	c.call("markConversationRead", peer, "", "", asAlice, http.StatusOK)
+	c.call("getBlocks", nil, "", "", asAlice, http.StatusOK)
+	c.call("blockUser", peer, "", "", asAlice, http.StatusOK)
+	c.call("unblockUser", peer, "", "", asAlice, http.StatusOK)
+
+	identity := newIdentityKey(t)
+	c.call("putKeys", nil, "", toJSON(t, testBundle(t, identity, 2)), asBob, http.StatusOK)
+	c.call("addPrekeys", nil, "", toJSON(t, dto.PrekeysRequest{OneTimePrekeys: []dto.Prekey{{KeyId: 100, PublicKey: randomKey(t)}}}), asBob, http.StatusOK)
+	c.call("getMyKeys", nil, "", "", asBob, http.StatusOK)
+	c.call("getKeyBundle", peer, "", "", asAlice, http.StatusOK)
+
+	c.call("listPushSubscriptions", nil, "", "", asAlice, http.StatusOK)
+	c.call("getOpenAPI", nil, "", "", nil, http.StatusOK)
+
+	c.call("exportMe", nil, "", "", asAlice, http.StatusOK)
+	c.call("deleteMe", nil, "", "", asAlice, http.StatusOK)
+}
@@ -0,0 +1,41 @@
+package api
+
+import (
+	"net/url"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// channelParam returns the channel (site) id of a request, read from the
+// path on versioned routes and from the SiteId query on legacy routes
+func channelParam(ctx *fiber.Ctx) string {
+	if channelId := ctx.Params("channelId"); channelId != "" {
+		if unescaped, err := url.PathUnescape(channelId); err == nil {
+			return unescaped
+		}
+		return channelId
+	}
+
+	return ctx.Query("SiteId")
+}
+
+// messageIdParam returns the message id from the path of versioned or legacy routes
+func messageIdParam(ctx *fiber.Ctx) string {
+	if messageId := ctx.Params("messageId"); messageId != "" {
+		return messageId
+	}
+	if messageId := ctx.Params("MessageId"); messageId != "" {
+		return messageId
+	}
+
+	return ctx.Params("_id")
+}
+
+// Deprecated marks a legacy route, clients are pointed at its versioned successor
+func Deprecated(successor string) fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		ctx.Set("Deprecation", "true")
+		ctx.Set("Link", "<"+successor+">; rel=\"successor-version\"")
+		return ctx.Next()
+	}
+}
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"server/dto"
+	"server/models"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetVAPIDKey returns the applicationServerKey browsers subscribe with
+func (c *ChatController) GetVAPIDKey(ctx *fiber.Ctx) error {
+	publicKey, err := models.VAPIDPublicKey()
+	if err != nil {
+		return err
+	}
+
+	return ctx.Status(200).JSON(fiber.Map{
+		"status":  200,
+		"message": "VAPID key retrieved successfully",
+		"data":    dto.VAPIDKey{PublicKey: publicKey},
+	})
+}
+
+// RegisterPushSubscription stores a push subscription of the calling user
+func (c *ChatController) RegisterPushSubscription(ctx *fiber.Ctx) error {
+	userId := authenticatedUser(ctx)
+
+	if _, err := models.GetUser(userId); err != nil {
+		return err
+	}
+
+	var request dto.PushSubscriptionRequest
+	if err := ctx.BodyParser(&request); err != nil {
+		return ErrInvalidBody
+	}
+
+	subscription, err := models.SavePushSubscription(userId, request)
+	if err != nil {
+		return err
+	}
+
+	return ctx.Status(200).JSON(fiber.Map{
+		"status":  200,
+		"message": "Push subscription registered successfully",
+		"data":    subscription.ToDTO(),
+	})
+}
+
+// ListPushSubscriptions returns the push subscriptions of the calling user
+func (c *ChatController) ListPushSubscriptions(ctx *fiber.Ctx) error {
+	userId := authenticatedUser(ctx)
+
+	subscriptions, err := models.ListPushSubscriptions(userId)
+	if err != nil {
+		return err
+	}
+
+	result := make([]dto.PushSubscription, 0, len(subscriptions))
+	for _, subscription := range subscriptions {
+		result = append(result, subscription.ToDTO())
+	}
+
+	return ctx.Status(200).JSON(fiber.Map{
+		"status":  200,
+		"message": "Push subscriptions retrieved successfully",
+		"data":    result,
+	})
+}
+
+// DeletePushSubscription unregisters a push subscription of the calling user
+func (c *ChatController) DeletePushSubscription(ctx *fiber.Ctx) error {
+	userId := authenticatedUser(ctx)
+
+	if err := models.DeletePushSubscription(userId, ctx.Params("subscriptionId")); err != nil {
+		return err
+	}
+
+	return ctx.Status(200).JSON(fiber.Map{
+		"status":  200,
+		"message": "Push subscription removed successfully",
+	})
+}
@@ -0,0 +1,187 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"server/db"
+	"server/dto"
+	"server/models"
+	"server/push"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestPushRoutesRequireAccessToken(t *testing.T) {
+	app := newTestApp(t)
+	caller := map[string]string{"X-Id": "victim"}
+
+	routes := []struct{ method, path, body string }{
+		{http.MethodGet, "/v1/push/subscriptions", ""},
+		{http.MethodPost, "/v1/push/subscriptions", `{"endpoint":"https://fcm.googleapis.com/fcm/send/x"}`},
+		{http.MethodDelete, "/v1/push/subscriptions/650000000000000000000001", ""},
+	}
+	for _, route := range routes {
+		res := call(t, app, route.method, route.path, route.body, caller, nil)
+		if res.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s %s with X-Id only: got status %d, want 401", route.method, route.path, res.StatusCode)
+		}
+	}
+}
+
+// enableTestPush sends notifications to a local fake push service
+func enableTestPush(t *testing.T) *push.FakeEndpoint {
+	t.Helper()
+
+	fake := push.NewFakeEndpoint("")
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	fake.URL = server.URL
+
+	key, err := push.GenerateVAPIDKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vapid, err := push.NewVAPID(key, "mailto:ops@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	models.SetPushSender(fake.Sender(vapid))
+	t.Cleanup(func() { models.SetPushSender(nil) })
+	return fake
+}
+
+// subscribePush registers a subscription of the fake service for user
+func subscribePush(t *testing.T, app *fiber.App, fake *push.FakeEndpoint, user dto.User) push.Subscription {
+	t.Helper()
+
+	subscription, err := fake.Subscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := call(t, app, http.MethodPost, "/v1/push/subscriptions", toJSON(t, subscription), bearer(user), nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("registering subscription: got status %d", res.StatusCode)
+	}
+	return subscription
+}
+
+// sendDirect sends a direct message from one user to another
+func sendDirect(t *testing.T, app *fiber.App, from dto.User, to dto.User, text string) dto.Message {
+	t.Helper()
+
+	call(t, app, http.MethodPost, "/v1/dms/"+to.Id, "", bearer(from), nil)
+	var response struct {
+		Data dto.Message `json:"data"`
+	}
+	path := "/v1/channels/" + url.PathEscape(models.DirectChannelId(from.Id, to.Id)) + "/messages"
+	res := call(t, app, http.MethodPost, path, toJSON(t, dto.SendMessageRequest{Message: text}), bearer(from), &response)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("sending: got status %d", res.StatusCode)
+	}
+	return response.Data
+}
+
+// waitFor polls condition until it holds or within passes
+func waitFor(t *testing.T, within time.Duration, condition func() bool) bool {
+	t.Helper()
+
+	deadline := time.Now().Add(within)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return true
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return condition()
+}
+
+func TestOfflineRecipientIsNotified(t *testing.T) {
+	requireMongo(t)
+	fake := enableTestPush(t)
+	app := newTestApp(t)
+
+	alice := registerTestUser(t, app)
+	bob := registerTestUser(t, app)
+	subscribePush(t, app, fake, bob)
+
+	message := sendDirect(t, app, alice, bob, "are you there?")
+	if !waitFor(t, 5*time.Second, func() bool { return len(fake.Deliveries()) == 1 }) {
+		t.Fatalf("got %d deliveries, want 1", len(fake.Deliveries()))
+	}
+
+	var notification dto.PushNotification
+	if err := json.Unmarshal(fake.Deliveries()[0].Payload, &notification); err != nil {
+		t.Fatal(err)
+	}
+	if notification.Type != models.PushDirect || notification.MessageId != message.Id || notification.Body != "are you there?" {
+		t.Fatalf("got notification %+v", notification)
+	}
+}
+
+func TestTemporaryPushFailuresAreRetried(t *testing.T) {
+	requireMongo(t)
+	fake := enableTestPush(t)
+	app := newTestApp(t)
+
+	alice := registerTestUser(t, app)
+	bob := registerTestUser(t, app)
+	subscribePush(t, app, fake, bob)
+
+	fake.FailWith(http.StatusServiceUnavailable)
+	time.AfterFunc(500*time.Millisecond, func() { fake.FailWith(0) })
+
+	sendDirect(t, app, alice, bob, "retry me")
+	if !waitFor(t, 5*time.Second, func() bool { return len(fake.Deliveries()) == 1 }) {
+		t.Fatalf("got %d deliveries after the service recovered, want 1", len(fake.Deliveries()))
+	}
+}
+
+func TestGoneSubscriptionIsDropped(t *testing.T) {
+	requireMongo(t)
+	fake := enableTestPush(t)
+	app := newTestApp(t)
+
+	alice := registerTestUser(t, app)
+	bob := registerTestUser(t, app)
+	fake.Expire(subscribePush(t, app, fake, bob))
+
+	sendDirect(t, app, alice, bob, "anyone?")
+	dropped := waitFor(t, 5*time.Second, func() bool {
+		var response struct {
+			Data []dto.PushSubscription `json:"data"`
+		}
+		call(t, app, http.MethodGet, "/v1/push/subscriptions", "", bearer(bob), &response)
+		return len(response.Data) == 0
+	})
+	if !dropped {
+		t.Fatal("subscription the push service reported gone is still registered")
+	}
+}
+
+func TestRecipientConnectedToAnotherInstanceIsNotNotified(t *testing.T) {
+	requireMongo(t)
+	fake := enableTestPush(t)
+	app := newTestApp(t)
+
+	alice := registerTestUser(t, app)
+	bob := registerTestUser(t, app)
+	subscribePush(t, app, fake, bob)
+
+	// What the instance holding bob's socket records every heartbeat
+	users, ctx := db.MongoInit("users")
+	_, err := users.UpdateOne(ctx, bson.M{"_id": bob.Id}, bson.M{"$set": bson.M{"connected_until": time.Now().Add(time.Minute)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sendDirect(t, app, alice, bob, "you are online")
+	if waitFor(t, time.Second, func() bool { return len(fake.Deliveries()) > 0 }) {
+		t.Fatal("a user connected to another instance was sent a push notification")
+	}
+}
@@ -0,0 +1,224 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"server/db"
+	"server/dto"
+	"server/logging"
+	"server/models"
+	"server/realtime"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/websocket/v2"
+)
+
+// openSession starts the event stream of a connection and follows the comma
+// separated channels of subscribe
+func openSession(user *models.UserModel, siteId string, subscribe string, conn *websocket.Conn) *realtime.Session {
+	session := realtime.Open(user, siteId, conn)
+
+	for _, channel := range strings.Split(subscribe, ",") {
+		if channel = strings.TrimSpace(channel); channel == "" {
+			continue
+		}
+		if err := models.Subscribe(session.Socket, channel, ""); err != nil {
+			sendFrameError(session.Socket, channel, err)
+		}
+	}
+	return session
+}
+
+// resumeSession continues the session of the Last-Event-ID of the request,
+// whose events up to it the client received, or opens a new one
+func resumeSession(ctx *fiber.Ctx, user *models.UserModel) (*realtime.Session, uint64, error) {
+	lastEventId := ctx.Get("Last-Event-ID", ctx.Query("last_event_id"))
+	if session, after, ok := realtime.Resume(lastEventId, user.Id); ok {
+		session.Ack(after)
+		return session, after, nil
+	}
+	if realtime.Draining() {
+		ctx.Set(fiber.HeaderRetryAfter, "5")
+		return nil, 0, ErrServerRestarting
+	}
+	return openSession(user, ctx.Query("SiteId"), ctx.Query("subscribe"), nil), 0, nil
+}
+
+// handleFrame acts on a frame sent by a client, over the websocket or posted
+// to its session
+func handleFrame(socket *db.UserSocket, frame dto.ClientFrame) {
+	switch frame.Type {
+	case dto.FrameTyping:
+		models.SendTyping(socket, frame.Channel)
+	case dto.FrameRead:
+		channel := frame.Channel
+		if channel == "" {
+			channel = models.SubscriptionsOf(socket).ActiveSite
+		}
+		if _, err := models.MarkRead(socket.UserId, channel, frame.MessageId); err != nil {
+			sendFrameError(socket, channel, err)
+		}
+	case dto.FrameSubscribe:
+		if err := models.Subscribe(socket, frame.Channel, frame.Tag); err != nil {
+			sendFrameError(socket, frame.Channel, err)
+			return
+		}
+		socket.Send(dto.NewEvent(dto.EventSubscriptions, "", models.SubscriptionsOf(socket)))
+	case dto.FrameUnsubscribe:
+		models.Unsubscribe(socket, frame.Channel)
+		socket.Send(dto.NewEvent(dto.EventSubscriptions, "", models.SubscriptionsOf(socket)))
+	}
+}
+
+// sendFrameError answers a client frame that failed with an error event
+func sendFrameError(socket *db.UserSocket, channel string, err error) {
+	apiErr := toAPIError(err)
+	if apiErr.Status >= fiber.StatusInternalServerError {
+		slog.Error("Handling realtime frame failed", "user_id", socket.UserId, "channel", channel, "err", err)
+	}
+
+	socket.Send(dto.NewEvent(dto.EventError, channel, dto.ErrorResponse{
+		Status:  apiErr.Status,
+		Code:    apiErr.Code,
+		Message: apiErr.Message,
+	}))
+}
+
+// Events streams the events of a user as Server-Sent Events, for clients
+// behind proxies that block websockets. EventSource resumes with the
+// Last-Event-ID header on its own after a drop.
+func (c *ChatController) Events(ctx *fiber.Ctx) error {
+	user, err := models.GetUser(ctx.Params("id"))
+	if err != nil {
+		return err
+	}
+
+	session, after, err := resumeSession(ctx, user)
+	if err != nil {
+		return err
+	}
+	session.Socket.Touch()
+	logger := requestLogger(ctx).With("user_id", user.Id, "session_id", session.Id, "transport", "sse")
+	logging.Noisy.Log(ctx.UserContext(), logger, slog.LevelInfo, "Event stream opened", "resumed", after > 0)
+
+	ctx.Set(fiber.HeaderContentType, "text/event-stream")
+	ctx.Set(fiber.HeaderCacheControl, "no-cache")
+	ctx.Set(fiber.HeaderConnection, "keep-alive")
+	ctx.Set("X-Accel-Buffering", "no")
+
+	// The stream outlives the handler, the session is left to expire when
+	// the client goes away so it can resume
+	// An idle stream gets a comment every heartbeat interval, which also
+	// keeps the session from being reaped
+	keepalive, _ := models.Heartbeat()
+	ctx.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		fmt.Fprintf(w, "retry: %d\n\n", 3000)
+		if err := w.Flush(); err != nil {
+			return
+		}
+
+		for {
+			waitCtx, cancel := context.WithTimeout(context.Background(), keepalive)
+			events, last, err := session.Next(waitCtx, after)
+			cancel()
+			if err != nil {
+				return
+			}
+			after = last
+
+			start := time.Now()
+			if len(events) == 0 {
+				fmt.Fprint(w, ": keepalive\n\n")
+			}
+			for _, event := range events {
+				payload, err := json.Marshal(event)
+				if err != nil {
+					logger.Error("Encoding event failed", "type", event.Type, "err", err)
+					continue
+				}
+				if event.Id != "" {
+					fmt.Fprintf(w, "id: %s\n", event.Id)
+				}
+				fmt.Fprintf(w, "data: %s\n\n", payload)
+			}
+
+			if err := w.Flush(); err != nil {
+				return
+			}
+			session.Written("sse", events, start)
+			session.Ack(after)
+			session.Socket.Touch()
+		}
+	})
+	return nil
+}
+
+// Poll returns the events of a user after last_event_id, waiting for one
+// when there are none yet
+func (c *ChatController) Poll(ctx *fiber.Ctx) error {
+	user, err := models.GetUser(ctx.Params("id"))
+	if err != nil {
+		return err
+	}
+
+	session, after, err := resumeSession(ctx, user)
+	if err != nil {
+		return err
+	}
+	session.Socket.Touch()
+
+	// Answer a heartbeat interval before the session would be reaped, so
+	// the next poll arrives in time
+	interval, timeout := models.Heartbeat()
+	waitCtx, cancel := context.WithTimeout(ctx.UserContext(), timeout-interval)
+	events, last, err := session.Next(waitCtx, after)
+	cancel()
+	if err != nil {
+		return ErrSessionNotFound
+	}
+	session.Socket.Touch()
+
+	if events == nil {
+		events = []dto.Event{}
+	}
+	session.Written("poll", events, time.Now())
+	return ctx.Status(200).JSON(fiber.Map{
+		"status":  200,
+		"message": "Events retrieved successfully",
+		"data": dto.EventBatch{
+			Events:      events,
+			LastEventId: session.EventId(last),
+		},
+	})
+}
+
+// PostFrame acts on a frame for a session without a client to server
+// channel, such as Server-Sent Events and long polls
+func (c *ChatController) PostFrame(ctx *fiber.Ctx) error {
+	session, ok := realtime.Find(ctx.Params("sessionId"), authenticatedUser(ctx))
+	if !ok {
+		return ErrSessionNotFound
+	}
+
+	var frame dto.ClientFrame
+	if err := ctx.BodyParser(&frame); err != nil {
+		return ErrInvalidBody
+	}
+
+	session.Socket.Touch()
+	if frame.Type != dto.FramePing {
+		handleFrame(session.Socket, frame)
+	}
+
+	return ctx.Status(200).JSON(fiber.Map{
+		"status":  200,
+		"message": "Frame accepted",
+		"data":    dto.Session{Id: session.Id},
+	})
+}
@@ -0,0 +1,61 @@
+package api
+
+import (
+	"server/dto"
+	"server/models"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// MarkChannelRead moves the calling user's read marker on a channel
+func (c *ChatController) MarkChannelRead(ctx *fiber.Ctx) error {
+	userId := authenticatedUser(ctx)
+
+	var request dto.ReadRequest
+	if err := ctx.BodyParser(&request); err != nil {
+		return ErrInvalidBody
+	}
+	if request.MessageId == "" {
+		return ErrMessageIdMissing
+	}
+
+	if _, err := models.GetUser(userId); err != nil {
+		return err
+	}
+
+	channel := channelParam(ctx)
+	if err := checkChannelAccess(ctx, channel, userId); err != nil {
+		return err
+	}
+
+	marker, err := models.MarkRead(userId, channel, request.MessageId)
+	if err != nil {
+		return err
+	}
+
+	return ctx.Status(200).JSON(fiber.Map{
+		"status":  200,
+		"message": "Channel marked read",
+		"data":    marker,
+	})
+}
+
+// GetUnreadCounts returns the read marker and unread count of every channel
+// the calling user explored
+func (c *ChatController) GetUnreadCounts(ctx *fiber.Ctx) error {
+	user, err := models.GetUser(authenticatedUser(ctx))
+	if err != nil {
+		return err
+	}
+
+	counts, err := models.UnreadCounts(user)
+	if err != nil {
+		return err
+	}
+
+	return ctx.Status(200).JSON(fiber.Map{
+		"status":  200,
+		"message": "Unread counts retrieved successfully",
+		"data":    counts,
+	})
+}
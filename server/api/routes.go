@@ -0,0 +1,640 @@
+package api
+
+import (
+	"time"
+
+	C "server/constants"
+	"server/dto"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/websocket/v2"
+)
+
+// Param documents a query, path or header parameter of a route
+type Param struct {
+	Name        string
+	In          string // query, header or path
+	Description string
+	Required    bool
+	Type        string // OpenAPI primitive type, defaults to string
+}
+
+// Route describes one versioned endpoint, the same table is used to register
+// handlers and to generate the OpenAPI document so the two cannot drift
+type Route struct {
+	Method       string
+	Path         string
+	OperationId  string
+	Summary      string
+	Tag          string
+	Params       []Param
+	Body         interface{} // zero value of the request body type, nil when there is none
+	BodyOptional bool        // Body may be left out
+	Response     interface{} // zero value of the "data" type of the response envelope
+	Raw          bool        // Response is the whole body instead of being wrapped in the envelope
+	ContentType  string      // Content type of a Raw response, defaults to JSON
+	Websocket    bool        // Route upgrades to a websocket
+	Redirect     bool        // Route answers with a redirect instead of a body
+	Auth         bool        // Route requires an access token, see RequireAuth
+	Middleware   []fiber.Handler
+	Handler      fiber.Handler
+}
+
+var (
+	userIdHeader = Param{Name: "X-Id", In: "header", Description: "Id of the calling user", Required: true}
+	channelPath  = Param{Name: "channelId", In: "path", Description: "Channel (site) id, URL encoded", Required: true}
+	messagePath  = Param{Name: "messageId", In: "path", Description: "Message id", Required: true}
+	userPath     = Param{Name: "userId", In: "path", Description: "Id of the other user", Required: true}
+	// accessTokenQuery carries the access token where browsers cannot set the Authorization header
+	accessTokenQuery = Param{Name: "access_token", In: "query", Description: "Access token, for clients that cannot send the Authorization header"}
+	providerPath     = Param{Name: "provider", In: "path", Description: "Identity provider, e.g. google", Required: true}
+	// realtimeParams are shared by the transports without a websocket
+	realtimeParams = []Param{
+		{Name: "id", In: "path", Description: "Id of the connecting user", Required: true},
+		{Name: "SiteId", In: "query", Description: "Channel a new session starts on"},
+		{Name: "subscribe", In: "query", Description: "Comma separated channels a new session also follows"},
+		{Name: "last_event_id", In: "query", Description: "Id of the last event received, to resume its session"},
+		{Name: "Last-Event-ID", In: "header", Description: "Same as last_event_id, sent by EventSource when it reconnects"},
+		accessTokenQuery,
+	}
+)
+
+// V1Routes returns the routes served under /v1
+func V1Routes(controller *ChatController) []Route {
+	return []Route{
+		{
+			Method:      fiber.MethodGet,
+			Path:        "/socket/:id",
+			OperationId: "openSocket",
+			Summary:     "Open a websocket receiving the events of its active site and of the channels it subscribes to",
+			Tag:         "realtime",
+			Params: []Param{
+				{Name: "id", In: "path", Description: "Id of the connecting user", Required: true},
+				{Name: "SiteId", In: "query", Description: "Channel the socket starts on"},
+				{Name: "subscribe", In: "query", Description: "Comma separated channels the socket also follows"},
+				accessTokenQuery,
+			},
+			Websocket:  true,
+			Auth:       true,
+			Middleware: []fiber.Handler{RefuseWhileDraining},
+			Handler:    websocket.New(controller.Ws),
+		},
+		{
+			Method:      fiber.MethodGet,
+			Path:        "/events/:id",
+			OperationId: "streamEvents",
+			Summary:     "Stream the events of the user as Server-Sent Events, for clients that cannot open a websocket",
+			Tag:         "realtime",
+			Params:      realtimeParams,
+			Response:    "",
+			Raw:         true,
+			ContentType: "text/event-stream",
+			Auth:        true,
+			Handler:     controller.Events,
+		},
+		{
+			Method:      fiber.MethodGet,
+			Path:        "/poll/:id",
+			OperationId: "pollEvents",
+			Summary:     "Long poll the events of the user after last_event_id",
+			Tag:         "realtime",
+			Params:      realtimeParams,
+			Response:    dto.EventBatch{},
+			Auth:        true,
+			Handler:     controller.Poll,
+		},
+		{
+			Method:      fiber.MethodPost,
+			Path:        "/sessions/:sessionId/frames",
+			OperationId: "postFrame",
+			Summary:     "Send a typing, read, subscribe or unsubscribe frame on a Server-Sent Events or long poll session",
+			Tag:         "realtime",
+			Params: []Param{
+				{Name: "sessionId", In: "path", Description: "Id from the session event", Required: true},
+			},
+			Body:       dto.ClientFrame{},
+			Response:   dto.Session{},
+			Auth:       true,
+			Middleware: []fiber.Handler{RateLimit(C.Tier3, 0)},
+			Handler:    controller.PostFrame,
+		},
+		{
+			Method:      fiber.MethodGet,
+			Path:        "/channels/:channelId",
+			OperationId: "getChannel",
+			Summary:     "Live user counts of a channel",
+			Tag:         "channels",
+			Params:      []Param{channelPath},
+			Response:    dto.ChannelMetadata{},
+			Middleware:  []fiber.Handler{RateLimit(C.Tier3, 0)},
+			Handler:     controller.GetChannelMetadata,
+		},
+		{
+			Method:      fiber.MethodGet,
+			Path:        "/channels/:channelId/presence",
+			OperationId: "getPresence",
+			Summary:     "Users currently on a channel, invisible users are only counted",
+			Tag:         "channels",
+			Params:      []Param{channelPath, {Name: "X-Id", In: "header", Description: "Id of the calling user, required on direct channels"}},
+			Response:    dto.Presence{},
+			Middleware:  []fiber.Handler{RateLimit(C.Tier3, 0)},
+			Handler:     controller.GetPresence,
+		},
+		{
+			Method:      fiber.MethodGet,
+			Path:        "/channels/:channelId/messages",
+			OperationId: "listMessages",
+			Summary:     "Page through the history of a channel, newest first",
+			Tag:         "messages",
+			Params: []Param{
+				channelPath,
+				userIdHeader,
+				{Name: "bookmark", In: "query", Description: "next_bookmark of the previous page"},
+			},
+			Response:   dto.MessagePage{},
+			Middleware: []fiber.Handler{RateLimit(C.Tier2, 0)},
+			Handler:    controller.GetMessages,
+		},
+		{
+			Method:      fiber.MethodPut,
+			Path:        "/channels/:channelId/read",
+			OperationId: "markChannelRead",
+			Summary:     "Move the calling user's read marker on a channel, it never moves backwards",
+			Tag:         "channels",
+			Params:      []Param{channelPath},
+			Body:        dto.ReadRequest{},
+			Response:    dto.ReadMarker{},
+			Auth:        true,
+			Middleware:  []fiber.Handler{RateLimit(C.Tier3, 0)},
+			Handler:     controller.MarkChannelRead,
+		},
+		{
+			Method:      fiber.MethodPost,
+			Path:        "/channels/:channelId/messages",
+			OperationId: "sendMessage",
+			Summary:     "Send a message to a channel",
+			Tag:         "messages",
+			Params:      []Param{channelPath},
+			Body:        dto.SendMessageRequest{},
+			Response:    dto.Message{},
+			Auth:        true,
+			Middleware:  []fiber.Handler{RateLimit(C.Tier3, 0)},
+			Handler:     controller.SendMessage,
+		},
+		{
+			Method:      fiber.MethodGet,
+			Path:        "/channels/:channelId/messages/:messageId",
+			OperationId: "getMessage",
+			Summary:     "Get a single message of a channel",
+			Tag:         "messages",
+			Params:      []Param{channelPath, messagePath, userIdHeader},
+			Response:    dto.Message{},
+			Middleware:  []fiber.Handler{RateLimit(C.Tier2, 0)},
+			Handler:     controller.GetMessage,
+		},
+		{
+			Method:      fiber.MethodPost,
+			Path:        "/messages/:messageId/reactions",
+			OperationId: "toggleReaction",
+			Summary:     "Add the caller's reaction to a message, or remove it when already present",
+			Tag:         "messages",
+			Params:      []Param{messagePath},
+			Body:        dto.ReactionRequest{},
+			Response:    dto.ReactionResult{},
+			Auth:        true,
+			Middleware:  []fiber.Handler{RateLimit(C.Tier2, 0)},
+			Handler:     controller.AddRemoveReactions,
+		},
+		{
+			Method:       fiber.MethodPost,
+			Path:         "/messages/:messageId/reports",
+			OperationId:  "toggleReport",
+			Summary:      "Report a message, or withdraw the caller's report",
+			Tag:          "messages",
+			Params:       []Param{messagePath},
+			Body:         dto.ReportRequest{},
+			BodyOptional: true,
+			Response:     dto.ReportResult{},
+			Auth:         true,
+			Middleware:   []fiber.Handler{RateLimit(C.Tier2, 0)},
+			Handler:      controller.ReportMessage,
+		},
+		{
+			Method:      fiber.MethodPost,
+			Path:        "/users",
+			OperationId: "registerUser",
+			Summary:     "Register a new anonymous user, the response carries its access token",
+			Tag:         "users",
+			Params: []Param{
+				{Name: "SiteId", In: "query", Description: "Channel the user registers from"},
+				{Name: "X-Id", In: "header", Description: "Id of a user registered before access tokens existed, its token is issued once"},
+			},
+			Response:   dto.User{},
+			Middleware: []fiber.Handler{RateLimit(C.Tier2, 0)},
+			Handler:    controller.RegisterUser,
+		},
+		{
+			Method:      fiber.MethodGet,
+			Path:        "/users/me",
+			OperationId: "getMe",
+			Summary:     "Get the calling user",
+			Tag:         "users",
+			Response:    dto.User{},
+			Auth:        true,
+			Middleware:  []fiber.Handler{RateLimit(C.Tier3, 0)},
+			Handler:     controller.GetMe,
+		},
+		{
+			Method:      fiber.MethodPatch,
+			Path:        "/users/me",
+			OperationId: "updateMe",
+			Summary:     "Update the active channel and online state of the calling user",
+			Tag:         "users",
+			Body:        dto.UpdateUserRequest{},
+			Response:    dto.User{},
+			Auth:        true,
+			Middleware:  []fiber.Handler{RateLimit(C.Tier2, 0)},
+			Handler:     controller.UpdateUser,
+		},
+		{
+			Method:      fiber.MethodGet,
+			Path:        "/users/me/export",
+			OperationId: "exportMe",
+			Summary:     "Download everything stored about the calling user",
+			Tag:         "users",
+			Response:    dto.UserExport{},
+			Raw:         true,
+			Auth:        true,
+			Middleware:  []fiber.Handler{RateLimit(C.Tier1, time.Hour)},
+			Handler:     controller.ExportMe,
+		},
+		{
+			Method:      fiber.MethodDelete,
+			Path:        "/users/me",
+			OperationId: "deleteMe",
+			Summary:     "Delete the calling user, anonymising their messages",
+			Tag:         "users",
+			Auth:        true,
+			Middleware:  []fiber.Handler{RateLimit(C.Tier1, 0)},
+			Handler:     controller.DeleteMe,
+		},
+		{
+			Method:      fiber.MethodPut,
+			Path:        "/users/me/username",
+			OperationId: "changeUsername",
+			Summary:     "Change the username of the calling user",
+			Tag:         "users",
+			Body:        dto.UsernameRequest{},
+			Response:    dto.User{},
+			Auth:        true,
+			Middleware:  []fiber.Handler{RateLimit(C.Tier2, 0)},
+			Handler:     controller.ChangeUsername,
+		},
+		{
+			Method:      fiber.MethodGet,
+			Path:        "/users/:userId/username-history",
+			OperationId: "getUsernameHistory",
+			Summary:     "Previous usernames of a user, moderators only",
+			Tag:         "moderation",
+			Params: []Param{
+				{Name: "userId", In: "path", Description: "Id of the user", Required: true},
+			},
+			Response:   dto.UsernameHistory{},
+			Auth:       true,
+			Middleware: []fiber.Handler{RateLimit(C.Tier3, 0)},
+			Handler:    controller.GetUsernameHistory,
+		},
+		{
+			Method:      fiber.MethodGet,
+			Path:        "/users/me/blocks",
+			OperationId: "getBlocks",
+			Summary:     "List the users the calling user blocked",
+			Tag:         "users",
+			Response:    dto.BlockList{},
+			Auth:        true,
+			Middleware:  []fiber.Handler{RateLimit(C.Tier3, 0)},
+			Handler:     controller.GetBlocks,
+		},
+		{
+			Method:      fiber.MethodPut,
+			Path:        "/users/me/blocks/:userId",
+			OperationId: "blockUser",
+			Summary:     "Block direct messages with a user",
+			Tag:         "users",
+			Params:      []Param{userPath},
+			Response:    dto.BlockList{},
+			Auth:        true,
+			Middleware:  []fiber.Handler{RateLimit(C.Tier2, 0)},
+			Handler:     controller.BlockUser,
+		},
+		{
+			Method:      fiber.MethodDelete,
+			Path:        "/users/me/blocks/:userId",
+			OperationId: "unblockUser",
+			Summary:     "Unblock a user",
+			Tag:         "users",
+			Params:      []Param{userPath},
+			Response:    dto.BlockList{},
+			Auth:        true,
+			Middleware:  []fiber.Handler{RateLimit(C.Tier2, 0)},
+			Handler:     controller.UnblockUser,
+		},
+		{
+			Method:      fiber.MethodGet,
+			Path:        "/users/me/mentions",
+			OperationId: "getMentions",
+			Summary:     "Page through the messages mentioning the calling user, newest first",
+			Tag:         "mentions",
+			Params: []Param{
+				{Name: "unread", In: "query", Type: "boolean", Description: "Only unread mentions"},
+				{Name: "bookmark", In: "query", Description: "next_bookmark of the previous page"},
+			},
+			Response:   dto.MentionPage{},
+			Auth:       true,
+			Middleware: []fiber.Handler{RateLimit(C.Tier3, 0)},
+			Handler:    controller.GetMentions,
+		},
+		{
+			Method:      fiber.MethodGet,
+			Path:        "/users/me/unread",
+			OperationId: "getUnreadCounts",
+			Summary:     "Read markers and unread counts of every channel the calling user explored",
+			Tag:         "users",
+			Response:    []dto.ReadMarker{},
+			Auth:        true,
+			Middleware:  []fiber.Handler{RateLimit(C.Tier2, 0)},
+			Handler:     controller.GetUnreadCounts,
+		},
+		{
+			Method:       fiber.MethodPost,
+			Path:         "/users/me/mentions/read",
+			OperationId:  "markMentionsRead",
+			Summary:      "Mark mentions read, all of them when no message ids are passed",
+			Tag:          "mentions",
+			Body:         dto.MentionReadRequest{},
+			BodyOptional: true,
+			Response:     dto.MentionCount{},
+			Auth:         true,
+			Middleware:   []fiber.Handler{RateLimit(C.Tier3, 0)},
+			Handler:      controller.MarkMentionsRead,
+		},
+		{
+			Method:      fiber.MethodGet,
+			Path:        "/users/me/keys",
+			OperationId: "getMyKeys",
+			Summary:     "Describe the encryption keys of the calling user",
+			Tag:         "keys",
+			Response:    dto.KeyBundleStatus{},
+			Auth:        true,
+			Middleware:  []fiber.Handler{RateLimit(C.Tier3, 0)},
+			Handler:     controller.GetMyKeys,
+		},
+		{
+			Method:      fiber.MethodPut,
+			Path:        "/users/me/keys",
+			OperationId: "putKeys",
+			Summary:     "Register or rotate the encryption keys of the calling user, a new identity key must be signed by the current one",
+			Tag:         "keys",
+			Body:        dto.KeyBundleRequest{},
+			Response:    dto.KeyBundleStatus{},
+			Auth:        true,
+			Middleware:  []fiber.Handler{RateLimit(C.Tier2, 0)},
+			Handler:     controller.PutKeys,
+		},
+		{
+			Method:      fiber.MethodPost,
+			Path:        "/users/me/keys/prekeys",
+			OperationId: "addPrekeys",
+			Summary:     "Upload more one time prekeys",
+			Tag:         "keys",
+			Body:        dto.PrekeysRequest{},
+			Response:    dto.KeyBundleStatus{},
+			Auth:        true,
+			Middleware:  []fiber.Handler{RateLimit(C.Tier2, 0)},
+			Handler:     controller.AddPrekeys,
+		},
+		{
+			Method:      fiber.MethodGet,
+			Path:        "/users/:userId/keys",
+			OperationId: "getKeyBundle",
+			Summary:     "Open the conversation with a user and get their key bundle, with one of their one time prekeys at most once a day",
+			Tag:         "keys",
+			Params:      []Param{{Name: "userId", In: "path", Description: "Id of the user", Required: true}},
+			Response:    dto.KeyBundle{},
+			Auth:        true,
+			Middleware:  []fiber.Handler{RateLimit(C.Tier2, 0)},
+			Handler:     controller.GetKeyBundle,
+		},
+		{
+			Method:      fiber.MethodGet,
+			Path:        "/push/vapid-key",
+			OperationId: "getVapidKey",
+			Summary:     "Get the applicationServerKey to subscribe to push notifications with",
+			Tag:         "push",
+			Response:    dto.VAPIDKey{},
+			Middleware:  []fiber.Handler{RateLimit(C.Tier3, 0)},
+			Handler:     controller.GetVAPIDKey,
+		},
+		{
+			Method:      fiber.MethodGet,
+			Path:        "/push/subscriptions",
+			OperationId: "listPushSubscriptions",
+			Summary:     "List the push subscriptions of the calling user",
+			Tag:         "push",
+			Response:    []dto.PushSubscription{},
+			Auth:        true,
+			Middleware:  []fiber.Handler{RateLimit(C.Tier3, 0)},
+			Handler:     controller.ListPushSubscriptions,
+		},
+		{
+			Method:      fiber.MethodPost,
+			Path:        "/push/subscriptions",
+			OperationId: "registerPushSubscription",
+			Summary:     "Register a push subscription so the calling user is notified while offline",
+			Tag:         "push",
+			Body:        dto.PushSubscriptionRequest{},
+			Response:    dto.PushSubscription{},
+			Auth:        true,
+			Middleware:  []fiber.Handler{RateLimit(C.Tier2, 0)},
+			Handler:     controller.RegisterPushSubscription,
+		},
+		{
+			Method:      fiber.MethodDelete,
+			Path:        "/push/subscriptions/:subscriptionId",
+			OperationId: "deletePushSubscription",
+			Summary:     "Remove a push subscription of the calling user",
+			Tag:         "push",
+			Params: []Param{
+				{Name: "subscriptionId", In: "path", Description: "Id of the subscription", Required: true},
+			},
+			Auth:       true,
+			Middleware: []fiber.Handler{RateLimit(C.Tier2, 0)},
+			Handler:    controller.DeletePushSubscription,
+		},
+		{
+			Method:      fiber.MethodGet,
+			Path:        "/dms",
+			OperationId: "listConversations",
+			Summary:     "List the direct message channels of the calling user, most recent first",
+			Tag:         "dms",
+			Response:    []dto.Conversation{},
+			Auth:        true,
+			Middleware:  []fiber.Handler{RateLimit(C.Tier3, 0)},
+			Handler:     controller.ListConversations,
+		},
+		{
+			Method:      fiber.MethodPost,
+			Path:        "/dms/:userId",
+			OperationId: "openConversation",
+			Summary:     "Open the direct message channel with a user, messages go through the channel routes",
+			Tag:         "dms",
+			Params:      []Param{userPath},
+			Response:    dto.Conversation{},
+			Auth:        true,
+			Middleware:  []fiber.Handler{RateLimit(C.Tier2, 0)},
+			Handler:     controller.OpenConversation,
+		},
+		{
+			Method:      fiber.MethodPost,
+			Path:        "/dms/:userId/read",
+			OperationId: "markConversationRead",
+			Summary:     "Clear the unread counter of a direct message channel",
+			Tag:         "dms",
+			Params:      []Param{userPath},
+			Response:    dto.Conversation{},
+			Auth:        true,
+			Middleware:  []fiber.Handler{RateLimit(C.Tier3, 0)},
+			Handler:     controller.MarkConversationRead,
+		},
+		{
+			Method:      fiber.MethodPost,
+			Path:        "/auth/email/start",
+			OperationId: "startEmailLogin",
+			Summary:     "Email a login code and magic link to sign the calling user in",
+			Tag:         "auth",
+			Body:        dto.EmailLoginRequest{},
+			Response:    dto.EmailLoginStarted{},
+			Auth:        true,
+			Middleware:  []fiber.Handler{RateLimit(C.Tier2, time.Hour)},
+			Handler:     controller.StartEmailLogin,
+		},
+		{
+			Method:      fiber.MethodPost,
+			Path:        "/auth/email/verify",
+			OperationId: "verifyEmailCode",
+			Summary:     "Sign in with the code received by email, by the user that asked for it",
+			Tag:         "auth",
+			Body:        dto.EmailCodeRequest{},
+			Response:    dto.User{},
+			Auth:        true,
+			Middleware:  []fiber.Handler{RateLimit(C.Tier2, 0)},
+			Handler:     controller.VerifyEmailCode,
+		},
+		{
+			Method:      fiber.MethodGet,
+			Path:        "/auth/email/verify",
+			OperationId: "showMagicLink",
+			Summary:     "Page asking to confirm the sign in of the link received by email, opening it does not use the link",
+			Tag:         "auth",
+			Params: []Param{
+				{Name: "token", In: "query", Description: "Token from the emailed link", Required: true},
+			},
+			Response:    "",
+			Raw:         true,
+			ContentType: "text/html",
+			Middleware:  []fiber.Handler{RateLimit(C.Tier2, 0)},
+			Handler:     controller.ShowMagicLink,
+		},
+		{
+			Method:      fiber.MethodPost,
+			Path:        "/auth/email/confirm",
+			OperationId: "confirmMagicLink",
+			Summary:     "Sign in with the link received by email, posted by the confirmation page",
+			Tag:         "auth",
+			Body:        dto.MagicLinkRequest{},
+			Response:    dto.User{},
+			Middleware:  []fiber.Handler{RateLimit(C.Tier2, 0)},
+			Handler:     controller.ConfirmMagicLink,
+		},
+		{
+			Method:      fiber.MethodPost,
+			Path:        "/auth/:provider/login",
+			OperationId: "startLogin",
+			Summary:     "Get the identity provider URL that signs the calling user in",
+			Tag:         "auth",
+			Params: []Param{
+				providerPath,
+				{Name: "redirect_uri", In: "query", Description: "Where to land after signing in, must be an allowed prefix"},
+			},
+			Response:   dto.LoginStarted{},
+			Auth:       true,
+			Middleware: []fiber.Handler{RateLimit(C.Tier2, 0)},
+			Handler:    controller.StartLogin,
+		},
+		{
+			Method:      fiber.MethodPost,
+			Path:        "/auth/:provider/nonce",
+			OperationId: "startIdTokenLogin",
+			Summary:     "Get the nonce to request an ID token for loginWithIdToken with",
+			Tag:         "auth",
+			Params:      []Param{providerPath},
+			Response:    dto.LoginNonce{},
+			Auth:        true,
+			Middleware:  []fiber.Handler{RateLimit(C.Tier2, 0)},
+			Handler:     controller.StartIdTokenLogin,
+		},
+		{
+			Method:      fiber.MethodGet,
+			Path:        "/auth/:provider/callback",
+			OperationId: "loginCallback",
+			Summary:     "Finish signing in, called by the identity provider",
+			Tag:         "auth",
+			Params: []Param{
+				providerPath,
+				{Name: "code", In: "query", Description: "Authorization code"},
+				{Name: "state", In: "query", Description: "State issued by the login step", Required: true},
+			},
+			Response:   dto.User{},
+			Middleware: []fiber.Handler{RateLimit(C.Tier2, 0)},
+			Handler:    controller.LoginCallback,
+		},
+		{
+			Method:      fiber.MethodPost,
+			Path:        "/auth/:provider/token",
+			OperationId: "loginWithIdToken",
+			Summary:     "Sign in with an ID token issued by the provider to this client",
+			Tag:         "auth",
+			Params:      []Param{providerPath},
+			Body:        dto.IdTokenLoginRequest{},
+			Response:    dto.User{},
+			Auth:        true,
+			Middleware:  []fiber.Handler{RateLimit(C.Tier2, 0)},
+			Handler:     controller.LoginWithIdToken,
+		},
+		{
+			Method:      fiber.MethodGet,
+			Path:        "/avatars/:seed.svg",
+			OperationId: "getAvatar",
+			Summary:     "Render the avatar of a seed",
+			Tag:         "users",
+			Params: []Param{
+				{Name: "seed", In: "path", Description: "Avatar seed", Required: true},
+				{Name: "size", In: "query", Description: "Width and height in pixels, 16 to 512", Type: "integer"},
+			},
+			Response:    "",
+			Raw:         true,
+			ContentType: "image/svg+xml",
+			Handler:     controller.GetAvatar,
+		},
+		{
+			Method:      fiber.MethodGet,
+			Path:        "/openapi.json",
+			OperationId: "getOpenAPI",
+			Summary:     "This document",
+			Tag:         "meta",
+			Response:    map[string]interface{}{},
+			Raw:         true,
+			Handler:     ServeOpenAPI,
+		},
+	}
+}
@@ -0,0 +1,141 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"server/db"
+	"server/models"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
+)
+
+// newTestApp builds the app with the middlewares main installs in front of
+// the routes and the default limits
+func newTestApp(t *testing.T) *fiber.App {
+	return newTestAppWith(t, NewChatController(DefaultMaxMessageLength, DefaultPageSize))
+}
+
+// newTestAppWith builds the app around controller
+func newTestAppWith(t *testing.T, controller *ChatController) *fiber.App {
+	t.Helper()
+
+	app := fiber.New(fiber.Config{ErrorHandler: ErrorHandler, DisableStartupMessage: true})
+	app.Use(requestid.New())
+	app.Use(Trace)
+	app.Use(RequestLogger)
+	SetupRoutes(app, controller)
+	return app
+}
+
+var (
+	mongoOnce      sync.Once
+	mongoConnected bool
+	mongoErr       error
+)
+
+// requireMongo points the models at a throwaway database on MONGO_URL, tests
+// touching stored data are skipped without one
+func requireMongo(t *testing.T) {
+	t.Helper()
+
+	url := os.Getenv("MONGO_URL")
+	if url == "" {
+		t.Skip("MONGO_URL is not set")
+	}
+
+	mongoOnce.Do(func() {
+		database := fmt.Sprintf("api_test_%d", time.Now().UnixNano())
+		if mongoErr = db.MongoConnect(url, database); mongoErr != nil {
+			return
+		}
+		mongoConnected = true
+
+		collection, ctx := db.MongoInit("messages")
+		models.CreateMessageService(collection, ctx)
+		collection, ctx = db.MongoInit("users")
+		models.CreateUserService(collection, ctx)
+		collection, ctx = db.MongoInit("conversations")
+		models.CreateConversationService(collection, ctx)
+		collection, ctx = db.MongoInit("mentions")
+		models.CreateMentionService(collection, ctx)
+		collection, ctx = db.MongoInit("push_subscriptions")
+		models.CreatePushService(collection, ctx)
+		collection, ctx = db.MongoInit("key_bundles")
+		models.CreateKeyService(collection, ctx)
+		collection, ctx = db.MongoInit("read_markers")
+		models.CreateReadMarkerService(collection, ctx)
+		collection, ctx = db.MongoInit("access_tokens")
+		models.CreateAccessTokenService(collection, ctx)
+		collection, ctx = db.MongoInit("logins")
+		models.CreateLoginService(collection, ctx)
+
+		for _, ensure := range []func() error{
+			models.EnsureUsernameIndex,
+			models.EnsureIdentityIndex,
+			models.EnsureConversationIndex,
+			models.EnsureMentionIndex,
+			models.EnsurePushIndex,
+			models.EnsureReadMarkerIndex,
+			models.EnsureAccessTokenIndex,
+			models.EnsureLoginIndex,
+		} {
+			if mongoErr = ensure(); mongoErr != nil {
+				return
+			}
+		}
+	})
+	if mongoErr != nil {
+		t.Fatalf("setting up Mongo: %v", mongoErr)
+	}
+}
+
+// TestMain drops the throwaway database once every test ran
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if mongoConnected {
+		collection, ctx := db.MongoInit("users")
+		collection.Database().Drop(ctx)
+		db.MongoClose(context.Background())
+	}
+	os.Exit(code)
+}
+
+// call sends a request to app and decodes the JSON body into out when given
+func call(t *testing.T, app *fiber.App, method string, path string, body string, header map[string]string, out interface{}) *http.Response {
+	t.Helper()
+
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	if body != "" {
+		req.Header.Set("Content-Type", fiber.MIMEApplicationJSON)
+	}
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+
+	res, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	if out != nil {
+		defer res.Body.Close()
+		if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+			t.Fatalf("%s %s: decoding body: %v", method, path, err)
+		}
+	}
+	return res
+}
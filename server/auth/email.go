@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/mail"
+	"strings"
+)
+
+const (
+	// EmailProvider is the login method and identity provider of email login
+	EmailProvider = "custom"
+
+	loginCodeDigits = 6
+)
+
+var (
+	ErrInvalidEmail = errors.New("auth: invalid email address")
+	ErrInvalidCode  = errors.New("auth: invalid or expired login code")
+	ErrTooManyCodes = errors.New("auth: too many login codes requested for this address")
+	ErrCodeLocked   = errors.New("auth: too many wrong login codes for this address")
+
+	loginCodeModulus = big.NewInt(1_000_000)
+)
+
+// EmailLogin is a pending email login
+type EmailLogin struct {
+	Email       string
+	UserId      string // signed in user that asked for the code
+	RedirectURI string
+}
+
+// NormalizeEmail validates address and returns it in the form identities
+// are stored under
+func NormalizeEmail(address string) (string, error) {
+	parsed, err := mail.ParseAddress(strings.TrimSpace(address))
+	if err != nil || parsed.Name != "" {
+		return "", ErrInvalidEmail
+	}
+	return strings.ToLower(parsed.Address), nil
+}
+
+// NewLoginCode returns a random code of loginCodeDigits digits
+func NewLoginCode() (string, error) {
+	number, err := rand.Int(rand.Reader, loginCodeModulus)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", loginCodeDigits, number), nil
+}
@@ -0,0 +1,45 @@
+package auth
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+)
+
+func TestLoginCodesAreSixDigits(t *testing.T) {
+	format := regexp.MustCompile(`^\d{6}$`)
+	seen := map[string]bool{}
+	for i := 0; i < 50; i++ {
+		code, err := NewLoginCode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !format.MatchString(code) {
+			t.Fatalf("code %q is not six digits", code)
+		}
+		seen[code] = true
+	}
+	if len(seen) < 45 {
+		t.Fatalf("only %d distinct codes in 50", len(seen))
+	}
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string
+		err     error
+	}{
+		{"Someone@Example.com", "someone@example.com", nil},
+		{"  a@example.com ", "a@example.com", nil},
+		{"Someone <a@example.com>", "", ErrInvalidEmail},
+		{"not an address", "", ErrInvalidEmail},
+		{"", "", ErrInvalidEmail},
+	}
+	for _, test := range tests {
+		got, err := NormalizeEmail(test.address)
+		if got != test.want || !errors.Is(err, test.err) {
+			t.Errorf("NormalizeEmail(%q) = %q, %v, want %q, %v", test.address, got, err, test.want, test.err)
+		}
+	}
+}
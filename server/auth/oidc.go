@@ -0,0 +1,172 @@
+// Package auth verifies users against external identity providers so
+// anonymous users can be upgraded to accounts.
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// OIDCConfig configures one OpenID Connect provider
+type OIDCConfig struct {
+	// Name identifies the provider in routes and stored identities, e.g. "google"
+	Name         string
+	Issuer       string
+	ClientId     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	// JWKSURL, AuthURL and TokenURL skip discovery when set, for providers
+	// without a discovery document or to pin the keys tokens are checked against
+	JWKSURL  string
+	AuthURL  string
+	TokenURL string
+}
+
+// Identity is the verified subject of an ID token
+type Identity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// OIDCProvider runs the authorization code flow against one provider and
+// verifies the ID tokens it issues
+type OIDCProvider struct {
+	name     string
+	verifier *oidc.IDTokenVerifier
+	oauth2   oauth2.Config
+}
+
+var (
+	ErrMissingIdToken = errors.New("auth: token response carries no id_token")
+	ErrNonceMismatch  = errors.New("auth: id token nonce does not match the login")
+)
+
+// NewOIDCProvider sets up a provider, using discovery on the issuer unless
+// all endpoints are configured
+func NewOIDCProvider(ctx context.Context, cfg OIDCConfig) (*OIDCProvider, error) {
+	if cfg.Name == "" || cfg.Issuer == "" || cfg.ClientId == "" {
+		return nil, errors.New("auth: provider name, issuer and client id are required")
+	}
+
+	scopes := cfg.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{oidc.ScopeOpenID, "email", "profile"}
+	}
+
+	provider := &OIDCProvider{
+		name: cfg.Name,
+		oauth2: oauth2.Config{
+			ClientID:     cfg.ClientId,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectURL,
+			Scopes:       scopes,
+		},
+	}
+	verifierConfig := &oidc.Config{ClientID: cfg.ClientId}
+
+	if cfg.JWKSURL != "" && cfg.AuthURL != "" && cfg.TokenURL != "" {
+		keySet := oidc.NewRemoteKeySet(ctx, cfg.JWKSURL)
+		provider.verifier = oidc.NewVerifier(cfg.Issuer, keySet, verifierConfig)
+		provider.oauth2.Endpoint = oauth2.Endpoint{AuthURL: cfg.AuthURL, TokenURL: cfg.TokenURL}
+		return provider, nil
+	}
+
+	discovered, err := oidc.NewProvider(ctx, cfg.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("auth: discovering %s: %w", cfg.Issuer, err)
+	}
+
+	provider.oauth2.Endpoint = discovered.Endpoint()
+	if cfg.JWKSURL != "" {
+		provider.verifier = oidc.NewVerifier(cfg.Issuer, oidc.NewRemoteKeySet(ctx, cfg.JWKSURL), verifierConfig)
+	} else {
+		provider.verifier = discovered.Verifier(verifierConfig)
+	}
+
+	return provider, nil
+}
+
+// Name returns the configured provider name
+func (p *OIDCProvider) Name() string {
+	return p.name
+}
+
+// AuthCodeURL returns the URL the browser is sent to, bound to state and
+// nonce and protected with PKCE
+func (p *OIDCProvider) AuthCodeURL(state string, nonce string, codeVerifier string) string {
+	return p.oauth2.AuthCodeURL(state,
+		oidc.Nonce(nonce),
+		oauth2.S256ChallengeOption(codeVerifier),
+		oauth2.SetAuthURLParam("prompt", "select_account"),
+	)
+}
+
+// Exchange trades an authorization code for tokens and verifies the ID token
+func (p *OIDCProvider) Exchange(ctx context.Context, code string, codeVerifier string, nonce string) (*Identity, error) {
+	token, err := p.oauth2.Exchange(ctx, code, oauth2.VerifierOption(codeVerifier))
+	if err != nil {
+		return nil, fmt.Errorf("auth: exchanging code: %w", err)
+	}
+
+	rawIdToken, ok := token.Extra("id_token").(string)
+	if !ok || rawIdToken == "" {
+		return nil, ErrMissingIdToken
+	}
+
+	return p.Verify(ctx, rawIdToken, nonce)
+}
+
+// Verify checks the signature, issuer, audience and expiry of an ID token,
+// and that it carries nonce. The nonce is issued by the server for every
+// login, so a token captured elsewhere cannot be replayed.
+func (p *OIDCProvider) Verify(ctx context.Context, rawIdToken string, nonce string) (*Identity, error) {
+	if nonce == "" {
+		return nil, ErrNonceMismatch
+	}
+
+	idToken, err := p.verifier.Verify(ctx, rawIdToken)
+	if err != nil {
+		return nil, fmt.Errorf("auth: verifying id token: %w", err)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(nonce)) != 1 {
+		return nil, ErrNonceMismatch
+	}
+
+	var claims struct {
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+		Name          string `json:"name"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("auth: decoding id token claims: %w", err)
+	}
+
+	return &Identity{
+		Provider:      p.name,
+		Subject:       idToken.Subject,
+		Email:         claims.Email,
+		EmailVerified: claims.EmailVerified,
+		Name:          claims.Name,
+	}, nil
+}
+
+// RandomToken returns a URL safe random string for states, nonces and verifiers
+func RandomToken() string {
+	buffer := make([]byte, 32)
+	if _, err := rand.Read(buffer); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buffer)
+}
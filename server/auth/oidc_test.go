@@ -0,0 +1,200 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v3"
+)
+
+const testClientId = "test-client"
+
+// fakeIssuer is an OpenID provider serving discovery, keys and a token
+// endpoint that answers with the ID token set by the test
+type fakeIssuer struct {
+	server  *httptest.Server
+	key     *rsa.PrivateKey
+	idToken string
+	// verifier is the PKCE verifier the token endpoint received
+	verifier string
+}
+
+func newFakeIssuer(t *testing.T) *fakeIssuer {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &fakeIssuer{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                issuer.server.URL,
+			"authorization_endpoint":                issuer.server.URL + "/authorize",
+			"token_endpoint":                        issuer.server.URL + "/token",
+			"jwks_uri":                              issuer.server.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"},
+		}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		issuer.verifier = r.PostForm.Get("code_verifier")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "provider-access-token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     issuer.idToken,
+		})
+	})
+	issuer.server = httptest.NewServer(mux)
+	t.Cleanup(issuer.server.Close)
+
+	return issuer
+}
+
+// sign returns an ID token for subject, claims override the defaults
+func (f *fakeIssuer) sign(t *testing.T, subject string, claims map[string]interface{}) string {
+	t.Helper()
+
+	payload := map[string]interface{}{
+		"iss":            f.server.URL,
+		"aud":            testClientId,
+		"sub":            subject,
+		"iat":            time.Now().Unix(),
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"email":          subject + "@example.com",
+		"email_verified": true,
+	}
+	for name, value := range claims {
+		if value == nil {
+			delete(payload, name)
+		} else {
+			payload[name] = value
+		}
+	}
+
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.RS256, Key: f.key},
+		(&jose.SignerOptions{}).WithHeader("kid", "test"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := signer.Sign(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := signed.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func (f *fakeIssuer) provider(t *testing.T) *OIDCProvider {
+	t.Helper()
+
+	provider, err := NewOIDCProvider(context.Background(), OIDCConfig{
+		Name:        "fake",
+		Issuer:      f.server.URL,
+		ClientId:    testClientId,
+		RedirectURL: "http://localhost/v1/auth/fake/callback",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider
+}
+
+func TestVerifyRequiresTheLoginNonce(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	provider := issuer.provider(t)
+	ctx := context.Background()
+
+	token := issuer.sign(t, "alice", map[string]interface{}{"nonce": "issued-nonce"})
+
+	identity, err := provider.Verify(ctx, token, "issued-nonce")
+	if err != nil {
+		t.Fatalf("verifying a token with the issued nonce: %v", err)
+	}
+	if identity.Provider != "fake" || identity.Subject != "alice" || identity.Email != "alice@example.com" || !identity.EmailVerified {
+		t.Fatalf("unexpected identity %+v", identity)
+	}
+
+	if _, err := provider.Verify(ctx, token, "other-nonce"); !errors.Is(err, ErrNonceMismatch) {
+		t.Fatalf("token replayed into another login: got %v, want ErrNonceMismatch", err)
+	}
+	if _, err := provider.Verify(ctx, token, ""); !errors.Is(err, ErrNonceMismatch) {
+		t.Fatalf("token verified without a nonce: got %v, want ErrNonceMismatch", err)
+	}
+
+	withoutNonce := issuer.sign(t, "alice", nil)
+	if _, err := provider.Verify(ctx, withoutNonce, "issued-nonce"); !errors.Is(err, ErrNonceMismatch) {
+		t.Fatalf("token without nonce: got %v, want ErrNonceMismatch", err)
+	}
+}
+
+func TestVerifyRejectsForeignTokens(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	provider := issuer.provider(t)
+	ctx := context.Background()
+
+	cases := map[string]string{
+		"other audience": issuer.sign(t, "alice", map[string]interface{}{"nonce": "n", "aud": "other-client"}),
+		"expired":        issuer.sign(t, "alice", map[string]interface{}{"nonce": "n", "exp": time.Now().Add(-time.Minute).Unix()}),
+		"other issuer":   issuer.sign(t, "alice", map[string]interface{}{"nonce": "n", "iss": "https://issuer.invalid"}),
+		"other key":      newFakeIssuer(t).sign(t, "alice", map[string]interface{}{"nonce": "n", "iss": issuer.server.URL}),
+	}
+	for name, token := range cases {
+		if _, err := provider.Verify(ctx, token, "n"); err == nil {
+			t.Errorf("%s: token was accepted", name)
+		}
+	}
+}
+
+func TestExchangeChecksNonceAndSendsVerifier(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	provider := issuer.provider(t)
+	ctx := context.Background()
+
+	issuer.idToken = issuer.sign(t, "bob", map[string]interface{}{"nonce": "state-nonce"})
+
+	identity, err := provider.Exchange(ctx, "code", "pkce-verifier", "state-nonce")
+	if err != nil {
+		t.Fatalf("exchanging code: %v", err)
+	}
+	if identity.Subject != "bob" {
+		t.Fatalf("got subject %q, want bob", identity.Subject)
+	}
+	if issuer.verifier != "pkce-verifier" {
+		t.Fatalf("token endpoint got code_verifier %q", issuer.verifier)
+	}
+
+	if _, err := provider.Exchange(ctx, "code", "pkce-verifier", "another-login"); !errors.Is(err, ErrNonceMismatch) {
+		t.Fatalf("exchange with another login's nonce: got %v, want ErrNonceMismatch", err)
+	}
+
+	issuer.idToken = ""
+	if _, err := provider.Exchange(ctx, "code", "pkce-verifier", "state-nonce"); !errors.Is(err, ErrMissingIdToken) {
+		t.Fatalf("token response without id_token: got %v, want ErrMissingIdToken", err)
+	}
+}
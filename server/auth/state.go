@@ -0,0 +1,10 @@
+package auth
+
+// LoginState is what the login step remembers for the callback
+type LoginState struct {
+	Provider     string
+	UserId       string // signed in user being upgraded
+	Nonce        string // ID token nonce, the key of the state for ID token logins
+	CodeVerifier string
+	RedirectURI  string
+}
@@ -0,0 +1,64 @@
+package avatar
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestSeed(t *testing.T) {
+	// Seeds are stored in avatar URLs, they must never change for a user
+	tests := map[string]string{
+		"user-1": "1e389ed580e1ba16",
+		"":       "ce1a46e733fe334c",
+	}
+	for userId, want := range tests {
+		if got := Seed(userId); got != want {
+			t.Errorf("Seed(%q) = %s, want %s", userId, got, want)
+		}
+	}
+}
+
+func TestIdenticonGolden(t *testing.T) {
+	// Clients cache avatars for a year, a seed must keep rendering the same
+	const want = "62091d264f8b0997c64b6900ae377f82e34f1cca78debfec7a33f03730a13614"
+
+	sum := sha256.Sum256(Identicon("ab12cd34ef56ab78", 64))
+	if got := hex.EncodeToString(sum[:]); got != want {
+		t.Fatalf("Identicon rendering changed, digest %s, want %s", got, want)
+	}
+}
+
+func TestIdenticon(t *testing.T) {
+	first := Identicon("seed", 64)
+	if !bytes.Equal(first, Identicon("seed", 64)) {
+		t.Fatal("the same seed rendered two different avatars")
+	}
+	if bytes.Equal(first, Identicon("other seed", 64)) {
+		t.Fatal("two seeds rendered the same avatar")
+	}
+
+	svg := string(Identicon("seed", 128))
+	if !strings.HasPrefix(svg, `<svg xmlns="http://www.w3.org/2000/svg" width="128" height="128"`) || !strings.HasSuffix(svg, "</svg>") {
+		t.Fatalf("not a 128 pixel SVG: %s", svg)
+	}
+}
+
+func TestETag(t *testing.T) {
+	etag := ETag(`a"b`, 64)
+	if !strings.HasPrefix(etag, `"`) || !strings.HasSuffix(etag, `"`) || strings.Count(etag, `"`) != 2 {
+		t.Fatalf("ETag = %s, want a single quoted string", etag)
+	}
+	if etag != ETag(`a"b`, 64) {
+		t.Fatal("ETag is not stable")
+	}
+	if etag == ETag(`a"b`, 65) || etag == ETag(`a"c`, 64) {
+		t.Fatal("different avatars share an ETag")
+	}
+	// The separator keeps seed and size apart
+	if ETag("a1", 23) == ETag("a", 123) {
+		t.Fatal("seed and size run into each other")
+	}
+}
@@ -0,0 +1,427 @@
+// Package client is a Go SDK for the chat API, used by bots and backend
+// integrations. Requests and responses use the server's dto types.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"server/dto"
+)
+
+// Client talks to one chat server as one user
+type Client struct {
+	baseURL     string
+	httpClient  *http.Client
+	userId      string
+	accessToken string
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithHTTPClient replaces the default http.Client
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithUserId makes the client act as an already registered user, routes
+// that need proof of being the user also need WithAccessToken
+func WithUserId(userId string) Option {
+	return func(c *Client) {
+		c.userId = userId
+	}
+}
+
+// WithAccessToken authenticates the client with the token issued when its
+// user registered or signed in
+func WithAccessToken(token string) Option {
+	return func(c *Client) {
+		c.accessToken = token
+	}
+}
+
+// New creates a client for the server at baseURL, e.g. http://localhost:8080
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: &http.Client{Timeout: 15 * time.Second},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// UserId returns the id the client acts as, empty until Register is called
+// or WithUserId is passed
+func (c *Client) UserId() string {
+	return c.userId
+}
+
+// AccessToken returns the token the client authenticates with, keep it to
+// act as the same user later
+func (c *Client) AccessToken() string {
+	return c.accessToken
+}
+
+// Error is returned for every non 2xx response
+type Error struct {
+	dto.ErrorResponse
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("chat api: %s (%d): %s [request %s]", e.Code, e.Status, e.Message, e.RequestId)
+}
+
+// envelope is the standard success body of the API
+type envelope[T any] struct {
+	Message string `json:"message"`
+	Status  int    `json:"status"`
+	Data    T      `json:"data"`
+}
+
+// Register creates a new anonymous user on channel and acts as it from
+// then on, authenticated with the access token it was issued
+func (c *Client) Register(ctx context.Context, channel string) (dto.User, error) {
+	query := url.Values{}
+	if channel != "" {
+		query.Set("SiteId", channel)
+	}
+
+	var user dto.User
+	if err := c.do(ctx, http.MethodPost, "/v1/users", query, nil, &user); err != nil {
+		return user, err
+	}
+
+	c.userId = user.Id
+	c.accessToken = user.AccessToken
+	return user, nil
+}
+
+// Me returns the user the client acts as
+func (c *Client) Me(ctx context.Context) (dto.User, error) {
+	var user dto.User
+	err := c.do(ctx, http.MethodGet, "/v1/users/me", nil, nil, &user)
+	return user, err
+}
+
+// SetActiveChannel updates the channel and online state of the user
+func (c *Client) SetActiveChannel(ctx context.Context, channel string, online bool) (dto.User, error) {
+	var user dto.User
+	body := dto.UpdateUserRequest{ActiveSite: &channel, IsOnline: &online}
+	err := c.do(ctx, http.MethodPatch, "/v1/users/me", nil, body, &user)
+	return user, err
+}
+
+// SetInvisible hides the user from channel presence lists, or shows them
+func (c *Client) SetInvisible(ctx context.Context, invisible bool) (dto.User, error) {
+	var user dto.User
+	body := dto.UpdateUserRequest{Invisible: &invisible}
+	err := c.do(ctx, http.MethodPatch, "/v1/users/me", nil, body, &user)
+	return user, err
+}
+
+// Export downloads everything the server stores about the user
+func (c *Client) Export(ctx context.Context) (dto.UserExport, error) {
+	var export dto.UserExport
+	payload, err := c.request(ctx, http.MethodGet, "/v1/users/me/export", nil, nil)
+	if err != nil {
+		return export, err
+	}
+	err = json.Unmarshal(payload, &export)
+	return export, err
+}
+
+// Delete erases the user, the client cannot be used as that user afterwards
+func (c *Client) Delete(ctx context.Context) error {
+	if err := c.do(ctx, http.MethodDelete, "/v1/users/me", nil, nil, nil); err != nil {
+		return err
+	}
+	c.userId = ""
+	return nil
+}
+
+// Send posts a message to channel, replyTo is the id of the message being
+// answered or empty
+func (c *Client) Send(ctx context.Context, channel string, text string, replyTo string) (dto.Message, error) {
+	var message dto.Message
+	body := dto.SendMessageRequest{Message: text, To: replyTo, Channel: channel}
+	err := c.do(ctx, http.MethodPost, channelPath(channel)+"/messages", nil, body, &message)
+	return message, err
+}
+
+// Message returns a single message of channel
+func (c *Client) Message(ctx context.Context, channel string, messageId string) (dto.Message, error) {
+	var message dto.Message
+	err := c.do(ctx, http.MethodGet, channelPath(channel)+"/messages/"+url.PathEscape(messageId), nil, nil, &message)
+	return message, err
+}
+
+// History returns one page of channel history, newest first. Pass the
+// NextBookmark of the previous page to continue, or an empty bookmark to start
+// from the newest message.
+func (c *Client) History(ctx context.Context, channel string, bookmark string) (dto.MessagePage, error) {
+	query := url.Values{}
+	if bookmark != "" {
+		query.Set("bookmark", bookmark)
+	}
+
+	var page dto.MessagePage
+	err := c.do(ctx, http.MethodGet, channelPath(channel)+"/messages", query, nil, &page)
+	return page, err
+}
+
+// Channel returns the live counts of channel
+func (c *Client) Channel(ctx context.Context, channel string) (dto.ChannelMetadata, error) {
+	var metadata dto.ChannelMetadata
+	err := c.do(ctx, http.MethodGet, channelPath(channel), nil, nil, &metadata)
+	return metadata, err
+}
+
+// Presence lists the visible users currently on channel
+func (c *Client) Presence(ctx context.Context, channel string) (dto.Presence, error) {
+	var presence dto.Presence
+	err := c.do(ctx, http.MethodGet, channelPath(channel)+"/presence", nil, nil, &presence)
+	return presence, err
+}
+
+// MarkRead moves the user's read marker on channel up to messageId
+func (c *Client) MarkRead(ctx context.Context, channel string, messageId string) (dto.ReadMarker, error) {
+	var marker dto.ReadMarker
+	body := dto.ReadRequest{MessageId: messageId}
+	err := c.do(ctx, http.MethodPut, channelPath(channel)+"/read", nil, body, &marker)
+	return marker, err
+}
+
+// UnreadCounts returns the read marker and unread count of every channel
+// the user explored
+func (c *Client) UnreadCounts(ctx context.Context) ([]dto.ReadMarker, error) {
+	var counts []dto.ReadMarker
+	err := c.do(ctx, http.MethodGet, "/v1/users/me/unread", nil, nil, &counts)
+	return counts, err
+}
+
+// ToggleReaction adds the user's emoji reaction to a message, or removes it
+// when already present
+func (c *Client) ToggleReaction(ctx context.Context, messageId string, emoji string) error {
+	body := dto.ReactionRequest{Emoji: emoji}
+	return c.do(ctx, http.MethodPost, "/v1/messages/"+url.PathEscape(messageId)+"/reactions", nil, body, nil)
+}
+
+// ToggleReport reports a message, or withdraws the user's report
+func (c *Client) ToggleReport(ctx context.Context, messageId string) error {
+	return c.do(ctx, http.MethodPost, "/v1/messages/"+url.PathEscape(messageId)+"/reports", nil, nil, nil)
+}
+
+// Conversations lists the direct message channels of the user, most recent first
+func (c *Client) Conversations(ctx context.Context) ([]dto.Conversation, error) {
+	var conversations []dto.Conversation
+	err := c.do(ctx, http.MethodGet, "/v1/dms", nil, nil, &conversations)
+	return conversations, err
+}
+
+// OpenConversation returns the direct message channel with another user.
+// Send, History and Subscribe work on its Channel like on any other.
+func (c *Client) OpenConversation(ctx context.Context, peerId string) (dto.Conversation, error) {
+	var conversation dto.Conversation
+	err := c.do(ctx, http.MethodPost, "/v1/dms/"+url.PathEscape(peerId), nil, nil, &conversation)
+	return conversation, err
+}
+
+// MarkConversationRead clears the unread counter of the conversation with peerId
+func (c *Client) MarkConversationRead(ctx context.Context, peerId string) (dto.Conversation, error) {
+	var conversation dto.Conversation
+	err := c.do(ctx, http.MethodPost, "/v1/dms/"+url.PathEscape(peerId)+"/read", nil, nil, &conversation)
+	return conversation, err
+}
+
+// Block stops direct messages between the user and another user
+func (c *Client) Block(ctx context.Context, userId string) (dto.BlockList, error) {
+	var blocks dto.BlockList
+	err := c.do(ctx, http.MethodPut, "/v1/users/me/blocks/"+url.PathEscape(userId), nil, nil, &blocks)
+	return blocks, err
+}
+
+// Unblock lifts a block
+func (c *Client) Unblock(ctx context.Context, userId string) (dto.BlockList, error) {
+	var blocks dto.BlockList
+	err := c.do(ctx, http.MethodDelete, "/v1/users/me/blocks/"+url.PathEscape(userId), nil, nil, &blocks)
+	return blocks, err
+}
+
+// Mentions returns a page of the user's mentions inbox, newest first
+func (c *Client) Mentions(ctx context.Context, unreadOnly bool, bookmark string) (dto.MentionPage, error) {
+	query := url.Values{}
+	if unreadOnly {
+		query.Set("unread", "true")
+	}
+	if bookmark != "" {
+		query.Set("bookmark", bookmark)
+	}
+
+	var page dto.MentionPage
+	err := c.do(ctx, http.MethodGet, "/v1/users/me/mentions", query, nil, &page)
+	return page, err
+}
+
+// MarkMentionsRead marks mentions of the given messages read, every mention
+// when none are given, and returns how many stay unread
+func (c *Client) MarkMentionsRead(ctx context.Context, messageIds ...string) (int64, error) {
+	var count dto.MentionCount
+	body := dto.MentionReadRequest{MessageIds: messageIds}
+	err := c.do(ctx, http.MethodPost, "/v1/users/me/mentions/read", nil, body, &count)
+	return count.Unread, err
+}
+
+// SendEncrypted posts an end-to-end encrypted message to a direct message
+// channel, payload is sealed by the caller for the peer's key bundle
+func (c *Client) SendEncrypted(ctx context.Context, channel string, payload dto.EncryptedPayload) (dto.Message, error) {
+	var message dto.Message
+	body := dto.SendMessageRequest{Channel: channel, Encrypted: &payload}
+	err := c.do(ctx, http.MethodPost, channelPath(channel)+"/messages", nil, body, &message)
+	return message, err
+}
+
+// PutKeys registers or rotates the public keys of the user
+func (c *Client) PutKeys(ctx context.Context, bundle dto.KeyBundleRequest) (dto.KeyBundleStatus, error) {
+	var status dto.KeyBundleStatus
+	err := c.do(ctx, http.MethodPut, "/v1/users/me/keys", nil, bundle, &status)
+	return status, err
+}
+
+// KeyBundle fetches the keys to encrypt to another user, using up one of
+// their one time prekeys
+func (c *Client) KeyBundle(ctx context.Context, userId string) (dto.KeyBundle, error) {
+	var bundle dto.KeyBundle
+	err := c.do(ctx, http.MethodGet, "/v1/users/"+url.PathEscape(userId)+"/keys", nil, nil, &bundle)
+	return bundle, err
+}
+
+// HistoryIterator walks channel history from the newest message backwards,
+// fetching pages as needed
+type HistoryIterator struct {
+	client   *Client
+	channel  string
+	bookmark string
+	buffer   []dto.Message
+	done     bool
+}
+
+// Iterate returns an iterator over the history of channel, starting after
+// bookmark (empty for the newest message)
+func (c *Client) Iterate(channel string, bookmark string) *HistoryIterator {
+	return &HistoryIterator{client: c, channel: channel, bookmark: bookmark}
+}
+
+// Next returns the next older message, ok is false once the start of the
+// channel is reached
+func (it *HistoryIterator) Next(ctx context.Context) (message dto.Message, ok bool, err error) {
+	for len(it.buffer) == 0 {
+		if it.done {
+			return message, false, nil
+		}
+
+		page, err := it.client.History(ctx, it.channel, it.bookmark)
+		if err != nil {
+			return message, false, err
+		}
+
+		it.buffer = page.Messages
+		it.bookmark = page.NextBookmark
+		it.done = !page.HasMore
+	}
+
+	message = it.buffer[0]
+	it.buffer = it.buffer[1:]
+	return message, true, nil
+}
+
+// Bookmark returns the bookmark to resume iteration from after the buffered
+// messages are consumed
+func (it *HistoryIterator) Bookmark() string {
+	return it.bookmark
+}
+
+func channelPath(channel string) string {
+	return "/v1/channels/" + url.PathEscape(channel)
+}
+
+// do sends a JSON request and decodes the data field of the response envelope into out
+func (c *Client) do(ctx context.Context, method string, path string, query url.Values, body interface{}, out interface{}) error {
+	payload, err := c.request(ctx, method, path, query, body)
+	if err != nil || out == nil {
+		return err
+	}
+
+	response := envelope[json.RawMessage]{}
+	if err := json.Unmarshal(payload, &response); err != nil {
+		return fmt.Errorf("chat api: decoding response of %s %s: %w", method, path, err)
+	}
+	return json.Unmarshal(response.Data, out)
+}
+
+// request sends a JSON request and returns the body of a 2xx response
+func (c *Client) request(ctx context.Context, method string, path string, query url.Values, body interface{}) ([]byte, error) {
+	endpoint := c.baseURL + path
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.userId != "" {
+		req.Header.Set("X-Id", c.userId)
+	}
+	if c.accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.accessToken)
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	payload, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		apiErr := &Error{}
+		if err := json.Unmarshal(payload, &apiErr.ErrorResponse); err != nil || apiErr.Code == "" {
+			apiErr.Status = res.StatusCode
+			apiErr.Code = http.StatusText(res.StatusCode)
+			apiErr.Message = strings.TrimSpace(string(payload))
+		}
+		return nil, apiErr
+	}
+
+	return payload, nil
+}
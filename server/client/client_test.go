@@ -0,0 +1,359 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"server/api"
+	"server/client"
+	"server/db"
+	"server/dto"
+	"server/models"
+	"server/tracing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// startServer serves the app on a local port and returns its base URL,
+// middlewares run after the request id one
+func startServer(t *testing.T, middlewares ...fiber.Handler) string {
+	t.Helper()
+
+	app := fiber.New(fiber.Config{ErrorHandler: api.ErrorHandler, DisableStartupMessage: true})
+	app.Use(requestid.New())
+	for _, middleware := range middlewares {
+		app.Use(middleware)
+	}
+	api.SetupRoutes(app, api.NewChatController(api.DefaultMaxMessageLength, api.DefaultPageSize))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go app.Listener(listener)
+	t.Cleanup(func() { app.Shutdown() })
+
+	return "http://" + listener.Addr().String()
+}
+
+var (
+	mongoOnce      sync.Once
+	mongoConnected bool
+	mongoErr       error
+	// liveChanges is false when Mongo runs without change streams, events
+	// then only reach sockets through history
+	liveChanges bool
+)
+
+// requireMongo points the models at a throwaway database on MONGO_URL
+func requireMongo(t *testing.T) {
+	t.Helper()
+
+	url := os.Getenv("MONGO_URL")
+	if url == "" {
+		t.Skip("MONGO_URL is not set")
+	}
+
+	mongoOnce.Do(func() {
+		database := fmt.Sprintf("client_test_%d", time.Now().UnixNano())
+		if mongoErr = db.MongoConnect(url, database); mongoErr != nil {
+			return
+		}
+		mongoConnected = true
+
+		collection, ctx := db.MongoInit("messages")
+		models.CreateMessageService(collection, ctx)
+		collection, ctx = db.MongoInit("users")
+		models.CreateUserService(collection, ctx)
+		collection, ctx = db.MongoInit("conversations")
+		models.CreateConversationService(collection, ctx)
+		collection, ctx = db.MongoInit("mentions")
+		models.CreateMentionService(collection, ctx)
+		collection, ctx = db.MongoInit("push_subscriptions")
+		models.CreatePushService(collection, ctx)
+		collection, ctx = db.MongoInit("key_bundles")
+		models.CreateKeyService(collection, ctx)
+		collection, ctx = db.MongoInit("read_markers")
+		models.CreateReadMarkerService(collection, ctx)
+		collection, ctx = db.MongoInit("access_tokens")
+		models.CreateAccessTokenService(collection, ctx)
+		if mongoErr = models.EnsureAccessTokenIndex(); mongoErr != nil {
+			return
+		}
+
+		// Change streams need a replica set, a standalone server refuses them at once
+		changes := make(chan error, 1)
+		go func() { changes <- models.ListenAllChanges(context.Background()) }()
+		select {
+		case <-changes:
+		case <-time.After(500 * time.Millisecond):
+			liveChanges = true
+		}
+	})
+	if mongoErr != nil {
+		t.Fatalf("setting up Mongo: %v", mongoErr)
+	}
+}
+
+// TestMain drops the throwaway database once every test ran
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if mongoConnected {
+		collection, ctx := db.MongoInit("users")
+		collection.Database().Drop(ctx)
+		db.MongoClose(context.Background())
+	}
+	os.Exit(code)
+}
+
+func TestErrorsAreDecoded(t *testing.T) {
+	baseURL := startServer(t)
+	ctx := context.Background()
+
+	_, err := client.New(baseURL).Me(ctx)
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) || apiErr.Status != http.StatusUnauthorized || apiErr.Code == "" {
+		t.Fatalf("got %#v, want a decoded 401", err)
+	}
+
+	// The socket needs the access token, the user id alone is refused
+	_, err = client.New(baseURL, client.WithUserId("someone")).Subscribe(ctx, "example.com", client.SubscribeOptions{})
+	if err == nil {
+		t.Fatal("subscribed without an access token")
+	}
+}
+
+func TestSendAndReadHistory(t *testing.T) {
+	requireMongo(t)
+	baseURL := startServer(t)
+	ctx := context.Background()
+	channel := fmt.Sprintf("history-%d.example", time.Now().UnixNano())
+
+	alice := client.New(baseURL)
+	if _, err := alice.Register(ctx, channel); err != nil {
+		t.Fatal(err)
+	}
+
+	var sent []dto.Message
+	for i := 0; i < 3; i++ {
+		message, err := alice.Send(ctx, channel, fmt.Sprintf("message %d", i), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sent = append(sent, message)
+	}
+
+	page, err := alice.History(ctx, channel, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Messages) != len(sent) {
+		t.Fatalf("history has %d messages, want %d", len(page.Messages), len(sent))
+	}
+	for i, message := range page.Messages {
+		if want := sent[len(sent)-1-i].Id; message.Id != want {
+			t.Fatalf("history[%d] is %s, want %s (newest first)", i, message.Id, want)
+		}
+	}
+
+	got, err := alice.Message(ctx, channel, sent[0].Id)
+	if err != nil || got.Message != "message 0" {
+		t.Fatalf("single message: %+v, %v", got, err)
+	}
+}
+
+// nextInsert waits for the next insert event of the subscription
+func nextInsert(t *testing.T, sub *client.Subscription) client.Event {
+	t.Helper()
+
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case event, ok := <-sub.Events():
+			if !ok {
+				t.Fatal("subscription closed")
+			}
+			if event.Type == dto.EventInsert {
+				return event
+			}
+		case <-timeout:
+			t.Fatal("no insert event within 10s")
+		}
+	}
+}
+
+func TestSubscriptionReplaysMessagesMissedWhileReconnecting(t *testing.T) {
+	requireMongo(t)
+	if !liveChanges {
+		t.Skip("Mongo has no change streams, live events need a replica set")
+	}
+	baseURL := startServer(t)
+	ctx := context.Background()
+	channel := fmt.Sprintf("reconnect-%d.example", time.Now().UnixNano())
+
+	alice, bob := client.New(baseURL), client.New(baseURL)
+	for _, c := range []*client.Client{alice, bob} {
+		if _, err := c.Register(ctx, channel); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sub, err := alice.Subscribe(ctx, channel, client.SubscribeOptions{MinBackoff: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	first, err := bob.Send(ctx, channel, "before the drop", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event := nextInsert(t, sub); event.Message.Id != first.Id || event.Resumed {
+		t.Fatalf("live event %+v, want %s", event.Message, first.Id)
+	}
+
+	// Going offline closes every socket of the user, the subscription waits
+	// MinBackoff before dialing again
+	if _, err := alice.SetActiveChannel(ctx, channel, false); err != nil {
+		t.Fatal(err)
+	}
+	missed, err := bob.Send(ctx, channel, "while reconnecting", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := nextInsert(t, sub)
+	if event.Message.Id != missed.Id || !event.Resumed {
+		t.Fatalf("after reconnecting got %+v (resumed %v), want %s from history", event.Message, event.Resumed, missed.Id)
+	}
+
+	// The replayed message is not delivered a second time
+	after, err := bob.Send(ctx, channel, "after reconnecting", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event := nextInsert(t, sub); event.Message.Id != after.Id {
+		t.Fatalf("got %s again, want %s", event.Message.Id, after.Id)
+	}
+}
+
+// childOf returns the span named name whose parent is parent
+func childOf(spans tracetest.SpanStubs, parent tracetest.SpanStub, name string) (tracetest.SpanStub, bool) {
+	for _, span := range spans {
+		if span.Name == name && span.Parent.SpanID() == parent.SpanContext.SpanID() {
+			return span, true
+		}
+	}
+	return tracetest.SpanStub{}, false
+}
+
+func TestMessageIsTracedToTheSocketWrite(t *testing.T) {
+	requireMongo(t)
+	if !liveChanges {
+		t.Skip("Mongo has no change streams, live events need a replica set")
+	}
+
+	// The provider is global, every test after this one is traced as well
+	exporter := tracetest.NewInMemoryExporter()
+	stopTracing := tracing.Setup(exporter, "client_test", 1)
+	t.Cleanup(func() { stopTracing(context.Background()) })
+
+	baseURL := startServer(t, api.Trace)
+	ctx := context.Background()
+	channel := fmt.Sprintf("traced-%d.example", time.Now().UnixNano())
+
+	alice, bob := client.New(baseURL), client.New(baseURL)
+	for _, c := range []*client.Client{alice, bob} {
+		if _, err := c.Register(ctx, channel); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sub, err := alice.Subscribe(ctx, channel, client.SubscribeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	sent, err := bob.Send(ctx, channel, "traced", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event := nextInsert(t, sub); event.Message.Id != sent.Id {
+		t.Fatalf("got %s, want %s", event.Message.Id, sent.Id)
+	}
+
+	// Spans are exported in batches, wait for the socket write to show up
+	var chain []tracetest.SpanStub
+	deadline := time.Now().Add(15 * time.Second)
+	for len(chain) < 5 {
+		if time.Now().After(deadline) {
+			for _, span := range chain {
+				t.Logf("found %s", span.Name)
+			}
+			t.Fatalf("the trace stops after %d spans", len(chain))
+		}
+		time.Sleep(100 * time.Millisecond)
+
+		spans := exporter.GetSpans()
+		chain = chain[:0]
+		for _, span := range spans {
+			if span.Name == "mongo.insert messages" && hasAttribute(span, attribute.String("message.id", sent.Id)) {
+				chain = append(chain, span)
+				break
+			}
+		}
+		if len(chain) == 0 {
+			continue
+		}
+
+		// The insert runs inside the span of the request that sent it
+		for _, span := range spans {
+			if span.SpanKind == trace.SpanKindServer && span.SpanContext.SpanID() == chain[0].Parent.SpanID() {
+				chain = append([]tracetest.SpanStub{span}, chain...)
+				break
+			}
+		}
+		if len(chain) == 1 {
+			continue
+		}
+		for _, name := range []string{"change_stream.receive", "realtime.fanout", "realtime.write"} {
+			span, ok := childOf(spans, chain[len(chain)-1], name)
+			if !ok {
+				break
+			}
+			chain = append(chain, span)
+		}
+	}
+
+	traceId := chain[0].SpanContext.TraceID()
+	for _, span := range chain {
+		if span.SpanContext.TraceID() != traceId {
+			t.Fatalf("%s is in trace %s, want %s", span.Name, span.SpanContext.TraceID(), traceId)
+		}
+	}
+	if !chain[2].Parent.IsRemote() {
+		t.Fatal("the change stream did not continue the trace from the stored traceparent")
+	}
+}
+
+// hasAttribute reports whether span was given want
+func hasAttribute(span tracetest.SpanStub, want attribute.KeyValue) bool {
+	for _, got := range span.Attributes {
+		if got == want {
+			return true
+		}
+	}
+	return false
+}
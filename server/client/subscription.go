@@ -0,0 +1,498 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"server/dto"
+
+	"github.com/fasthttp/websocket"
+)
+
+// Event is a decoded websocket event
+type Event struct {
+	Type    string
+	Channel string
+	// Message is set for insert, update and delete events
+	Message *dto.Message
+	// Mention is set for mention events
+	Mention *dto.MentionNotification
+	// Presence is set for joined and left events
+	Presence *dto.PresenceEvent
+	// Typing is set for typing events
+	Typing *dto.Typing
+	// Read is set for read events
+	Read *dto.ReadMarker
+	// Subscriptions is set when the server confirms Follow or Unfollow
+	Subscriptions *dto.Subscriptions
+	// Error is set when the server refused a frame
+	Error *dto.ErrorResponse
+	// Subscription is the tag passed to Follow for events of followed channels
+	Subscription string
+	// Resumed is true for messages recovered from history after a reconnect
+	Resumed bool
+	// Raw holds the undecoded data of the event
+	Raw json.RawMessage
+}
+
+// SubscribeOptions tunes a subscription, zero values pick the defaults
+type SubscribeOptions struct {
+	// PingInterval between keepalive frames, defaults to 5 seconds
+	PingInterval time.Duration
+	// MinBackoff and MaxBackoff bound the delay between reconnect attempts
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// ResumePages caps the history pages fetched to fill a gap after a reconnect
+	ResumePages int
+	// Buffer is the capacity of the Events channel, defaults to 64
+	Buffer int
+}
+
+// Subscription delivers the events of a channel, reconnecting until closed
+type Subscription struct {
+	client  *Client
+	channel string
+	opts    SubscribeOptions
+	events  chan Event
+	errors  chan error
+	cancel  context.CancelFunc
+	done    chan struct{}
+
+	// writeMutex serialises frames written to the connection
+	writeMutex sync.Mutex
+
+	mutex    sync.Mutex
+	conn     *websocket.Conn
+	follows  map[string]string
+	lastSeen string
+	seen     map[string]struct{}
+	seenIds  []string
+}
+
+// ErrNotConnected is returned when a frame is sent while the subscription
+// is between connections
+var ErrNotConnected = errors.New("chat api: subscription is not connected")
+
+// seenWindow is how many delivered message ids are remembered for deduplication
+const seenWindow = 1024
+
+// Subscribe opens a websocket on channel. The subscription reconnects with
+// backoff when the connection drops and replays messages sent in between from
+// history, so consumers see every insert once.
+func (c *Client) Subscribe(ctx context.Context, channel string, opts SubscribeOptions) (*Subscription, error) {
+	if opts.PingInterval == 0 {
+		opts.PingInterval = 5 * time.Second
+	}
+	if opts.MinBackoff == 0 {
+		opts.MinBackoff = 500 * time.Millisecond
+	}
+	if opts.MaxBackoff == 0 {
+		opts.MaxBackoff = 30 * time.Second
+	}
+	if opts.ResumePages == 0 {
+		opts.ResumePages = 4
+	}
+	if opts.Buffer == 0 {
+		opts.Buffer = 64
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	sub := &Subscription{
+		client:  c,
+		channel: channel,
+		opts:    opts,
+		events:  make(chan Event, opts.Buffer),
+		errors:  make(chan error, 1),
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		seen:    map[string]struct{}{},
+	}
+
+	// Dial once up front so configuration errors surface to the caller
+	conn, err := sub.dial(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	go sub.run(ctx, conn)
+	return sub, nil
+}
+
+// Events returns the channel events are delivered on, closed with the subscription
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Errors reports connection errors, the subscription keeps reconnecting after them
+func (s *Subscription) Errors() <-chan error {
+	return s.errors
+}
+
+// Close stops the subscription and waits for it to shut down
+func (s *Subscription) Close() {
+	s.cancel()
+	<-s.done
+}
+
+func (s *Subscription) dial(ctx context.Context) (*websocket.Conn, error) {
+	endpoint, err := url.Parse(s.client.baseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch endpoint.Scheme {
+	case "https":
+		endpoint.Scheme = "wss"
+	default:
+		endpoint.Scheme = "ws"
+	}
+	endpoint.Path += "/v1/socket/" + url.PathEscape(s.client.userId)
+	endpoint.RawQuery = url.Values{"SiteId": {s.channel}}.Encode()
+
+	header := http.Header{}
+	if s.client.accessToken != "" {
+		header.Set("Authorization", "Bearer "+s.client.accessToken)
+	}
+
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, endpoint.String(), header)
+	return conn, err
+}
+
+func (s *Subscription) run(ctx context.Context, conn *websocket.Conn) {
+	defer close(s.done)
+	defer close(s.events)
+
+	backoff := s.opts.MinBackoff
+	for {
+		// A restarting server says how long to wait before coming back
+		if restartIn := s.serve(ctx, conn); restartIn > 0 {
+			backoff = restartIn
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		// Reconnect with exponential backoff until it succeeds or we are closed
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+
+			var err error
+			conn, err = s.dial(ctx)
+			if err == nil {
+				backoff = s.opts.MinBackoff
+				break
+			}
+
+			s.reportError(err)
+			backoff *= 2
+			if backoff > s.opts.MaxBackoff {
+				backoff = s.opts.MaxBackoff
+			}
+		}
+
+		s.resume(ctx)
+	}
+}
+
+// serve reads events from conn until it fails or ctx is cancelled, it
+// returns the delay asked for by a restarting server
+func (s *Subscription) serve(ctx context.Context, conn *websocket.Conn) (restartIn time.Duration) {
+	defer conn.Close()
+
+	s.mutex.Lock()
+	s.conn = conn
+	follows := make(map[string]string, len(s.follows))
+	for channel, tag := range s.follows {
+		follows[channel] = tag
+	}
+	s.mutex.Unlock()
+
+	// Subscriptions live on the connection, follow again after a reconnect
+	for channel, tag := range follows {
+		s.send(dto.ClientFrame{Type: dto.FrameSubscribe, Channel: channel, Tag: tag})
+	}
+	defer func() {
+		s.mutex.Lock()
+		s.conn = nil
+		s.mutex.Unlock()
+	}()
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	// Keepalive, the server answers the text frame "ping" with "pong"
+	go func() {
+		ticker := time.NewTicker(s.opts.PingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ctx.Done():
+				conn.WriteControl(
+					websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+					time.Now().Add(time.Second),
+				)
+				conn.Close()
+				return
+			case <-ticker.C:
+				if err := s.write(conn, []byte(dto.FramePing)); err != nil {
+					conn.Close()
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		_, payload, err := conn.ReadMessage()
+		if err != nil {
+			if ctx.Err() == nil {
+				s.reportError(err)
+			}
+			return
+		}
+
+		if strings.TrimSpace(string(payload)) == "pong" {
+			continue
+		}
+
+		var raw struct {
+			dto.Event
+			Data json.RawMessage `json:"data"`
+		}
+		if err := json.Unmarshal(payload, &raw); err != nil {
+			s.reportError(err)
+			continue
+		}
+
+		event := Event{Type: raw.Type, Channel: raw.Channel, Subscription: raw.Subscription, Raw: raw.Data}
+		switch raw.Type {
+		case dto.EventInsert, dto.EventUpdate, dto.EventDelete:
+			var message dto.Message
+			if err := json.Unmarshal(raw.Data, &message); err != nil {
+				s.reportError(err)
+				continue
+			}
+			event.Message = &message
+			if raw.Type == dto.EventInsert && !s.markSeen(event.Channel, message.Id) {
+				continue
+			}
+		case dto.EventMention:
+			var mention dto.MentionNotification
+			if err := json.Unmarshal(raw.Data, &mention); err != nil {
+				s.reportError(err)
+				continue
+			}
+			event.Mention = &mention
+		case dto.EventJoined, dto.EventLeft:
+			var presence dto.PresenceEvent
+			if err := json.Unmarshal(raw.Data, &presence); err != nil {
+				s.reportError(err)
+				continue
+			}
+			event.Presence = &presence
+		case dto.EventTyping:
+			var typing dto.Typing
+			if err := json.Unmarshal(raw.Data, &typing); err != nil {
+				s.reportError(err)
+				continue
+			}
+			event.Typing = &typing
+		case dto.EventRead:
+			var marker dto.ReadMarker
+			if err := json.Unmarshal(raw.Data, &marker); err != nil {
+				s.reportError(err)
+				continue
+			}
+			event.Read = &marker
+		case dto.EventSubscriptions:
+			var subscriptions dto.Subscriptions
+			if err := json.Unmarshal(raw.Data, &subscriptions); err != nil {
+				s.reportError(err)
+				continue
+			}
+			event.Subscriptions = &subscriptions
+		case dto.EventError:
+			var response dto.ErrorResponse
+			if err := json.Unmarshal(raw.Data, &response); err != nil {
+				s.reportError(err)
+				continue
+			}
+			event.Error = &response
+		case dto.EventRestarting:
+			var restarting dto.Restarting
+			if err := json.Unmarshal(raw.Data, &restarting); err == nil {
+				restartIn = time.Duration(restarting.ReconnectInMs) * time.Millisecond
+			}
+		}
+
+		if !s.deliver(ctx, event) {
+			return
+		}
+	}
+}
+
+// write sends a text frame, the keepalive and Typing share the connection
+func (s *Subscription) write(conn *websocket.Conn, payload []byte) error {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	return conn.WriteMessage(websocket.TextMessage, payload)
+}
+
+// Typing tells the other users on the channel that the caller is typing,
+// the server drops calls more frequent than every few seconds
+func (s *Subscription) Typing() error {
+	return s.send(dto.ClientFrame{Type: dto.FrameTyping, Channel: s.channel})
+}
+
+// MarkRead moves the user's read marker on the channel up to messageId
+func (s *Subscription) MarkRead(messageId string) error {
+	return s.send(dto.ClientFrame{Type: dto.FrameRead, Channel: s.channel, MessageId: messageId})
+}
+
+// Follow also delivers the events of channel on this subscription, tagged
+// with tag. Missed messages of followed channels are not replayed after a
+// reconnect, only those of the subscribed channel are. Between connections
+// ErrNotConnected is returned and channel is followed on the next one.
+func (s *Subscription) Follow(channel string, tag string) error {
+	s.mutex.Lock()
+	if s.follows == nil {
+		s.follows = make(map[string]string)
+	}
+	s.follows[channel] = tag
+	s.mutex.Unlock()
+
+	return s.send(dto.ClientFrame{Type: dto.FrameSubscribe, Channel: channel, Tag: tag})
+}
+
+// Unfollow stops the events of a channel passed to Follow
+func (s *Subscription) Unfollow(channel string) error {
+	s.mutex.Lock()
+	delete(s.follows, channel)
+	s.mutex.Unlock()
+
+	return s.send(dto.ClientFrame{Type: dto.FrameUnsubscribe, Channel: channel})
+}
+
+// send writes a JSON frame to the current connection
+func (s *Subscription) send(frame dto.ClientFrame) error {
+	s.mutex.Lock()
+	conn := s.conn
+	s.mutex.Unlock()
+
+	if conn == nil {
+		return ErrNotConnected
+	}
+
+	payload, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+	return s.write(conn, payload)
+}
+
+// resume replays inserts missed while disconnected, oldest first
+func (s *Subscription) resume(ctx context.Context) {
+	s.mutex.Lock()
+	lastSeen := s.lastSeen
+	s.mutex.Unlock()
+
+	if lastSeen == "" {
+		return
+	}
+
+	var missed []dto.Message
+	bookmark := ""
+	for page := 0; page < s.opts.ResumePages; page++ {
+		history, err := s.client.History(ctx, s.channel, bookmark)
+		if err != nil {
+			s.reportError(err)
+			return
+		}
+
+		reached := false
+		for _, message := range history.Messages {
+			if !idAfter(message.Id, lastSeen) {
+				reached = true
+				break
+			}
+			missed = append(missed, message)
+		}
+
+		if reached || !history.HasMore {
+			break
+		}
+		bookmark = history.NextBookmark
+	}
+
+	for i := len(missed) - 1; i >= 0; i-- {
+		message := missed[i]
+		if !s.markSeen(s.channel, message.Id) {
+			continue
+		}
+		event := Event{Type: dto.EventInsert, Channel: s.channel, Message: &message, Resumed: true}
+		if !s.deliver(ctx, event) {
+			return
+		}
+	}
+}
+
+// markSeen records id as delivered on channel, it returns false for ids
+// already seen. Only messages of the subscribed channel move the resume point,
+// as resume replays the history of that channel alone.
+func (s *Subscription) markSeen(channel string, id string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.seen[id]; exists {
+		return false
+	}
+
+	s.seen[id] = struct{}{}
+	s.seenIds = append(s.seenIds, id)
+	if len(s.seenIds) > seenWindow {
+		delete(s.seen, s.seenIds[0])
+		s.seenIds = s.seenIds[1:]
+	}
+
+	if channel == s.channel && idAfter(id, s.lastSeen) {
+		s.lastSeen = id
+	}
+	return true
+}
+
+func (s *Subscription) deliver(ctx context.Context, event Event) bool {
+	select {
+	case s.events <- event:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (s *Subscription) reportError(err error) {
+	select {
+	case s.errors <- err:
+	default:
+	}
+}
+
+// idAfter reports whether message id a was created after b. Ids are hex
+// object ids which start with their creation time, so they sort as strings.
+func idAfter(a string, b string) bool {
+	return strings.ToLower(a) > strings.ToLower(b)
+}
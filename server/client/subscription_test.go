@@ -0,0 +1,23 @@
+package client
+
+import "testing"
+
+func TestResumePointFollowsTheSubscribedChannel(t *testing.T) {
+	sub := &Subscription{channel: "example.com", seen: map[string]struct{}{}}
+
+	own := "650000000000000000000001"
+	followed := "650000000000000000000002"
+
+	if !sub.markSeen("example.com", own) {
+		t.Fatal("first message not delivered")
+	}
+	if !sub.markSeen("other.example", followed) {
+		t.Fatal("message of a followed channel not delivered")
+	}
+	if sub.lastSeen != own {
+		t.Fatalf("resume point moved to %s by a followed channel, want %s", sub.lastSeen, own)
+	}
+	if sub.markSeen("other.example", followed) {
+		t.Fatal("message of a followed channel delivered twice")
+	}
+}
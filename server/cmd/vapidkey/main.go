@@ -0,0 +1,25 @@
+// Command vapidkey prints a new VAPID key pair for Web Push. Put the private
+// key in VAPID_PRIVATE_KEY, the server hands out the public key itself.
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"server/push"
+)
+
+func main() {
+	privateKey, err := push.GenerateVAPIDKey()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	vapid, err := push.NewVAPID(privateKey, "mailto:unused@example.com")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("VAPID_PRIVATE_KEY=%s\n", privateKey)
+	fmt.Printf("# public key: %s\n", vapid.PublicKey())
+}
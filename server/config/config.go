@@ -0,0 +1,203 @@
+// Package config loads the settings of the server from defaults, a JSON
+// file, the environment and command line flags, in increasing order of
+// precedence. Subsystems receive the values they need from main instead of
+// reading the environment themselves.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"server/logging"
+)
+
+// Config is every setting of the server. Fields are tagged with the
+// environment variable they are read from, their default and whether they
+// are secret; flags are the variable in lower case with dashes, e.g.
+// -mongo-url, and file keys follow the json tags.
+type Config struct {
+	Server   Server   `json:"server"`
+	Log      Log      `json:"log"`
+	Tracing  Tracing  `json:"tracing"`
+	Mongo    Mongo    `json:"mongo"`
+	Redis    Redis    `json:"redis"`
+	Chat     Chat     `json:"chat"`
+	Realtime Realtime `json:"realtime"`
+	Privacy  Privacy  `json:"privacy"`
+	GeoIP    GeoIP    `json:"geoip"`
+	Push     Push     `json:"push"`
+	Google   Google   `json:"google"`
+	Mail     Mail     `json:"mail"`
+	Auth     Auth     `json:"auth"`
+}
+
+type Server struct {
+	Port string `json:"port" env:"PORT" default:"8080" help:"Port the API listens on"`
+	// PublicURL is where clients reach the server, used in avatar and magic links
+	PublicURL string `json:"public_url" env:"PUBLIC_URL" help:"Public URL of the server"`
+	// CORSOrigins is empty by default, no other origin may call the API
+	CORSOrigins []string `json:"cors_origins" env:"CORS_ORIGINS" help:"Comma separated origins allowed by CORS, * for any"`
+	// MaxProcs is passed to runtime.GOMAXPROCS, 0 uses every core
+	MaxProcs        int           `json:"max_procs" env:"GOMAXPROCS" default:"0" help:"Maximum CPUs executing Go code, 0 for all"`
+	PprofAddr       string        `json:"pprof_addr" env:"PPROF_ADDR" default:":6060" help:"Address of the pprof and metrics server, empty disables it"`
+	ShutdownTimeout time.Duration `json:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT" default:"25s" help:"Time allowed for a graceful shutdown"`
+	ReconnectDelay  time.Duration `json:"reconnect_delay" env:"RECONNECT_DELAY" default:"5s" help:"Delay, plus jitter, clients wait before reconnecting after a restart"`
+}
+
+type Log struct {
+	Level  string `json:"level" env:"LOG_LEVEL" default:"info" help:"Lowest level logged: debug, info, warn or error"`
+	Format string `json:"format" env:"LOG_FORMAT" default:"json" help:"Log output format: json or text"`
+}
+
+type Tracing struct {
+	// Endpoint is the base URL of an OTLP/HTTP collector, e.g.
+	// http://localhost:4318, spans are posted to its /v1/traces
+	Endpoint    string  `json:"endpoint" env:"OTEL_EXPORTER_OTLP_ENDPOINT" help:"Base URL of the OTLP/HTTP collector traces are exported to, empty disables tracing"`
+	ServiceName string  `json:"service_name" env:"OTEL_SERVICE_NAME" default:"blablah-server" help:"Service name of the exported spans"`
+	SampleRatio float64 `json:"sample_ratio" env:"TRACE_SAMPLE_RATIO" default:"1" help:"Share of new traces recorded, between 0 and 1"`
+}
+
+type Mongo struct {
+	URL      string `json:"url" env:"MONGO_URL" secret:"true" help:"Mongo connection string"`
+	Database string `json:"database" env:"MONGO_DB_NAME" help:"Mongo database name"`
+}
+
+type Redis struct {
+	URL string `json:"url" env:"REDIS_URL" secret:"true" help:"Redis connection string, unused unless Redis is enabled"`
+}
+
+type Chat struct {
+	MaxMessageLength int `json:"max_message_length" env:"MAX_MESSAGE_LENGTH" default:"255" help:"Longest message accepted, in bytes"`
+	PageSize         int `json:"page_size" env:"PAGE_SIZE" default:"25" help:"Messages and mentions per page"`
+}
+
+type Realtime struct {
+	HeartbeatInterval time.Duration `json:"heartbeat_interval" env:"HEARTBEAT_INTERVAL" default:"10s" help:"How often websockets are pinged"`
+	HeartbeatTimeout  time.Duration `json:"heartbeat_timeout" env:"HEARTBEAT_TIMEOUT" default:"30s" help:"How long a silent socket stays open"`
+}
+
+type Privacy struct {
+	IPHashKeys  string        `json:"ip_hash_keys" env:"IP_HASH_KEYS" secret:"true" help:"Ring of ip hash keys, \"id:base64secret,...\" with the current key first"`
+	IPRetention time.Duration `json:"ip_retention" env:"IP_RETENTION" default:"0s" help:"How long raw ips are kept, 0 keeps none"`
+}
+
+type GeoIP struct {
+	DBPath string `json:"db_path" env:"GEOIP_DB_PATH" help:"MaxMind database resolving locations of new users"`
+}
+
+type Push struct {
+	VAPIDPrivateKey string   `json:"vapid_private_key" env:"VAPID_PRIVATE_KEY" secret:"true" help:"VAPID key, generate one with go run ./cmd/vapidkey"`
+	VAPIDSubject    string   `json:"vapid_subject" env:"VAPID_SUBJECT" help:"Contact of the VAPID key, mailto: or https: URL"`
+	EndpointHosts   []string `json:"endpoint_hosts" env:"PUSH_ENDPOINT_HOSTS" help:"Comma separated push service hosts, the well known ones when empty"`
+}
+
+type Google struct {
+	ClientId     string `json:"client_id" env:"GOOGLE_CLIENT_ID" help:"OAuth client id, enables Sign in with Google"`
+	ClientSecret string `json:"client_secret" env:"GOOGLE_CLIENT_SECRET" secret:"true" help:"OAuth client secret"`
+	RedirectURL  string `json:"redirect_url" env:"GOOGLE_REDIRECT_URL" help:"OAuth callback URL"`
+	Issuer       string `json:"issuer" env:"GOOGLE_ISSUER" default:"https://accounts.google.com" help:"OpenID Connect issuer"`
+	JWKSURL      string `json:"jwks_url" env:"GOOGLE_JWKS_URL" help:"Overrides the discovered key set"`
+	AuthURL      string `json:"auth_url" env:"GOOGLE_AUTH_URL" help:"Overrides the discovered authorization endpoint"`
+	TokenURL     string `json:"token_url" env:"GOOGLE_TOKEN_URL" help:"Overrides the discovered token endpoint"`
+}
+
+type Mail struct {
+	SMTPHost     string `json:"smtp_host" env:"SMTP_HOST" help:"SMTP server sending login codes, enables email login"`
+	SMTPPort     string `json:"smtp_port" env:"SMTP_PORT" default:"587" help:"SMTP port"`
+	SMTPUsername string `json:"smtp_username" env:"SMTP_USERNAME" help:"SMTP user"`
+	SMTPPassword string `json:"smtp_password" env:"SMTP_PASSWORD" secret:"true" help:"SMTP password"`
+	SMTPFrom     string `json:"smtp_from" env:"SMTP_FROM" help:"Sender address of login emails"`
+	Dir          string `json:"dir" env:"MAIL_DIR" help:"Writes login emails to files instead of sending them, for development"`
+}
+
+type Auth struct {
+	LoginRedirectPrefixes []string      `json:"login_redirect_prefixes" env:"LOGIN_REDIRECT_PREFIXES" help:"Comma separated URL prefixes a finished sign in may redirect to"`
+	AccessTokenTTL        time.Duration `json:"access_token_ttl" env:"ACCESS_TOKEN_TTL" default:"4320h" help:"How long an unused access token stays valid"`
+}
+
+// Validate checks values that would otherwise fail later, or silently
+func (c *Config) Validate() error {
+	var problems []string
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if port, err := strconv.Atoi(c.Server.Port); err != nil || port < 1 || port > 65535 {
+		add("PORT must be a port number, got %q", c.Server.Port)
+	}
+	if c.Server.PublicURL != "" {
+		if parsed, err := url.Parse(c.Server.PublicURL); err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			add("PUBLIC_URL must be an absolute URL, got %q", c.Server.PublicURL)
+		}
+	}
+	if c.Server.MaxProcs < 0 {
+		add("GOMAXPROCS must not be negative")
+	}
+	if c.Server.ShutdownTimeout <= 0 {
+		add("SHUTDOWN_TIMEOUT must be positive")
+	}
+	if c.Server.ReconnectDelay < 0 {
+		add("RECONNECT_DELAY must not be negative")
+	}
+
+	if _, err := logging.ParseLevel(c.Log.Level); err != nil {
+		add("LOG_LEVEL: %v", err)
+	}
+	if c.Log.Format != logging.FormatJSON && c.Log.Format != logging.FormatText {
+		add("LOG_FORMAT must be json or text, got %q", c.Log.Format)
+	}
+
+	if c.Tracing.Endpoint != "" {
+		if parsed, err := url.Parse(c.Tracing.Endpoint); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			add("OTEL_EXPORTER_OTLP_ENDPOINT must be an http or https URL, got %q", c.Tracing.Endpoint)
+		}
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		add("TRACE_SAMPLE_RATIO must be between 0 and 1")
+	}
+
+	if c.Mongo.URL == "" {
+		add("MONGO_URL is required")
+	}
+	if c.Mongo.Database == "" {
+		add("MONGO_DB_NAME is required")
+	}
+
+	if c.Chat.MaxMessageLength < 1 || c.Chat.MaxMessageLength > 4096 {
+		add("MAX_MESSAGE_LENGTH must be between 1 and 4096")
+	}
+	if c.Chat.PageSize < 1 || c.Chat.PageSize > 100 {
+		add("PAGE_SIZE must be between 1 and 100")
+	}
+
+	if c.Realtime.HeartbeatInterval <= 0 || c.Realtime.HeartbeatTimeout <= c.Realtime.HeartbeatInterval {
+		add("HEARTBEAT_TIMEOUT must be longer than a positive HEARTBEAT_INTERVAL")
+	}
+	if c.Auth.AccessTokenTTL <= 0 {
+		add("ACCESS_TOKEN_TTL must be positive, got %s", c.Auth.AccessTokenTTL)
+	}
+	if c.Privacy.IPRetention < 0 {
+		add("IP_RETENTION must not be negative")
+	}
+
+	if c.Push.VAPIDPrivateKey != "" && c.Push.VAPIDSubject == "" {
+		add("VAPID_SUBJECT is required with VAPID_PRIVATE_KEY")
+	}
+	if c.Mail.SMTPHost != "" {
+		if _, err := strconv.Atoi(c.Mail.SMTPPort); err != nil {
+			add("SMTP_PORT must be a port number, got %q", c.Mail.SMTPPort)
+		}
+		if c.Mail.SMTPFrom == "" {
+			add("SMTP_FROM is required with SMTP_HOST")
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Redacted replaces the values of secret settings
+const Redacted = "[redacted]"
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// field is one setting of Config
+type field struct {
+	path   []string // json names from the root, e.g. ["mongo", "url"]
+	env    string
+	flag   string
+	def    string
+	help   string
+	secret bool
+	value  reflect.Value
+}
+
+// fields lists the settings of c in declaration order
+func fields(c *Config) []field {
+	var result []field
+	var walk func(value reflect.Value, path []string)
+	walk = func(value reflect.Value, path []string) {
+		for i := 0; i < value.NumField(); i++ {
+			structField := value.Type().Field(i)
+			name := strings.Split(structField.Tag.Get("json"), ",")[0]
+			fieldPath := append(append([]string{}, path...), name)
+
+			if structField.Type.Kind() == reflect.Struct && structField.Type != durationType {
+				walk(value.Field(i), fieldPath)
+				continue
+			}
+
+			env := structField.Tag.Get("env")
+			result = append(result, field{
+				path:   fieldPath,
+				env:    env,
+				flag:   strings.ToLower(strings.ReplaceAll(env, "_", "-")),
+				def:    structField.Tag.Get("default"),
+				help:   structField.Tag.Get("help"),
+				secret: structField.Tag.Get("secret") == "true",
+				value:  value.Field(i),
+			})
+		}
+	}
+	walk(reflect.ValueOf(c).Elem(), nil)
+	return result
+}
+
+// set parses raw into the setting
+func (f field) set(raw string) error {
+	switch {
+	case f.value.Type() == durationType:
+		duration, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.env, err)
+		}
+		f.value.SetInt(int64(duration))
+	case f.value.Kind() == reflect.String:
+		f.value.SetString(raw)
+	case f.value.Kind() == reflect.Int:
+		number, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not a number", f.env, raw)
+		}
+		f.value.SetInt(int64(number))
+	case f.value.Kind() == reflect.Float64:
+		number, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not a number", f.env, raw)
+		}
+		f.value.SetFloat(number)
+	case f.value.Kind() == reflect.Bool:
+		flag, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not a boolean", f.env, raw)
+		}
+		f.value.SetBool(flag)
+	case f.value.Kind() == reflect.Slice:
+		items := []string{}
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		f.value.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("%s: unsupported setting type %s", f.env, f.value.Type())
+	}
+	return nil
+}
+
+// display formats the value of the setting as it would be written in env
+func (f field) display() interface{} {
+	switch {
+	case f.value.Type() == durationType:
+		return time.Duration(f.value.Int()).String()
+	default:
+		return f.value.Interface()
+	}
+}
+
+// Load builds the configuration from args (without the program name). The
+// file named by -config or CONFIG_FILE is read first, the environment
+// overrides it and flags override both.
+func Load(args []string) (*Config, error) {
+	c := &Config{}
+	all := fields(c)
+	for _, f := range all {
+		if err := f.set(f.def); err != nil {
+			return nil, err
+		}
+	}
+
+	flags := flag.NewFlagSet("server", flag.ContinueOnError)
+	configFile := flags.String("config", os.Getenv("CONFIG_FILE"), "JSON configuration file")
+	flagValues := map[string]*string{}
+	for _, f := range all {
+		flagValues[f.flag] = flags.String(f.flag, "", f.help+" ("+f.env+")")
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *configFile != "" {
+		if err := loadFile(*configFile, all); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, f := range all {
+		if value, ok := os.LookupEnv(f.env); ok && value != "" {
+			if err := f.set(value); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var flagErr error
+	flags.Visit(func(set *flag.Flag) {
+		for _, f := range all {
+			if f.flag == set.Name && flagErr == nil {
+				flagErr = f.set(*flagValues[f.flag])
+			}
+		}
+	})
+	if flagErr != nil {
+		return nil, flagErr
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// loadFile applies a JSON file shaped like Config, durations are strings
+// such as "30s" and lists are arrays or comma separated strings
+func loadFile(path string, all []field) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	var document map[string]interface{}
+	if err := decoder.Decode(&document); err != nil {
+		return fmt.Errorf("config: parsing %s: %w", path, err)
+	}
+
+	byPath := map[string]field{}
+	for _, f := range all {
+		byPath[strings.Join(f.path, ".")] = f
+	}
+
+	var apply func(node map[string]interface{}, prefix string) error
+	apply = func(node map[string]interface{}, prefix string) error {
+		for key, value := range node {
+			key = prefix + key
+			if nested, ok := value.(map[string]interface{}); ok {
+				if err := apply(nested, key+"."); err != nil {
+					return err
+				}
+				continue
+			}
+
+			f, ok := byPath[key]
+			if !ok {
+				return fmt.Errorf("config: unknown setting %q in %s", key, path)
+			}
+
+			raw := fmt.Sprint(value)
+			if items, ok := value.([]interface{}); ok {
+				parts := make([]string, len(items))
+				for i, item := range items {
+					parts[i] = fmt.Sprint(item)
+				}
+				raw = strings.Join(parts, ",")
+			}
+			if err := f.set(raw); err != nil {
+				return fmt.Errorf("config: %s: %w", path, err)
+			}
+		}
+		return nil
+	}
+	return apply(document, "")
+}
+
+// Redacted returns the effective configuration keyed like the JSON file,
+// secrets that are set are replaced by Redacted
+func (c *Config) Redacted() map[string]interface{} {
+	document := map[string]interface{}{}
+	for _, f := range fields(c) {
+		node := document
+		for _, name := range f.path[:len(f.path)-1] {
+			child, ok := node[name].(map[string]interface{})
+			if !ok {
+				child = map[string]interface{}{}
+				node[name] = child
+			}
+			node = child
+		}
+
+		value := f.display()
+		if f.secret && !f.value.IsZero() {
+			value = Redacted
+		}
+		node[f.path[len(f.path)-1]] = value
+	}
+	return document
+}
@@ -2,10 +2,11 @@ package db
 
 import (
 	"context"
-	"fmt"
-	"os"
+	"log/slog"
 
-	"github.com/gofiber/fiber/v2/log"
+	"server/metrics"
+
+	"go.mongodb.org/mongo-driver/event"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -15,25 +16,48 @@ var (
 	db       *mongo.Database = nil
 )
 
-func MongoInit(colName string) (*mongo.Collection, context.Context) {
-
-	if db != nil {
-		fmt.Printf("Connected to collection - %s\n", colName)
-		return db.Collection(colName), mongoCtx
-	}
+// commandMonitor times every command sent to Mongo
+var commandMonitor = &event.CommandMonitor{
+	Succeeded: func(_ context.Context, succeeded *event.CommandSucceededEvent) {
+		metrics.MongoCommandDuration.WithLabelValues(succeeded.CommandName, "ok").Observe(succeeded.Duration.Seconds())
+	},
+	Failed: func(_ context.Context, failed *event.CommandFailedEvent) {
+		metrics.MongoCommandDuration.WithLabelValues(failed.CommandName, "error").Observe(failed.Duration.Seconds())
+	},
+}
 
-	clientOptions := options.Client().ApplyURI(os.Getenv("MONGO_URL"))
+// MongoConnect connects to the database named database at url, it must be
+// called before MongoInit
+func MongoConnect(url string, database string) error {
+	clientOptions := options.Client().ApplyURI(url).SetMonitor(commandMonitor)
 	client, err := mongo.Connect(mongoCtx, clientOptions)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	err = client.Ping(mongoCtx, nil)
-	if err != nil {
-		log.Fatal(err)
+	if err := client.Ping(mongoCtx, nil); err != nil {
+		return err
 	}
 
-	db = client.Database(os.Getenv("MONGO_DB_NAME"))
-	fmt.Printf("Connected to collection - %s\n", colName)
+	db = client.Database(database)
+	return nil
+}
+
+func MongoInit(colName string) (*mongo.Collection, context.Context) {
+
+	if db == nil {
+		panic("db: MongoInit called before MongoConnect")
+	}
+
+	slog.Info("Connected to collection", "collection", colName)
 	return db.Collection(colName), mongoCtx
 }
+
+// MongoClose disconnects from Mongo, waiting for in-flight operations
+// until ctx is done
+func MongoClose(ctx context.Context) error {
+	if db == nil {
+		return nil
+	}
+	return db.Client().Disconnect(ctx)
+}
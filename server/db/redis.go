@@ -2,13 +2,10 @@ package db
 
 import (
 	"context"
-	"fmt"
-	"os"
+	"log/slog"
 	"sync"
 
 	"github.com/go-redis/redis/v8"
-	"github.com/gofiber/fiber/v2/log"
-	"github.com/gofiber/websocket/v2"
 )
 
 // Message representation
@@ -21,27 +18,19 @@ type MessageModel struct {
 	Flagged   []interface{}          `json:"Flagged"`
 }
 
-type UserSocket struct {
-	UserId     string
-	Conn       *websocket.Conn
-	IsActive   bool
-	ActiveSite string
-	Channel    chan map[string]interface{}
-}
-
 var (
-	ctx         = context.Background()
-	client      *redis.Client
-	mutex       sync.Mutex
-	Connections = make(map[string]*UserSocket)
+	ctx    = context.Background()
+	client *redis.Client
+	mutex  sync.Mutex
 )
 
-func RedisInit() bool {
+func RedisInit(url string) bool {
 
 	// Parse the Redis URL and connect
-	options, parseErr := redis.ParseURL(os.Getenv("REDIS_URL"))
+	options, parseErr := redis.ParseURL(url)
 	if parseErr != nil {
-		log.Fatalf("Failed to parse Redis URL: %v", parseErr)
+		slog.Error("Parsing Redis URL failed", "err", parseErr)
+		return false
 	}
 
 	// Create a new Redis client
@@ -50,10 +39,10 @@ func RedisInit() bool {
 	// Ping Redis to ensure the connection is successful
 	_, err := client.Ping(ctx).Result()
 	if err != nil {
-		log.Fatalf("Could not connect to Redis: %v", err)
+		slog.Error("Connecting to Redis failed", "err", err)
 		return false
 	}
-	log.Debug("Connected to Redis")
+	slog.Debug("Connected to Redis")
 	return true
 }
 
@@ -63,10 +52,10 @@ func Set(hashId string, mp map[string]interface{}) (bool, error) {
 	_, err := client.HSet(ctx, hashId, mp).Result()
 	mutex.Unlock()
 	if err != nil {
-		log.Error("Could not add entry to hash set: %v", err)
+		slog.Error("Adding entry to hash set failed", "hash_id", hashId, "err", err)
 		return false, err
 	}
-	log.Debug("Entry added to hash set for hashId - ", hashId)
+	slog.Debug("Entry added to hash set", "hash_id", hashId)
 	return true, nil
 }
 
@@ -77,7 +66,7 @@ func Get(hashId string) (map[string]interface{}, bool) {
 	hashValuesStringMap, err := client.HGetAll(ctx, hashId).Result()
 	mutex.Unlock()
 	if err != nil {
-		log.Error("Could not add entry to hash set: %v", err)
+		slog.Error("Reading hash set failed", "hash_id", hashId, "err", err)
 		return nil, true
 	}
 
@@ -109,9 +98,10 @@ func StreamExists(siteId string) bool {
 		if err == redis.Nil {
 			return false
 		} else {
-			log.Fatalf("Error checking stream %s: %v", siteId, err)
+			slog.Error("Checking stream failed", "stream", siteId, "err", err)
+			return false
 		}
 	}
-	fmt.Printf("Stream %s exists\n", siteId)
+	slog.Debug("Stream exists", "stream", siteId)
 	return true
 }
@@ -0,0 +1,334 @@
+package db
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"server/dto"
+	"server/metrics"
+
+	"github.com/gofiber/websocket/v2"
+)
+
+// UserSocket is one open websocket of a user, a user has one per tab
+type UserSocket struct {
+	UserId     string
+	Conn       *websocket.Conn
+	IsActive   bool
+	ActiveSite string
+	Channel    chan dto.Event
+	// Shown in presence lists and events unless Invisible
+	Username   string
+	AvatarSeed string
+	Invisible  bool
+
+	// subscriptions maps the channels followed besides ActiveSite to the tag
+	// the client gave them, guarded by socketsMutex
+	subscriptions map[string]string
+	lastSeen      atomic.Int64 // unix nanoseconds
+	done          chan struct{}
+	closeOnce     sync.Once
+}
+
+// SendBuffer is how many events a socket holds for its reader, a reader
+// falling further behind is closed, see Send
+const SendBuffer = 64
+
+var (
+	socketsMutex sync.RWMutex
+	// connections holds the open sockets of every connected user
+	connections = make(map[string][]*UserSocket)
+)
+
+// NewUserSocket wraps conn, events sent to it are written by the caller
+// reading Channel until Done is closed
+func NewUserSocket(userId string, conn *websocket.Conn, activeSite string) *UserSocket {
+	socket := &UserSocket{
+		UserId:     userId,
+		Conn:       conn,
+		IsActive:   true,
+		ActiveSite: activeSite,
+		Channel:    make(chan dto.Event, SendBuffer),
+		done:       make(chan struct{}),
+	}
+	socket.Touch()
+	return socket
+}
+
+// Send hands event to the writer of the socket without waiting, so fan-out
+// to every other socket never stalls on one. It returns false once the
+// socket is closed, and closes a socket whose reader fell SendBuffer events
+// behind; its client reconnects and resumes. Events of a subscribed channel
+// carry the tag of the subscription.
+func (s *UserSocket) Send(event dto.Event) bool {
+	socketsMutex.RLock()
+	event.Subscription = s.subscriptions[event.Channel]
+	socketsMutex.RUnlock()
+
+	select {
+	case <-s.done:
+		metrics.DroppedEvents.WithLabelValues("closed").Inc()
+		return false
+	default:
+	}
+
+	select {
+	case s.Channel <- event:
+		return true
+	default:
+		metrics.DroppedEvents.WithLabelValues("slow_consumer").Inc()
+		s.Close()
+		return false
+	}
+}
+
+// Done is closed when the socket is closed
+func (s *UserSocket) Done() <-chan struct{} {
+	return s.done
+}
+
+// Close stops delivery and closes the connection, it is safe to call more
+// than once
+func (s *UserSocket) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		if s.Conn != nil {
+			s.Conn.Close()
+		}
+	})
+}
+
+// Touch records that the client was heard from
+func (s *UserSocket) Touch() {
+	s.lastSeen.Store(time.Now().UnixNano())
+}
+
+// LastSeen is when the client was last heard from
+func (s *UserSocket) LastSeen() time.Time {
+	return time.Unix(0, s.lastSeen.Load())
+}
+
+// Subscribed reports whether the socket receives the events of channel, it
+// must be called with the registry locked, as Sockets filters are
+func (s *UserSocket) Subscribed(channel string) bool {
+	if s.ActiveSite == channel {
+		return true
+	}
+	_, ok := s.subscriptions[channel]
+	return ok
+}
+
+// IsSubscribed is Subscribed for callers not holding the registry lock
+func IsSubscribed(socket *UserSocket, channel string) bool {
+	socketsMutex.RLock()
+	defer socketsMutex.RUnlock()
+
+	return socket.Subscribed(channel)
+}
+
+// Subscribe adds channel to the subscriptions of socket under tag. It
+// returns false when the socket already follows limit channels.
+func Subscribe(socket *UserSocket, channel string, tag string, limit int) bool {
+	socketsMutex.Lock()
+	defer socketsMutex.Unlock()
+
+	if _, ok := socket.subscriptions[channel]; !ok && len(socket.subscriptions) >= limit {
+		return false
+	}
+	if socket.subscriptions == nil {
+		socket.subscriptions = make(map[string]string)
+	}
+	socket.subscriptions[channel] = tag
+	return true
+}
+
+// Unsubscribe removes channel from the subscriptions of socket, the active
+// site stays subscribed
+func Unsubscribe(socket *UserSocket, channel string) {
+	socketsMutex.Lock()
+	defer socketsMutex.Unlock()
+
+	delete(socket.subscriptions, channel)
+}
+
+// Subscriptions returns the active site of socket and the channels it
+// follows besides it
+func Subscriptions(socket *UserSocket) (activeSite string, channels []string) {
+	socketsMutex.RLock()
+	defer socketsMutex.RUnlock()
+
+	channels = make([]string, 0, len(socket.subscriptions))
+	for channel := range socket.subscriptions {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+	return socket.ActiveSite, channels
+}
+
+// presentLocked reports whether a user has a socket on site, the registry
+// must be locked
+func presentLocked(userId string, site string) bool {
+	for _, socket := range connections[userId] {
+		if socket.ActiveSite == site {
+			return true
+		}
+	}
+	return false
+}
+
+// AddSocket registers an open socket, joined is true when it is the first
+// socket of its user on its site
+func AddSocket(socket *UserSocket) (joined bool) {
+	socketsMutex.Lock()
+	defer socketsMutex.Unlock()
+
+	joined = !presentLocked(socket.UserId, socket.ActiveSite)
+	connections[socket.UserId] = append(connections[socket.UserId], socket)
+	return joined
+}
+
+// RemoveSocket forgets a socket, left is true when its user has no other
+// socket on its site. Removing a socket that is already gone is a no-op.
+func RemoveSocket(socket *UserSocket) (left bool) {
+	socketsMutex.Lock()
+	defer socketsMutex.Unlock()
+
+	socket.IsActive = false
+	sockets := connections[socket.UserId]
+	index := -1
+	for i, current := range sockets {
+		if current == socket {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return false
+	}
+
+	sockets = append(sockets[:index:index], sockets[index+1:]...)
+	if len(sockets) == 0 {
+		delete(connections, socket.UserId)
+	} else {
+		connections[socket.UserId] = sockets
+	}
+	return !presentLocked(socket.UserId, socket.ActiveSite)
+}
+
+// UserSockets returns the open sockets of a user
+func UserSockets(userId string) []*UserSocket {
+	socketsMutex.RLock()
+	defer socketsMutex.RUnlock()
+
+	return append([]*UserSocket(nil), connections[userId]...)
+}
+
+// Sockets returns the open sockets matching filter, filter is called with
+// the registry locked so it may read ActiveSite safely
+func Sockets(filter func(socket *UserSocket) bool) []*UserSocket {
+	socketsMutex.RLock()
+	defer socketsMutex.RUnlock()
+
+	result := []*UserSocket{}
+	for _, sockets := range connections {
+		for _, socket := range sockets {
+			if socket.IsActive && filter(socket) {
+				result = append(result, socket)
+			}
+		}
+	}
+	return result
+}
+
+// ConnectedUsers counts the users with at least one open socket matching
+// filter, nil matches every socket
+func ConnectedUsers(filter func(socket *UserSocket) bool) int {
+	socketsMutex.RLock()
+	defer socketsMutex.RUnlock()
+
+	count := 0
+	for _, sockets := range connections {
+		for _, socket := range sockets {
+			if socket.IsActive && (filter == nil || filter(socket)) {
+				count++
+				break
+			}
+		}
+	}
+	return count
+}
+
+// SocketsPerChannel counts the open sockets receiving the events of each
+// channel, through their active site or a subscription
+func SocketsPerChannel() map[string]int {
+	socketsMutex.RLock()
+	defer socketsMutex.RUnlock()
+
+	counts := map[string]int{}
+	for _, sockets := range connections {
+		for _, socket := range sockets {
+			if !socket.IsActive {
+				continue
+			}
+			if socket.ActiveSite != "" {
+				counts[socket.ActiveSite]++
+			}
+			for channel := range socket.subscriptions {
+				if channel != socket.ActiveSite {
+					counts[channel]++
+				}
+			}
+		}
+	}
+	return counts
+}
+
+// SetActiveSite moves every socket of a user to site. It returns the sites
+// the user left and whether they joined site.
+func SetActiveSite(userId string, site string) (left []string, joined bool) {
+	socketsMutex.Lock()
+	defer socketsMutex.Unlock()
+
+	sockets := connections[userId]
+	if len(sockets) == 0 {
+		return nil, false
+	}
+
+	joined = !presentLocked(userId, site)
+	seen := map[string]bool{}
+	for _, socket := range sockets {
+		if socket.ActiveSite != site && !seen[socket.ActiveSite] {
+			seen[socket.ActiveSite] = true
+			left = append(left, socket.ActiveSite)
+		}
+		socket.ActiveSite = site
+	}
+	return left, joined
+}
+
+// SetInvisible hides or shows a user in presence lists, it returns the
+// sites the user is on
+func SetInvisible(userId string, invisible bool) []string {
+	socketsMutex.Lock()
+	defer socketsMutex.Unlock()
+
+	sites := []string{}
+	seen := map[string]bool{}
+	for _, socket := range connections[userId] {
+		socket.Invisible = invisible
+		if !seen[socket.ActiveSite] {
+			seen[socket.ActiveSite] = true
+			sites = append(sites, socket.ActiveSite)
+		}
+	}
+	return sites
+}
+
+// StaleSockets returns the open sockets not heard from since before
+func StaleSockets(before time.Time) []*UserSocket {
+	return Sockets(func(socket *UserSocket) bool {
+		return socket.LastSeen().Before(before)
+	})
+}
@@ -0,0 +1,97 @@
+// Package dto holds the canonical JSON shapes exchanged with clients over
+// REST and websocket. Storage models live in the models package and are
+// converted to these types before they leave the server.
+package dto
+
+import "context"
+
+// Version of the wire schema, bumped on any breaking change to the types in
+// this package
+const Version = 1
+
+// Event types pushed over the websocket
+const (
+	EventInsert = "insert"
+	EventUpdate = "update"
+	EventDelete = "delete"
+	// EventMention is pushed to every socket of a mentioned user, whatever
+	// channel they are on
+	EventMention = "mention"
+	// EventJoined and EventLeft are pushed to a channel when a visible user
+	// opens their first or closes their last socket on it
+	EventJoined = "joined"
+	EventLeft   = "left"
+	// EventTyping is pushed to a channel while a user is writing a message
+	EventTyping = "typing"
+	// EventRead is pushed when a user moves their read marker, to their own
+	// sockets and to the peer of a direct channel
+	EventRead = "read"
+	// EventSubscriptions answers subscribe and unsubscribe frames with the
+	// channels the socket follows
+	EventSubscriptions = "subscriptions"
+	// EventError answers a client frame that failed, its data is an
+	// ErrorResponse
+	EventError = "error"
+	// EventSession is the first event of every connection, its data is a
+	// Session
+	EventSession = "session"
+	// EventReset tells a resuming client that events were dropped and it
+	// should reload history
+	EventReset = "reset"
+	// EventRestarting is the last event before the server closes the
+	// connection to restart, its data is a Restarting
+	EventRestarting = "restarting"
+	// EventPrekeysLow is pushed to the sockets of a user whose one time
+	// prekeys run low, its data is a PrekeysLow
+	EventPrekeysLow = "prekeys_low"
+)
+
+// Event is the envelope for every frame pushed to a realtime client
+type Event struct {
+	// Id is "<session>:<sequence>", passed back as Last-Event-ID to resume
+	Id      string `json:"id,omitempty"`
+	Version int    `json:"v"`
+	Type    string `json:"type"`
+	Channel string `json:"channel,omitempty"`
+	// Subscription is the tag the client gave the subscription the event
+	// is delivered for, empty for the active site and direct channels
+	Subscription string      `json:"sub,omitempty"`
+	Data         interface{} `json:"data,omitempty"`
+
+	// ctx carries the trace of the change that caused the event to the
+	// writers of the sockets, it is never sent
+	ctx context.Context
+}
+
+// NewEvent wraps data in a versioned event envelope
+func NewEvent(eventType string, channel string, data interface{}) Event {
+	return Event{
+		Version: Version,
+		Type:    eventType,
+		Channel: channel,
+		Data:    data,
+	}
+}
+
+// WithContext returns a copy of the event carrying ctx, the context of the
+// change it reports
+func (e Event) WithContext(ctx context.Context) Event {
+	e.ctx = ctx
+	return e
+}
+
+// Context returns the context set by WithContext, or the background context
+func (e Event) Context() context.Context {
+	if e.ctx == nil {
+		return context.Background()
+	}
+	return e.ctx
+}
+
+// ErrorResponse is the body of every non 2xx response
+type ErrorResponse struct {
+	Status    int    `json:"status"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestId string `json:"request_id"`
+}
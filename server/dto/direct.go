@@ -0,0 +1,16 @@
+package dto
+
+import "time"
+
+// Conversation is a direct message channel as seen by one participant
+type Conversation struct {
+	Channel       string    `json:"channel"`
+	Peer          Author    `json:"peer"`
+	Unread        int       `json:"unread"`
+	LastMessageAt time.Time `json:"last_message_at"`
+}
+
+// BlockList is the users the caller has blocked
+type BlockList struct {
+	UserIds []string `json:"user_ids"`
+}
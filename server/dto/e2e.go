@@ -0,0 +1,74 @@
+package dto
+
+import "time"
+
+// EncryptedPayload is an end-to-end encrypted direct message. The server
+// checks its shape and sizes, only the participants can read it. Binary
+// fields are base64.
+type EncryptedPayload struct {
+	Algorithm       string `json:"alg"`
+	SenderKey       string `json:"sender_key"`    // identity key of the sender
+	EphemeralKey    string `json:"ephemeral_key"` // X25519 key of this message
+	SignedPrekeyId  int64  `json:"signed_prekey_id"`
+	OneTimePrekeyId *int64 `json:"one_time_prekey_id,omitempty"`
+	Nonce           string `json:"nonce"`
+	Ciphertext      string `json:"ciphertext"`
+}
+
+// SignedPrekey is a medium term X25519 key signed by the identity key
+type SignedPrekey struct {
+	KeyId     int64  `json:"key_id"`
+	PublicKey string `json:"public_key"`
+	Signature string `json:"signature"`
+}
+
+// Prekey is a single use X25519 key
+type Prekey struct {
+	KeyId     int64  `json:"key_id"`
+	PublicKey string `json:"public_key"`
+}
+
+// KeyBundleRequest registers or rotates the public keys of the caller
+type KeyBundleRequest struct {
+	IdentityKey    string       `json:"identity_key"` // Ed25519
+	SignedPrekey   SignedPrekey `json:"signed_prekey"`
+	OneTimePrekeys []Prekey     `json:"one_time_prekeys"`
+	// RotationSignature is the new identity key signed by the registered
+	// one, required to replace it
+	RotationSignature string `json:"rotation_signature,omitempty"`
+}
+
+// PrekeysRequest adds single use keys to the bundle of the caller
+type PrekeysRequest struct {
+	OneTimePrekeys []Prekey `json:"one_time_prekeys"`
+}
+
+// KeyBundle is what a sender needs to start an encrypted conversation, the
+// one time prekey is handed out once and may be missing when none are left
+type KeyBundle struct {
+	UserId        string       `json:"user_id"`
+	IdentityKey   string       `json:"identity_key"`
+	SignedPrekey  SignedPrekey `json:"signed_prekey"`
+	OneTimePrekey *Prekey      `json:"one_time_prekey,omitempty"`
+	UpdatedAt     time.Time    `json:"updated_at"`
+}
+
+// KeyBundleStatus describes the bundle of the caller
+type KeyBundleStatus struct {
+	IdentityKey    string    `json:"identity_key"`
+	SignedPrekeyId int64     `json:"signed_prekey_id"`
+	OneTimePrekeys int       `json:"one_time_prekeys"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// PrekeysLow is pushed to the owner of a bundle whose one time prekeys run
+// low, they should upload more
+type PrekeysLow struct {
+	OneTimePrekeys int `json:"one_time_prekeys"`
+}
+
+// ReportRequest carries the decrypted text when the recipient reports an
+// encrypted message
+type ReportRequest struct {
+	Plaintext string `json:"plaintext"`
+}
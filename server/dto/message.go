@@ -0,0 +1,131 @@
+package dto
+
+import "time"
+
+// Author identifies who wrote a message
+type Author struct {
+	Id       string `json:"id"`
+	Username string `json:"username"`
+	Avatar   string `json:"avatar"`
+}
+
+// Message is the canonical representation of a chat message
+type Message struct {
+	Version   int                 `json:"v"`
+	Id        string              `json:"id"`
+	Channel   string              `json:"channel"`
+	Message   string              `json:"message"`
+	To        string              `json:"to"`
+	From      Author              `json:"from"`
+	Reactions map[string][]string `json:"reactions"`
+	Flagged   map[string][]string `json:"flagged"`
+	Encrypted *EncryptedPayload   `json:"encrypted,omitempty"`
+	Mentions  []Mention           `json:"mentions"`
+	CreatedAt time.Time           `json:"created_at"`
+	UpdatedAt time.Time           `json:"updated_at"`
+}
+
+// SendMessageRequest is the body accepted when posting a new message
+type SendMessageRequest struct {
+	Message string `json:"message"`
+	To      string `json:"to"`
+	Channel string `json:"channel"`
+	// Encrypted replaces Message on end-to-end encrypted direct messages
+	Encrypted *EncryptedPayload `json:"encrypted,omitempty"`
+}
+
+// MessagePage is one page of channel history
+type MessagePage struct {
+	Messages     []Message `json:"messages"`
+	NextBookmark string    `json:"next_bookmark"`
+	HasMore      bool      `json:"has_more"`
+	// Divider marks where the messages new since the caller last read the
+	// channel start, set on the first page when there are any
+	Divider *UnreadDivider `json:"divider,omitempty"`
+}
+
+// UnreadDivider goes after the last read message of a page of history
+type UnreadDivider struct {
+	// LastReadId is empty when the caller never read the channel
+	LastReadId string `json:"last_read_id"`
+	Unread     int64  `json:"unread"`
+}
+
+// ReadRequest is the body accepted when marking a channel read up to a message
+type ReadRequest struct {
+	MessageId string `json:"message_id"`
+}
+
+// ReadMarker is how far a user read a channel, it is also the data of read
+// events sent to the user's other sockets and to the peer of a direct channel
+type ReadMarker struct {
+	UserId     string    `json:"user_id"`
+	Channel    string    `json:"channel"`
+	LastReadId string    `json:"last_read_id"`
+	Unread     int64     `json:"unread"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// ReactionRequest is the body accepted when toggling a reaction
+type ReactionRequest struct {
+	Emoji string `json:"emoji"`
+}
+
+// ReactionResult is the caller's reaction after a toggle
+type ReactionResult struct {
+	MessageId string `json:"message_id"`
+	Emoji     string `json:"emoji"`
+	// Reacted is false when the toggle removed the caller's reaction
+	Reacted bool `json:"reacted"`
+	// Count is how many users now react with Emoji
+	Count int `json:"count"`
+}
+
+// ReportResult is the caller's report after a toggle
+type ReportResult struct {
+	MessageId string `json:"message_id"`
+	// Reported is false when the toggle withdrew the caller's report
+	Reported bool `json:"reported"`
+}
+
+// ChannelMetadata holds the live counts of a channel
+type ChannelMetadata struct {
+	Live         int `json:"live"`
+	PlatformLive int `json:"platform_live"`
+}
+
+// Mention is a user mentioned in a message
+type Mention struct {
+	UserId   string `json:"user_id"`
+	Username string `json:"username"`
+}
+
+// MentionNotification is an entry of the mentions inbox, it is also the
+// data of "mention" events
+type MentionNotification struct {
+	MessageId string    `json:"message_id"`
+	Channel   string    `json:"channel"`
+	From      Author    `json:"from"`
+	Message   string    `json:"message"`
+	Read      bool      `json:"read"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// MentionPage is one page of the mentions inbox, newest first
+type MentionPage struct {
+	Mentions     []MentionNotification `json:"mentions"`
+	NextBookmark string                `json:"next_bookmark"`
+	HasMore      bool                  `json:"has_more"`
+	Unread       int64                 `json:"unread"`
+}
+
+// MentionReadRequest marks inbox entries read, all of them when MessageIds
+// is empty
+type MentionReadRequest struct {
+	MessageIds []string `json:"message_ids"`
+}
+
+// MentionCount is the number of unread mentions
+type MentionCount struct {
+	Unread int64 `json:"unread"`
+}
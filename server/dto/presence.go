@@ -0,0 +1,55 @@
+package dto
+
+// PresentUser is a user with an open socket on a channel
+type PresentUser struct {
+	Id       string `json:"id"`
+	Username string `json:"username"`
+	Avatar   string `json:"avatar"`
+}
+
+// Presence lists the visible users on a channel, Live also counts the
+// invisible ones
+type Presence struct {
+	Channel string        `json:"channel"`
+	Live    int           `json:"live"`
+	Users   []PresentUser `json:"users"`
+}
+
+// PresenceEvent is the data of joined and left events
+type PresenceEvent struct {
+	User PresentUser `json:"user"`
+}
+
+// Typing is the data of typing events
+type Typing struct {
+	UserId   string `json:"user_id"`
+	Username string `json:"username"`
+}
+
+// ClientFrame is a JSON frame sent by a client over the websocket, the
+// plain text "ping" frame is still accepted
+type ClientFrame struct {
+	Type string `json:"type"` // <ping, typing, read, subscribe, unsubscribe>
+	// Channel the frame is about, the socket's active site when empty
+	Channel string `json:"channel,omitempty"`
+	// MessageId is the last message read, for read frames
+	MessageId string `json:"message_id,omitempty"`
+	// Tag is echoed in the sub field of events of a subscribed channel
+	Tag string `json:"tag,omitempty"`
+}
+
+// Subscriptions lists the channels a socket receives events of
+type Subscriptions struct {
+	ActiveSite string   `json:"active_site"`
+	Channels   []string `json:"channels"`
+	Limit      int      `json:"limit"`
+}
+
+// Frame types accepted from clients
+const (
+	FramePing        = "ping"
+	FrameTyping      = "typing"
+	FrameRead        = "read"
+	FrameSubscribe   = "subscribe"
+	FrameUnsubscribe = "unsubscribe"
+)
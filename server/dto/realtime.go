@@ -0,0 +1,21 @@
+package dto
+
+// Session identifies the event stream of one connection, frames are posted
+// to it by transports without a client to server channel
+type Session struct {
+	Id string `json:"id"`
+}
+
+// EventBatch is the body of a long poll
+type EventBatch struct {
+	Events []Event `json:"events"`
+	// LastEventId is passed to the next poll to continue after these events
+	LastEventId string `json:"last_event_id"`
+}
+
+// Restarting is the data of restarting events, sent before the server shuts
+// down. Clients reconnect after ReconnectIn, which is jittered per
+// connection so they do not all come back at once.
+type Restarting struct {
+	ReconnectInMs int64 `json:"reconnect_in_ms"`
+}
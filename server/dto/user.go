@@ -0,0 +1,182 @@
+package dto
+
+import "time"
+
+// User is the canonical representation of a user, without network or
+// location data
+type User struct {
+	Version       int       `json:"v"`
+	Id            string    `json:"id"`
+	Username      string    `json:"username"`
+	Avatar        string    `json:"avatar"`
+	IsOnline      bool      `json:"is_online"`
+	ActiveSite    string    `json:"active_site"`
+	ExploredSites []string  `json:"explored_sites"`
+	IsLoggedIn    bool      `json:"is_logged_in"`
+	LoginMethod   string    `json:"login_method"`
+	Invisible     bool      `json:"invisible"`
+	CreatedAt     time.Time `json:"created_at"`
+	// AccessToken is only set by the registration or sign in that issued it
+	AccessToken string `json:"access_token,omitempty"`
+}
+
+// UpdateUserRequest is the body accepted when updating the calling user,
+// fields left out are not changed
+type UpdateUserRequest struct {
+	ActiveSite *string `json:"active_site"`
+	IsOnline   *bool   `json:"is_online"`
+	// Invisible users are left out of presence lists and events
+	Invisible *bool `json:"invisible"`
+}
+
+// UserExport is the archive of everything stored about a user
+type UserExport struct {
+	Version     int              `json:"v"`
+	ExportedAt  time.Time        `json:"exported_at"`
+	Profile     UserProfile      `json:"profile"`
+	Messages    []Message        `json:"messages"`
+	Reactions   []ReactionEntry  `json:"reactions"`
+	Reports     []ReportEntry    `json:"reports"`
+	Keys        *KeyBundleStatus `json:"keys,omitempty"`
+	ReadMarkers []ReadMarker     `json:"read_markers"`
+	// PushSubscriptions leaves out the encryption keys of the subscriptions
+	PushSubscriptions []PushSubscription `json:"push_subscriptions"`
+	Mentions          []MentionEntry     `json:"mentions"`
+	Conversations     []Conversation     `json:"conversations"`
+}
+
+// UserProfile is the full stored user record, including network and
+// moderation data that User leaves out
+type UserProfile struct {
+	User
+	IpHash         string          `json:"ip_hash"`
+	RawIp          string          `json:"raw_ip,omitempty"`
+	RawIpExpiresAt *time.Time      `json:"raw_ip_expires_at,omitempty"`
+	Country        string          `json:"country"`
+	Region         string          `json:"region"`
+	IsBanned       bool            `json:"is_banned"`
+	ModifiedAt     time.Time       `json:"modified_at"`
+	Identities     []IdentityEntry `json:"identities"`
+	Blocked        []string        `json:"blocked"`
+}
+
+// IdentityEntry is an external account linked to a user
+type IdentityEntry struct {
+	Provider string    `json:"provider"`
+	Email    string    `json:"email,omitempty"`
+	LinkedAt time.Time `json:"linked_at"`
+}
+
+// ReactionEntry is one reaction a user left on a message
+type ReactionEntry struct {
+	MessageId string `json:"message_id"`
+	Channel   string `json:"channel"`
+	Emoji     string `json:"emoji"`
+}
+
+// ReportEntry is one report a user filed against a message
+type ReportEntry struct {
+	MessageId string `json:"message_id"`
+	Channel   string `json:"channel"`
+	Code      string `json:"code"`
+}
+
+// MentionEntry is one entry of a user's mentions inbox
+type MentionEntry struct {
+	MessageId string    `json:"message_id"`
+	Channel   string    `json:"channel"`
+	Read      bool      `json:"read"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// UsernameRequest is the body accepted when changing one's username
+type UsernameRequest struct {
+	Username string `json:"username"`
+}
+
+// UsernameHistory lists the previous names of a user, for moderators
+type UsernameHistory struct {
+	UserId   string          `json:"user_id"`
+	Username string          `json:"username"`
+	History  []UsernameEntry `json:"history"`
+}
+
+// UsernameEntry is a name a user held until ChangedAt
+type UsernameEntry struct {
+	Username  string    `json:"username"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// IdTokenLoginRequest signs in with an ID token the client obtained itself
+type IdTokenLoginRequest struct {
+	IdToken string `json:"id_token"`
+	Nonce   string `json:"nonce"` // from LoginNonce, the token must carry it
+}
+
+// LoginNonce is the nonce a client requests its ID token with
+type LoginNonce struct {
+	Nonce     string `json:"nonce"`
+	ExpiresIn int    `json:"expires_in"` // seconds
+}
+
+// LoginStarted is the provider URL to open in the browser to sign in
+type LoginStarted struct {
+	AuthURL string `json:"auth_url"`
+}
+
+// EmailLoginRequest asks for a login code by email
+type EmailLoginRequest struct {
+	Email       string `json:"email"`
+	RedirectURI string `json:"redirect_uri,omitempty"`
+}
+
+// EmailLoginStarted tells how long the emailed code stays valid
+type EmailLoginStarted struct {
+	ExpiresIn int `json:"expires_in"` // seconds
+}
+
+// EmailCodeRequest signs in with the code received by email
+type EmailCodeRequest struct {
+	Email string `json:"email"`
+	Code  string `json:"code"`
+}
+
+// MagicLinkRequest signs in with the token of an emailed link, posted as a
+// form by the confirmation page
+type MagicLinkRequest struct {
+	Token string `json:"token" form:"token"`
+}
+
+// PushSubscriptionRequest registers a browser push subscription, it is the
+// JSON of PushSubscription plus an optional device label
+type PushSubscriptionRequest struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+	Device string `json:"device,omitempty"`
+}
+
+// PushSubscription is a registered push subscription
+type PushSubscription struct {
+	Id        string    `json:"id"`
+	Endpoint  string    `json:"endpoint"`
+	Device    string    `json:"device"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// VAPIDKey is the applicationServerKey to subscribe with
+type VAPIDKey struct {
+	PublicKey string `json:"public_key"`
+}
+
+// PushNotification is the payload of a Web Push notification
+type PushNotification struct {
+	Version   int    `json:"v"`
+	Type      string `json:"type"` // mention, dm or reply
+	Title     string `json:"title"`
+	Body      string `json:"body"`
+	Channel   string `json:"channel"`
+	MessageId string `json:"message_id"`
+}
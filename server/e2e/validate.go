@@ -0,0 +1,164 @@
+// Package e2e checks the public keys and encrypted payloads of end-to-end
+// encrypted direct messages. It never sees private keys or plaintext.
+package e2e
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"server/dto"
+)
+
+const (
+	// MaxCiphertextSize bounds an encrypted message, ciphertext includes the
+	// authentication tag
+	MaxCiphertextSize = 4096
+	// MaxOneTimePrekeys is how many single use keys the server keeps per user
+	MaxOneTimePrekeys = 100
+
+	keySize = 32
+	tagSize = 16
+)
+
+// Algorithms lists the accepted payload algorithms with their nonce size
+var Algorithms = map[string]int{
+	"x25519-xchacha20poly1305": 24,
+	"x25519-aes256gcm":         12,
+}
+
+// InvalidError describes why a bundle or payload was refused
+type InvalidError struct {
+	Reason string
+}
+
+func (e *InvalidError) Error() string {
+	return "e2e: " + e.Reason
+}
+
+func invalid(format string, args ...interface{}) error {
+	return &InvalidError{Reason: fmt.Sprintf(format, args...)}
+}
+
+// decode accepts standard and URL safe base64, padded or not
+func decode(value string) ([]byte, error) {
+	for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if decoded, err := encoding.DecodeString(value); err == nil {
+			return decoded, nil
+		}
+	}
+	return nil, errors.New("not base64")
+}
+
+// SameKey compares two base64 keys whatever base64 flavour they use
+func SameKey(a string, b string) bool {
+	keyA, errA := decode(a)
+	keyB, errB := decode(b)
+	return errA == nil && errB == nil && len(keyA) > 0 && bytes.Equal(keyA, keyB)
+}
+
+func decodeKey(name string, value string) ([]byte, error) {
+	key, err := decode(value)
+	if err != nil || len(key) != keySize {
+		return nil, invalid("%s must be a base64 %d byte key", name, keySize)
+	}
+	return key, nil
+}
+
+// ValidateBundle checks the keys of a bundle and that the signed prekey is
+// signed by the identity key
+func ValidateBundle(bundle dto.KeyBundleRequest) error {
+	identityKey, err := decodeKey("identity_key", bundle.IdentityKey)
+	if err != nil {
+		return err
+	}
+
+	prekey, err := decodeKey("signed_prekey.public_key", bundle.SignedPrekey.PublicKey)
+	if err != nil {
+		return err
+	}
+	signature, err := decode(bundle.SignedPrekey.Signature)
+	if err != nil || len(signature) != ed25519.SignatureSize {
+		return invalid("signed_prekey.signature must be a base64 Ed25519 signature")
+	}
+	if !ed25519.Verify(ed25519.PublicKey(identityKey), prekey, signature) {
+		return invalid("signed_prekey.signature does not verify against identity_key")
+	}
+
+	return ValidatePrekeys(bundle.OneTimePrekeys)
+}
+
+// ValidateRotation checks that the identity key being replaced signed its
+// successor, so whoever holds the access token alone cannot swap the key
+// others encrypt to
+func ValidateRotation(currentKey string, nextKey string, signature string) error {
+	current, err := decodeKey("current identity key", currentKey)
+	if err != nil {
+		return err
+	}
+	next, err := decodeKey("identity_key", nextKey)
+	if err != nil {
+		return err
+	}
+
+	decoded, err := decode(signature)
+	if err != nil || len(decoded) != ed25519.SignatureSize {
+		return invalid("replacing the identity key needs rotation_signature, the new key signed by the current one")
+	}
+	if !ed25519.Verify(ed25519.PublicKey(current), next, decoded) {
+		return invalid("rotation_signature does not verify against the current identity key")
+	}
+	return nil
+}
+
+// ValidatePrekeys checks single use keys
+func ValidatePrekeys(prekeys []dto.Prekey) error {
+	if len(prekeys) > MaxOneTimePrekeys {
+		return invalid("at most %d one time prekeys are kept", MaxOneTimePrekeys)
+	}
+
+	seen := map[int64]bool{}
+	for _, prekey := range prekeys {
+		if seen[prekey.KeyId] {
+			return invalid("one time prekey id %d is used twice", prekey.KeyId)
+		}
+		seen[prekey.KeyId] = true
+
+		if _, err := decodeKey("one_time_prekeys.public_key", prekey.PublicKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidatePayload checks the envelope of an encrypted message without
+// reading it
+func ValidatePayload(payload dto.EncryptedPayload) error {
+	nonceSize, ok := Algorithms[payload.Algorithm]
+	if !ok {
+		return invalid("alg %q is not supported", payload.Algorithm)
+	}
+
+	if _, err := decodeKey("sender_key", payload.SenderKey); err != nil {
+		return err
+	}
+	if _, err := decodeKey("ephemeral_key", payload.EphemeralKey); err != nil {
+		return err
+	}
+
+	nonce, err := decode(payload.Nonce)
+	if err != nil || len(nonce) != nonceSize {
+		return invalid("nonce must be %d base64 bytes for %s", nonceSize, payload.Algorithm)
+	}
+
+	ciphertext, err := decode(payload.Ciphertext)
+	if err != nil {
+		return invalid("ciphertext must be base64")
+	}
+	if len(ciphertext) < tagSize || len(ciphertext) > MaxCiphertextSize {
+		return invalid("ciphertext must be between %d and %d bytes", tagSize, MaxCiphertextSize)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package e2e
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"testing"
+)
+
+func newIdentity(t *testing.T) (string, ed25519.PrivateKey) {
+	t.Helper()
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(public), private
+}
+
+func sign(private ed25519.PrivateKey, key string) string {
+	decoded, _ := base64.StdEncoding.DecodeString(key)
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(private, decoded))
+}
+
+func TestValidateRotation(t *testing.T) {
+	current, currentPrivate := newIdentity(t)
+	next, nextPrivate := newIdentity(t)
+
+	if err := ValidateRotation(current, next, sign(currentPrivate, next)); err != nil {
+		t.Fatalf("rotation signed by the current key: %v", err)
+	}
+
+	cases := map[string]string{
+		"missing signature":      "",
+		"signed by the new key":  sign(nextPrivate, next),
+		"signature of other key": sign(currentPrivate, current),
+		"not base64":             "!!",
+	}
+	for name, signature := range cases {
+		err := ValidateRotation(current, next, signature)
+		var invalidErr *InvalidError
+		if !errors.As(err, &invalidErr) {
+			t.Errorf("%s: got %v, want an InvalidError", name, err)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package geoip
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// CachedProvider bounds the time spent in another provider and caches its
+// answers. Lookups never take longer than the timeout, a slow provider
+// yields an empty location. Concurrent lookups of an ip share one call to
+// the provider, whose answer is cached even when it came too late.
+type CachedProvider struct {
+	provider Provider
+	timeout  time.Duration
+	ttl      time.Duration
+	size     int
+	flights  singleflight.Group
+
+	mutex   sync.Mutex
+	order   *list.List // most recently used first
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	ip        string
+	location  Location
+	expiresAt time.Time
+}
+
+// NewCachedProvider wraps provider, keeping at most size answers for ttl
+func NewCachedProvider(provider Provider, timeout time.Duration, ttl time.Duration, size int) *CachedProvider {
+	return &CachedProvider{
+		provider: provider,
+		timeout:  timeout,
+		ttl:      ttl,
+		size:     size,
+		order:    list.New(),
+		entries:  map[string]*list.Element{},
+	}
+}
+
+func (p *CachedProvider) Lookup(ctx context.Context, ip string) (Location, error) {
+	if location, ok := p.get(ip); ok {
+		return location, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	done := p.flights.DoChan(ip, func() (interface{}, error) {
+		// The call outlives the request that started it, which may give up
+		// or finish before it, so it only keeps the timeout
+		lookupCtx, cancelLookup := context.WithTimeout(context.Background(), p.timeout)
+		defer cancelLookup()
+
+		location, err := p.provider.Lookup(lookupCtx, ip)
+		if err != nil {
+			return Location{}, err
+		}
+		p.put(ip, location)
+		return location, nil
+	})
+
+	select {
+	case <-ctx.Done():
+		return Location{}, ctx.Err()
+	case res := <-done:
+		if res.Err != nil {
+			return Location{}, res.Err
+		}
+		return res.Val.(Location), nil
+	}
+}
+
+func (p *CachedProvider) get(ip string) (Location, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	element, ok := p.entries[ip]
+	if !ok {
+		return Location{}, false
+	}
+
+	entry := element.Value.(*cacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		p.order.Remove(element)
+		delete(p.entries, ip)
+		return Location{}, false
+	}
+
+	p.order.MoveToFront(element)
+	return entry.location, true
+}
+
+func (p *CachedProvider) put(ip string, location Location) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if element, ok := p.entries[ip]; ok {
+		p.order.Remove(element)
+	}
+
+	p.entries[ip] = p.order.PushFront(&cacheEntry{
+		ip:        ip,
+		location:  location,
+		expiresAt: time.Now().Add(p.ttl),
+	})
+
+	for p.order.Len() > p.size {
+		oldest := p.order.Back()
+		p.order.Remove(oldest)
+		delete(p.entries, oldest.Value.(*cacheEntry).ip)
+	}
+}
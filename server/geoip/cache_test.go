@@ -0,0 +1,168 @@
+package geoip
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowProvider answers after delay, ignoring ctx like a local database
+// lookup would, and counts its calls
+type slowProvider struct {
+	delay time.Duration
+	err   error
+
+	mutex sync.Mutex
+	calls int
+}
+
+func (p *slowProvider) Lookup(ctx context.Context, ip string) (Location, error) {
+	p.mutex.Lock()
+	p.calls++
+	p.mutex.Unlock()
+
+	time.Sleep(p.delay)
+	if p.err != nil {
+		return Location{}, p.err
+	}
+	return Location{City: "city of " + ip}, nil
+}
+
+func (p *slowProvider) Calls() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.calls
+}
+
+func TestCachedProvider(t *testing.T) {
+	errLookup := errors.New("lookup failed")
+
+	// step is a lookup made after waiting for wait
+	type step struct {
+		wait      time.Duration
+		ip        string
+		wantErr   error
+		wantCalls int // calls to the provider so far
+	}
+	tests := []struct {
+		name     string
+		provider *slowProvider
+		timeout  time.Duration
+		ttl      time.Duration
+		size     int
+		steps    []step
+	}{
+		{
+			name:     "answers are cached",
+			provider: &slowProvider{},
+			timeout:  time.Second, ttl: time.Hour, size: 10,
+			steps: []step{
+				{ip: "1.1.1.1", wantCalls: 1},
+				{ip: "1.1.1.1", wantCalls: 1},
+				{ip: "2.2.2.2", wantCalls: 2},
+			},
+		},
+		{
+			name:     "slow provider times out and its late answer is cached",
+			provider: &slowProvider{delay: 100 * time.Millisecond},
+			timeout:  20 * time.Millisecond, ttl: time.Hour, size: 10,
+			steps: []step{
+				{ip: "1.1.1.1", wantErr: context.DeadlineExceeded, wantCalls: 1},
+				{wait: 150 * time.Millisecond, ip: "1.1.1.1", wantCalls: 1},
+			},
+		},
+		{
+			name:     "entries expire after the ttl",
+			provider: &slowProvider{},
+			timeout:  time.Second, ttl: 50 * time.Millisecond, size: 10,
+			steps: []step{
+				{ip: "1.1.1.1", wantCalls: 1},
+				{ip: "1.1.1.1", wantCalls: 1},
+				{wait: 80 * time.Millisecond, ip: "1.1.1.1", wantCalls: 2},
+			},
+		},
+		{
+			name:     "least recently used entry is evicted",
+			provider: &slowProvider{},
+			timeout:  time.Second, ttl: time.Hour, size: 2,
+			steps: []step{
+				{ip: "1.1.1.1", wantCalls: 1},
+				{ip: "2.2.2.2", wantCalls: 2},
+				{ip: "1.1.1.1", wantCalls: 2},
+				{ip: "3.3.3.3", wantCalls: 3},
+				{ip: "1.1.1.1", wantCalls: 3},
+				{ip: "2.2.2.2", wantCalls: 4},
+			},
+		},
+		{
+			name:     "errors are not cached",
+			provider: &slowProvider{err: errLookup},
+			timeout:  time.Second, ttl: time.Hour, size: 10,
+			steps: []step{
+				{ip: "1.1.1.1", wantErr: errLookup, wantCalls: 1},
+				{ip: "1.1.1.1", wantErr: errLookup, wantCalls: 2},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cache := NewCachedProvider(test.provider, test.timeout, test.ttl, test.size)
+			for i, step := range test.steps {
+				time.Sleep(step.wait)
+
+				location, err := cache.Lookup(context.Background(), step.ip)
+				if !errors.Is(err, step.wantErr) {
+					t.Fatalf("step %d: Lookup(%s) error = %v, want %v", i, step.ip, err, step.wantErr)
+				}
+				if err == nil && location.City != "city of "+step.ip {
+					t.Fatalf("step %d: Lookup(%s) = %+v", i, step.ip, location)
+				}
+				if calls := test.provider.Calls(); calls != step.wantCalls {
+					t.Fatalf("step %d: provider called %d times, want %d", i, calls, step.wantCalls)
+				}
+			}
+		})
+	}
+}
+
+func TestCachedProviderMergesConcurrentLookups(t *testing.T) {
+	provider := &slowProvider{delay: 50 * time.Millisecond}
+	cache := NewCachedProvider(provider, time.Second, time.Hour, 10)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := cache.Lookup(context.Background(), "1.1.1.1"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if calls := provider.Calls(); calls != 1 {
+		t.Fatalf("provider called %d times for one ip, want once", calls)
+	}
+}
+
+func TestCachedProviderHonorsTheCallerContext(t *testing.T) {
+	provider := &slowProvider{delay: 100 * time.Millisecond}
+	cache := NewCachedProvider(provider, time.Second, time.Hour, 10)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := cache.Lookup(ctx, "1.1.1.1"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Lookup with a canceled context = %v, want context.Canceled", err)
+	}
+
+	// The lookup it started still completes for the next caller
+	if _, err := cache.Lookup(context.Background(), "1.1.1.1"); err != nil {
+		t.Fatal(err)
+	}
+	if calls := provider.Calls(); calls != 1 {
+		t.Fatalf("provider called %d times, want once", calls)
+	}
+}
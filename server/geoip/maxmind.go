@@ -0,0 +1,71 @@
+package geoip
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// MaxMindProvider looks addresses up in a local MaxMind format (mmdb) city
+// database such as GeoLite2-City
+type MaxMindProvider struct {
+	reader *maxminddb.Reader
+}
+
+// cityRecord is the subset of a GeoIP2/GeoLite2 city record we read
+type cityRecord struct {
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Country struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+	Location struct {
+		Latitude  float64 `maxminddb:"latitude"`
+		Longitude float64 `maxminddb:"longitude"`
+	} `maxminddb:"location"`
+}
+
+// OpenMaxMind memory maps the database at path
+func OpenMaxMind(path string) (*MaxMindProvider, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("geoip: opening %s: %w", path, err)
+	}
+
+	return &MaxMindProvider{reader: reader}, nil
+}
+
+func (p *MaxMindProvider) Lookup(ctx context.Context, ip string) (Location, error) {
+	parsed, public, err := parsePublicIP(ip)
+	if err != nil || !public {
+		return Location{}, err
+	}
+
+	var record cityRecord
+	if err := p.reader.Lookup(parsed, &record); err != nil {
+		return Location{}, fmt.Errorf("geoip: looking up %s: %w", ip, err)
+	}
+
+	location := Location{
+		City:    record.City.Names["en"],
+		Country: record.Country.IsoCode,
+	}
+	if len(record.Subdivisions) > 0 {
+		location.Region = record.Subdivisions[0].Names["en"]
+	}
+	if record.Location.Latitude != 0 || record.Location.Longitude != 0 {
+		location.Coords = fmt.Sprintf("%.4f,%.4f", record.Location.Latitude, record.Location.Longitude)
+	}
+
+	return location, nil
+}
+
+// Close unmaps the database
+func (p *MaxMindProvider) Close() error {
+	return p.reader.Close()
+}
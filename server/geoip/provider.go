@@ -0,0 +1,50 @@
+// Package geoip resolves IP addresses to coarse locations for user
+// registration. Lookups are local, the default provider reads a MaxMind
+// format database file.
+package geoip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// Location is what registration stores about where a user connects from
+type Location struct {
+	City    string
+	Region  string
+	Country string
+	Coords  string // "latitude,longitude"
+}
+
+// Provider resolves an IP address to a location
+type Provider interface {
+	Lookup(ctx context.Context, ip string) (Location, error)
+}
+
+// ErrInvalidIP is returned for addresses that cannot be parsed
+var ErrInvalidIP = errors.New("geoip: invalid ip address")
+
+// NoopProvider resolves every address to an empty location
+type NoopProvider struct{}
+
+func (NoopProvider) Lookup(ctx context.Context, ip string) (Location, error) {
+	return Location{}, nil
+}
+
+// parsePublicIP parses ip, ok is false for private, loopback and other
+// addresses no database knows about
+func parsePublicIP(ip string) (net.IP, bool, error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return nil, false, fmt.Errorf("%w: %q", ErrInvalidIP, ip)
+	}
+
+	if parsed.IsPrivate() || parsed.IsLoopback() || parsed.IsUnspecified() ||
+		parsed.IsLinkLocalUnicast() || parsed.IsLinkLocalMulticast() {
+		return parsed, false, nil
+	}
+
+	return parsed, true, nil
+}
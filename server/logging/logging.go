@@ -0,0 +1,141 @@
+// Package logging configures the structured logger of the server. Every
+// package logs through log/slog; request handlers use the logger carried by
+// their context, which the api middleware tags with the request and user.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Formats of the log output
+const (
+	FormatJSON = "json"
+	FormatText = "text"
+)
+
+// ParseLevel reads a level name: debug, info, warn or error
+func ParseLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return 0, fmt.Errorf("unknown log level %q, use debug, info, warn or error", name)
+	}
+	return level, nil
+}
+
+// Setup makes the default slog logger, and the standard log package, write
+// records of level and above to w in format
+func Setup(w io.Writer, level string, format string) error {
+	parsed, err := ParseLevel(level)
+	if err != nil {
+		return err
+	}
+
+	options := &slog.HandlerOptions{Level: parsed}
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case FormatJSON:
+		handler = slog.NewJSONHandler(w, options)
+	case FormatText:
+		handler = slog.NewTextHandler(w, options)
+	default:
+		return fmt.Errorf("unknown log format %q, use json or text", format)
+	}
+
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+type contextKey struct{}
+
+// With returns a copy of ctx carrying logger
+func With(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+// From returns the logger carried by ctx, or the default logger
+func From(ctx context.Context) *slog.Logger {
+	if ctx != nil {
+		if logger, ok := ctx.Value(contextKey{}).(*slog.Logger); ok {
+			return logger
+		}
+	}
+	return slog.Default()
+}
+
+// Sampler lets through the first burst records of each message every
+// period and drops the rest, for events that can flood the log such as
+// sockets connecting. The next record let through counts the dropped ones.
+// Errors are never dropped.
+type Sampler struct {
+	burst  int
+	period time.Duration
+
+	mutex   sync.Mutex
+	windows map[string]*window
+}
+
+type window struct {
+	start   time.Time
+	logged  int
+	dropped int
+}
+
+// Noisy samples the records of realtime connections
+var Noisy = NewSampler(10, time.Second)
+
+// NewSampler returns a sampler allowing burst records of a message per
+// period
+func NewSampler(burst int, period time.Duration) *Sampler {
+	return &Sampler{burst: burst, period: period, windows: make(map[string]*window)}
+}
+
+// allow reports whether a record of msg is let through at now, with the
+// number of records dropped since the last one
+func (s *Sampler) allow(msg string, now time.Time) (bool, int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	current, ok := s.windows[msg]
+	if !ok || now.Sub(current.start) >= s.period {
+		dropped := 0
+		if ok {
+			dropped = current.dropped
+		}
+		s.windows[msg] = &window{start: now, logged: 1}
+		return true, dropped
+	}
+
+	if current.logged >= s.burst {
+		current.dropped++
+		return false, 0
+	}
+	current.logged++
+	return true, 0
+}
+
+// Log writes a record through logger unless too many with the same message
+// were written this period, errors are always written
+func (s *Sampler) Log(ctx context.Context, logger *slog.Logger, level slog.Level, msg string, args ...any) {
+	if !logger.Enabled(ctx, level) {
+		return
+	}
+	if level >= slog.LevelError {
+		logger.Log(ctx, level, msg, args...)
+		return
+	}
+
+	ok, dropped := s.allow(msg, time.Now())
+	if !ok {
+		return
+	}
+	if dropped > 0 {
+		args = append(args, "dropped", dropped)
+	}
+	logger.Log(ctx, level, msg, args...)
+}
@@ -0,0 +1,153 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+// records decodes the JSON records written to buf
+func records(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+
+	result := []map[string]any{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		record := map[string]any{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("decoding %q: %v", line, err)
+		}
+		result = append(result, record)
+	}
+	return result
+}
+
+func TestParseLevel(t *testing.T) {
+	tests := []struct {
+		name  string
+		level slog.Level
+		valid bool
+	}{
+		{"debug", slog.LevelDebug, true},
+		{"INFO", slog.LevelInfo, true},
+		{"warn", slog.LevelWarn, true},
+		{"error", slog.LevelError, true},
+		{"verbose", 0, false},
+		{"", 0, false},
+	}
+	for _, test := range tests {
+		level, err := ParseLevel(test.name)
+		if (err == nil) != test.valid || (test.valid && level != test.level) {
+			t.Errorf("ParseLevel(%q) = %v, %v, want %v, valid %v", test.name, level, err, test.level, test.valid)
+		}
+	}
+}
+
+func TestSetupRejectsUnknownFormats(t *testing.T) {
+	previous := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(previous) })
+
+	var buf bytes.Buffer
+	if err := Setup(&buf, "info", "xml"); err == nil {
+		t.Fatal("an unknown format was accepted")
+	}
+	if err := Setup(&buf, "loud", FormatJSON); err == nil {
+		t.Fatal("an unknown level was accepted")
+	}
+
+	if err := Setup(&buf, "warn", FormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	slog.Info("left out")
+	slog.Warn("written", "key", "value")
+	got := records(t, &buf)
+	if len(got) != 1 || got[0]["msg"] != "written" || got[0]["key"] != "value" {
+		t.Fatalf("wrote %v, want the warning only", got)
+	}
+}
+
+func TestContextCarriesLogger(t *testing.T) {
+	if From(context.Background()) != slog.Default() {
+		t.Fatal("a context without a logger did not fall back to the default")
+	}
+
+	logger := slog.New(slog.NewJSONHandler(&bytes.Buffer{}, nil)).With("request_id", "abc")
+	if From(With(context.Background(), logger)) != logger {
+		t.Fatal("the logger put in the context was not returned")
+	}
+}
+
+func TestSamplerAllow(t *testing.T) {
+	sampler := NewSampler(2, time.Second)
+	start := time.Now()
+
+	tests := []struct {
+		name    string
+		msg     string
+		at      time.Duration
+		allowed bool
+		dropped int
+	}{
+		{"first", "connected", 0, true, 0},
+		{"within the burst", "connected", 100 * time.Millisecond, true, 0},
+		{"past the burst", "connected", 200 * time.Millisecond, false, 0},
+		{"past the burst again", "connected", 300 * time.Millisecond, false, 0},
+		{"other message", "closed", 400 * time.Millisecond, true, 0},
+		{"next period counts the dropped", "connected", time.Second, true, 2},
+		{"dropped are counted once", "connected", 1100 * time.Millisecond, true, 0},
+		{"quiet period", "connected", 3 * time.Second, true, 0},
+	}
+	for _, test := range tests {
+		allowed, dropped := sampler.allow(test.msg, start.Add(test.at))
+		if allowed != test.allowed || dropped != test.dropped {
+			t.Errorf("%s: allow = %v, %d, want %v, %d", test.name, allowed, dropped, test.allowed, test.dropped)
+		}
+	}
+}
+
+func TestSamplerLog(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	sampler := NewSampler(2, 50*time.Millisecond)
+	ctx := context.Background()
+
+	for i := 0; i < 5; i++ {
+		sampler.Log(ctx, logger, slog.LevelInfo, "Socket opened", "i", i)
+		sampler.Log(ctx, logger, slog.LevelError, "Socket failed", "i", i)
+		// Disabled levels are neither written nor counted
+		sampler.Log(ctx, logger, slog.LevelDebug, "Socket opened", "i", i)
+	}
+	time.Sleep(60 * time.Millisecond)
+	sampler.Log(ctx, logger, slog.LevelInfo, "Socket opened", "i", 5)
+
+	opened, failed := []map[string]any{}, 0
+	for _, record := range records(t, &buf) {
+		switch record["msg"] {
+		case "Socket opened":
+			opened = append(opened, record)
+		case "Socket failed":
+			failed++
+		}
+	}
+
+	if failed != 5 {
+		t.Errorf("wrote %d of 5 errors, errors must never be sampled", failed)
+	}
+	if len(opened) != 3 {
+		t.Fatalf("wrote %d info records, want the burst of 2 and the first of the next period", len(opened))
+	}
+	for i, want := range []float64{0, 1, 5} {
+		if opened[i]["i"] != want {
+			t.Errorf("info record %d is %v, want %v", i, opened[i]["i"], want)
+		}
+	}
+	if opened[0]["dropped"] != nil || opened[2]["dropped"] != float64(3) {
+		t.Errorf("dropped counts %v and %v, want none and 3", opened[0]["dropped"], opened[2]["dropped"])
+	}
+}
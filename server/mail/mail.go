@@ -0,0 +1,113 @@
+// Package mail sends the emails of the server, e.g. login codes.
+package mail
+
+import (
+	"context"
+	"fmt"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sender delivers emails
+type Sender interface {
+	Send(ctx context.Context, message Message) error
+}
+
+// SMTPSender delivers emails through an SMTP relay
+type SMTPSender struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+// NewSMTPSender creates a sender for the relay at host:port. Authentication
+// is skipped when username is empty.
+func NewSMTPSender(host string, port string, username string, password string, from string) *SMTPSender {
+	sender := &SMTPSender{addr: host + ":" + port, from: from}
+	if username != "" {
+		sender.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return sender
+}
+
+func (s *SMTPSender) Send(ctx context.Context, message Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return smtp.SendMail(s.addr, s.auth, s.from, []string{message.To}, format(s.from, message))
+}
+
+// FileSender writes every email to its own file in a directory, for local
+// development without a relay
+type FileSender struct {
+	dir string
+}
+
+// NewFileSender creates a sender writing to dir, creating it when missing
+func NewFileSender(dir string) (*FileSender, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &FileSender{dir: dir}, nil
+}
+
+func (s *FileSender) Send(ctx context.Context, message Message) error {
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), sanitize(message.To))
+	return os.WriteFile(filepath.Join(s.dir, name), format("", message), 0o600)
+}
+
+// MemorySender keeps emails in memory instead of sending them
+type MemorySender struct {
+	mutex    sync.Mutex
+	messages []Message
+}
+
+func (s *MemorySender) Send(ctx context.Context, message Message) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.messages = append(s.messages, message)
+	return nil
+}
+
+// Sent returns the emails sent so far
+func (s *MemorySender) Sent() []Message {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return append([]Message(nil), s.messages...)
+}
+
+func format(from string, message Message) []byte {
+	var b strings.Builder
+	if from != "" {
+		b.WriteString("From: " + from + "\r\n")
+	}
+	b.WriteString("To: " + message.To + "\r\n")
+	b.WriteString("Subject: " + message.Subject + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(message.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+func sanitize(address string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, address)
+}
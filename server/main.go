@@ -1,13 +1,27 @@
 package main
 
 import (
-	"fmt"
-	"log"
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
 	"os"
+	"os/signal"
 	"runtime"
 	"server/api"
+	"server/auth"
+	"server/config"
 	"server/db"
+	"server/geoip"
+	"server/logging"
+	"server/mail"
+	"server/metrics"
 	"server/models"
+	"server/privacy"
+	"server/push"
+	"server/tracing"
+	"strings"
+	"syscall"
 	"time"
 
 	"net/http"
@@ -16,14 +30,45 @@ import (
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
+	"github.com/gofiber/fiber/v2/middleware/recover"
 	"github.com/gofiber/fiber/v2/middleware/requestid"
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func main() {
-	// Launch pprof in a different goroutine
+	godotenv.Load(".env")
+
+	cfg, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fatal("Loading configuration failed", err)
+	}
+	if err := logging.Setup(os.Stdout, cfg.Log.Level, cfg.Log.Format); err != nil {
+		fatal("Setting up logging failed", err)
+	}
+	slog.Info("Effective configuration", "config", cfg.Redacted())
+
+	// Spans are exported when OTEL_EXPORTER_OTLP_ENDPOINT is set
+	stopTracing := func(context.Context) error { return nil }
+	if cfg.Tracing.Endpoint != "" {
+		exporter, err := tracing.NewOTLPExporter(context.Background(), cfg.Tracing.Endpoint)
+		if err != nil {
+			fatal("Setting up tracing failed", err)
+		}
+		stopTracing = tracing.Setup(exporter, cfg.Tracing.ServiceName, cfg.Tracing.SampleRatio)
+	}
+
+	// Launch pprof and /metrics in a different goroutine, unless PPROF_ADDR is empty
+	pprofServer := &http.Server{Addr: cfg.Server.PprofAddr}
 	go func() {
+		if pprofServer.Addr == "" {
+			return
+		}
+
 		router := mux.NewRouter()
 
 		router.HandleFunc(
@@ -56,59 +101,291 @@ func main() {
 		router.Handle(
 			"/debug/vars", http.DefaultServeMux,
 		)
+		router.Handle(
+			"/metrics", promhttp.Handler(),
+		)
 
-		http.ListenAndServe(":6060", router)
+		pprofServer.Handler = router
+		if err := pprofServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.Error("pprof server stopped", "err", err)
+		}
 	}()
 
-	godotenv.Load(".env")
+	app := fiber.New(fiber.Config{
+		ErrorHandler: api.ErrorHandler,
+		// The banner is not structured, the listen address is logged instead
+		DisableStartupMessage: true,
+	})
+
+	// Request ids first so every error body and log record can carry one,
+	// then the span whose trace id is logged along
+	app.Use(requestid.New())
+	app.Use(api.Trace)
+	app.Use(api.RequestLogger)
+
+	// Time every request, including those failing in the middlewares below
+	app.Use(api.Instrument)
 
-	app := fiber.New()
+	// Turn panics in handlers into 500 responses instead of crashing the process
+	app.Use(recover.New())
 
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowHeaders: "Origin, Content-Type, Accept, Authorization, X-Id",
-		AllowMethods: "GET, POST, PUT, DELETE, PATCH, HEAD",
-	}))
+	// Without CORS_ORIGINS browsers only call the API from its own origin,
+	// the middleware would allow any origin for an empty list
+	if len(cfg.Server.CORSOrigins) > 0 {
+		app.Use(cors.New(cors.Config{
+			AllowOrigins: strings.Join(cfg.Server.CORSOrigins, ", "),
+			AllowHeaders: "Origin, Content-Type, Accept, Authorization, X-Id",
+			AllowMethods: "GET, POST, PUT, DELETE, PATCH, HEAD",
+		}))
+	}
 
 	// Connect redis DB
-	// db.RedisInit()
+	// db.RedisInit(cfg.Redis.URL)
 
 	// Connect Mongo DB
+	if err := db.MongoConnect(cfg.Mongo.URL, cfg.Mongo.Database); err != nil {
+		fatal("Connecting to Mongo failed", err)
+	}
+
 	messageCollection, ctx := db.MongoInit("messages")
 	models.CreateMessageService(messageCollection, ctx)
 
 	usersCollection, ctx := db.MongoInit("users")
 	models.CreateUserService(usersCollection, ctx)
 
-	app.Use(requestid.New())
+	conversationsCollection, ctx := db.MongoInit("conversations")
+	models.CreateConversationService(conversationsCollection, ctx)
 
-	// Setup APIs
-	api.SetupRoutes(app)
+	mentionsCollection, ctx := db.MongoInit("mentions")
+	models.CreateMentionService(mentionsCollection, ctx)
+
+	pushCollection, ctx := db.MongoInit("push_subscriptions")
+	models.CreatePushService(pushCollection, ctx)
+
+	keysCollection, ctx := db.MongoInit("key_bundles")
+	models.CreateKeyService(keysCollection, ctx)
+
+	readMarkersCollection, ctx := db.MongoInit("read_markers")
+	models.CreateReadMarkerService(readMarkersCollection, ctx)
+
+	accessTokensCollection, ctx := db.MongoInit("access_tokens")
+	models.CreateAccessTokenService(accessTokensCollection, ctx)
+	models.SetAccessTokenTTL(cfg.Auth.AccessTokenTTL)
+
+	loginsCollection, ctx := db.MongoInit("logins")
+	models.CreateLoginService(loginsCollection, ctx)
+
+	if err := models.EnsureUsernameIndex(); err != nil {
+		slog.Error("Username index setup failed", "err", err)
+	}
+
+	if err := models.EnsureIdentityIndex(); err != nil {
+		slog.Error("Identity index setup failed", "err", err)
+	}
+
+	if err := models.EnsureIpHashIndex(); err != nil {
+		slog.Error("IP hash index setup failed", "err", err)
+	}
+
+	if err := models.EnsureConversationIndex(); err != nil {
+		slog.Error("Conversation index setup failed", "err", err)
+	}
+
+	if err := models.EnsureMentionIndex(); err != nil {
+		slog.Error("Mention index setup failed", "err", err)
+	}
+
+	if err := models.EnsurePushIndex(); err != nil {
+		slog.Error("Push subscription index setup failed", "err", err)
+	}
+
+	if err := models.EnsureReadMarkerIndex(); err != nil {
+		slog.Error("Read marker index setup failed", "err", err)
+	}
+
+	if err := models.EnsureAccessTokenIndex(); err != nil {
+		slog.Error("Access token index setup failed", "err", err)
+	}
+
+	if err := models.EnsureLoginIndex(); err != nil {
+		slog.Error("Login index setup failed", "err", err)
+	}
+
+	if err := models.EnsureMessagePreImages(); err != nil {
+		slog.Error("Message pre-image setup failed", "err", err)
+	}
+
+	// Web Push needs a stable VAPID key, generate one with `go run ./cmd/vapidkey`
+	if cfg.Push.VAPIDPrivateKey != "" {
+		vapid, err := push.NewVAPID(cfg.Push.VAPIDPrivateKey, cfg.Push.VAPIDSubject)
+		if err != nil {
+			fatal("Invalid VAPID_PRIVATE_KEY", err)
+		}
+
+		hosts := push.DefaultEndpointHosts
+		if len(cfg.Push.EndpointHosts) > 0 {
+			hosts = cfg.Push.EndpointHosts
+		}
+		models.SetPushSender(push.NewSender(vapid, hosts))
+	} else {
+		slog.Warn("VAPID_PRIVATE_KEY not set, push notifications disabled")
+	}
+
+	// Sign in with Google upgrades anonymous users, enabled when GOOGLE_CLIENT_ID is set
+	if cfg.Google.ClientId != "" {
+		google, err := auth.NewOIDCProvider(context.Background(), auth.OIDCConfig{
+			Name:         "google",
+			Issuer:       cfg.Google.Issuer,
+			ClientId:     cfg.Google.ClientId,
+			ClientSecret: cfg.Google.ClientSecret,
+			RedirectURL:  cfg.Google.RedirectURL,
+			JWKSURL:      cfg.Google.JWKSURL,
+			AuthURL:      cfg.Google.AuthURL,
+			TokenURL:     cfg.Google.TokenURL,
+		})
+		if err != nil {
+			slog.Error("Sign in with Google disabled", "err", err)
+		} else {
+			api.RegisterAuthProvider(google)
+		}
+	}
+
+	// Email login sends codes through SMTP_HOST, or writes them to MAIL_DIR during development
+	if cfg.Mail.SMTPHost != "" {
+		sender := mail.NewSMTPSender(cfg.Mail.SMTPHost, cfg.Mail.SMTPPort, cfg.Mail.SMTPUsername, cfg.Mail.SMTPPassword, cfg.Mail.SMTPFrom)
+		api.EnableEmailLogin(sender, cfg.Server.PublicURL)
+	} else if cfg.Mail.Dir != "" {
+		sender, err := mail.NewFileSender(cfg.Mail.Dir)
+		if err != nil {
+			slog.Error("Email login disabled", "err", err)
+		} else {
+			api.EnableEmailLogin(sender, cfg.Server.PublicURL)
+		}
+	}
+
+	// Comma separated URL prefixes a finished sign in may redirect to, e.g. https://<extension-id>.chromiumapp.org/
+	if len(cfg.Auth.LoginRedirectPrefixes) > 0 {
+		api.SetAllowedLoginRedirects(cfg.Auth.LoginRedirectPrefixes)
+	}
+
+	// Avatar links are absolute when the public URL of the server is known
+	models.SetAvatarBaseURL(cfg.Server.PublicURL)
+
+	// Store ips as keyed hashes, IP_HASH_KEYS is a ring "id:base64secret,..." with the current key first
+	ipHashKeys, err := privacy.ParseIPHashKeys(cfg.Privacy.IPHashKeys)
+	if err != nil {
+		fatal("Invalid IP_HASH_KEYS", err)
+	}
+	if len(ipHashKeys) == 0 {
+		slog.Warn("IP_HASH_KEYS not set, ip hashes will not match across restarts")
+		ipHashKeys = append(ipHashKeys, privacy.EphemeralKey())
+	}
+	ipHasher, err := privacy.NewIPHasher(ipHashKeys...)
+	if err != nil {
+		fatal("Invalid IP_HASH_KEYS", err)
+	}
+
+	// Raw ips are not stored unless IP_RETENTION (e.g. "72h") is set
+	models.SetIpPrivacy(ipHasher, cfg.Privacy.IPRetention)
+
+	// Websockets are pinged every HEARTBEAT_INTERVAL and closed after HEARTBEAT_TIMEOUT without a frame
+	if err := models.SetHeartbeat(cfg.Realtime.HeartbeatInterval, cfg.Realtime.HeartbeatTimeout); err != nil {
+		fatal("Invalid heartbeat", err)
+	}
+
+	if migrated, err := models.MigrateUserNetworkData(); err != nil {
+		slog.Error("User network data migration failed", "err", err)
+	} else if migrated > 0 {
+		slog.Info("Migrated network data", "users", migrated)
+	}
 
 	go func() {
-		// Create a ticker that triggers every 5 seconds
-		ticker := time.NewTicker(5 * time.Minute)
+		ticker := time.NewTicker(time.Hour)
 		defer ticker.Stop()
 
-		// Infinite loop to print the number of Goroutines
 		for range ticker.C {
-			// Get the number of running Goroutines
-			numGoroutines := runtime.NumGoroutine()
-			fmt.Printf("Number of Running Goroutines: %d\n", numGoroutines)
+			if purged, err := models.PurgeExpiredNetworkData(); err != nil {
+				slog.Error("Purging expired network data failed", "err", err)
+			} else if purged > 0 {
+				slog.Info("Purged expired network data", "users", purged)
+			}
+		}
+	}()
 
+	// Resolve locations of new users from a local MaxMind database, if configured
+	if cfg.GeoIP.DBPath != "" {
+		geoipProvider, err := geoip.OpenMaxMind(cfg.GeoIP.DBPath)
+		if err != nil {
+			slog.Error("GeoIP disabled", "err", err)
+		} else {
+			defer geoipProvider.Close()
+			models.SetLocationProvider(geoip.NewCachedProvider(geoipProvider, 200*time.Millisecond, time.Hour, 10000))
+		}
+	}
+
+	// Setup APIs
+	api.SetupRoutes(app, api.NewChatController(cfg.Chat.MaxMessageLength, cfg.Chat.PageSize))
+
+	// Refuse to start when the served OpenAPI document does not match the handlers
+	if err := api.VerifyOpenAPI(app, api.V1Prefix, api.OpenAPI()); err != nil {
+		fatal("OpenAPI document does not match the routes", err)
+	}
+
+	// The goroutine count and the rest of the runtime are on /metrics
+	metrics.WatchSockets(db.SocketsPerChannel)
+
+	// GOMAXPROCS defaults to every available CPU core
+	if cfg.Server.MaxProcs > 0 {
+		runtime.GOMAXPROCS(cfg.Server.MaxProcs)
+	}
+	slog.Info("CPUs", "cores", runtime.NumCPU(), "gomaxprocs", runtime.GOMAXPROCS(0))
+
+	// A change stream that fails shuts the server down like a signal, with
+	// a failing exit code
+	changesCtx, stopChanges := context.WithCancel(context.Background())
+	changesDone := make(chan struct{})
+	changesErr := make(chan error, 1)
+	go func() {
+		defer close(changesDone)
+		// The stream returns nil when it is stopped, which is no failure
+		if err := models.ListenAllChanges(changesCtx); err != nil {
+			changesErr <- err
 		}
 	}()
 
-	// Set GOMAXPROCS to utilize all available CPU cores
-	maxCores := runtime.NumCPU()
-	fmt.Printf("maxCores value: %d\n", maxCores)
+	// Drop sockets whose clients stopped answering so presence does not go stale
+	go models.ReapPresence()
 
-	runtime.GOMAXPROCS(8)
-	fmt.Printf("Updated GOMAXPROCS value: %d\n", runtime.GOMAXPROCS(0))
+	go func() {
+		slog.Info("Listening", "port", cfg.Server.Port)
+		if err := app.Listen(":" + cfg.Server.Port); err != nil {
+			fatal("Listening failed", err)
+		}
+	}()
 
-	go models.ListenAllChanges()
+	signals, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stopSignals()
 
-	PORT := os.Getenv("PORT")
-	log.Fatal(app.Listen(":" + PORT))
+	exitCode := 0
+	select {
+	case <-signals.Done():
+		slog.Info("Shutting down")
+	case err := <-changesErr:
+		slog.Error("Change stream stopped, shutting down", "err", err)
+		exitCode = 1
+	}
+
+	// SHUTDOWN_TIMEOUT bounds the whole shutdown, clients are told to reconnect after RECONNECT_DELAY plus jitter
+	shutdown(app, pprofServer, stopChanges, changesDone, stopTracing, cfg.Server.ShutdownTimeout, cfg.Server.ReconnectDelay)
+	slog.Info("Shutdown complete")
+
+	if exitCode != 0 {
+		os.Exit(exitCode)
+	}
+}
 
+// fatal logs err and exits, for failures while starting up
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
 }
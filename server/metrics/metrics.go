@@ -0,0 +1,168 @@
+// Package metrics defines the Prometheus collectors of the server. They are
+// registered with the default registry and served on /metrics of the debug
+// server. The package imports nothing from the server so every layer can
+// record into it.
+package metrics
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "blablah"
+
+// MaxChannelLabels bounds the channels given their own series in the socket
+// gauge, the rest are summed under "other"
+const MaxChannelLabels = 20
+
+// Channel labels that are not the hash of a site, see ChannelLabel
+const (
+	ChannelDirect = "direct"
+	ChannelOther  = "other"
+)
+
+var (
+	HTTPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of HTTP requests by route template, method and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	MessagesSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_sent_total",
+		Help:      "Messages written, by kind of channel (site or direct).",
+	}, []string{"kind"})
+
+	Reactions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reactions_total",
+		Help:      "Reactions toggled on messages, by action (add or remove).",
+	}, []string{"action"})
+
+	Reports = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reports_total",
+		Help:      "Messages reported, by kind (plain or encrypted).",
+	}, []string{"kind"})
+
+	FanoutLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "fanout_latency_seconds",
+		Help:      "Time from a message insert to its write to a realtime client.",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	})
+
+	ChangeStreamLag = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "change_stream_lag_seconds",
+		Help:      "Age of the last change stream event when it was received, to the second.",
+	})
+
+	DroppedEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "realtime_dropped_events_total",
+		Help:      "Events that never reached a client, by reason (queue_full, slow_consumer or closed).",
+	}, []string{"reason"})
+
+	ReapedSockets = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "realtime_reaped_sockets_total",
+		Help:      "Sockets closed for missing heartbeats, by reason (idle or read_deadline).",
+	}, []string{"reason"})
+
+	RateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limit_rejections_total",
+		Help:      "Requests refused by a rate limit, by route template.",
+	}, []string{"route"})
+
+	MongoCommandDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "mongo_command_duration_seconds",
+		Help:      "Latency of Mongo commands by name and outcome (ok or error).",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 5},
+	}, []string{"command", "outcome"})
+)
+
+// Since returns the seconds elapsed since start
+func Since(start time.Time) float64 {
+	return time.Since(start).Seconds()
+}
+
+// socketsCollector reports the open sockets per channel when scraped
+type socketsCollector struct {
+	desc  *prometheus.Desc
+	count func() map[string]int
+}
+
+// ChannelLabel returns the label of a site channel: a short hash, so the
+// URLs users browse do not end up in the metrics. Operators find the label
+// of a known site by hashing its URL the same way.
+func ChannelLabel(site string) string {
+	sum := sha256.Sum256([]byte(site))
+	return "site:" + hex.EncodeToString(sum[:6])
+}
+
+// WatchSockets registers the gauge of open sockets per channel, count
+// returns the sockets receiving the events of each channel. Site channels
+// are labelled by ChannelLabel, those outside the MaxChannelLabels busiest
+// are reported as "other" and direct channels, which are per user, as
+// "direct".
+func WatchSockets(count func() map[string]int) {
+	prometheus.MustRegister(&socketsCollector{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "realtime_sockets"),
+			"Open realtime sockets by hashed site channel, bounded to the busiest channels.",
+			[]string{"channel"}, nil,
+		),
+		count: count,
+	})
+}
+
+func (c *socketsCollector) Describe(descs chan<- *prometheus.Desc) {
+	descs <- c.desc
+}
+
+func (c *socketsCollector) Collect(metrics chan<- prometheus.Metric) {
+	for channel, sockets := range boundChannels(c.count(), MaxChannelLabels) {
+		metrics <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(sockets), channel)
+	}
+}
+
+// boundChannels keeps the limit busiest channels of counts under their
+// ChannelLabel and folds the others into ChannelOther and ChannelDirect
+func boundChannels(counts map[string]int, limit int) map[string]int {
+	bounded := map[string]int{ChannelDirect: 0, ChannelOther: 0}
+
+	sites := make([]string, 0, len(counts))
+	for channel, sockets := range counts {
+		if strings.HasPrefix(channel, "dm:") {
+			bounded[ChannelDirect] += sockets
+			continue
+		}
+		sites = append(sites, channel)
+	}
+
+	sort.Slice(sites, func(i, j int) bool {
+		if counts[sites[i]] != counts[sites[j]] {
+			return counts[sites[i]] > counts[sites[j]]
+		}
+		return sites[i] < sites[j]
+	})
+	for i, site := range sites {
+		if i < limit {
+			bounded[ChannelLabel(site)] = counts[site]
+		} else {
+			bounded[ChannelOther] += counts[site]
+		}
+	}
+	return bounded
+}
@@ -0,0 +1,37 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBoundChannelsHidesSiteURLs(t *testing.T) {
+	counts := map[string]int{
+		"news.example/today": 5,
+		"shop.example":       3,
+		"blog.example":       1,
+		"dm:alice:bob":       2,
+	}
+
+	bounded := boundChannels(counts, 2)
+	for label := range bounded {
+		if strings.Contains(label, "example") {
+			t.Fatalf("label %q holds a site URL", label)
+		}
+	}
+
+	want := map[string]int{
+		ChannelLabel("news.example/today"): 5,
+		ChannelLabel("shop.example"):       3,
+		ChannelOther:                       1,
+		ChannelDirect:                      2,
+	}
+	if len(bounded) != len(want) {
+		t.Fatalf("got %v, want %v", bounded, want)
+	}
+	for label, sockets := range want {
+		if bounded[label] != sockets {
+			t.Fatalf("%s has %d sockets, want %d", label, bounded[label], sockets)
+		}
+	}
+}
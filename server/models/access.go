@@ -0,0 +1,167 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"server/auth"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrAccessTokenInvalid is returned for tokens that were never issued,
+// expired or were revoked
+var ErrAccessTokenInvalid = errors.New("access token is invalid or expired")
+
+// ErrAccessTokenClaimed is returned when a user that was already given an
+// access token asks for one without it
+var ErrAccessTokenClaimed = errors.New("access token was already issued to this user")
+
+// accessTokenTTL is how long a token stays valid without being used, every
+// use pushes the expiry back
+var accessTokenTTL = 180 * 24 * time.Hour
+
+// accessTokenRefresh is how stale the expiry of a token may get before a
+// use writes a new one, so busy clients do not write on every request
+const accessTokenRefresh = 24 * time.Hour
+
+// AccessTokenModel is a credential issued to a user at registration or
+// sign in. Only the hash of the token is stored.
+type AccessTokenModel struct {
+	Hash      string    `bson:"_id"`
+	UserId    string    `bson:"user_id"`
+	CreatedAt time.Time `bson:"created_at"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+type AccessTokenService struct {
+	Collection *mongo.Collection
+	ctx        context.Context
+}
+
+var accessTokenService AccessTokenService
+
+func CreateAccessTokenService(collection *mongo.Collection, ctx context.Context) {
+	accessTokenService = AccessTokenService{Collection: collection, ctx: ctx}
+}
+
+// SetAccessTokenTTL sets how long an unused access token stays valid
+func SetAccessTokenTTL(ttl time.Duration) {
+	accessTokenTTL = ttl
+}
+
+// EnsureAccessTokenIndex lets Mongo drop expired tokens and revoke the
+// tokens of a user at once
+func EnsureAccessTokenIndex() error {
+	_, err := accessTokenService.Collection.Indexes().CreateMany(accessTokenService.ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetName("expiry").SetExpireAfterSeconds(0),
+		},
+		{
+			Keys:    bson.D{{Key: "user_id", Value: 1}},
+			Options: options.Index().SetName("user"),
+		},
+	})
+	return err
+}
+
+// hashToken returns the hash stored in place of a secret token
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// IssueAccessToken creates a new token for userId, the token is only
+// returned here and cannot be recovered later
+func IssueAccessToken(userId string) (string, error) {
+	_, err := userService.Collection.UpdateOne(userService.ctx,
+		bson.M{"_id": userId, "token_issued": bson.M{"$ne": true}},
+		bson.M{"$set": bson.M{"token_issued": true}},
+	)
+	if err != nil {
+		return "", err
+	}
+	return insertAccessToken(userId)
+}
+
+// ClaimAccessToken issues the first access token of a user registered
+// before tokens existed, whose client only knows its id. Ids are public, so
+// this only works once: whoever claims first holds the user, and users that
+// were ever given a token get ErrAccessTokenClaimed and must sign in.
+func ClaimAccessToken(userId string) (string, error) {
+	result, err := userService.Collection.UpdateOne(userService.ctx,
+		bson.M{"_id": userId, "token_issued": bson.M{"$ne": true}},
+		bson.M{"$set": bson.M{"token_issued": true}},
+	)
+	if err != nil {
+		return "", err
+	}
+	if result.MatchedCount == 0 {
+		return "", ErrAccessTokenClaimed
+	}
+	return insertAccessToken(userId)
+}
+
+// insertAccessToken stores a new token of userId and returns it
+func insertAccessToken(userId string) (string, error) {
+	token := auth.RandomToken()
+	now := time.Now()
+
+	_, err := accessTokenService.Collection.InsertOne(accessTokenService.ctx, AccessTokenModel{
+		Hash:      hashToken(token),
+		UserId:    userId,
+		CreatedAt: now,
+		ExpiresAt: now.Add(accessTokenTTL),
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// AccessTokenUser returns the id of the user token was issued to
+func AccessTokenUser(token string) (string, error) {
+	if token == "" {
+		return "", ErrAccessTokenInvalid
+	}
+
+	hash := hashToken(token)
+	var stored AccessTokenModel
+	err := accessTokenService.Collection.FindOne(accessTokenService.ctx, bson.M{"_id": hash}).Decode(&stored)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return "", ErrAccessTokenInvalid
+		}
+		return "", err
+	}
+
+	// The TTL monitor runs once a minute, expired tokens can still be found
+	now := time.Now()
+	if now.After(stored.ExpiresAt) {
+		return "", ErrAccessTokenInvalid
+	}
+
+	if stored.ExpiresAt.Sub(now) < accessTokenTTL-accessTokenRefresh {
+		_, err = accessTokenService.Collection.UpdateOne(accessTokenService.ctx,
+			bson.M{"_id": hash},
+			bson.M{"$set": bson.M{"expires_at": now.Add(accessTokenTTL)}},
+		)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return stored.UserId, nil
+}
+
+// RevokeAccessTokens signs every client of a user out
+func RevokeAccessTokens(userId string) error {
+	_, err := accessTokenService.Collection.DeleteMany(accessTokenService.ctx, bson.M{"user_id": userId})
+	return err
+}
@@ -0,0 +1,385 @@
+package models
+
+import (
+	"errors"
+	"regexp"
+	"time"
+
+	"server/dto"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// DeletedAuthor replaces the author of messages written by deleted users
+var DeletedAuthor = MessageAuthor{Id: "deleted", Username: "Deleted user", AvatarSeed: "deleted"}
+
+// listContains matches messages where userId appears in any list of the
+// map stored at field (reactions or flagged)
+func listContains(field string, userId string) bson.M {
+	return bson.M{"$expr": bson.M{"$gt": bson.A{
+		bson.M{"$size": bson.M{"$filter": bson.M{
+			"input": bson.M{"$objectToArray": bson.M{"$ifNull": bson.A{"$" + field, bson.M{}}}},
+			"cond":  bson.M{"$in": bson.A{userId, bson.M{"$ifNull": bson.A{"$$this.v", bson.A{}}}}},
+		}}},
+		0,
+	}}}
+}
+
+// withoutUser is an aggregation expression rebuilding the map stored at
+// field without userId, dropping lists that become empty
+func withoutUser(field string, userId string) bson.M {
+	return bson.M{"$arrayToObject": bson.M{"$filter": bson.M{
+		"input": bson.M{"$map": bson.M{
+			"input": bson.M{"$objectToArray": bson.M{"$ifNull": bson.A{"$" + field, bson.M{}}}},
+			"in": bson.M{
+				"k": "$$this.k",
+				"v": bson.M{"$filter": bson.M{
+					"input": "$$this.v",
+					"as":    "id",
+					"cond":  bson.M{"$ne": bson.A{"$$id", userId}},
+				}},
+			},
+		}},
+		"cond": bson.M{"$gt": bson.A{bson.M{"$size": "$$this.v"}, 0}},
+	}}}
+}
+
+func (u UserModel) toProfile() dto.UserProfile {
+	identities := []dto.IdentityEntry{}
+	for _, identity := range u.Identities {
+		identities = append(identities, dto.IdentityEntry{
+			Provider: identity.Provider,
+			Email:    identity.Email,
+			LinkedAt: identity.LinkedAt,
+		})
+	}
+
+	blocked := u.Blocked
+	if blocked == nil {
+		blocked = []string{}
+	}
+
+	return dto.UserProfile{
+		Identities:     identities,
+		Blocked:        blocked,
+		User:           u.ToDTO(),
+		IpHash:         u.IpHash,
+		RawIp:          u.RawIp,
+		RawIpExpiresAt: u.RawIpExpiresAt,
+		Country:        u.Country,
+		Region:         u.Region,
+		IsBanned:       u.IsBanned,
+		ModifiedAt:     u.ModifiedAt,
+	}
+}
+
+// findMessages returns every message matching filter, oldest first
+func findMessages(filter bson.M) ([]MessageModel, error) {
+	cursor, err := messageService.Collection.Find(messageService.ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(messageService.ctx)
+
+	messages := []MessageModel{}
+	if err := cursor.All(messageService.ctx, &messages); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// ExportUser collects everything stored about user: the profile, authored
+// messages, the reactions and reports left on any message, push
+// subscriptions, the mentions inbox and direct conversations
+func ExportUser(user *UserModel) (dto.UserExport, error) {
+	export := dto.UserExport{
+		Version:           dto.Version,
+		ExportedAt:        time.Now(),
+		Profile:           user.toProfile(),
+		Reactions:         []dto.ReactionEntry{},
+		Reports:           []dto.ReportEntry{},
+		PushSubscriptions: []dto.PushSubscription{},
+		Mentions:          []dto.MentionEntry{},
+	}
+
+	authored, err := findMessages(bson.M{"from.Id": user.Id})
+	if err != nil {
+		return export, err
+	}
+	export.Messages = MessagesToDTO(authored)
+
+	reacted, err := findMessages(listContains("reactions", user.Id))
+	if err != nil {
+		return export, err
+	}
+	for _, message := range reacted {
+		for emoji, userIds := range message.Reactions {
+			if containsString(userIds, user.Id) {
+				export.Reactions = append(export.Reactions, dto.ReactionEntry{
+					MessageId: message.Id.Hex(),
+					Channel:   message.ChannelId,
+					Emoji:     emoji,
+				})
+			}
+		}
+	}
+
+	markers, err := listReadMarkers(user.Id)
+	if err != nil {
+		return export, err
+	}
+	export.ReadMarkers = []dto.ReadMarker{}
+	for _, marker := range markers {
+		export.ReadMarkers = append(export.ReadMarkers, marker.ToDTO(0))
+	}
+
+	if bundle, err := GetKeyBundle(user.Id); err == nil {
+		status := bundle.Status()
+		export.Keys = &status
+	} else if !errors.Is(err, ErrKeyBundleNotFound) {
+		return export, err
+	}
+
+	reported, err := findMessages(listContains("flagged", user.Id))
+	if err != nil {
+		return export, err
+	}
+	for _, message := range reported {
+		for code, userIds := range message.Flagged {
+			if containsString(userIds, user.Id) {
+				export.Reports = append(export.Reports, dto.ReportEntry{
+					MessageId: message.Id.Hex(),
+					Channel:   message.ChannelId,
+					Code:      code,
+				})
+			}
+		}
+	}
+
+	subscriptions, err := ListPushSubscriptions(user.Id)
+	if err != nil {
+		return export, err
+	}
+	for _, subscription := range subscriptions {
+		export.PushSubscriptions = append(export.PushSubscriptions, subscription.ToDTO())
+	}
+
+	mentions, err := mentionService.Collection.Find(mentionService.ctx, bson.M{"user_id": user.Id},
+		options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return export, err
+	}
+	var entries []MentionModel
+	if err := mentions.All(mentionService.ctx, &entries); err != nil {
+		return export, err
+	}
+	for _, entry := range entries {
+		export.Mentions = append(export.Mentions, dto.MentionEntry{
+			MessageId: entry.MessageId.Hex(),
+			Channel:   entry.Channel,
+			Read:      entry.Read,
+			CreatedAt: entry.CreatedAt,
+		})
+	}
+
+	// ListConversations stops at the most recent ones, the export has them all
+	cursor, err := conversationService.Collection.Find(conversationService.ctx, bson.M{"user_id": user.Id},
+		options.Find().SetSort(bson.M{"last_message_at": -1}))
+	if err != nil {
+		return export, err
+	}
+	conversations := []ConversationModel{}
+	if err := cursor.All(conversationService.ctx, &conversations); err != nil {
+		return export, err
+	}
+	export.Conversations, err = ConversationsToDTO(conversations)
+	return export, err
+}
+
+// DeleteUser erases a user: authored messages are attributed to
+// DeletedAuthor, the user's id is removed from reactions and reports, from
+// other users' blocks and prekey claims, and the user document, keys, push
+// subscriptions, mentions, forwarded reports, access tokens and its side of
+// direct conversations are deleted. Peers keep their side of direct
+// conversations, which move to a pseudonym, see pseudonymizeDirectChannels.
+func DeleteUser(userId string) error {
+	now := time.Now()
+
+	_, err := messageService.Collection.UpdateMany(messageService.ctx,
+		bson.M{"from.Id": userId},
+		bson.M{"$set": withRewrite(bson.M{"from": DeletedAuthor, "updated_at": now})},
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, field := range []string{"reactions", "flagged"} {
+		_, err := messageService.Collection.UpdateMany(messageService.ctx,
+			listContains(field, userId),
+			bson.A{bson.M{"$set": withRewrite(bson.M{field: withoutUser(field, userId), "updated_at": now})}},
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = messageService.Collection.UpdateMany(messageService.ctx,
+		bson.M{"forwarded_reports.reporter_id": userId},
+		bson.M{
+			"$pull": bson.M{"forwarded_reports": bson.M{"reporter_id": userId}},
+			"$set":  withRewrite(bson.M{}),
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = messageService.Collection.UpdateMany(messageService.ctx,
+		bson.M{"mentions.user_id": userId},
+		bson.M{
+			"$pull": bson.M{"mentions": bson.M{"user_id": userId}},
+			"$set":  withRewrite(bson.M{}),
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = mentionService.Collection.DeleteMany(mentionService.ctx, bson.M{"user_id": userId})
+	if err != nil {
+		return err
+	}
+
+	_, err = pushService.Collection.DeleteMany(pushService.ctx, bson.M{"user_id": userId})
+	if err != nil {
+		return err
+	}
+
+	_, err = keyService.Collection.DeleteOne(keyService.ctx, bson.M{"_id": userId})
+	if err != nil {
+		return err
+	}
+
+	_, err = conversationService.Collection.DeleteMany(conversationService.ctx, bson.M{"user_id": userId})
+	if err != nil {
+		return err
+	}
+
+	_, err = readMarkerService.Collection.DeleteMany(readMarkerService.ctx, bson.M{"user_id": userId})
+	if err != nil {
+		return err
+	}
+
+	if err := pseudonymizeDirectChannels(userId, now); err != nil {
+		return err
+	}
+
+	_, err = userService.Collection.UpdateMany(userService.ctx,
+		bson.M{"blocked": userId},
+		bson.M{"$pull": bson.M{"blocked": userId}},
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = keyService.Collection.UpdateMany(keyService.ctx,
+		bson.M{"prekey_claims.requester_id": userId},
+		bson.M{"$pull": bson.M{"prekey_claims": bson.M{"requester_id": userId}}},
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := RevokeAccessTokens(userId); err != nil {
+		return err
+	}
+
+	// Wrong guesses stay, deleting the guessing user must not lift a lockout
+	_, err = loginService.Collection.DeleteMany(loginService.ctx, bson.M{
+		"user_id": userId,
+		"kind":    bson.M{"$in": bson.A{loginKindState, loginKindCode}},
+	})
+	if err != nil {
+		return err
+	}
+
+	result, err := userService.Collection.DeleteOne(userService.ctx, bson.M{"_id": userId})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrUserNotFound
+	}
+
+	return nil
+}
+
+// pseudonymizeDirectChannels replaces userId by a new random pseudonym in
+// the direct channels the user took part in: the channel ids of messages,
+// of the peers' conversations, read markers and mentions, the peer id of
+// the conversations and the recipient of messages sent to the user. Peers
+// keep reading the conversation, but no record names the deleted user.
+func pseudonymizeDirectChannels(userId string, now time.Time) error {
+	pseudonym := "deleted-" + uuid.New().String()
+
+	quoted := regexp.QuoteMeta(userId)
+	channels, err := messageService.Collection.Distinct(messageService.ctx, "channel", bson.M{
+		"channel": bson.M{"$regex": "^" + directChannelPrefix + "(" + quoted + ":|[^:]+:" + quoted + "$)"},
+	})
+	if err != nil {
+		return err
+	}
+	opened, err := conversationService.Collection.Distinct(conversationService.ctx, "channel", bson.M{"peer_id": userId})
+	if err != nil {
+		return err
+	}
+
+	seen := map[string]bool{}
+	for _, value := range append(channels, opened...) {
+		channel, _ := value.(string)
+		peerId, ok := DirectPeer(channel, userId)
+		if !ok || seen[channel] {
+			continue
+		}
+		seen[channel] = true
+		renamed := bson.M{"channel": DirectChannelId(pseudonym, peerId)}
+
+		_, err := messageService.Collection.UpdateMany(messageService.ctx,
+			bson.M{"channel": channel},
+			bson.M{"$set": withRewrite(bson.M{"channel": renamed["channel"]})},
+		)
+		if err != nil {
+			return err
+		}
+		_, err = conversationService.Collection.UpdateMany(conversationService.ctx,
+			bson.M{"channel": channel},
+			bson.M{"$set": bson.M{"channel": renamed["channel"], "peer_id": pseudonym}},
+		)
+		if err != nil {
+			return err
+		}
+		if _, err := readMarkerService.Collection.UpdateMany(readMarkerService.ctx, bson.M{"channel": channel}, bson.M{"$set": renamed}); err != nil {
+			return err
+		}
+		if _, err := mentionService.Collection.UpdateMany(mentionService.ctx, bson.M{"channel": channel}, bson.M{"$set": renamed}); err != nil {
+			return err
+		}
+	}
+
+	_, err = messageService.Collection.UpdateMany(messageService.ctx,
+		bson.M{"to": userId},
+		bson.M{"$set": withRewrite(bson.M{"to": pseudonym, "updated_at": now})},
+	)
+	return err
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
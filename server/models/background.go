@@ -0,0 +1,36 @@
+package models
+
+import (
+	"context"
+	"sync"
+)
+
+// background tracks the work requests leave running after they answered,
+// so shutdown can wait for it before closing Mongo
+var background sync.WaitGroup
+
+// Background runs fn in its own goroutine that WaitForBackground waits for
+func Background(fn func()) {
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		fn()
+	}()
+}
+
+// WaitForBackground waits for the work started with Background, or until
+// ctx is done. Start no more work once it was called.
+func WaitForBackground(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		background.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,303 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"server/dto"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// directChannelPrefix marks the channel ids of direct messages, public
+// channels are site ids and never start with it
+const directChannelPrefix = "dm:"
+
+var (
+	ErrNotChannelMember = errors.New("user is not a member of this channel")
+	ErrBlocked          = errors.New("user is blocked")
+	ErrDirectToSelf     = errors.New("cannot message yourself")
+)
+
+// ConversationModel is one participant's side of a direct message channel
+type ConversationModel struct {
+	Id            primitive.ObjectID `bson:"_id,omitempty"`
+	UserId        string             `bson:"user_id"`
+	Channel       string             `bson:"channel"`
+	PeerId        string             `bson:"peer_id"`
+	Unread        int                `bson:"unread"`
+	LastMessageAt time.Time          `bson:"last_message_at"`
+	CreatedAt     time.Time          `bson:"created_at"`
+}
+
+type ConversationService struct {
+	Collection *mongo.Collection
+	ctx        context.Context
+}
+
+var conversationService ConversationService
+
+func CreateConversationService(collection *mongo.Collection, ctx context.Context) {
+	conversationService = ConversationService{Collection: collection, ctx: ctx}
+}
+
+// EnsureConversationIndex makes sure a user has one conversation per channel
+func EnsureConversationIndex() error {
+	_, err := conversationService.Collection.Indexes().CreateMany(conversationService.ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "channel", Value: 1}},
+			Options: options.Index().SetName("user_channel_unique").SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "last_message_at", Value: -1}},
+			Options: options.Index().SetName("user_recent"),
+		},
+	})
+	return err
+}
+
+// DirectChannelId is the channel of the conversation between two users, it
+// is the same whichever of them asks
+func DirectChannelId(userId string, peerId string) string {
+	ids := []string{userId, peerId}
+	sort.Strings(ids)
+	return directChannelPrefix + ids[0] + ":" + ids[1]
+}
+
+// IsDirectChannel tells direct message channels from public ones
+func IsDirectChannel(channel string) bool {
+	return strings.HasPrefix(channel, directChannelPrefix)
+}
+
+// DirectParticipants returns the two users of a direct message channel
+func DirectParticipants(channel string) (string, string, bool) {
+	if !IsDirectChannel(channel) {
+		return "", "", false
+	}
+	ids := strings.Split(strings.TrimPrefix(channel, directChannelPrefix), ":")
+	if len(ids) != 2 || ids[0] == "" || ids[1] == "" {
+		return "", "", false
+	}
+	return ids[0], ids[1], true
+}
+
+// DirectPeer returns the other participant of a direct message channel,
+// ok is false when userId is not a participant
+func DirectPeer(channel string, userId string) (string, bool) {
+	first, second, ok := DirectParticipants(channel)
+	switch {
+	case !ok:
+		return "", false
+	case first == userId:
+		return second, true
+	case second == userId:
+		return first, true
+	}
+	return "", false
+}
+
+// CheckChannelAccess returns ErrNotChannelMember when userId may not read or
+// write channel, public channels are open to everyone
+func CheckChannelAccess(channel string, userId string) error {
+	if !IsDirectChannel(channel) {
+		return nil
+	}
+	if _, ok := DirectPeer(channel, userId); !ok {
+		return ErrNotChannelMember
+	}
+	return nil
+}
+
+// HasBlocked reports whether u blocked userId
+func (u UserModel) HasBlocked(userId string) bool {
+	return containsString(u.Blocked, userId)
+}
+
+// CheckDirectAllowed returns the peer when sender may message peerId, that
+// is when neither of them blocked the other
+func CheckDirectAllowed(sender *UserModel, peerId string) (*UserModel, error) {
+	if sender.Id == peerId {
+		return nil, ErrDirectToSelf
+	}
+
+	peer, err := GetUser(peerId)
+	if err != nil {
+		return nil, err
+	}
+	if sender.HasBlocked(peerId) || peer.HasBlocked(sender.Id) {
+		return nil, ErrBlocked
+	}
+	return peer, nil
+}
+
+// OpenConversation returns the conversation of user with peerId, creating it
+// when they have not talked before
+func OpenConversation(user *UserModel, peerId string) (*ConversationModel, error) {
+	if _, err := CheckDirectAllowed(user, peerId); err != nil {
+		return nil, err
+	}
+
+	channel := DirectChannelId(user.Id, peerId)
+	now := time.Now()
+	filter := bson.M{"user_id": user.Id, "channel": channel}
+	update := bson.M{"$setOnInsert": bson.M{
+		"peer_id":         peerId,
+		"unread":          0,
+		"last_message_at": now,
+		"created_at":      now,
+	}}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	var conversation ConversationModel
+	err := conversationService.Collection.FindOneAndUpdate(conversationService.ctx, filter, update, opts).Decode(&conversation)
+	if err != nil {
+		return nil, err
+	}
+	return &conversation, nil
+}
+
+// RecordDirectMessage moves the conversation of both participants to the
+// top of their lists and counts the message as unread for the recipient
+func RecordDirectMessage(message MessageModel) error {
+	senderId := message.From.Id
+	recipientId, ok := DirectPeer(message.ChannelId, senderId)
+	if !ok {
+		return ErrNotChannelMember
+	}
+
+	opts := options.Update().SetUpsert(true)
+	sides := []struct {
+		userId string
+		peerId string
+		unread int
+	}{
+		{senderId, recipientId, 0},
+		{recipientId, senderId, 1},
+	}
+	for _, side := range sides {
+		_, err := conversationService.Collection.UpdateOne(conversationService.ctx,
+			bson.M{"user_id": side.userId, "channel": message.ChannelId},
+			bson.M{
+				"$set":         bson.M{"last_message_at": message.CreatedAt},
+				"$inc":         bson.M{"unread": side.unread},
+				"$setOnInsert": bson.M{"peer_id": side.peerId, "created_at": message.CreatedAt},
+			},
+			opts,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MarkConversationRead clears the unread counter of user on channel
+func MarkConversationRead(userId string, channel string) (*ConversationModel, error) {
+	var conversation ConversationModel
+	err := conversationService.Collection.FindOneAndUpdate(conversationService.ctx,
+		bson.M{"user_id": userId, "channel": channel},
+		bson.M{"$set": bson.M{"unread": 0}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&conversation)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrNotChannelMember
+		}
+		return nil, err
+	}
+	return &conversation, nil
+}
+
+// ListConversations returns the conversations of a user, most recent first
+func ListConversations(userId string) ([]ConversationModel, error) {
+	opts := options.Find().SetSort(bson.M{"last_message_at": -1}).SetLimit(100)
+	cursor, err := conversationService.Collection.Find(conversationService.ctx, bson.M{"user_id": userId}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(conversationService.ctx)
+
+	conversations := []ConversationModel{}
+	if err := cursor.All(conversationService.ctx, &conversations); err != nil {
+		return nil, err
+	}
+	return conversations, nil
+}
+
+// ConversationsToDTO converts conversations, looking up their peers
+func ConversationsToDTO(conversations []ConversationModel) ([]dto.Conversation, error) {
+	peerIds := []string{}
+	for _, conversation := range conversations {
+		peerIds = append(peerIds, conversation.PeerId)
+	}
+
+	peers := map[string]MessageAuthor{}
+	if len(peerIds) > 0 {
+		cursor, err := userService.Collection.Find(userService.ctx, bson.M{"_id": bson.M{"$in": peerIds}})
+		if err != nil {
+			return nil, err
+		}
+		defer cursor.Close(userService.ctx)
+
+		var users []UserModel
+		if err := cursor.All(userService.ctx, &users); err != nil {
+			return nil, err
+		}
+		for _, user := range users {
+			peers[user.Id] = user.Author()
+		}
+	}
+
+	result := make([]dto.Conversation, 0, len(conversations))
+	for _, conversation := range conversations {
+		peer, ok := peers[conversation.PeerId]
+		if !ok {
+			peer = DeletedAuthor
+		}
+		result = append(result, dto.Conversation{
+			Channel:       conversation.Channel,
+			Peer:          dto.Author{Id: peer.Id, Username: peer.Username, Avatar: AvatarURL(peer.avatarSeed())},
+			Unread:        conversation.Unread,
+			LastMessageAt: conversation.LastMessageAt,
+		})
+	}
+	return result, nil
+}
+
+// BlockUser stops userId and targetId from messaging each other directly
+func BlockUser(userId string, targetId string) (*UserModel, error) {
+	if userId == targetId {
+		return nil, ErrDirectToSelf
+	}
+	if _, err := GetUser(targetId); err != nil {
+		return nil, err
+	}
+	return updateBlocked(userId, bson.M{"$addToSet": bson.M{"blocked": targetId}})
+}
+
+// UnblockUser lifts a block
+func UnblockUser(userId string, targetId string) (*UserModel, error) {
+	return updateBlocked(userId, bson.M{"$pull": bson.M{"blocked": targetId}})
+}
+
+func updateBlocked(userId string, update bson.M) (*UserModel, error) {
+	var user UserModel
+	err := userService.Collection.FindOneAndUpdate(userService.ctx,
+		bson.M{"_id": userId},
+		update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&user)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	return &user, nil
+}
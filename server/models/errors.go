@@ -0,0 +1,10 @@
+package models
+
+import "errors"
+
+// Errors returned by the model services, mapped to API errors by the handlers
+var (
+	ErrUserNotFound     = errors.New("user not found")
+	ErrMessageNotFound  = errors.New("message not found")
+	ErrInvalidMessageId = errors.New("invalid message id")
+)
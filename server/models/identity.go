@@ -0,0 +1,99 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// LinkedIdentity is an external account a user signs in with
+type LinkedIdentity struct {
+	Provider string    `bson:"provider"`
+	Subject  string    `bson:"subject"`
+	Email    string    `bson:"email,omitempty"`
+	LinkedAt time.Time `bson:"linked_at"`
+}
+
+// ErrProviderAlreadyLinked is returned when upgrading a user that is already
+// signed in with another account of the same provider
+var ErrProviderAlreadyLinked = errors.New("user is already linked to another account of this provider")
+
+// EnsureIdentityIndex makes sure an external account links to one user only
+func EnsureIdentityIndex() error {
+	_, err := userService.Collection.Indexes().CreateOne(userService.ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "identities.provider", Value: 1}, {Key: "identities.subject", Value: 1}},
+		Options: options.Index().
+			SetName("identities_unique").
+			SetUnique(true).
+			SetPartialFilterExpression(bson.M{"identities": bson.M{"$exists": true}}),
+	})
+	return err
+}
+
+// FindUserByIdentity returns the user linked to an external account
+func FindUserByIdentity(provider string, subject string) (*UserModel, error) {
+	filter := bson.M{"identities": bson.M{"$elemMatch": bson.M{"provider": provider, "subject": subject}}}
+
+	var user UserModel
+	err := userService.Collection.FindOne(userService.ctx, filter).Decode(&user)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	return &user, nil
+}
+
+// LinkIdentity signs a user in with an external account. When the account
+// is already linked, its user is returned so one account works from several
+// browsers and devices. Otherwise the anonymous user is upgraded in place,
+// keeping its id, messages and history.
+func LinkIdentity(anonymousUserId string, identity LinkedIdentity) (*UserModel, error) {
+	linked, err := FindUserByIdentity(identity.Provider, identity.Subject)
+	if err == nil {
+		return linked, nil
+	}
+	if !errors.Is(err, ErrUserNotFound) {
+		return nil, err
+	}
+
+	user, err := GetUser(anonymousUserId)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, existing := range user.Identities {
+		if existing.Provider == identity.Provider {
+			return nil, ErrProviderAlreadyLinked
+		}
+	}
+
+	identity.LinkedAt = time.Now()
+	update := bson.M{
+		"$push": bson.M{"identities": identity},
+		"$set": bson.M{
+			"is_logged_in": true,
+			"login_method": identity.Provider,
+			"modified_at":  identity.LinkedAt,
+		},
+	}
+
+	_, err = userService.Collection.UpdateOne(userService.ctx, bson.M{"_id": user.Id}, update)
+	if err != nil {
+		// Lost a race with another device linking the same account
+		if mongo.IsDuplicateKeyError(err) {
+			return FindUserByIdentity(identity.Provider, identity.Subject)
+		}
+		return nil, err
+	}
+
+	user.Identities = append(user.Identities, identity)
+	user.IsLoggedIn = true
+	user.LoginMethod = identity.Provider
+	user.ModifiedAt = identity.LinkedAt
+	return user, nil
+}
@@ -0,0 +1,379 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"server/db"
+	"server/dto"
+	"server/e2e"
+	"server/metrics"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrKeyBundleNotFound  = errors.New("user has no key bundle")
+	ErrEncryptionRequired = errors.New("direct messages between users with keys must be encrypted")
+	ErrSenderKeyMismatch  = errors.New("sender key is not the registered identity key")
+	ErrKeyBundleChanged   = errors.New("key bundle changed while it was being replaced")
+)
+
+const (
+	// LowPrekeys is the number of one time prekeys left at which the owner
+	// is told to upload more
+	LowPrekeys = 10
+	// prekeyClaimWindow is how long a user waits before getting another
+	// one time prekey of the same peer, so prekeys cannot be drained
+	prekeyClaimWindow = 24 * time.Hour
+	// maxPrekeyClaims is how many recent claims a bundle remembers
+	maxPrekeyClaims = 200
+)
+
+// KeyBundleModel holds the public keys a user registered for end-to-end
+// encrypted direct messages, keyed by user id
+type KeyBundleModel struct {
+	UserId         string            `bson:"_id"`
+	IdentityKey    string            `bson:"identity_key"`
+	SignedPrekey   SignedPrekeyModel `bson:"signed_prekey"`
+	OneTimePrekeys []PrekeyModel     `bson:"one_time_prekeys"`
+	// Recent requesters of a one time prekey, see TakeKeyBundle
+	PrekeyClaims []PrekeyClaimModel `bson:"prekey_claims,omitempty"`
+	CreatedAt    time.Time          `bson:"created_at"`
+	UpdatedAt    time.Time          `bson:"updated_at"`
+}
+
+type PrekeyClaimModel struct {
+	RequesterId string    `bson:"requester_id"`
+	ClaimedAt   time.Time `bson:"claimed_at"`
+}
+
+type SignedPrekeyModel struct {
+	KeyId     int64  `bson:"key_id"`
+	PublicKey string `bson:"public_key"`
+	Signature string `bson:"signature"`
+}
+
+type PrekeyModel struct {
+	KeyId     int64  `bson:"key_id"`
+	PublicKey string `bson:"public_key"`
+}
+
+// EncryptedPayload is the stored form of dto.EncryptedPayload
+type EncryptedPayload struct {
+	Algorithm       string `bson:"alg"`
+	SenderKey       string `bson:"sender_key"`
+	EphemeralKey    string `bson:"ephemeral_key"`
+	SignedPrekeyId  int64  `bson:"signed_prekey_id"`
+	OneTimePrekeyId *int64 `bson:"one_time_prekey_id,omitempty"`
+	Nonce           string `bson:"nonce"`
+	Ciphertext      string `bson:"ciphertext"`
+}
+
+// ForwardedReport is the decrypted text of an encrypted message as
+// forwarded by its recipient. The server cannot check it against the
+// ciphertext, moderators weigh it as the reporter's word.
+type ForwardedReport struct {
+	ReporterId string    `bson:"reporter_id"`
+	Plaintext  string    `bson:"plaintext"`
+	ReportedAt time.Time `bson:"reported_at"`
+}
+
+func NewEncryptedPayload(payload dto.EncryptedPayload) *EncryptedPayload {
+	return &EncryptedPayload{
+		Algorithm:       payload.Algorithm,
+		SenderKey:       payload.SenderKey,
+		EphemeralKey:    payload.EphemeralKey,
+		SignedPrekeyId:  payload.SignedPrekeyId,
+		OneTimePrekeyId: payload.OneTimePrekeyId,
+		Nonce:           payload.Nonce,
+		Ciphertext:      payload.Ciphertext,
+	}
+}
+
+func (p *EncryptedPayload) ToDTO() *dto.EncryptedPayload {
+	if p == nil {
+		return nil
+	}
+	return &dto.EncryptedPayload{
+		Algorithm:       p.Algorithm,
+		SenderKey:       p.SenderKey,
+		EphemeralKey:    p.EphemeralKey,
+		SignedPrekeyId:  p.SignedPrekeyId,
+		OneTimePrekeyId: p.OneTimePrekeyId,
+		Nonce:           p.Nonce,
+		Ciphertext:      p.Ciphertext,
+	}
+}
+
+func (b KeyBundleModel) Status() dto.KeyBundleStatus {
+	return dto.KeyBundleStatus{
+		IdentityKey:    b.IdentityKey,
+		SignedPrekeyId: b.SignedPrekey.KeyId,
+		OneTimePrekeys: len(b.OneTimePrekeys),
+		UpdatedAt:      b.UpdatedAt,
+	}
+}
+
+type KeyService struct {
+	Collection *mongo.Collection
+	ctx        context.Context
+}
+
+var keyService KeyService
+
+func CreateKeyService(collection *mongo.Collection, ctx context.Context) {
+	keyService = KeyService{Collection: collection, ctx: ctx}
+}
+
+func toPrekeyModels(prekeys []dto.Prekey) []PrekeyModel {
+	result := make([]PrekeyModel, 0, len(prekeys))
+	for _, prekey := range prekeys {
+		result = append(result, PrekeyModel{KeyId: prekey.KeyId, PublicKey: prekey.PublicKey})
+	}
+	return result
+}
+
+// GetKeyBundle returns the bundle of a user
+func GetKeyBundle(userId string) (*KeyBundleModel, error) {
+	var bundle KeyBundleModel
+	err := keyService.Collection.FindOne(keyService.ctx, bson.M{"_id": userId}).Decode(&bundle)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrKeyBundleNotFound
+		}
+		return nil, err
+	}
+	return &bundle, nil
+}
+
+// PutKeyBundle registers the keys of a user, or rotates them. The first
+// identity key stays until the user replaces it with a successor it signed.
+// One time prekeys are kept when the identity key stays and none are sent.
+func PutKeyBundle(userId string, request dto.KeyBundleRequest) (*KeyBundleModel, error) {
+	if err := e2e.ValidateBundle(request); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	signedPrekey := SignedPrekeyModel{
+		KeyId:     request.SignedPrekey.KeyId,
+		PublicKey: request.SignedPrekey.PublicKey,
+		Signature: request.SignedPrekey.Signature,
+	}
+
+	existing, err := GetKeyBundle(userId)
+	if err != nil && !errors.Is(err, ErrKeyBundleNotFound) {
+		return nil, err
+	}
+
+	if existing == nil {
+		bundle := KeyBundleModel{
+			UserId:         userId,
+			IdentityKey:    request.IdentityKey,
+			SignedPrekey:   signedPrekey,
+			OneTimePrekeys: toPrekeyModels(request.OneTimePrekeys),
+			CreatedAt:      now,
+			UpdatedAt:      now,
+		}
+		_, err := keyService.Collection.InsertOne(keyService.ctx, bundle)
+		if err != nil {
+			if mongo.IsDuplicateKeyError(err) {
+				return nil, ErrKeyBundleChanged
+			}
+			return nil, err
+		}
+		return &bundle, nil
+	}
+
+	sameIdentity := e2e.SameKey(existing.IdentityKey, request.IdentityKey)
+	if !sameIdentity {
+		if err := e2e.ValidateRotation(existing.IdentityKey, request.IdentityKey, request.RotationSignature); err != nil {
+			return nil, err
+		}
+	}
+
+	set := bson.M{
+		"identity_key":  request.IdentityKey,
+		"signed_prekey": signedPrekey,
+		"updated_at":    now,
+	}
+	if !sameIdentity || len(request.OneTimePrekeys) > 0 {
+		set["one_time_prekeys"] = toPrekeyModels(request.OneTimePrekeys)
+	}
+
+	// Only replace the identity key the rotation was signed by
+	var bundle KeyBundleModel
+	err = keyService.Collection.FindOneAndUpdate(keyService.ctx,
+		bson.M{"_id": userId, "identity_key": existing.IdentityKey},
+		bson.M{"$set": set},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&bundle)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrKeyBundleChanged
+		}
+		return nil, err
+	}
+	return &bundle, nil
+}
+
+// AddPrekeys appends single use keys to a bundle, keeping the newest
+// e2e.MaxOneTimePrekeys
+func AddPrekeys(userId string, prekeys []dto.Prekey) (*KeyBundleModel, error) {
+	if err := e2e.ValidatePrekeys(prekeys); err != nil {
+		return nil, err
+	}
+
+	var bundle KeyBundleModel
+	err := keyService.Collection.FindOneAndUpdate(keyService.ctx,
+		bson.M{"_id": userId},
+		bson.M{
+			"$push": bson.M{"one_time_prekeys": bson.M{
+				"$each":  toPrekeyModels(prekeys),
+				"$slice": -e2e.MaxOneTimePrekeys,
+			}},
+			"$set": bson.M{"updated_at": time.Now()},
+		},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&bundle)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrKeyBundleNotFound
+		}
+		return nil, err
+	}
+	return &bundle, nil
+}
+
+// TakeKeyBundle returns the bundle of a user for a requester, handing out
+// one of the one time prekeys and removing it so it is never used twice.
+// A requester gets at most one prekey of the same user per
+// prekeyClaimWindow, later bundles come without one.
+func TakeKeyBundle(requesterId string, userId string) (*dto.KeyBundle, error) {
+	now := time.Now()
+	filter := bson.M{
+		"_id": userId,
+		"prekey_claims": bson.M{"$not": bson.M{"$elemMatch": bson.M{
+			"requester_id": requesterId,
+			"claimed_at":   bson.M{"$gt": now.Add(-prekeyClaimWindow)},
+		}}},
+	}
+	update := bson.M{
+		"$pop": bson.M{"one_time_prekeys": -1},
+		"$push": bson.M{"prekey_claims": bson.M{
+			"$each":  []PrekeyClaimModel{{RequesterId: requesterId, ClaimedAt: now}},
+			"$slice": -maxPrekeyClaims,
+		}},
+	}
+
+	var before KeyBundleModel
+	err := keyService.Collection.FindOneAndUpdate(keyService.ctx, filter, update,
+		options.FindOneAndUpdate().SetReturnDocument(options.Before),
+	).Decode(&before)
+	if err == mongo.ErrNoDocuments {
+		// No bundle, or the requester claimed a prekey recently
+		bundle, err := GetKeyBundle(userId)
+		if err != nil {
+			return nil, err
+		}
+		return bundle.forSender(nil), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(before.OneTimePrekeys) == 0 {
+		return before.forSender(nil), nil
+	}
+
+	left := len(before.OneTimePrekeys) - 1
+	if left <= LowPrekeys {
+		notifyPrekeysLow(userId, left)
+	}
+	return before.forSender(&before.OneTimePrekeys[0]), nil
+}
+
+// forSender converts a bundle to what a sender receives, with prekey as
+// the one time prekey when there is one
+func (b KeyBundleModel) forSender(prekey *PrekeyModel) *dto.KeyBundle {
+	bundle := &dto.KeyBundle{
+		UserId:      b.UserId,
+		IdentityKey: b.IdentityKey,
+		SignedPrekey: dto.SignedPrekey{
+			KeyId:     b.SignedPrekey.KeyId,
+			PublicKey: b.SignedPrekey.PublicKey,
+			Signature: b.SignedPrekey.Signature,
+		},
+		UpdatedAt: b.UpdatedAt,
+	}
+	if prekey != nil {
+		bundle.OneTimePrekey = &dto.Prekey{KeyId: prekey.KeyId, PublicKey: prekey.PublicKey}
+	}
+	return bundle
+}
+
+// notifyPrekeysLow tells the sockets of a user to upload more prekeys.
+// Clients also check the count of GetMyKeys when they connect, for the
+// times they were offline.
+func notifyPrekeysLow(userId string, left int) {
+	event := dto.NewEvent(dto.EventPrekeysLow, "", dto.PrekeysLow{OneTimePrekeys: left})
+	for _, userConn := range db.UserSockets(userId) {
+		userConn.Send(event)
+	}
+}
+
+// CheckEncryption decides whether a direct message may be sent as it is:
+// once both participants registered keys only ciphertext is accepted, and
+// ciphertext must come from the sender's registered identity key
+func CheckEncryption(senderId string, recipientId string, payload *dto.EncryptedPayload) error {
+	senderBundle, err := GetKeyBundle(senderId)
+	if err != nil && !errors.Is(err, ErrKeyBundleNotFound) {
+		return err
+	}
+	recipientBundle, err := GetKeyBundle(recipientId)
+	if err != nil && !errors.Is(err, ErrKeyBundleNotFound) {
+		return err
+	}
+
+	if payload == nil {
+		if senderBundle != nil && recipientBundle != nil {
+			return ErrEncryptionRequired
+		}
+		return nil
+	}
+
+	if err := e2e.ValidatePayload(*payload); err != nil {
+		return err
+	}
+	if senderBundle == nil || recipientBundle == nil {
+		return ErrKeyBundleNotFound
+	}
+	if !e2e.SameKey(payload.SenderKey, senderBundle.IdentityKey) {
+		return ErrSenderKeyMismatch
+	}
+	return nil
+}
+
+// ForwardEncryptedReport files the recipient's report of an encrypted
+// message together with the text they decrypted
+func ForwardEncryptedReport(message MessageModel, reporterId string, plaintext string) (dto.ReportResult, error) {
+	now := time.Now()
+	_, err := messageService.Collection.UpdateOne(messageService.ctx,
+		bson.M{"_id": message.Id},
+		bson.M{
+			"$push":     bson.M{"forwarded_reports": ForwardedReport{ReporterId: reporterId, Plaintext: plaintext, ReportedAt: now}},
+			"$addToSet": bson.M{"flagged.FLAG_CODE_1": reporterId},
+			"$set":      bson.M{"updated_at": now},
+		},
+	)
+	if err != nil {
+		return dto.ReportResult{}, err
+	}
+
+	metrics.Reports.WithLabelValues("encrypted").Inc()
+	return dto.ReportResult{MessageId: message.Id.Hex(), Reported: true}, nil
+}
@@ -0,0 +1,308 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"server/auth"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrLoginStateInvalid is returned for login states that were never stored,
+// expired or were already used
+var ErrLoginStateInvalid = errors.New("login state is invalid or expired")
+
+const (
+	// LoginStateTTL is how long a sign in with an identity provider may take
+	LoginStateTTL = 10 * time.Minute
+	// LoginCodeTTL is how long an emailed login code and link stay valid
+	LoginCodeTTL = 15 * time.Minute
+	// LoginCodeWindow is the period codes requested and wrong guesses are
+	// counted over
+	LoginCodeWindow = time.Hour
+	// loginCodeLimit is how many codes a user may request for one address
+	// within LoginCodeWindow
+	loginCodeLimit = 5
+	// loginCodeAttempts is how many wrong guesses use up a code
+	loginCodeAttempts = 5
+	// loginCodeLockout is how many wrong guesses, by any user, lock the codes
+	// of an address for LoginCodeWindow. Magic links keep working, their
+	// tokens cannot be guessed.
+	loginCodeLockout = 10
+)
+
+// Kinds of the documents of the logins collection
+const (
+	loginKindState  = "state"
+	loginKindCode   = "code"
+	loginKindIssued = "issued"
+	loginKindFailed = "failed"
+)
+
+// LoginModel is a pending login: the state of a sign in with an identity
+// provider or an emailed code, or a record of a code issued or guessed
+// wrong that limits apply to. Mongo drops them at ExpiresAt.
+type LoginModel struct {
+	Id     interface{} `bson:"_id"`
+	Kind   string      `bson:"kind"`
+	UserId string      `bson:"user_id,omitempty"`
+	Email  string      `bson:"email,omitempty"`
+	// Provider logins
+	Provider     string `bson:"provider,omitempty"`
+	Nonce        string `bson:"nonce,omitempty"`
+	CodeVerifier string `bson:"code_verifier,omitempty"`
+	RedirectURI  string `bson:"redirect_uri,omitempty"`
+	// Email logins, only hashes of the code and the link token are stored
+	CodeHash  string    `bson:"code_hash,omitempty"`
+	TokenHash string    `bson:"token_hash,omitempty"`
+	Attempts  int       `bson:"attempts,omitempty"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+type LoginService struct {
+	Collection *mongo.Collection
+	ctx        context.Context
+}
+
+var loginService LoginService
+
+func CreateLoginService(collection *mongo.Collection, ctx context.Context) {
+	loginService = LoginService{Collection: collection, ctx: ctx}
+}
+
+// EnsureLoginIndex lets Mongo drop finished logins and finds magic link
+// tokens and the records limits count
+func EnsureLoginIndex() error {
+	_, err := loginService.Collection.Indexes().CreateMany(loginService.ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetName("expiry").SetExpireAfterSeconds(0),
+		},
+		{
+			Keys:    bson.D{{Key: "token_hash", Value: 1}},
+			Options: options.Index().SetName("token").SetSparse(true),
+		},
+		{
+			Keys:    bson.D{{Key: "kind", Value: 1}, {Key: "email", Value: 1}, {Key: "user_id", Value: 1}},
+			Options: options.Index().SetName("limits"),
+		},
+	})
+	return err
+}
+
+// PutLoginState stores state until its callback arrives and returns the key
+// it is taken with
+func PutLoginState(state auth.LoginState) (string, error) {
+	key := auth.RandomToken()
+	return key, putLoginState(key, state)
+}
+
+// PutLoginNonce stores state under a key that is also its nonce, for
+// clients that obtain the ID token themselves and only know the nonce
+func PutLoginNonce(state auth.LoginState) (string, error) {
+	key := auth.RandomToken()
+	state.Nonce = key
+	return key, putLoginState(key, state)
+}
+
+func putLoginState(key string, state auth.LoginState) error {
+	_, err := loginService.Collection.InsertOne(loginService.ctx, LoginModel{
+		Id:           hashToken(key),
+		Kind:         loginKindState,
+		UserId:       state.UserId,
+		Provider:     state.Provider,
+		Nonce:        state.Nonce,
+		CodeVerifier: state.CodeVerifier,
+		RedirectURI:  state.RedirectURI,
+		ExpiresAt:    time.Now().Add(LoginStateTTL),
+	})
+	return err
+}
+
+// TakeLoginState returns and removes the state stored under key, states
+// are single use
+func TakeLoginState(key string) (auth.LoginState, error) {
+	if key == "" {
+		return auth.LoginState{}, ErrLoginStateInvalid
+	}
+
+	var stored LoginModel
+	err := loginService.Collection.FindOneAndDelete(loginService.ctx, bson.M{
+		"_id":        hashToken(key),
+		"kind":       loginKindState,
+		"expires_at": bson.M{"$gt": time.Now()},
+	}).Decode(&stored)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return auth.LoginState{}, ErrLoginStateInvalid
+		}
+		return auth.LoginState{}, err
+	}
+
+	return auth.LoginState{
+		Provider:     stored.Provider,
+		UserId:       stored.UserId,
+		Nonce:        stored.Nonce,
+		CodeVerifier: stored.CodeVerifier,
+		RedirectURI:  stored.RedirectURI,
+	}, nil
+}
+
+// loginCodeId is the id of the code login.UserId asked for login.Email,
+// each user has a code of its own so guesses by others do not touch it
+func loginCodeId(userId string, email string) string {
+	return hashToken(userId + "\n" + email)
+}
+
+// IssueLoginCode creates a code and a magic link token for login, replacing
+// any code the same user still has pending for the address
+func IssueLoginCode(login auth.EmailLogin) (code string, token string, err error) {
+	now := time.Now()
+
+	issued, err := loginService.Collection.CountDocuments(loginService.ctx, bson.M{
+		"kind":       loginKindIssued,
+		"email":      login.Email,
+		"user_id":    login.UserId,
+		"expires_at": bson.M{"$gt": now},
+	})
+	if err != nil {
+		return "", "", err
+	}
+	if issued >= loginCodeLimit {
+		return "", "", auth.ErrTooManyCodes
+	}
+
+	code, err = auth.NewLoginCode()
+	if err != nil {
+		return "", "", err
+	}
+	token = auth.RandomToken()
+
+	id := loginCodeId(login.UserId, login.Email)
+	pending := LoginModel{
+		Id:          id,
+		Kind:        loginKindCode,
+		UserId:      login.UserId,
+		Email:       login.Email,
+		RedirectURI: login.RedirectURI,
+		CodeHash:    hashToken(id + ":" + code),
+		TokenHash:   hashToken(token),
+		ExpiresAt:   now.Add(LoginCodeTTL),
+	}
+	_, err = loginService.Collection.ReplaceOne(loginService.ctx, bson.M{"_id": id}, pending, options.Replace().SetUpsert(true))
+	if err != nil {
+		return "", "", err
+	}
+
+	_, err = loginService.Collection.InsertOne(loginService.ctx, bson.M{
+		"kind":       loginKindIssued,
+		"email":      login.Email,
+		"user_id":    login.UserId,
+		"expires_at": now.Add(LoginCodeWindow),
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return code, token, nil
+}
+
+// VerifyLoginCode consumes the code userId asked for email. A code stops
+// working after a few wrong guesses, and the codes of an address after
+// more wrong guesses by anyone.
+func VerifyLoginCode(userId string, email string, code string) (auth.EmailLogin, error) {
+	now := time.Now()
+
+	failed, err := loginService.Collection.CountDocuments(loginService.ctx, bson.M{
+		"kind":       loginKindFailed,
+		"email":      email,
+		"expires_at": bson.M{"$gt": now},
+	})
+	if err != nil {
+		return auth.EmailLogin{}, err
+	}
+	if failed >= loginCodeLockout {
+		return auth.EmailLogin{}, auth.ErrCodeLocked
+	}
+
+	id := loginCodeId(userId, email)
+	var stored LoginModel
+	err = loginService.Collection.FindOneAndDelete(loginService.ctx, bson.M{
+		"_id":        id,
+		"code_hash":  hashToken(id + ":" + code),
+		"expires_at": bson.M{"$gt": now},
+	}).Decode(&stored)
+	if err == nil {
+		return stored.emailLogin(), nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return auth.EmailLogin{}, err
+	}
+
+	// A wrong guess counts against the code and the address
+	result, err := loginService.Collection.UpdateOne(loginService.ctx,
+		bson.M{"_id": id, "expires_at": bson.M{"$gt": now}},
+		bson.M{"$inc": bson.M{"attempts": 1}},
+	)
+	if err != nil {
+		return auth.EmailLogin{}, err
+	}
+	if result.MatchedCount > 0 {
+		_, err = loginService.Collection.InsertOne(loginService.ctx, bson.M{
+			"kind":       loginKindFailed,
+			"email":      email,
+			"user_id":    userId,
+			"expires_at": now.Add(LoginCodeWindow),
+		})
+		if err != nil {
+			return auth.EmailLogin{}, err
+		}
+		_, err = loginService.Collection.DeleteOne(loginService.ctx, bson.M{"_id": id, "attempts": bson.M{"$gte": loginCodeAttempts}})
+		if err != nil {
+			return auth.EmailLogin{}, err
+		}
+	}
+	return auth.EmailLogin{}, auth.ErrInvalidCode
+}
+
+// PeekLoginToken returns the login of a magic link token without consuming
+// it, so the confirmation page can be shown any number of times
+func PeekLoginToken(token string) (auth.EmailLogin, error) {
+	var stored LoginModel
+	err := loginService.Collection.FindOne(loginService.ctx, loginTokenFilter(token)).Decode(&stored)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return auth.EmailLogin{}, auth.ErrInvalidCode
+		}
+		return auth.EmailLogin{}, err
+	}
+	return stored.emailLogin(), nil
+}
+
+// TakeLoginToken consumes the magic link token, along with its code
+func TakeLoginToken(token string) (auth.EmailLogin, error) {
+	var stored LoginModel
+	err := loginService.Collection.FindOneAndDelete(loginService.ctx, loginTokenFilter(token)).Decode(&stored)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return auth.EmailLogin{}, auth.ErrInvalidCode
+		}
+		return auth.EmailLogin{}, err
+	}
+	return stored.emailLogin(), nil
+}
+
+func loginTokenFilter(token string) bson.M {
+	return bson.M{
+		"kind":       loginKindCode,
+		"token_hash": hashToken(token),
+		"expires_at": bson.M{"$gt": time.Now()},
+	}
+}
+
+func (l LoginModel) emailLogin() auth.EmailLogin {
+	return auth.EmailLogin{Email: l.Email, UserId: l.UserId, RedirectURI: l.RedirectURI}
+}
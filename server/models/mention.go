@@ -0,0 +1,284 @@
+package models
+
+import (
+	"context"
+	"log/slog"
+	"regexp"
+	"strings"
+	"time"
+
+	"server/db"
+	"server/dto"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MaxMentions is how many users one message can notify
+const MaxMentions = 10
+
+// mentionPattern matches @username, the name follows the rules of
+// ValidateUsername and must not follow a word character (e-mail addresses)
+var mentionPattern = regexp.MustCompile(`(^|[^\p{L}\p{N}_])@([\p{L}\p{N}][\p{L}\p{N}_.\-]*)`)
+
+// MessageMention is a user mentioned in a message
+type MessageMention struct {
+	UserId   string `bson:"user_id"`
+	Username string `bson:"username"`
+}
+
+// MentionModel is an entry of a user's mentions inbox
+type MentionModel struct {
+	Id        primitive.ObjectID `bson:"_id,omitempty"`
+	UserId    string             `bson:"user_id"`
+	MessageId primitive.ObjectID `bson:"message_id"`
+	Channel   string             `bson:"channel"`
+	Read      bool               `bson:"read"`
+	CreatedAt time.Time          `bson:"created_at"`
+}
+
+type MentionService struct {
+	Collection *mongo.Collection
+	ctx        context.Context
+}
+
+var mentionService MentionService
+
+func CreateMentionService(collection *mongo.Collection, ctx context.Context) {
+	mentionService = MentionService{Collection: collection, ctx: ctx}
+}
+
+// EnsureMentionIndex makes sure a message lands in an inbox once
+func EnsureMentionIndex() error {
+	_, err := mentionService.Collection.Indexes().CreateMany(mentionService.ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "message_id", Value: 1}},
+			Options: options.Index().SetName("user_message_unique").SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "read", Value: 1}},
+			Options: options.Index().SetName("user_read"),
+		},
+	})
+	return err
+}
+
+func mentionsToDTO(mentions []MessageMention) []dto.Mention {
+	result := make([]dto.Mention, 0, len(mentions))
+	for _, mention := range mentions {
+		result = append(result, dto.Mention{UserId: mention.UserId, Username: mention.Username})
+	}
+	return result
+}
+
+// ParseMentions returns the distinct folded usernames mentioned in text, in
+// order of appearance
+func ParseMentions(text string) []string {
+	keys := []string{}
+	seen := map[string]bool{}
+	for _, match := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		// Punctuation ending a sentence is not part of the name
+		name := strings.TrimRight(match[2], ".-")
+		if ValidateUsername(name) != nil {
+			continue
+		}
+
+		key := FoldUsername(name)
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+		if len(keys) == MaxMentions {
+			break
+		}
+	}
+	return keys
+}
+
+// ResolveMentions finds the users mentioned in text who can see the
+// channel: the peer of a direct message, or users who have been on a
+// public channel. Users who blocked the sender and the sender are left out.
+func ResolveMentions(text string, channel string, sender *UserModel) ([]MessageMention, error) {
+	keys := ParseMentions(text)
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	filter := bson.M{
+		"username_key": bson.M{"$in": keys},
+		"_id":          bson.M{"$ne": sender.Id},
+		"blocked":      bson.M{"$ne": sender.Id},
+	}
+	if peerId, ok := DirectPeer(channel, sender.Id); ok {
+		filter["_id"] = peerId
+	} else {
+		filter["explored_sites"] = channel
+	}
+
+	cursor, err := userService.Collection.Find(userService.ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(userService.ctx)
+
+	var users []UserModel
+	if err := cursor.All(userService.ctx, &users); err != nil {
+		return nil, err
+	}
+
+	mentions := []MessageMention{}
+	for _, user := range users {
+		if sender.HasBlocked(user.Id) {
+			continue
+		}
+		mentions = append(mentions, MessageMention{UserId: user.Id, Username: user.Username})
+	}
+	return mentions, nil
+}
+
+// AddToMentionInboxes files a message in the inbox of every user it mentions
+func AddToMentionInboxes(message MessageModel) error {
+	if len(message.Mentions) == 0 {
+		return nil
+	}
+
+	writes := []mongo.WriteModel{}
+	for _, mention := range message.Mentions {
+		writes = append(writes, mongo.NewInsertOneModel().SetDocument(MentionModel{
+			UserId:    mention.UserId,
+			MessageId: message.Id,
+			Channel:   message.ChannelId,
+			CreatedAt: message.CreatedAt,
+		}))
+	}
+
+	_, err := mentionService.Collection.BulkWrite(mentionService.ctx, writes, options.BulkWrite().SetOrdered(false))
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		return err
+	}
+	return nil
+}
+
+func mentionNotification(message MessageModel, read bool) dto.MentionNotification {
+	wire := message.ToDTO()
+	return dto.MentionNotification{
+		MessageId: wire.Id,
+		Channel:   wire.Channel,
+		From:      wire.From,
+		Message:   wire.Message,
+		Read:      read,
+		CreatedAt: wire.CreatedAt,
+	}
+}
+
+// notifyMentions pushes a mention event to every socket of the mentioned
+// users, wherever they are
+func notifyMentions(message MessageModel) {
+	if len(message.Mentions) == 0 {
+		return
+	}
+
+	event := dto.NewEvent(dto.EventMention, message.ChannelId, mentionNotification(message, false))
+	for _, mention := range message.Mentions {
+		for _, userConn := range db.UserSockets(mention.UserId) {
+			userConn.Send(event)
+		}
+	}
+}
+
+// GetMentions returns a page of a user's mentions inbox, newest first
+func GetMentions(userId string, unreadOnly bool, limit int64, bookmarkID string) (dto.MentionPage, error) {
+	page := dto.MentionPage{Mentions: []dto.MentionNotification{}}
+
+	filter := bson.M{"user_id": userId}
+	if unreadOnly {
+		filter["read"] = false
+	}
+	if bookmarkID != "" {
+		objectID, err := primitive.ObjectIDFromHex(bookmarkID)
+		if err != nil {
+			return page, ErrInvalidMessageId
+		}
+		filter["_id"] = bson.M{"$lt": objectID}
+	}
+
+	opts := options.Find().SetLimit(limit + 1).SetSort(bson.M{"_id": -1})
+	cursor, err := mentionService.Collection.Find(mentionService.ctx, filter, opts)
+	if err != nil {
+		return page, err
+	}
+	defer cursor.Close(mentionService.ctx)
+
+	var entries []MentionModel
+	if err := cursor.All(mentionService.ctx, &entries); err != nil {
+		return page, err
+	}
+
+	page.HasMore = len(entries) > int(limit)
+	if page.HasMore {
+		entries = entries[:limit]
+	}
+	if len(entries) > 0 {
+		page.NextBookmark = entries[len(entries)-1].Id.Hex()
+	}
+
+	messageIds := []primitive.ObjectID{}
+	for _, entry := range entries {
+		messageIds = append(messageIds, entry.MessageId)
+	}
+	messages, err := findMessages(bson.M{"_id": bson.M{"$in": messageIds}})
+	if err != nil {
+		return page, err
+	}
+	byId := map[primitive.ObjectID]MessageModel{}
+	for _, message := range messages {
+		byId[message.Id] = message
+	}
+
+	for _, entry := range entries {
+		if message, ok := byId[entry.MessageId]; ok {
+			page.Mentions = append(page.Mentions, mentionNotification(message, entry.Read))
+		}
+	}
+
+	page.Unread, err = CountUnreadMentions(userId)
+	return page, err
+}
+
+// CountUnreadMentions counts the unread entries of a user's inbox
+func CountUnreadMentions(userId string) (int64, error) {
+	return mentionService.Collection.CountDocuments(mentionService.ctx, bson.M{"user_id": userId, "read": false})
+}
+
+// MarkMentionsRead marks inbox entries read, every entry when messageIds is empty
+func MarkMentionsRead(userId string, messageIds []string) error {
+	filter := bson.M{"user_id": userId, "read": false}
+	if len(messageIds) > 0 {
+		objectIds := []primitive.ObjectID{}
+		for _, id := range messageIds {
+			objectID, err := primitive.ObjectIDFromHex(id)
+			if err != nil {
+				return ErrInvalidMessageId
+			}
+			objectIds = append(objectIds, objectID)
+		}
+		filter["message_id"] = bson.M{"$in": objectIds}
+	}
+
+	_, err := mentionService.Collection.UpdateMany(mentionService.ctx, filter, bson.M{"$set": bson.M{"read": true}})
+	return err
+}
+
+// renameMentions keeps the stored mentions of a user rendering their current name
+func renameMentions(userId string, username string) {
+	err := updateMessagesInBatches(
+		bson.M{"mentions": bson.M{"$elemMatch": bson.M{"user_id": userId, "username": bson.M{"$ne": username}}}},
+		bson.M{"mentions.$[m].username": username},
+		options.Update().SetArrayFilters(options.ArrayFilters{Filters: []interface{}{bson.M{"m.user_id": userId}}}),
+	)
+	if err != nil {
+		slog.Error("Renaming mentions failed", "user_id", userId, "err", err)
+	}
+}
@@ -0,0 +1,108 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMentions(t *testing.T) {
+	many := []string{}
+	for i := 0; i < MaxMentions+2; i++ {
+		many = append(many, fmt.Sprintf("user%02d", i))
+	}
+
+	tests := []struct {
+		name string
+		text string
+		want []string // usernames, compared folded
+	}{
+		{"plain", "hello @alice", []string{"alice"}},
+		{"start of text", "@alice hello", []string{"alice"}},
+		{"in parentheses", "(@alice)", []string{"alice"}},
+		{"email address", "write to bob@example.com", []string{}},
+		{"after a word", "x@alice", []string{}},
+		{"trailing punctuation", "thanks @alice, @bob. and @carol-", []string{"alice", "bob", "carol"}},
+		{"separators inside", "@jo_ann.lee", []string{"joannlee"}},
+		{"too short", "@ab", []string{}},
+		{"not starting with a letter", "@_alice @.bob", []string{}},
+		{"folded names", "@Alice @ALICE @al1ce", []string{"alice"}},
+		{"duplicates", "@bob @carol @bob", []string{"bob", "carol"}},
+		{"order of appearance", "@carol then @alice", []string{"carol", "alice"}},
+		{"capped", "@" + strings.Join(many, " @"), many[:MaxMentions]},
+		{"no mention", "hello @", []string{}},
+	}
+	for _, test := range tests {
+		want := make([]string, 0, len(test.want))
+		for _, name := range test.want {
+			want = append(want, FoldUsername(name))
+		}
+
+		got := ParseMentions(test.text)
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("%s: ParseMentions(%q) = %v, want %v", test.name, test.text, got, want)
+		}
+	}
+}
+
+// insertMentionUser stores a user named username, who explored sites
+func insertMentionUser(t *testing.T, username string, sites []string, blocked ...string) *UserModel {
+	t.Helper()
+
+	user := &UserModel{
+		Id:            fmt.Sprintf("%s-%d", username, time.Now().UnixNano()),
+		Username:      username,
+		UsernameKey:   FoldUsername(username),
+		ExploredSites: sites,
+		Blocked:       blocked,
+		CreatedAt:     time.Now(),
+	}
+	if _, err := userService.Collection.InsertOne(userService.ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func TestResolveMentions(t *testing.T) {
+	requireMongo(t)
+
+	suffix := fmt.Sprint(time.Now().UnixNano() % 1000000)
+	channel := "mentions-" + suffix + ".example"
+	sender := insertMentionUser(t, "sender"+suffix, []string{channel})
+	present := insertMentionUser(t, "present"+suffix, []string{channel})
+	elsewhere := insertMentionUser(t, "elsewhere"+suffix, []string{"other.example"})
+	blocking := insertMentionUser(t, "blocking"+suffix, []string{channel}, sender.Id)
+	blockedBySender := insertMentionUser(t, "blocked"+suffix, []string{channel})
+	sender.Blocked = []string{blockedBySender.Id}
+
+	text := fmt.Sprintf("@%s @%s @%s @%s @%s @nobody%s",
+		sender.Username, present.Username, elsewhere.Username, blocking.Username, blockedBySender.Username, suffix)
+
+	tests := []struct {
+		name    string
+		channel string
+		want    []string
+	}{
+		{"public channel", channel, []string{present.Id}},
+		{"direct channel", DirectChannelId(sender.Id, elsewhere.Id), []string{elsewhere.Id}},
+		{"direct channel with a blocked peer", DirectChannelId(sender.Id, blockedBySender.Id), []string{}},
+	}
+	for _, test := range tests {
+		mentions, err := ResolveMentions(text, test.channel, sender)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		got := []string{}
+		for _, mention := range mentions {
+			got = append(got, mention.UserId)
+		}
+		if strings.Join(got, ",") != strings.Join(test.want, ",") {
+			t.Errorf("%s: mentioned %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	if mentions, err := ResolveMentions("no mention here", channel, sender); err != nil || len(mentions) != 0 {
+		t.Fatalf("text without mentions resolved to %v, %v", mentions, err)
+	}
+}
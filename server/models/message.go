@@ -2,28 +2,97 @@ package models
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
+	"server/avatar"
 	"server/db"
+	"server/dto"
+	"server/metrics"
+	"server/tracing"
 	"time"
 
-	"github.com/gofiber/fiber/v2/log"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Message representation
 type MessageModel struct {
-	Id        primitive.ObjectID     `bson:"_id"`
-	CreatedAt time.Time              `bson:"created_at"`
-	UpdatedAt time.Time              `bson:"updated_at"`
-	Message   string                 `bson:"message"`
-	ChannelId string                 `bson:"channel"`
-	To        string                 `json:"to"`
-	From      map[string]interface{} `json:"from"`
-	Reactions map[string]interface{} `json:"reactions"`
-	Flagged   map[string]interface{} `json:"flagged"`
+	Id        primitive.ObjectID  `bson:"_id"`
+	CreatedAt time.Time           `bson:"created_at"`
+	UpdatedAt time.Time           `bson:"updated_at"`
+	Message   string              `bson:"message"`
+	ChannelId string              `bson:"channel"`
+	To        string              `bson:"to"`
+	From      MessageAuthor       `bson:"from"`
+	Reactions map[string][]string `bson:"reactions"`
+	Flagged   map[string][]string `bson:"flagged"`
+	// Set instead of Message on end-to-end encrypted direct messages
+	Encrypted        *EncryptedPayload `bson:"encrypted,omitempty"`
+	Mentions         []MessageMention  `bson:"mentions,omitempty"`
+	ForwardedReports []ForwardedReport `bson:"forwarded_reports,omitempty"`
+	// TraceParent identifies the span that inserted a sampled message, the
+	// change stream continues the trace from it
+	TraceParent string `bson:"traceparent,omitempty"`
+}
+
+// Author block embedded in every message, keys match documents written by
+// earlier versions of the extension
+type MessageAuthor struct {
+	Id         string `bson:"Id"`
+	Username   string `bson:"Username"`
+	AvatarSeed string `bson:"AvatarSeed,omitempty"`
+}
+
+// avatarSeed returns the stored seed, messages written before avatars
+// existed get the seed derived from the author's id
+func (a MessageAuthor) avatarSeed() string {
+	if a.AvatarSeed != "" {
+		return a.AvatarSeed
+	}
+	return avatar.Seed(a.Id)
+}
+
+// ToDTO converts a stored message to its wire representation
+func (m MessageModel) ToDTO() dto.Message {
+	reactions := m.Reactions
+	if reactions == nil {
+		reactions = map[string][]string{}
+	}
+
+	flagged := m.Flagged
+	if flagged == nil {
+		flagged = map[string][]string{}
+	}
+
+	return dto.Message{
+		Version:   dto.Version,
+		Id:        m.Id.Hex(),
+		Channel:   m.ChannelId,
+		Message:   m.Message,
+		To:        m.To,
+		From:      dto.Author{Id: m.From.Id, Username: m.From.Username, Avatar: AvatarURL(m.From.avatarSeed())},
+		Reactions: reactions,
+		Flagged:   flagged,
+		Encrypted: m.Encrypted.ToDTO(),
+		Mentions:  mentionsToDTO(m.Mentions),
+		CreatedAt: m.CreatedAt,
+		UpdatedAt: m.UpdatedAt,
+	}
+}
+
+// MessagesToDTO converts a slice of stored messages to their wire representation
+func MessagesToDTO(messages []MessageModel) []dto.Message {
+	result := make([]dto.Message, 0, len(messages))
+	for _, message := range messages {
+		result = append(result, message.ToDTO())
+	}
+	return result
 }
 
 type MessageService struct {
@@ -37,26 +106,46 @@ func CreateMessageService(collection *mongo.Collection, ctx context.Context) {
 	messageService = MessageService{Collection: collection, ctx: ctx}
 }
 
-func WriteMessageToChannel(message MessageModel) interface{} {
+func WriteMessageToChannel(ctx context.Context, message MessageModel) (MessageModel, error) {
+	ctx, span := tracing.Tracer.Start(ctx, "mongo.insert messages", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
 
 	message.Id = primitive.NewObjectID()
 	message.CreatedAt = time.Now()
-	message.UpdatedAt = time.Now()
+	message.UpdatedAt = message.CreatedAt
+	if message.Reactions == nil {
+		message.Reactions = map[string][]string{}
+	}
+	if message.Flagged == nil {
+		message.Flagged = map[string][]string{}
+	}
+
+	message.TraceParent = tracing.TraceParent(ctx)
+	span.SetAttributes(attribute.String("message.id", message.Id.Hex()))
 
-	result, streamErr := messageService.Collection.InsertOne(messageService.ctx, message)
+	_, streamErr := messageService.Collection.InsertOne(ctx, message)
 	if streamErr != nil {
-		log.Error("%s", streamErr)
+		slog.Error("Writing message failed", "channel", message.ChannelId, "err", streamErr)
+		span.RecordError(streamErr)
+		span.SetStatus(codes.Error, streamErr.Error())
+		return message, streamErr
+	}
+
+	kind := "site"
+	if IsDirectChannel(message.ChannelId) {
+		kind = "direct"
 	}
+	metrics.MessagesSent.WithLabelValues(kind).Inc()
 
-	return result.InsertedID
+	return message, nil
 }
 
 // Report message
-func ReportMessage(messageID string, userID string) (*mongo.UpdateResult, error) {
+func ReportMessage(messageID string, userID string) (dto.ReportResult, error) {
 	// Convert the string to ObjectID
 	objectID, stringToMongIDErr := primitive.ObjectIDFromHex(messageID)
 	if stringToMongIDErr != nil {
-		fmt.Println("Invalid ObjectID passed: ", stringToMongIDErr)
+		return dto.ReportResult{}, ErrInvalidMessageId
 	}
 
 	filter := bson.M{"_id": objectID}
@@ -65,7 +154,10 @@ func ReportMessage(messageID string, userID string) (*mongo.UpdateResult, error)
 	var message bson.M
 	err := messageService.Collection.FindOne(messageService.ctx, filter).Decode(&message)
 	if err != nil {
-		return nil, err
+		if err == mongo.ErrNoDocuments {
+			return dto.ReportResult{}, ErrMessageNotFound
+		}
+		return dto.ReportResult{}, err
 	}
 
 	// Check if the reaction array already exists
@@ -118,21 +210,26 @@ func ReportMessage(messageID string, userID string) (*mongo.UpdateResult, error)
 	}
 
 	// Update the document in the database
-	result, err := messageService.Collection.UpdateOne(messageService.ctx, filter, update)
+	_, err = messageService.Collection.UpdateOne(messageService.ctx, filter, update)
 	if err != nil {
-		return nil, err
+		return dto.ReportResult{}, err
+	}
+
+	// Withdrawn reports are not counted
+	if !userExists {
+		metrics.Reports.WithLabelValues("plain").Inc()
 	}
 
-	return result, nil
+	return dto.ReportResult{MessageId: messageID, Reported: !userExists}, nil
 }
 
 // AddReaction adds or updates a reaction in the message's reactions map
-func AddRemoveReaction(messageID string, reactionKey string, userID string) (*mongo.UpdateResult, error) {
+func AddRemoveReaction(messageID string, reactionKey string, userID string) (dto.ReactionResult, error) {
 
 	// Convert the string to ObjectID
 	objectID, stringToMongIDErr := primitive.ObjectIDFromHex(messageID)
 	if stringToMongIDErr != nil {
-		fmt.Println("Invalid ObjectID passed: ", stringToMongIDErr)
+		return dto.ReactionResult{}, ErrInvalidMessageId
 	}
 
 	filter := bson.M{"_id": objectID}
@@ -141,7 +238,10 @@ func AddRemoveReaction(messageID string, reactionKey string, userID string) (*mo
 	var message bson.M
 	err := messageService.Collection.FindOne(messageService.ctx, filter).Decode(&message)
 	if err != nil {
-		return nil, err
+		if err == mongo.ErrNoDocuments {
+			return dto.ReactionResult{}, ErrMessageNotFound
+		}
+		return dto.ReactionResult{}, err
 	}
 
 	// Check if the reaction array already exists
@@ -194,35 +294,48 @@ func AddRemoveReaction(messageID string, reactionKey string, userID string) (*mo
 	}
 
 	// Update the document in the database
-	result, err := messageService.Collection.UpdateOne(messageService.ctx, filter, update)
+	_, err = messageService.Collection.UpdateOne(messageService.ctx, filter, update)
 	if err != nil {
-		return nil, err
+		return dto.ReactionResult{}, err
+	}
+
+	action := "add"
+	if userExists {
+		action = "remove"
 	}
+	metrics.Reactions.WithLabelValues(action).Inc()
 
-	return result, nil
+	return dto.ReactionResult{
+		MessageId: messageID,
+		Emoji:     reactionKey,
+		Reacted:   !userExists,
+		Count:     len(updatedUserList),
+	}, nil
 }
 
-func GetSingleMessage(id string, siteId string) (MessageModel, bool) {
-	filter := bson.M{
-		"channel": siteId,
+// GetSingleMessage returns a message of a channel, any channel when siteId is empty
+func GetSingleMessage(id string, siteId string) (MessageModel, error) {
+	filter := bson.M{}
+	if siteId != "" {
+		filter["channel"] = siteId
 	}
 
+	var message MessageModel
 	objectID, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
-		fmt.Println("Invalid ObjectID:", err)
+		return message, ErrInvalidMessageId
 	}
 	filter["_id"] = objectID
 
-	var message MessageModel
 	err = messageService.Collection.FindOne(messageService.ctx, filter).Decode(&message)
 	if err != nil {
-		log.Fatal("Message not found:", err)
-		return message, false
+		if err == mongo.ErrNoDocuments {
+			return message, ErrMessageNotFound
+		}
+		return message, err
 	}
 
-	// Print the result
-	fmt.Println("Message found:", id)
-	return message, true
+	return message, nil
 }
 
 // GetLast50Messages returns the last 50 messages for a specific channel, starting from a given message ID
@@ -237,7 +350,7 @@ func GetMessages(limit int64, channel string, bookmarkID string) ([]MessageModel
 		// Convert the string to ObjectID
 		objectID, err := primitive.ObjectIDFromHex(bookmarkID)
 		if err != nil {
-			fmt.Println("Invalid ObjectID:", err)
+			return nil, "", false, ErrInvalidMessageId
 		}
 		filter["_id"] = bson.M{"$lt": objectID} // Get messages with IDs less than the bookmark
 	}
@@ -274,85 +387,168 @@ func GetMessages(limit int64, channel string, bookmarkID string) ([]MessageModel
 	return messages, lastMessageID, hasMoreMessages, nil
 }
 
-func ListenAllChanges() {
+// changeEvent is the subset of a change stream document the server reacts to
+type changeEvent struct {
+	OperationType string              `bson:"operationType"`
+	ClusterTime   primitive.Timestamp `bson:"clusterTime"`
+	DocumentKey   struct {
+		Id primitive.ObjectID `bson:"_id"`
+	} `bson:"documentKey"`
+	FullDocument MessageModel `bson:"fullDocument"`
+	// FullDocumentBeforeChange is set on deletes once pre-images are
+	// enabled, see EnsureMessagePreImages
+	FullDocumentBeforeChange MessageModel `bson:"fullDocumentBeforeChange"`
+}
+
+// rewriteField is set to a new id by every bulk rewrite of messages, such as
+// a rename or an erasure. The change stream leaves these updates out, so one
+// rewrite does not send an update event per message to every socket.
+const rewriteField = "rewrite_id"
+
+// withRewrite marks the fields set by a bulk rewrite of messages
+func withRewrite(set bson.M) bson.M {
+	set[rewriteField] = primitive.NewObjectID()
+	return set
+}
+
+// EnsureMessagePreImages makes the messages collection record pre-images,
+// the change stream needs them to tell which channel a deleted message was on
+func EnsureMessagePreImages() error {
+	database := messageService.Collection.Database()
+	preImages := bson.M{"enabled": true}
+
+	err := database.RunCommand(messageService.ctx, bson.D{
+		{Key: "collMod", Value: messageService.Collection.Name()},
+		{Key: "changeStreamPreAndPostImages", Value: preImages},
+	}).Err()
+
+	// A fresh database has no messages collection yet
+	var commandErr mongo.CommandError
+	if errors.As(err, &commandErr) && commandErr.Name == "NamespaceNotFound" {
+		return database.CreateCollection(messageService.ctx, messageService.Collection.Name(),
+			options.CreateCollection().SetChangeStreamPreAndPostImages(preImages))
+	}
+	return err
+}
+
+// dispatchChange pushes a message change to every socket subscribed to its
+// channel, direct messages reach every socket of both participants. The
+// events carry the fan-out span so socket writes join the trace.
+func dispatchChange(ctx context.Context, eventType string, message MessageModel) {
+	if message.Id.IsZero() {
+		return
+	}
+
+	ctx, span := tracing.Tracer.Start(ctx, "realtime.fanout")
+	defer span.End()
+
+	event := dto.NewEvent(eventType, message.ChannelId, message.ToDTO()).WithContext(ctx)
+	sockets := db.Sockets(func(socket *db.UserSocket) bool {
+		if IsDirectChannel(message.ChannelId) {
+			return CheckChannelAccess(message.ChannelId, socket.UserId) == nil
+		}
+		return socket.Subscribed(message.ChannelId)
+	})
+	span.SetAttributes(
+		attribute.String("event.type", eventType),
+		attribute.String("message.id", message.Id.Hex()),
+		attribute.Int("realtime.sockets", len(sockets)),
+	)
+	for _, userConn := range sockets {
+		userConn.Send(event)
+	}
+
+	if eventType == dto.EventInsert {
+		notifyMentions(message)
+	}
+}
+
+// receiveChange records the receipt of a change stream event. An insert
+// continues the trace of the request that wrote the message; updates carry
+// the context of the insert too, so they start a trace of their own.
+func receiveChange(ctx context.Context, event changeEvent) context.Context {
+	if event.OperationType == "insert" {
+		ctx = tracing.ContinueTrace(ctx, event.FullDocument.TraceParent)
+	}
+
+	ctx, span := tracing.Tracer.Start(ctx, "change_stream.receive", trace.WithSpanKind(trace.SpanKindConsumer))
+	span.SetAttributes(
+		attribute.String("change.operation", event.OperationType),
+		attribute.Int64("change.lag_seconds", time.Now().Unix()-int64(event.ClusterTime.T)),
+	)
+	span.End()
+	return ctx
+}
+
+// handleChange dispatches one change stream event of the messages
+// collection
+func handleChange(ctx context.Context, event changeEvent) {
+	switch event.OperationType {
+	case "insert":
+		dispatchChange(ctx, dto.EventInsert, event.FullDocument)
+	case "update":
+		dispatchChange(ctx, dto.EventUpdate, event.FullDocument)
+	case "delete":
+		message := event.FullDocumentBeforeChange
+		if message.ChannelId == "" {
+			slog.Debug("Deleted message has no pre-image", "message_id", event.DocumentKey.Id.Hex())
+			return
+		}
+		message.Id = event.DocumentKey.Id
+		dispatchChange(ctx, dto.EventDelete, message)
+	default:
+		slog.Debug("Unhandled change stream operation", "operation", event.OperationType)
+	}
+}
+
+// ListenAllChanges dispatches every change of the messages collection until
+// ctx is cancelled, it returns the error that stopped the change stream
+// otherwise
+func ListenAllChanges(ctx context.Context) error {
 
-	// Define the options for the change stream
-	options := options.ChangeStream().SetFullDocument(options.UpdateLookup) // Retrieve the full document
+	// Define the options for the change stream, deletes carry the message
+	// as it was so its channel is known
+	options := options.ChangeStream().
+		SetFullDocument(options.UpdateLookup).
+		SetFullDocumentBeforeChange(options.WhenAvailable)
 
-	// Define the pipeline without any filters to capture all changes
-	pipeline := mongo.Pipeline{}
+	// Capture every change but the bulk rewrites, see rewriteField
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"updateDescription.updatedFields." + rewriteField: bson.M{"$exists": false}}}},
+	}
 
 	// Start the change stream
-	changeStream, err := messageService.Collection.Watch(context.TODO(), pipeline, options)
+	changeStream, err := messageService.Collection.Watch(ctx, pipeline, options)
 	if err != nil {
-		log.Fatalf("Error watching collection: %v", err)
+		return fmt.Errorf("watching messages: %w", err)
 	}
-	defer changeStream.Close(context.TODO())
+	defer changeStream.Close(context.Background())
 
-	fmt.Println("Watching for all changes in the collection...")
+	slog.Info("Watching for all changes in the collection")
 
 	// Listen for changes
-	for changeStream.Next(context.TODO()) {
-		var event bson.M
+	for changeStream.Next(ctx) {
+		var event changeEvent
 		if err := changeStream.Decode(&event); err != nil {
-			log.Errorf("Error decoding change stream event: %v", err)
+			slog.Error("Decoding change stream event failed", "err", err)
 			continue
 		}
-
-		// Process the change event (insert, update, delete, etc.)
-		// fmt.Printf("Received change event: %v\n", event)
-
-		operationType, ok := event["operationType"]
-		if ok {
-			switch operationType {
-			case "insert":
-				// fmt.Println("An insert operation occurred.", event)
-				for _, userConn := range db.Connections {
-					if doc, docExists := event["fullDocument"].(bson.M); docExists {
-						if channel, channelExists := doc["channel"].(string); channelExists {
-							if userConn.IsActive && userConn.ActiveSite == channel {
-								userConn.Channel <- map[string]interface{}{
-									"doc":  doc,
-									"type": "insert",
-								}
-							}
-						}
-					}
-				}
-			case "update":
-				// fmt.Println("An update operation occurred.", event)
-				for _, userConn := range db.Connections {
-					if doc, docExists := event["fullDocument"].(bson.M); docExists {
-						if channel, channelExists := doc["channel"].(string); channelExists {
-							if userConn.IsActive && userConn.ActiveSite == channel {
-								userConn.Channel <- map[string]interface{}{
-									"doc":  doc,
-									"type": "update",
-								}
-							}
-						}
-					}
-				}
-			case "delete":
-				fmt.Println("A delete operation occurred.", event)
-				// Handle delete logic here
-			default:
-				fmt.Printf("Other operation: %v\n", operationType)
-			}
-		}
+		metrics.ChangeStreamLag.Set(metrics.Since(time.Unix(int64(event.ClusterTime.T), 0)))
+		handleChange(receiveChange(ctx, event), event)
 	}
 
-	// Check for errors in the change stream
-	if err := changeStream.Err(); err != nil {
-		log.Fatalf("Change stream error: %v", err)
+	// Check for errors in the change stream, cancelling ctx is a clean stop
+	if err := changeStream.Err(); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("change stream: %w", err)
 	}
+	return nil
 }
 
 func ListenChannel(channelId string) {
 
 	// Define a match stage for filtering by channel
-	matchStage := bson.D{{"$match", bson.D{
-		{"fullDocument.channel", channelId}, // Match documents where the 'channel' field equals the provided channel name
+	matchStage := bson.D{{Key: "$match", Value: bson.D{
+		{Key: "fullDocument.channel", Value: channelId}, // Match documents where the 'channel' field equals the provided channel name
 	}}}
 
 	// Define the pipeline with the match stage
@@ -361,49 +557,37 @@ func ListenChannel(channelId string) {
 	// Start the change stream
 	changeStream, err := messageService.Collection.Watch(context.TODO(), pipeline)
 	if err != nil {
-		log.Fatalf("Error watching collection: %v", err)
+		slog.Error("Watching channel failed", "channel", channelId, "err", err)
+		return
 	}
 	defer changeStream.Close(context.TODO())
 
-	fmt.Printf("Watching for changes in channel: %s\n", channelId)
+	slog.Info("Watching for changes in channel", "channel", channelId)
 
 	// Listen for changes
 	for changeStream.Next(context.TODO()) {
-		var event bson.M
+		var event changeEvent
 		if err := changeStream.Decode(&event); err != nil {
-			log.Errorf("Error decoding change stream event: %v", err)
+			slog.Error("Decoding change stream event failed", "err", err)
+			continue
 		}
 
-		// Process the change event (insert, update, delete, etc.)
-		fmt.Printf("Received change event: %v\n", event)
-
-		operationType, ok := event["operationType"].(string)
-		if ok {
-			switch operationType {
-			case "insert":
-				for _, userConn := range db.Connections {
-					if doc, docExists := event["fullDocument"].(bson.M); docExists {
-						if channel, channelExists := doc["channel"].(string); channelExists {
-							if userConn.IsActive && userConn.ActiveSite == channel {
-								userConn.Channel <- doc
-							}
-						}
-					}
-				}
-			case "update":
-				fmt.Printf("Update event: %v\n", event)
-			case "delete":
-				//
-			default:
-				log.Debugf("Unhandled operation type: %s", operationType)
-			}
+		switch event.OperationType {
+		case "insert":
+			dispatchChange(receiveChange(context.Background(), event), dto.EventInsert, event.FullDocument)
+		case "update":
+			slog.Debug("Message updated", "change", event)
+		case "delete":
+			//
+		default:
+			slog.Debug("Unhandled change stream operation", "operation", event.OperationType)
 		}
 
 	}
 
 	// Check for errors in the change stream
 	if err := changeStream.Err(); err != nil {
-		log.Fatalf("Change stream error: %v", err)
+		slog.Error("Channel change stream stopped", "channel", channelId, "err", err)
 	}
 
 }
@@ -0,0 +1,300 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"server/db"
+	"server/dto"
+	"server/logging"
+	"server/metrics"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// TypingInterval throttles typing events of a user on a channel
+const TypingInterval = 3 * time.Second
+
+var (
+	// heartbeatInterval is how often the server pings websockets and writes
+	// keepalives to event streams
+	heartbeatInterval = 10 * time.Second
+	// heartbeatTimeout is how long a socket stays open without hearing from
+	// its client, see SetHeartbeat
+	heartbeatTimeout = 30 * time.Second
+)
+
+// SetHeartbeat changes how often clients are pinged and how long a socket
+// may stay silent, the timeout must leave room for a ping and its answer
+func SetHeartbeat(interval time.Duration, timeout time.Duration) error {
+	if interval <= 0 || timeout <= interval {
+		return fmt.Errorf("heartbeat timeout %s must be longer than the interval %s", timeout, interval)
+	}
+	heartbeatInterval = interval
+	heartbeatTimeout = timeout
+	return nil
+}
+
+// Heartbeat returns the ping interval and the idle timeout of sockets
+func Heartbeat() (time.Duration, time.Duration) {
+	return heartbeatInterval, heartbeatTimeout
+}
+
+// presentUser is the entry shown for a socket in presence lists and events
+func presentUser(socket *db.UserSocket) dto.PresentUser {
+	return dto.PresentUser{
+		Id:       socket.UserId,
+		Username: socket.Username,
+		Avatar:   AvatarURL(socket.AvatarSeed),
+	}
+}
+
+// broadcast pushes event to every socket subscribed to channel except those
+// of userId
+func broadcast(channel string, userId string, event dto.Event) {
+	sockets := db.Sockets(func(socket *db.UserSocket) bool {
+		return socket.Subscribed(channel) && socket.UserId != userId
+	})
+	for _, userConn := range sockets {
+		userConn.Send(event)
+	}
+}
+
+// announce tells a channel that user joined or left it, direct channels
+// have no presence
+func announce(eventType string, channel string, user dto.PresentUser) {
+	if channel == "" || IsDirectChannel(channel) {
+		return
+	}
+	broadcast(channel, user.Id, dto.NewEvent(eventType, channel, dto.PresenceEvent{User: user}))
+}
+
+// Connect registers an open socket and announces its user on their channel
+func Connect(socket *db.UserSocket) {
+	if db.AddSocket(socket) && !socket.Invisible {
+		go announce(dto.EventJoined, socket.ActiveSite, presentUser(socket))
+	}
+	Background(func() { refreshConnected([]string{socket.UserId}, time.Now()) })
+}
+
+// refreshConnected records that users have a socket on this instance, so
+// other instances know not to send them push notifications. The record
+// lapses a heartbeat timeout after the last refresh, ReapPresence refreshes
+// it every heartbeat interval while the sockets stay open.
+func refreshConnected(userIds []string, now time.Time) {
+	until := now.Add(heartbeatTimeout)
+	for len(userIds) > 0 {
+		batch := userIds
+		if len(batch) > 1000 {
+			batch = batch[:1000]
+		}
+		userIds = userIds[len(batch):]
+
+		_, err := userService.Collection.UpdateMany(userService.ctx,
+			bson.M{"_id": bson.M{"$in": batch}},
+			bson.M{"$set": bson.M{"connected_until": until}},
+		)
+		if err != nil {
+			slog.Error("Refreshing connected users failed", "users", len(batch), "err", err)
+		}
+	}
+}
+
+// IsConnected reports whether user has a socket open on this or, as of its
+// last refresh, another instance
+func (u UserModel) IsConnected(now time.Time) bool {
+	if len(db.UserSockets(u.Id)) > 0 {
+		return true
+	}
+	return u.ConnectedUntil != nil && now.Before(*u.ConnectedUntil)
+}
+
+// Disconnect forgets a socket and announces when its user left the channel,
+// it is safe to call more than once
+func Disconnect(socket *db.UserSocket) {
+	if db.RemoveSocket(socket) && !socket.Invisible {
+		go announce(dto.EventLeft, socket.ActiveSite, presentUser(socket))
+	}
+}
+
+// MoveUser moves every socket of a user to channel, announcing the user on
+// the channels they left and the one they joined
+func MoveUser(userId string, channel string) {
+	left, joined := db.SetActiveSite(userId, channel)
+
+	sockets := db.UserSockets(userId)
+	if len(sockets) == 0 {
+		return
+	}
+	if sockets[0].Invisible {
+		return
+	}
+	user := presentUser(sockets[0])
+
+	go func() {
+		for _, site := range left {
+			announce(dto.EventLeft, site, user)
+		}
+		if joined {
+			announce(dto.EventJoined, channel, user)
+		}
+	}()
+}
+
+// SetInvisible hides or shows a connected user, they appear to leave or
+// join the channels they are on
+func SetInvisible(userId string, invisible bool) {
+	sockets := db.UserSockets(userId)
+	if len(sockets) == 0 || sockets[0].Invisible == invisible {
+		return
+	}
+
+	sites := db.SetInvisible(userId, invisible)
+	eventType := dto.EventJoined
+	if invisible {
+		eventType = dto.EventLeft
+	}
+
+	user := presentUser(sockets[0])
+	go func() {
+		for _, site := range sites {
+			announce(eventType, site, user)
+		}
+	}()
+}
+
+// ListPresence returns the visible users on channel, sorted by username
+func ListPresence(channel string) dto.Presence {
+	sockets := db.Sockets(func(socket *db.UserSocket) bool {
+		return socket.ActiveSite == channel
+	})
+
+	presence := dto.Presence{Channel: channel, Users: []dto.PresentUser{}}
+	seen := map[string]bool{}
+	for _, socket := range sockets {
+		if seen[socket.UserId] {
+			continue
+		}
+		seen[socket.UserId] = true
+		presence.Live++
+
+		if !socket.Invisible {
+			presence.Users = append(presence.Users, presentUser(socket))
+		}
+	}
+
+	sort.Slice(presence.Users, func(i, j int) bool {
+		return presence.Users[i].Username < presence.Users[j].Username
+	})
+	return presence
+}
+
+var (
+	typingMutex sync.Mutex
+	// lastTyping holds when a typing event was last sent per user and channel
+	lastTyping = make(map[string]time.Time)
+)
+
+// allowTyping reports whether a typing event of userId on channel may be
+// sent now
+func allowTyping(userId string, channel string, now time.Time) bool {
+	typingMutex.Lock()
+	defer typingMutex.Unlock()
+
+	key := userId + "\x00" + channel
+	if last, ok := lastTyping[key]; ok && now.Sub(last) < TypingInterval {
+		return false
+	}
+	lastTyping[key] = now
+	return true
+}
+
+// pruneTyping forgets throttle entries that no longer hold anything back
+func pruneTyping(now time.Time) {
+	typingMutex.Lock()
+	defer typingMutex.Unlock()
+
+	for key, last := range lastTyping {
+		if now.Sub(last) >= TypingInterval {
+			delete(lastTyping, key)
+		}
+	}
+}
+
+// SendTyping tells the other users on channel that the owner of socket is
+// typing, at most once per TypingInterval. On a direct channel only the
+// peer is told, and only when neither blocked the other.
+func SendTyping(socket *db.UserSocket, channel string) {
+	if channel == "" {
+		channel = socket.ActiveSite
+	}
+	if channel == "" || !allowTyping(socket.UserId, channel, time.Now()) {
+		return
+	}
+
+	event := dto.NewEvent(dto.EventTyping, channel, dto.Typing{UserId: socket.UserId, Username: socket.Username})
+
+	if !IsDirectChannel(channel) {
+		if db.IsSubscribed(socket, channel) {
+			broadcast(channel, socket.UserId, event)
+		}
+		return
+	}
+
+	peerId, ok := DirectPeer(channel, socket.UserId)
+	if !ok {
+		return
+	}
+	sender, err := GetUser(socket.UserId)
+	if err != nil {
+		return
+	}
+	if _, err := CheckDirectAllowed(sender, peerId); err != nil {
+		return
+	}
+	for _, userConn := range db.UserSockets(peerId) {
+		userConn.Send(event)
+	}
+}
+
+// ReapPresence closes sockets whose clients stopped sending heartbeats, so
+// presence does not depend on close frames that never arrive. Websockets
+// also time out on their own read deadline, this catches the others.
+func ReapPresence() {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		reapStale(now)
+		pruneTyping(now)
+		refreshConnected(connectedUsers(), now)
+	}
+}
+
+// reapStale closes the sockets not heard from within a heartbeat timeout
+// of now
+func reapStale(now time.Time) {
+	for _, socket := range db.StaleSockets(now.Add(-heartbeatTimeout)) {
+		logging.Noisy.Log(context.Background(), slog.Default(), slog.LevelInfo, "Closing socket without heartbeat", "user_id", socket.UserId)
+		metrics.ReapedSockets.WithLabelValues("idle").Inc()
+		Disconnect(socket)
+		socket.Close()
+	}
+}
+
+// connectedUsers returns the ids of the users with a socket on this instance
+func connectedUsers() []string {
+	connected := map[string]bool{}
+	for _, socket := range db.Sockets(func(*db.UserSocket) bool { return true }) {
+		connected[socket.UserId] = true
+	}
+	userIds := make([]string, 0, len(connected))
+	for userId := range connected {
+		userIds = append(userIds, userId)
+	}
+	return userIds
+}
@@ -0,0 +1,332 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"server/db"
+	"server/dto"
+	"server/metrics"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var (
+	mongoOnce      sync.Once
+	mongoConnected bool
+	mongoErr       error
+)
+
+// requireMongo points the services the tests use at a throwaway database
+// on MONGO_URL
+func requireMongo(t *testing.T) {
+	t.Helper()
+
+	url := os.Getenv("MONGO_URL")
+	if url == "" {
+		t.Skip("MONGO_URL is not set")
+	}
+
+	mongoOnce.Do(func() {
+		database := fmt.Sprintf("models_test_%d", time.Now().UnixNano())
+		if mongoErr = db.MongoConnect(url, database); mongoErr != nil {
+			return
+		}
+		mongoConnected = true
+
+		collection, ctx := db.MongoInit("users")
+		CreateUserService(collection, ctx)
+	})
+	if mongoErr != nil {
+		t.Fatalf("setting up Mongo: %v", mongoErr)
+	}
+}
+
+// TestMain drops the throwaway database once every test ran
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if mongoConnected {
+		collection, ctx := db.MongoInit("users")
+		collection.Database().Drop(ctx)
+		db.MongoClose(context.Background())
+	}
+	os.Exit(code)
+}
+
+// addTestSocket registers a socket of userId outside any channel, so no
+// presence is announced
+func addTestSocket(t *testing.T, userId string) *db.UserSocket {
+	t.Helper()
+
+	socket := db.NewUserSocket(userId, nil, "")
+	db.AddSocket(socket)
+	t.Cleanup(func() {
+		db.RemoveSocket(socket)
+		socket.Close()
+	})
+	return socket
+}
+
+func TestSetHeartbeat(t *testing.T) {
+	interval, timeout := Heartbeat()
+	t.Cleanup(func() { SetHeartbeat(interval, timeout) })
+
+	tests := []struct {
+		interval time.Duration
+		timeout  time.Duration
+		valid    bool
+	}{
+		{time.Second, 3 * time.Second, true},
+		{time.Second, time.Second, false},
+		{time.Second, 500 * time.Millisecond, false},
+		{0, time.Second, false},
+	}
+	for _, test := range tests {
+		err := SetHeartbeat(test.interval, test.timeout)
+		if (err == nil) != test.valid {
+			t.Errorf("SetHeartbeat(%s, %s) = %v, want valid %v", test.interval, test.timeout, err, test.valid)
+		}
+	}
+	if gotInterval, gotTimeout := Heartbeat(); gotInterval != time.Second || gotTimeout != 3*time.Second {
+		t.Fatalf("invalid settings were applied: %s, %s", gotInterval, gotTimeout)
+	}
+}
+
+func TestReapClosesSocketsWithoutHeartbeat(t *testing.T) {
+	_, timeout := Heartbeat()
+	socket := addTestSocket(t, "reaped-user")
+	before := testutil.ToFloat64(metrics.ReapedSockets.WithLabelValues("idle"))
+
+	// Heard from just now, the socket stays
+	now := socket.LastSeen()
+	reapStale(now.Add(timeout - time.Second))
+	if len(db.UserSockets("reaped-user")) != 1 {
+		t.Fatal("a socket heard from within the timeout was reaped")
+	}
+
+	reapStale(now.Add(timeout + time.Second))
+	if len(db.UserSockets("reaped-user")) != 0 {
+		t.Fatal("a silent socket was not reaped")
+	}
+	select {
+	case <-socket.Done():
+	default:
+		t.Fatal("the reaped socket was not closed")
+	}
+	if got := testutil.ToFloat64(metrics.ReapedSockets.WithLabelValues("idle")) - before; got != 1 {
+		t.Fatalf("counted %v reaped sockets, want 1", got)
+	}
+}
+
+func TestConnectedUsersListsEachUserOnce(t *testing.T) {
+	addTestSocket(t, "tabs-user")
+	addTestSocket(t, "tabs-user")
+
+	count := 0
+	for _, userId := range connectedUsers() {
+		if userId == "tabs-user" {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Fatalf("user with two tabs listed %d times, want once", count)
+	}
+}
+
+func TestLocalSocketMeansConnected(t *testing.T) {
+	addTestSocket(t, "local-user")
+
+	if !(UserModel{Id: "local-user"}).IsConnected(time.Now()) {
+		t.Fatal("user with a socket on this instance is not connected")
+	}
+	if (UserModel{Id: "nobody"}).IsConnected(time.Now()) {
+		t.Fatal("user without a socket or lease is connected")
+	}
+}
+
+func TestConnectedLeaseLapsesAfterTheTimeout(t *testing.T) {
+	requireMongo(t)
+	_, timeout := Heartbeat()
+
+	userId := fmt.Sprintf("lease-%d", time.Now().UnixNano())
+	if _, err := userService.Collection.InsertOne(userService.ctx, UserModel{Id: userId}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another instance holds the socket, this one only sees the lease
+	now := time.Now().Truncate(time.Millisecond)
+	refreshConnected([]string{userId}, now)
+	user, err := GetUser(userId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.IsConnected(now.Add(timeout - time.Second)) {
+		t.Fatal("user is not connected within the lease")
+	}
+	if user.IsConnected(now.Add(timeout + time.Second)) {
+		t.Fatal("lease did not lapse after the heartbeat timeout")
+	}
+
+	// A refresh a heartbeat later pushes the lease back
+	interval, _ := Heartbeat()
+	refreshConnected([]string{userId}, now.Add(interval))
+	if user, err = GetUser(userId); err != nil {
+		t.Fatal(err)
+	}
+	if !user.IsConnected(now.Add(timeout + time.Second)) {
+		t.Fatal("refresh did not extend the lease")
+	}
+}
+
+// forgetTyping clears the typing throttle once the test is done, so reruns
+// start from nothing
+func forgetTyping(t *testing.T, now time.Time) {
+	t.Cleanup(func() { pruneTyping(now.Add(time.Hour)) })
+}
+
+func TestAllowTyping(t *testing.T) {
+	now := time.Now()
+	forgetTyping(t, now)
+	tests := []struct {
+		name    string
+		userId  string
+		channel string
+		at      time.Duration
+		want    bool
+	}{
+		{"first event", "typist", "typing.example", 0, true},
+		{"within the interval", "typist", "typing.example", TypingInterval - time.Millisecond, false},
+		{"other channel", "typist", "other.example", time.Second, true},
+		{"other user", "other-typist", "typing.example", time.Second, true},
+		{"after the interval", "typist", "typing.example", TypingInterval, true},
+		{"interval restarts", "typist", "typing.example", TypingInterval + time.Second, false},
+	}
+	for _, test := range tests {
+		if got := allowTyping(test.userId, test.channel, now.Add(test.at)); got != test.want {
+			t.Errorf("%s: allowTyping = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestPruneTyping(t *testing.T) {
+	now := time.Now()
+	forgetTyping(t, now)
+	allowTyping("pruned-typist", "typing.example", now)
+	allowTyping("kept-typist", "typing.example", now.Add(time.Second))
+
+	pruneTyping(now.Add(TypingInterval))
+
+	// A forgotten event no longer throttles, even at a time it would have
+	if !allowTyping("pruned-typist", "typing.example", now.Add(time.Millisecond)) {
+		t.Error("an expired entry was not pruned")
+	}
+	if allowTyping("kept-typist", "typing.example", now.Add(time.Second+time.Millisecond)) {
+		t.Error("an entry within the interval was pruned")
+	}
+}
+
+// addPresentSocket registers a socket of userId on channel under username
+func addPresentSocket(t *testing.T, userId string, username string, channel string) *db.UserSocket {
+	t.Helper()
+
+	socket := db.NewUserSocket(userId, nil, channel)
+	socket.Username = username
+	db.AddSocket(socket)
+	t.Cleanup(func() {
+		db.RemoveSocket(socket)
+		socket.Close()
+	})
+	return socket
+}
+
+// drainSocket discards the events sent to socket until it is closed, as
+// the writer of a connected client would
+func drainSocket(socket *db.UserSocket) {
+	go func() {
+		for {
+			select {
+			case <-socket.Channel:
+			case <-socket.Done():
+				return
+			}
+		}
+	}()
+}
+
+// nextEvent returns the next event sent to socket
+func nextEvent(t *testing.T, socket *db.UserSocket) dto.Event {
+	t.Helper()
+
+	select {
+	case event := <-socket.Channel:
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("no event was sent")
+		return dto.Event{}
+	}
+}
+
+func TestInvisibleUsersAreLeftOutOfPresence(t *testing.T) {
+	channel := "invisible.example"
+	observer := addPresentSocket(t, "observer", "observer", "")
+	db.Subscribe(observer, channel, "tag", 10)
+	drainSocket(addPresentSocket(t, "zoe", "zoe", channel))
+	drainSocket(addPresentSocket(t, "amy", "amy", channel))
+	drainSocket(addPresentSocket(t, "amy", "amy", channel))
+
+	presence := ListPresence(channel)
+	if presence.Live != 2 || len(presence.Users) != 2 || presence.Users[0].Username != "amy" || presence.Users[1].Username != "zoe" {
+		t.Fatalf("presence = %+v, want amy then zoe, each once", presence)
+	}
+
+	SetInvisible("amy", true)
+	if event := nextEvent(t, observer); event.Type != dto.EventLeft || event.Data.(dto.PresenceEvent).User.Id != "amy" {
+		t.Fatalf("going invisible sent %+v, want amy leaving", event)
+	}
+	presence = ListPresence(channel)
+	if presence.Live != 2 || len(presence.Users) != 1 || presence.Users[0].Id != "zoe" {
+		t.Fatalf("presence = %+v, want only zoe listed and both counted", presence)
+	}
+
+	// Hiding twice announces nothing more
+	SetInvisible("amy", true)
+
+	SetInvisible("amy", false)
+	if event := nextEvent(t, observer); event.Type != dto.EventJoined || event.Data.(dto.PresenceEvent).User.Id != "amy" {
+		t.Fatalf("showing again sent %+v, want amy joining", event)
+	}
+	if presence = ListPresence(channel); len(presence.Users) != 2 {
+		t.Fatalf("presence = %+v, want amy listed again", presence)
+	}
+}
+
+func TestStalledSocketDoesNotBlockBroadcast(t *testing.T) {
+	channel := "stalled.example"
+	observer := addPresentSocket(t, "observer", "observer", channel)
+	stalled := addPresentSocket(t, "stalled", "stalled", channel)
+	before := testutil.ToFloat64(metrics.DroppedEvents.WithLabelValues("slow_consumer"))
+
+	// Nobody reads the stalled socket, the observer keeps up
+	for i := 0; i <= db.SendBuffer; i++ {
+		broadcast(channel, "typist", dto.NewEvent(dto.EventTyping, channel, nil))
+		nextEvent(t, observer)
+	}
+
+	select {
+	case <-stalled.Done():
+	default:
+		t.Fatal("a socket that fell a whole buffer behind was not closed")
+	}
+	select {
+	case <-observer.Done():
+		t.Fatal("a socket that kept up was closed")
+	default:
+	}
+	if got := testutil.ToFloat64(metrics.DroppedEvents.WithLabelValues("slow_consumer")) - before; got != 1 {
+		t.Fatalf("counted %v slow consumers, want 1", got)
+	}
+}
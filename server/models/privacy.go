@@ -0,0 +1,157 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"server/privacy"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrIpHashKeyMissing is returned by MigrateUserNetworkData when raw ips
+// would be replaced by hashes that no longer match after a restart
+var ErrIpHashKeyMissing = errors.New("IP_HASH_KEYS is not set, refusing to replace stored ips with hashes that do not survive a restart")
+
+var (
+	ipHasher, _ = privacy.NewIPHasher(privacy.EphemeralKey())
+	// rawIpRetention is how long the raw ip of a user is kept, zero never stores it
+	rawIpRetention time.Duration
+)
+
+// SetIpPrivacy configures how network data of users is stored
+func SetIpPrivacy(hasher *privacy.IPHasher, retention time.Duration) {
+	ipHasher = hasher
+	rawIpRetention = retention
+}
+
+// HashIp returns the keyed hash stored in place of ip
+func HashIp(ip string) string {
+	return ipHasher.Hash(ip)
+}
+
+// RetainRawIp records ip on the user when a retention period is configured
+func RetainRawIp(user *UserModel, ip string) {
+	if rawIpRetention <= 0 {
+		user.RawIp = ""
+		user.RawIpExpiresAt = nil
+		return
+	}
+
+	expiresAt := time.Now().Add(rawIpRetention)
+	user.RawIp = ip
+	user.RawIpExpiresAt = &expiresAt
+}
+
+// EnsureIpHashIndex indexes users by the hash of their ip, which IsIpBanned
+// looks up on every registration
+func EnsureIpHashIndex() error {
+	_, err := userService.Collection.Indexes().CreateOne(userService.ctx, mongo.IndexModel{
+		Keys:    bson.M{"ip_hash": 1},
+		Options: options.Index().SetName("ip_hash"),
+	})
+	return err
+}
+
+// IsIpBanned reports whether a banned user was seen on ip, under any key of the ring
+func IsIpBanned(ip string) (bool, error) {
+	filter := bson.M{
+		"is_banned": true,
+		"ip_hash":   bson.M{"$in": ipHasher.Candidates(ip)},
+	}
+
+	count, err := userService.Collection.CountDocuments(userService.ctx, filter, options.Count().SetLimit(1))
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// PurgeExpiredNetworkData removes raw ips whose retention period is over
+func PurgeExpiredNetworkData() (int64, error) {
+	filter := bson.M{"raw_ip_expires_at": bson.M{"$lte": time.Now()}}
+	update := bson.M{"$unset": bson.M{"raw_ip": "", "raw_ip_expires_at": ""}}
+
+	result, err := userService.Collection.UpdateMany(userService.ctx, filter, update)
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+// MigrateUserNetworkData rewrites users stored before ips were hashed: the
+// raw ip is replaced by its hash and the precise city and coordinates are
+// dropped. Documents already migrated are not touched, so it is safe to run
+// on every start. Raw ips are left alone while the hasher is ephemeral, as
+// their hashes could not be matched by a ban after the next restart.
+func MigrateUserNetworkData() (int64, error) {
+	filter := bson.M{"$or": bson.A{
+		bson.M{"ip": bson.M{"$exists": true}},
+		bson.M{"city": bson.M{"$exists": true}},
+		bson.M{"coords": bson.M{"$exists": true}},
+	}}
+	if ipHasher.Ephemeral() {
+		count, err := userService.Collection.CountDocuments(userService.ctx, filter, options.Count().SetLimit(1))
+		if err != nil {
+			return 0, err
+		}
+		if count > 0 {
+			return 0, ErrIpHashKeyMissing
+		}
+		return 0, nil
+	}
+
+	opts := options.Find().SetProjection(bson.M{"_id": 1, "ip": 1})
+
+	cursor, err := userService.Collection.Find(userService.ctx, filter, opts)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(userService.ctx)
+
+	var writes []mongo.WriteModel
+	var migrated int64
+	for cursor.Next(userService.ctx) {
+		var legacy struct {
+			Id string `bson:"_id"`
+			Ip string `bson:"ip"`
+		}
+		if err := cursor.Decode(&legacy); err != nil {
+			slog.Error("Skipping user during network data migration", "err", err)
+			continue
+		}
+
+		update := bson.M{"$unset": bson.M{"ip": "", "city": "", "coords": ""}}
+		if legacy.Ip != "" {
+			update["$set"] = bson.M{"ip_hash": ipHasher.Hash(legacy.Ip)}
+		}
+		writes = append(writes, mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": legacy.Id}).SetUpdate(update))
+
+		if len(writes) == 500 {
+			result, err := userService.Collection.BulkWrite(userService.ctx, writes)
+			if err != nil {
+				return migrated, fmt.Errorf("migrating user network data: %w", err)
+			}
+			migrated += result.ModifiedCount
+			writes = writes[:0]
+		}
+	}
+
+	if err := cursor.Err(); err != nil {
+		return migrated, err
+	}
+
+	if len(writes) > 0 {
+		result, err := userService.Collection.BulkWrite(userService.ctx, writes)
+		if err != nil {
+			return migrated, fmt.Errorf("migrating user network data: %w", err)
+		}
+		migrated += result.ModifiedCount
+	}
+
+	return migrated, nil
+}
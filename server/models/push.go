@@ -0,0 +1,343 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"time"
+	"unicode/utf8"
+
+	"server/dto"
+	"server/push"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// Notification kinds, in order of precedence when a message is more
+	// than one of them for a user
+	PushDirect  = "dm"
+	PushMention = "mention"
+	PushReply   = "reply"
+
+	// maxPushFailures is how many sends in a row may fail before a
+	// subscription is dropped
+	maxPushFailures = 5
+	// maxPushSubscriptions is how many devices a user can register
+	maxPushSubscriptions = 10
+	pushBodyLength       = 120
+	pushTTL              = 24 * time.Hour
+)
+
+var (
+	ErrPushDisabled             = errors.New("push notifications are not configured")
+	ErrPushSubscriptionNotFound = errors.New("push subscription not found")
+	ErrTooManyPushSubscriptions = errors.New("too many push subscriptions")
+)
+
+// PushSubscriptionInvalidError is returned for subscriptions that are
+// malformed or point outside the known push services
+type PushSubscriptionInvalidError struct {
+	Reason string
+}
+
+func (e *PushSubscriptionInvalidError) Error() string {
+	return "invalid push subscription: " + e.Reason
+}
+
+// PushSubscriptionModel is a browser subscription of a user, one per device
+type PushSubscriptionModel struct {
+	Id            primitive.ObjectID `bson:"_id,omitempty"`
+	UserId        string             `bson:"user_id"`
+	Endpoint      string             `bson:"endpoint"`
+	P256dh        string             `bson:"p256dh"`
+	Auth          string             `bson:"auth"`
+	Device        string             `bson:"device"`
+	Failures      int                `bson:"failures"`
+	CreatedAt     time.Time          `bson:"created_at"`
+	LastSuccessAt *time.Time         `bson:"last_success_at,omitempty"`
+}
+
+func (s PushSubscriptionModel) ToDTO() dto.PushSubscription {
+	return dto.PushSubscription{
+		Id:        s.Id.Hex(),
+		Endpoint:  s.Endpoint,
+		Device:    s.Device,
+		CreatedAt: s.CreatedAt,
+	}
+}
+
+type PushService struct {
+	Collection *mongo.Collection
+	ctx        context.Context
+}
+
+var (
+	pushService PushService
+	// pushSender delivers notifications, nil when push is not configured
+	pushSender *push.Sender
+)
+
+func CreatePushService(collection *mongo.Collection, ctx context.Context) {
+	pushService = PushService{Collection: collection, ctx: ctx}
+}
+
+// SetPushSender enables Web Push notifications
+func SetPushSender(sender *push.Sender) {
+	pushSender = sender
+}
+
+// VAPIDPublicKey is the key browsers subscribe with
+func VAPIDPublicKey() (string, error) {
+	if pushSender == nil {
+		return "", ErrPushDisabled
+	}
+	return pushSender.PublicKey(), nil
+}
+
+// EnsurePushIndex makes sure an endpoint belongs to one user
+func EnsurePushIndex() error {
+	_, err := pushService.Collection.Indexes().CreateMany(pushService.ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "endpoint", Value: 1}},
+			Options: options.Index().SetName("endpoint_unique").SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "user_id", Value: 1}},
+			Options: options.Index().SetName("user"),
+		},
+	})
+	return err
+}
+
+// SavePushSubscription registers a subscription for a user. A browser
+// handing the same endpoint to another user moves it over.
+func SavePushSubscription(userId string, request dto.PushSubscriptionRequest) (*PushSubscriptionModel, error) {
+	if pushSender == nil {
+		return nil, ErrPushDisabled
+	}
+	if err := pushSender.ValidateEndpoint(request.Endpoint); err != nil {
+		return nil, &PushSubscriptionInvalidError{Reason: err.Error()}
+	}
+	keys := push.Keys{P256dh: request.Keys.P256dh, Auth: request.Keys.Auth}
+	if err := push.ValidateKeys(keys); err != nil {
+		return nil, &PushSubscriptionInvalidError{Reason: err.Error()}
+	}
+
+	count, err := pushService.Collection.CountDocuments(pushService.ctx, bson.M{"user_id": userId, "endpoint": bson.M{"$ne": request.Endpoint}})
+	if err != nil {
+		return nil, err
+	}
+	if count >= maxPushSubscriptions {
+		return nil, ErrTooManyPushSubscriptions
+	}
+
+	device := request.Device
+	if utf8.RuneCountInString(device) > 64 {
+		device = string([]rune(device)[:64])
+	}
+
+	var subscription PushSubscriptionModel
+	err = pushService.Collection.FindOneAndUpdate(pushService.ctx,
+		bson.M{"endpoint": request.Endpoint},
+		bson.M{
+			"$set": bson.M{
+				"user_id":  userId,
+				"p256dh":   keys.P256dh,
+				"auth":     keys.Auth,
+				"device":   device,
+				"failures": 0,
+			},
+			"$setOnInsert": bson.M{"created_at": time.Now()},
+		},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&subscription)
+	if err != nil {
+		return nil, err
+	}
+	return &subscription, nil
+}
+
+// ListPushSubscriptions returns the subscriptions of a user
+func ListPushSubscriptions(userId string) ([]PushSubscriptionModel, error) {
+	cursor, err := pushService.Collection.Find(pushService.ctx, bson.M{"user_id": userId})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(pushService.ctx)
+
+	subscriptions := []PushSubscriptionModel{}
+	if err := cursor.All(pushService.ctx, &subscriptions); err != nil {
+		return nil, err
+	}
+	return subscriptions, nil
+}
+
+// DeletePushSubscription unregisters a subscription of a user
+func DeletePushSubscription(userId string, subscriptionId string) error {
+	objectID, err := primitive.ObjectIDFromHex(subscriptionId)
+	if err != nil {
+		return ErrPushSubscriptionNotFound
+	}
+
+	result, err := pushService.Collection.DeleteOne(pushService.ctx, bson.M{"_id": objectID, "user_id": userId})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrPushSubscriptionNotFound
+	}
+	return nil
+}
+
+// NotifyOfflineRecipients sends a Web Push notification to the users a new
+// message is for (direct message peer, mentioned users, author of the
+// message replied to) who have no socket open on any instance. Call it with
+// Background.
+func NotifyOfflineRecipients(message MessageModel) {
+	if pushSender == nil {
+		return
+	}
+
+	recipients := map[string]string{}
+	add := func(userId string, kind string) {
+		if userId == "" || userId == message.From.Id {
+			return
+		}
+		if _, ok := recipients[userId]; !ok {
+			recipients[userId] = kind
+		}
+	}
+
+	if peerId, ok := DirectPeer(message.ChannelId, message.From.Id); ok {
+		add(peerId, PushDirect)
+	}
+	for _, mention := range message.Mentions {
+		add(mention.UserId, PushMention)
+	}
+	if !IsDirectChannel(message.ChannelId) && message.To != "" {
+		if replied, err := GetSingleMessage(message.To, message.ChannelId); err == nil {
+			add(replied.From.Id, PushReply)
+		}
+	}
+
+	for userId, kind := range recipients {
+		notifyUser(userId, message.From.Id, pushNotification(message, kind))
+	}
+}
+
+func pushNotification(message MessageModel, kind string) dto.PushNotification {
+	body := message.Message
+	if message.Encrypted != nil {
+		body = "Encrypted message"
+	}
+	if utf8.RuneCountInString(body) > pushBodyLength {
+		body = string([]rune(body)[:pushBodyLength-1]) + "…"
+	}
+
+	title := message.From.Username
+	switch kind {
+	case PushMention:
+		title += " mentioned you"
+	case PushReply:
+		title += " replied to you"
+	}
+
+	return dto.PushNotification{
+		Version:   dto.Version,
+		Type:      kind,
+		Title:     title,
+		Body:      body,
+		Channel:   message.ChannelId,
+		MessageId: message.Id.Hex(),
+	}
+}
+
+// notifyUser sends notification to every subscription of a user, dropping
+// subscriptions the push service reports gone or that keep failing
+func notifyUser(userId string, senderId string, notification dto.PushNotification) {
+	// A socket on any instance delivers the message itself
+	recipient, err := GetUser(userId)
+	if err != nil || recipient.HasBlocked(senderId) || recipient.IsConnected(time.Now()) {
+		return
+	}
+
+	subscriptions, err := ListPushSubscriptions(userId)
+	if err != nil {
+		slog.Error("Loading push subscriptions failed", "user_id", userId, "err", err)
+		return
+	}
+
+	payload, err := json.Marshal(notification)
+	if err != nil {
+		slog.Error("Encoding push notification failed", "err", err)
+		return
+	}
+
+	urgency := push.UrgencyNormal
+	if notification.Type == PushDirect || notification.Type == PushMention {
+		urgency = push.UrgencyHigh
+	}
+
+	for _, subscription := range subscriptions {
+		target := push.Subscription{
+			Endpoint: subscription.Endpoint,
+			Keys:     push.Keys{P256dh: subscription.P256dh, Auth: subscription.Auth},
+		}
+
+		err := sendWithRetry(target, payload, urgency)
+		recordPushResult(subscription, err)
+	}
+}
+
+// sendWithRetry sends once more when the push service is temporarily
+// unavailable, waiting as long as it asked (up to 30 seconds)
+func sendWithRetry(target push.Subscription, payload []byte, urgency push.Urgency) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	err := pushSender.Send(ctx, target, payload, pushTTL, urgency)
+
+	var statusErr *push.StatusError
+	if errors.As(err, &statusErr) && statusErr.Temporary() {
+		wait := statusErr.RetryAfter
+		if wait <= 0 {
+			wait = 2 * time.Second
+		}
+		if wait > 30*time.Second {
+			wait = 30 * time.Second
+		}
+
+		select {
+		case <-time.After(wait):
+			err = pushSender.Send(ctx, target, payload, pushTTL, urgency)
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	return err
+}
+
+func recordPushResult(subscription PushSubscriptionModel, err error) {
+	filter := bson.M{"_id": subscription.Id}
+
+	switch {
+	case err == nil:
+		now := time.Now()
+		_, err = pushService.Collection.UpdateOne(pushService.ctx, filter, bson.M{"$set": bson.M{"failures": 0, "last_success_at": now}})
+	case errors.Is(err, push.ErrSubscriptionGone) || subscription.Failures+1 >= maxPushFailures:
+		slog.Info("Dropping push subscription", "subscription_id", subscription.Id.Hex(), "user_id", subscription.UserId, "err", err)
+		_, err = pushService.Collection.DeleteOne(pushService.ctx, filter)
+	default:
+		slog.Warn("Push failed", "user_id", subscription.UserId, "err", err)
+		_, err = pushService.Collection.UpdateOne(pushService.ctx, filter, bson.M{"$inc": bson.M{"failures": 1}})
+	}
+
+	if err != nil {
+		slog.Error("Updating push subscription failed", "subscription_id", subscription.Id.Hex(), "err", err)
+	}
+}
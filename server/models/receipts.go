@@ -0,0 +1,227 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"server/db"
+	"server/dto"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MaxUnreadCount caps unread counts, clients show "99+" past it
+const MaxUnreadCount = 100
+
+// ReadMarkerModel is the last message a user read on a channel
+type ReadMarkerModel struct {
+	Id         primitive.ObjectID `bson:"_id,omitempty"`
+	UserId     string             `bson:"user_id"`
+	Channel    string             `bson:"channel"`
+	LastReadId primitive.ObjectID `bson:"last_read_id"`
+	UpdatedAt  time.Time          `bson:"updated_at"`
+}
+
+// ToDTO converts a marker, unread is counted by the caller
+func (m ReadMarkerModel) ToDTO(unread int64) dto.ReadMarker {
+	marker := dto.ReadMarker{
+		UserId:    m.UserId,
+		Channel:   m.Channel,
+		Unread:    unread,
+		UpdatedAt: m.UpdatedAt,
+	}
+	if !m.LastReadId.IsZero() {
+		marker.LastReadId = m.LastReadId.Hex()
+	}
+	return marker
+}
+
+type ReadMarkerService struct {
+	Collection *mongo.Collection
+	ctx        context.Context
+}
+
+var readMarkerService ReadMarkerService
+
+func CreateReadMarkerService(collection *mongo.Collection, ctx context.Context) {
+	readMarkerService = ReadMarkerService{Collection: collection, ctx: ctx}
+}
+
+// EnsureReadMarkerIndex makes sure a user has one marker per channel
+func EnsureReadMarkerIndex() error {
+	_, err := readMarkerService.Collection.Indexes().CreateOne(readMarkerService.ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "channel", Value: 1}},
+		Options: options.Index().SetName("user_channel_unique").SetUnique(true),
+	})
+	return err
+}
+
+// GetReadMarker returns the marker of user on channel, a zero marker when
+// they never read it
+func GetReadMarker(userId string, channel string) (ReadMarkerModel, error) {
+	marker := ReadMarkerModel{UserId: userId, Channel: channel}
+	err := readMarkerService.Collection.FindOne(readMarkerService.ctx, bson.M{"user_id": userId, "channel": channel}).Decode(&marker)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return marker, err
+	}
+	return marker, nil
+}
+
+// CountUnread counts the messages of others on channel after lastReadId, up
+// to MaxUnreadCount
+func CountUnread(userId string, channel string, lastReadId primitive.ObjectID) (int64, error) {
+	filter := bson.M{"channel": channel, "from.Id": bson.M{"$ne": userId}}
+	if !lastReadId.IsZero() {
+		filter["_id"] = bson.M{"$gt": lastReadId}
+	}
+	return messageService.Collection.CountDocuments(messageService.ctx, filter, options.Count().SetLimit(MaxUnreadCount))
+}
+
+// MarkRead moves the marker of user on channel up to messageId, it never
+// moves backwards. The user's other sockets are told, and so is the peer
+// of a direct channel as a read receipt.
+func MarkRead(userId string, channel string, messageId string) (dto.ReadMarker, error) {
+	if err := CheckChannelAccess(channel, userId); err != nil {
+		return dto.ReadMarker{}, err
+	}
+	message, err := GetSingleMessage(messageId, channel)
+	if err != nil {
+		return dto.ReadMarker{}, err
+	}
+
+	var marker ReadMarkerModel
+	err = readMarkerService.Collection.FindOneAndUpdate(readMarkerService.ctx,
+		bson.M{"user_id": userId, "channel": channel},
+		bson.M{
+			"$max": bson.M{"last_read_id": message.Id},
+			"$set": bson.M{"updated_at": time.Now()},
+		},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&marker)
+	if err != nil {
+		return dto.ReadMarker{}, err
+	}
+
+	unread, err := CountUnread(userId, channel, marker.LastReadId)
+	if err != nil {
+		return dto.ReadMarker{}, err
+	}
+
+	if IsDirectChannel(channel) {
+		_, err := conversationService.Collection.UpdateOne(conversationService.ctx,
+			bson.M{"user_id": userId, "channel": channel},
+			bson.M{"$set": bson.M{"unread": unread}},
+		)
+		if err != nil {
+			return dto.ReadMarker{}, err
+		}
+	}
+
+	result := marker.ToDTO(unread)
+	go notifyRead(result)
+	return result, nil
+}
+
+// notifyRead sends a read event to the other sockets of the reader and to
+// the peer of a direct channel
+func notifyRead(marker dto.ReadMarker) {
+	event := dto.NewEvent(dto.EventRead, marker.Channel, marker)
+
+	recipients := []string{marker.UserId}
+	if peerId, ok := DirectPeer(marker.Channel, marker.UserId); ok {
+		recipients = append(recipients, peerId)
+	}
+	for _, userId := range recipients {
+		for _, userConn := range db.UserSockets(userId) {
+			userConn.Send(event)
+		}
+	}
+}
+
+// UnreadCounts returns the marker and unread count of every channel the
+// user explored, counted in one aggregation grouped by channel
+func UnreadCounts(user *UserModel) ([]dto.ReadMarker, error) {
+	markers, err := listReadMarkers(user.Id)
+	if err != nil {
+		return nil, err
+	}
+	byChannel := map[string]ReadMarkerModel{}
+	for _, marker := range markers {
+		byChannel[marker.Channel] = marker
+	}
+
+	unread := []bson.M{}
+	for _, channel := range user.ExploredSites {
+		clause := bson.M{"channel": channel}
+		if marker, ok := byChannel[channel]; ok && !marker.LastReadId.IsZero() {
+			clause["_id"] = bson.M{"$gt": marker.LastReadId}
+		}
+		unread = append(unread, clause)
+	}
+
+	counts := map[string]int64{}
+	if len(unread) > 0 {
+		cursor, err := messageService.Collection.Aggregate(messageService.ctx, mongo.Pipeline{
+			{{Key: "$match", Value: bson.M{"from.Id": bson.M{"$ne": user.Id}, "$or": unread}}},
+			{{Key: "$group", Value: bson.M{"_id": "$channel", "count": bson.M{"$sum": 1}}}},
+		})
+		if err != nil {
+			return nil, err
+		}
+		defer cursor.Close(messageService.ctx)
+
+		var groups []struct {
+			Channel string `bson:"_id"`
+			Count   int64  `bson:"count"`
+		}
+		if err := cursor.All(messageService.ctx, &groups); err != nil {
+			return nil, err
+		}
+		for _, group := range groups {
+			counts[group.Channel] = min(group.Count, MaxUnreadCount)
+		}
+	}
+
+	result := []dto.ReadMarker{}
+	for _, channel := range user.ExploredSites {
+		marker, ok := byChannel[channel]
+		if !ok {
+			marker = ReadMarkerModel{UserId: user.Id, Channel: channel}
+		}
+		result = append(result, marker.ToDTO(counts[channel]))
+	}
+	return result, nil
+}
+
+// UnreadDivider returns where the messages new to the user start on
+// channel, nil when there are none
+func UnreadDivider(userId string, channel string) (*dto.UnreadDivider, error) {
+	marker, err := GetReadMarker(userId, channel)
+	if err != nil {
+		return nil, err
+	}
+
+	unread, err := CountUnread(userId, channel, marker.LastReadId)
+	if err != nil || unread == 0 {
+		return nil, err
+	}
+	return &dto.UnreadDivider{LastReadId: marker.ToDTO(unread).LastReadId, Unread: unread}, nil
+}
+
+// listReadMarkers returns every marker of a user
+func listReadMarkers(userId string) ([]ReadMarkerModel, error) {
+	cursor, err := readMarkerService.Collection.Find(readMarkerService.ctx, bson.M{"user_id": userId})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(readMarkerService.ctx)
+
+	markers := []ReadMarkerModel{}
+	if err := cursor.All(readMarkerService.ctx, &markers); err != nil {
+		return nil, err
+	}
+	return markers, nil
+}
@@ -0,0 +1,43 @@
+package models
+
+import (
+	"errors"
+
+	"server/db"
+	"server/dto"
+)
+
+// MaxSubscriptions caps the channels one socket follows besides its active site
+const MaxSubscriptions = 20
+
+var (
+	ErrTooManySubscriptions = errors.New("too many channel subscriptions")
+	ErrChannelMissing       = errors.New("channel missing")
+)
+
+// Subscribe makes socket receive the events of channel, tagged with tag.
+// Direct channels can only be followed by their participants.
+func Subscribe(socket *db.UserSocket, channel string, tag string) error {
+	if channel == "" {
+		return ErrChannelMissing
+	}
+	if err := CheckChannelAccess(channel, socket.UserId); err != nil {
+		return err
+	}
+	if !db.Subscribe(socket, channel, tag, MaxSubscriptions) {
+		return ErrTooManySubscriptions
+	}
+	return nil
+}
+
+// Unsubscribe stops the events of channel on socket, unless it is the
+// socket's active site
+func Unsubscribe(socket *db.UserSocket, channel string) {
+	db.Unsubscribe(socket, channel)
+}
+
+// SubscriptionsOf returns what socket is subscribed to
+func SubscriptionsOf(socket *db.UserSocket) dto.Subscriptions {
+	activeSite, channels := db.Subscriptions(socket)
+	return dto.Subscriptions{ActiveSite: activeSite, Channels: channels, Limit: MaxSubscriptions}
+}
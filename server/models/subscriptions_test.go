@@ -0,0 +1,141 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"server/db"
+	"server/dto"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// noEvent fails when an event is waiting on socket
+func noEvent(t *testing.T, socket *db.UserSocket) {
+	t.Helper()
+
+	select {
+	case event := <-socket.Channel:
+		t.Fatalf("socket of %s got %+v, want nothing", socket.UserId, event)
+	default:
+	}
+}
+
+func TestSubscribeLimit(t *testing.T) {
+	socket := addTestSocket(t, "subscriber")
+
+	for i := 0; i < MaxSubscriptions; i++ {
+		if err := Subscribe(socket, fmt.Sprintf("limit-%d.example", i), "tag"); err != nil {
+			t.Fatalf("subscription %d: %v", i, err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		channel string
+		want    error
+	}{
+		{"past the limit", "limit-extra.example", ErrTooManySubscriptions},
+		{"already followed", "limit-0.example", nil},
+		{"empty channel", "", ErrChannelMissing},
+		{"direct channel of others", DirectChannelId("amy", "zoe"), ErrNotChannelMember},
+	}
+	for _, test := range tests {
+		if err := Subscribe(socket, test.channel, "retagged"); !errors.Is(err, test.want) {
+			t.Errorf("%s: Subscribe = %v, want %v", test.name, err, test.want)
+		}
+	}
+
+	subscriptions := SubscriptionsOf(socket)
+	if len(subscriptions.Channels) != MaxSubscriptions || subscriptions.Limit != MaxSubscriptions {
+		t.Fatalf("subscriptions = %+v, want %d channels", subscriptions, MaxSubscriptions)
+	}
+
+	// Leaving a channel makes room for another
+	Unsubscribe(socket, "limit-1.example")
+	if err := Subscribe(socket, "limit-extra.example", "tag"); err != nil {
+		t.Fatalf("subscribing after leaving a channel: %v", err)
+	}
+	if db.IsSubscribed(socket, "limit-1.example") || !db.IsSubscribed(socket, "limit-extra.example") {
+		t.Fatal("subscriptions were not swapped")
+	}
+}
+
+func TestDispatchChangeReachesSubscribedSockets(t *testing.T) {
+	channel := "dispatch.example"
+	onSite := addPresentSocket(t, "on-site", "on-site", channel)
+	following := addTestSocket(t, "following")
+	if err := Subscribe(following, channel, "followed"); err != nil {
+		t.Fatal(err)
+	}
+	unsubscribed := addTestSocket(t, "unsubscribed")
+	if err := Subscribe(unsubscribed, channel, "followed"); err != nil {
+		t.Fatal(err)
+	}
+	Unsubscribe(unsubscribed, channel)
+	elsewhere := addPresentSocket(t, "elsewhere", "elsewhere", "other.example")
+
+	message := MessageModel{Id: primitive.NewObjectID(), ChannelId: channel, Message: "hello"}
+	dispatchChange(context.Background(), dto.EventInsert, message)
+
+	tests := []struct {
+		name         string
+		socket       *db.UserSocket
+		subscription string
+	}{
+		{"active site", onSite, ""},
+		{"subscription", following, "followed"},
+	}
+	for _, test := range tests {
+		event := nextEvent(t, test.socket)
+		if event.Type != dto.EventInsert || event.Channel != channel || event.Subscription != test.subscription {
+			t.Errorf("%s: got %+v, want the insert tagged %q", test.name, event, test.subscription)
+		}
+		if data, ok := event.Data.(dto.Message); !ok || data.Id != message.Id.Hex() {
+			t.Errorf("%s: got data %+v, want message %s", test.name, event.Data, message.Id.Hex())
+		}
+	}
+	noEvent(t, unsubscribed)
+	noEvent(t, elsewhere)
+}
+
+func TestDispatchChangeReachesDirectParticipants(t *testing.T) {
+	amy := addTestSocket(t, "dispatch-amy")
+	zoe := addPresentSocket(t, "dispatch-zoe", "dispatch-zoe", "some.example")
+	outsider := addTestSocket(t, "dispatch-outsider")
+
+	channel := DirectChannelId("dispatch-amy", "dispatch-zoe")
+	dispatchChange(context.Background(), dto.EventUpdate, MessageModel{Id: primitive.NewObjectID(), ChannelId: channel, To: "dispatch-zoe"})
+
+	// Participants get direct messages on every socket, subscribed or not
+	for _, socket := range []*db.UserSocket{amy, zoe} {
+		if event := nextEvent(t, socket); event.Type != dto.EventUpdate || event.Channel != channel {
+			t.Errorf("socket of %s got %+v, want the update", socket.UserId, event)
+		}
+	}
+	noEvent(t, outsider)
+}
+
+func TestHandleChangeSendsDeletes(t *testing.T) {
+	channel := "deletes.example"
+	socket := addPresentSocket(t, "deletes", "deletes", channel)
+
+	deleted := changeEvent{OperationType: "delete"}
+	deleted.DocumentKey.Id = primitive.NewObjectID()
+
+	// Without a pre-image the channel of the message is unknown
+	handleChange(context.Background(), deleted)
+	noEvent(t, socket)
+
+	deleted.FullDocumentBeforeChange = MessageModel{Id: deleted.DocumentKey.Id, ChannelId: channel, Message: "gone"}
+	handleChange(context.Background(), deleted)
+	event := nextEvent(t, socket)
+	if event.Type != dto.EventDelete || event.Channel != channel {
+		t.Fatalf("got %+v, want the delete on %s", event, channel)
+	}
+	if data, ok := event.Data.(dto.Message); !ok || data.Id != deleted.DocumentKey.Id.Hex() {
+		t.Fatalf("got data %+v, want message %s", event.Data, deleted.DocumentKey.Id.Hex())
+	}
+}
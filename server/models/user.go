@@ -3,20 +3,21 @@ package models
 import (
 	"context"
 	"fmt"
-	"io"
-	"net/http"
+	"log/slog"
+	"net/url"
 	"strings"
 	"time"
 
 	"github.com/brianvoe/gofakeit/v6"
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/log"
 	"github.com/google/uuid"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 
+	"server/avatar"
 	C "server/constants"
-	"server/utils"
+	"server/dto"
+	"server/geoip"
 )
 
 type Flagged struct {
@@ -29,7 +30,9 @@ type Flagged struct {
 type UserModel struct {
 	Id            string    `bson:"_id"`
 	Username      string    `bson:"username"`
-	Ip            string    `bson:"ip"`
+	AvatarSeed    string    `bson:"avatar_seed"`
+	Role          string    `bson:"role,omitempty"` // <moderator, admin>
+	IpHash        string    `bson:"ip_hash"`        // keyed hash, see privacy.IPHasher
 	IsOnline      bool      `bson:"is_online"`
 	ExploredSites []string  `bson:"explored_sites"`
 	ActiveSite    string    `bson:"active_site"`
@@ -39,10 +42,80 @@ type UserModel struct {
 	IsBanned      bool      `bson:"is_banned"`
 	CreatedAt     time.Time `bson:"created_at"`
 	ModifiedAt    time.Time `bson:"modified_at"`
-	City          string    `bson:"city"`
 	Country       string    `bson:"country"`
 	Region        string    `bson:"region"`
-	Coords        string    `bson:"coords"`
+	// Raw network data, only kept when a retention period is configured
+	RawIp          string     `bson:"raw_ip,omitempty"`
+	RawIpExpiresAt *time.Time `bson:"raw_ip_expires_at,omitempty"`
+	// Folded username the unique index is on, see FoldUsername
+	UsernameKey       string           `bson:"username_key,omitempty"`
+	UsernameChangedAt *time.Time       `bson:"username_changed_at,omitempty"`
+	UsernameHistory   []UsernameChange `bson:"username_history,omitempty"`
+	// External accounts the user signs in with, see LinkIdentity
+	Identities []LinkedIdentity `bson:"identities,omitempty"`
+	// Users this user does not exchange direct messages with
+	Blocked []string `bson:"blocked,omitempty"`
+	// Invisible users are left out of channel presence, see ListPresence
+	Invisible bool `bson:"invisible"`
+	// ConnectedUntil is refreshed while the user has a socket on any
+	// instance, see refreshConnected
+	ConnectedUntil *time.Time `bson:"connected_until,omitempty"`
+	// TokenIssued is set once the user was given an access token, users
+	// registered before tokens existed may claim one, see ClaimAccessToken
+	TokenIssued bool `bson:"token_issued,omitempty"`
+}
+
+// ToDTO converts a stored user to its wire representation
+func (u UserModel) ToDTO() dto.User {
+	exploredSites := u.ExploredSites
+	if exploredSites == nil {
+		exploredSites = []string{}
+	}
+
+	return dto.User{
+		Version:       dto.Version,
+		Id:            u.Id,
+		Username:      u.Username,
+		Avatar:        AvatarURL(u.avatarSeed()),
+		IsOnline:      u.IsOnline,
+		ActiveSite:    u.ActiveSite,
+		ExploredSites: exploredSites,
+		IsLoggedIn:    u.IsLoggedIn,
+		LoginMethod:   u.LoginMethod,
+		Invisible:     u.Invisible,
+		CreatedAt:     u.CreatedAt,
+	}
+}
+
+// avatarSeed returns the stored seed, users created before avatars existed
+// get the same seed derived from their id
+func (u UserModel) avatarSeed() string {
+	if u.AvatarSeed != "" {
+		return u.AvatarSeed
+	}
+	return avatar.Seed(u.Id)
+}
+
+// Author returns the author block embedded in messages the user writes
+func (u UserModel) Author() MessageAuthor {
+	return MessageAuthor{Id: u.Id, Username: u.Username, AvatarSeed: u.avatarSeed()}
+}
+
+// NoSite is the active site of users outside the extension, it is never an
+// explored site
+const NoSite = "USER_NOT_IN_PLUGIN"
+
+// avatarBaseURL is prepended to avatar paths, empty keeps them relative
+var avatarBaseURL string
+
+// SetAvatarBaseURL sets the public URL of the server used in avatar links
+func SetAvatarBaseURL(baseURL string) {
+	avatarBaseURL = strings.TrimRight(baseURL, "/")
+}
+
+// AvatarURL returns the link to the avatar rendered for seed
+func AvatarURL(seed string) string {
+	return avatarBaseURL + strings.Replace(C.AVATAR_PATH, "REPLACE_SEED_HERE", url.PathEscape(seed), 1)
 }
 
 type UserService struct {
@@ -56,41 +129,38 @@ func CreateUserService(collection *mongo.Collection, ctx context.Context) {
 	userService = UserService{Collection: collection, ctx: ctx}
 }
 
-func NewUser(ctx *fiber.Ctx) (*UserModel, bool) {
-
-	username := gofakeit.Gamertag()
-	ipUrl := strings.Replace(C.IP_INFO_URL, "REPLACE_IP_HERE", ctx.IP(), 1)
+// locationProvider resolves the location stored for new users
+var locationProvider geoip.Provider = geoip.NoopProvider{}
 
-	var str []byte
-	res, err := http.Get(ipUrl)
-	if err != nil {
-		log.Error(err.Error())
-		str = []byte("{}")
-	}
+// SetLocationProvider replaces the provider used by NewUser, the default
+// resolves every address to an empty location
+func SetLocationProvider(provider geoip.Provider) {
+	locationProvider = provider
+}
 
-	defer res.Body.Close()
-	str, readErr := io.ReadAll(res.Body)
-	if readErr != nil {
-		log.Error(err.Error())
-	}
+func NewUser(ctx *fiber.Ctx) (*UserModel, bool) {
 
-	// Convert string to map
-	ipinfoMap, err := utils.Convert_JSONStringToMap(string(str))
+	// Geolocation is best effort, registration goes ahead without it
+	location, err := locationProvider.Lookup(ctx.Context(), ctx.IP())
 	if err != nil {
-		log.Error("Error:", err, ipinfoMap)
-		ipinfoMap = map[string]string{}
+		slog.Warn("Location lookup failed for new user", "err", err)
 	}
 
 	// Get SiteId from Query params
-	siteId := ctx.Query("SiteId", "USER_NOT_IN_PLUGIN")
+	siteId := ctx.Query("SiteId", NoSite)
 	userId := uuid.New().String()
 
+	exploredSites := []string{}
+	if siteId != NoSite {
+		exploredSites = append(exploredSites, siteId)
+	}
+
 	user := &UserModel{
 		Id:            userId,
-		Username:      username,
-		Ip:            ctx.IP(),
+		AvatarSeed:    avatar.Seed(userId),
+		IpHash:        HashIp(ctx.IP()),
 		IsOnline:      true,
-		ExploredSites: []string{siteId},
+		ExploredSites: exploredSites,
 		ActiveSite:    siteId,
 		Flagged:       []Flagged{},
 		IsLoggedIn:    false,
@@ -98,23 +168,37 @@ func NewUser(ctx *fiber.Ctx) (*UserModel, bool) {
 		IsBanned:      false,
 		CreatedAt:     time.Now(),
 		ModifiedAt:    time.Now(),
-		City:          utils.GetJSONValue(ipinfoMap.(map[string]interface{}), "city"),
-		Country:       utils.GetJSONValue(ipinfoMap.(map[string]interface{}), "country"),
-		Region:        utils.GetJSONValue(ipinfoMap.(map[string]interface{}), "region"),
-		Coords:        utils.GetJSONValue(ipinfoMap.(map[string]interface{}), "loc"),
+		Country:       location.Country,
+		Region:        location.Region,
+		// Registration issues the token, it cannot be claimed in between
+		TokenIssued: true,
 	}
+	RetainRawIp(user, ctx.IP())
+
+	// Generated names can collide with taken or reserved ones, draw again when they do
+	insertError := ErrUsernameTaken
+	for attempt := 0; attempt < 5 && insertError != nil; attempt++ {
+		user.Username = gofakeit.Gamertag()
+		user.UsernameKey = FoldUsername(user.Username)
+		if IsReservedUsername(user.Username) {
+			continue
+		}
 
-	_, insertError := userService.Collection.InsertOne(userService.ctx, user)
+		_, insertError = userService.Collection.InsertOne(userService.ctx, user)
+		if insertError != nil && !mongo.IsDuplicateKeyError(insertError) {
+			break
+		}
+	}
 	if insertError != nil {
-		log.Error("Error while creating new user in mongo: ", err)
+		slog.Error("Creating user failed", "err", insertError)
 		return nil, false
 	}
-	log.Info("New user added to mongo by id: ", userId)
+	slog.Info("User created", "user_id", userId)
 	return user, true
 
 }
 
-func GetUser(userId string) (*UserModel, bool) {
+func GetUser(userId string) (*UserModel, error) {
 
 	filter := bson.M{"_id": userId}
 
@@ -122,15 +206,15 @@ func GetUser(userId string) (*UserModel, bool) {
 	err := userService.Collection.FindOne(userService.ctx, filter).Decode(&user)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
-			log.Error("no user found with id:", userId)
-		} else {
-			log.Error(err)
+			slog.Debug("User not found", "user_id", userId)
+			return nil, ErrUserNotFound
 		}
 
-		return nil, true
+		slog.Error("Loading user failed", "user_id", userId, "err", err)
+		return nil, err
 	}
 
-	return &user, false
+	return &user, nil
 
 }
 
@@ -148,3 +232,21 @@ func UpdateUser(userId string, mp bson.M) error {
 	return nil
 
 }
+
+// AddExploredSite records that user visited siteId, empty ids and NoSite
+// are ignored
+func AddExploredSite(user *UserModel, siteId string) error {
+	if siteId == "" || siteId == NoSite || containsString(user.ExploredSites, siteId) {
+		return nil
+	}
+
+	_, err := userService.Collection.UpdateOne(userService.ctx,
+		bson.M{"_id": user.Id},
+		bson.M{"$addToSet": bson.M{"explored_sites": siteId}},
+	)
+	if err != nil {
+		return err
+	}
+	user.ExploredSites = append(user.ExploredSites, siteId)
+	return nil
+}
@@ -0,0 +1,324 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	UsernameMinLength = 3
+	UsernameMaxLength = 24
+)
+
+// Roles a user can hold, set directly in the database
+const (
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// UsernameCooldown is the minimum time between two username changes
+var UsernameCooldown = 7 * 24 * time.Hour
+
+var (
+	ErrUsernameTaken    = errors.New("username is already taken")
+	ErrUsernameReserved = errors.New("username is reserved")
+)
+
+// UsernameInvalidError explains why a username was rejected
+type UsernameInvalidError struct {
+	Reason string
+}
+
+func (e *UsernameInvalidError) Error() string {
+	return "invalid username: " + e.Reason
+}
+
+// UsernameCooldownError is returned when the username was changed too recently
+type UsernameCooldownError struct {
+	RetryAt time.Time
+}
+
+func (e *UsernameCooldownError) Error() string {
+	return fmt.Sprintf("username can be changed again at %s", e.RetryAt.Format(time.RFC3339))
+}
+
+// UsernameChange is one entry of a user's name history
+type UsernameChange struct {
+	Username  string    `bson:"username"`
+	ChangedAt time.Time `bson:"changed_at"`
+}
+
+// reservedContains may not appear anywhere in a username, reservedExact may
+// not be a whole username. Both are compared against folded names.
+var (
+	reservedContains = []string{"admin", "moderator", "blablah", "official"}
+	reservedExact    = []string{"mod", "mods", "system", "support", "staff", "root", "deleteduser", "deleted", "everyone", "here", "null", "undefined", "anonymous"}
+)
+
+// confusables maps look-alike characters to the ASCII letter they imitate
+var confusables = map[rune]rune{
+	// Digits and symbols
+	'0': 'o', '1': 'l', '3': 'e', '4': 'a', '5': 's', '7': 't', '8': 'b', '$': 's', '@': 'a', '|': 'l', '!': 'l',
+	// ASCII letters that are hard to tell apart
+	'i': 'l', 'j': 'l',
+	// Cyrillic
+	'а': 'a', 'в': 'b', 'е': 'e', 'ё': 'e', 'к': 'k', 'м': 'm', 'н': 'h', 'о': 'o', 'р': 'p', 'с': 'c',
+	'т': 't', 'у': 'y', 'х': 'x', 'ѕ': 's', 'і': 'l', 'ї': 'l', 'ј': 'l', 'ԁ': 'd', 'һ': 'h', 'ԛ': 'q', 'ԝ': 'w',
+	// Greek
+	'α': 'a', 'β': 'b', 'ε': 'e', 'η': 'n', 'ι': 'l', 'κ': 'k', 'ν': 'v', 'ο': 'o', 'ρ': 'p', 'τ': 't',
+	'υ': 'u', 'χ': 'x', 'ω': 'w',
+}
+
+// confusableSequences are multi letter look-alikes, applied after single characters are folded
+var confusableSequences = strings.NewReplacer("rn", "m", "vv", "w", "cl", "d")
+
+// ValidateUsername checks length and charset: letters, digits and _ . -,
+// starting with a letter or digit
+func ValidateUsername(username string) error {
+	username = norm.NFKC.String(username)
+
+	length := utf8.RuneCountInString(username)
+	if length < UsernameMinLength || length > UsernameMaxLength {
+		return &UsernameInvalidError{Reason: fmt.Sprintf("must be %d to %d characters long", UsernameMinLength, UsernameMaxLength)}
+	}
+
+	for i, r := range username {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+		case (r == '_' || r == '.' || r == '-') && i > 0:
+		default:
+			return &UsernameInvalidError{Reason: "may only contain letters, digits, _ . and - and must start with a letter or digit"}
+		}
+	}
+
+	return nil
+}
+
+// FoldUsername returns the key two usernames collide on: case, separators
+// and look-alike characters are folded so "Adm1n", "ADMIN" and "аdmin" (with
+// a Cyrillic a) are the same name
+func FoldUsername(username string) string {
+	username = strings.ToLower(norm.NFKC.String(username))
+
+	var folded strings.Builder
+	for _, r := range username {
+		if r == '_' || r == '.' || r == '-' || unicode.IsSpace(r) {
+			continue
+		}
+		if mapped, ok := confusables[r]; ok {
+			r = mapped
+		}
+		folded.WriteRune(r)
+	}
+
+	// Sequences can reappear after folding (r-n), so fold until stable
+	key := folded.String()
+	for {
+		next := confusableSequences.Replace(key)
+		if next == key {
+			return key
+		}
+		key = next
+	}
+}
+
+// IsReservedUsername reports whether a username imitates staff or the system
+func IsReservedUsername(username string) bool {
+	key := FoldUsername(username)
+	for _, reserved := range reservedContains {
+		if strings.Contains(key, FoldUsername(reserved)) {
+			return true
+		}
+	}
+	for _, reserved := range reservedExact {
+		if key == FoldUsername(reserved) {
+			return true
+		}
+	}
+	return false
+}
+
+// EnsureUsernameIndex creates the unique index on folded usernames and
+// backfills the key on users created before it existed. Users whose folded
+// name collides with an earlier user keep their name without a key until
+// they pick a new one.
+func EnsureUsernameIndex() error {
+	_, err := userService.Collection.Indexes().CreateOne(userService.ctx, mongo.IndexModel{
+		Keys: bson.M{"username_key": 1},
+		Options: options.Index().
+			SetName("username_key_unique").
+			SetUnique(true).
+			SetPartialFilterExpression(bson.M{"username_key": bson.M{"$exists": true}}),
+	})
+	if err != nil {
+		return err
+	}
+
+	filter := bson.M{"username_key": bson.M{"$exists": false}}
+	opts := options.Find().SetProjection(bson.M{"_id": 1, "username": 1}).SetSort(bson.M{"created_at": 1})
+	cursor, err := userService.Collection.Find(userService.ctx, filter, opts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(userService.ctx)
+
+	for cursor.Next(userService.ctx) {
+		var user struct {
+			Id       string `bson:"_id"`
+			Username string `bson:"username"`
+		}
+		if err := cursor.Decode(&user); err != nil {
+			continue
+		}
+
+		_, err := userService.Collection.UpdateOne(userService.ctx,
+			bson.M{"_id": user.Id},
+			bson.M{"$set": bson.M{"username_key": FoldUsername(user.Username)}},
+		)
+		if err != nil && !mongo.IsDuplicateKeyError(err) {
+			slog.Error("Backfilling username key failed", "user_id", user.Id, "err", err)
+		}
+	}
+
+	return cursor.Err()
+}
+
+// ChangeUsername renames a user after validation, reserved name, uniqueness
+// and cooldown checks. The previous name is kept in the user's history and
+// the author block of their messages is updated to the new name.
+func ChangeUsername(userId string, username string) (*UserModel, error) {
+	username = norm.NFKC.String(strings.TrimSpace(username))
+	if err := ValidateUsername(username); err != nil {
+		return nil, err
+	}
+	if IsReservedUsername(username) {
+		return nil, ErrUsernameReserved
+	}
+
+	user, err := GetUser(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	// The cooldown is part of the filter, so two renames racing each other
+	// cannot both pass it
+	now := time.Now()
+	filter := bson.M{
+		"_id": userId,
+		"$or": bson.A{
+			bson.M{"username_changed_at": nil},
+			bson.M{"username_changed_at": bson.M{"$lte": now.Add(-UsernameCooldown)}},
+		},
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"username":            username,
+			"username_key":        FoldUsername(username),
+			"username_changed_at": now,
+			"modified_at":         now,
+		},
+		"$push": bson.M{
+			"username_history": UsernameChange{Username: user.Username, ChangedAt: now},
+		},
+	}
+
+	result, err := userService.Collection.UpdateOne(userService.ctx, filter, update)
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, ErrUsernameTaken
+		}
+		return nil, err
+	}
+	if result.MatchedCount == 0 {
+		return nil, usernameCooldown(userId)
+	}
+
+	// Messages embed the author's name, keep them rendering the current one
+	err = updateMessagesInBatches(
+		bson.M{"from.Id": userId, "from.Username": bson.M{"$ne": username}},
+		bson.M{"from.Username": username},
+	)
+	if err != nil {
+		slog.Error("Renaming author of messages failed", "user_id", userId, "err", err)
+	}
+
+	renameMentions(userId, username)
+
+	user.UsernameHistory = append(user.UsernameHistory, UsernameChange{Username: user.Username, ChangedAt: now})
+	user.Username = username
+	user.UsernameKey = FoldUsername(username)
+	user.UsernameChangedAt = &now
+	user.ModifiedAt = now
+	return user, nil
+}
+
+// usernameCooldown explains why a rename matched no user: the user is gone
+// or changed their name within the cooldown
+func usernameCooldown(userId string) error {
+	user, err := GetUser(userId)
+	if err != nil {
+		return err
+	}
+
+	retryAt := time.Now()
+	if user.UsernameChangedAt != nil {
+		retryAt = user.UsernameChangedAt.Add(UsernameCooldown)
+	}
+	return &UsernameCooldownError{RetryAt: retryAt}
+}
+
+// renameBatch is how many messages a rename rewrites per write
+const renameBatch = 500
+
+// updateMessagesInBatches sets the fields of set on the messages matching
+// filter a batch at a time, so renaming a prolific user does not hold one
+// long write. The update must make a message stop matching filter. Each
+// batch is a bulk rewrite, left out of the change stream.
+func updateMessagesInBatches(filter bson.M, set bson.M, opts ...*options.UpdateOptions) error {
+	find := options.Find().SetProjection(bson.M{"_id": 1}).SetLimit(renameBatch)
+	for {
+		cursor, err := messageService.Collection.Find(messageService.ctx, filter, find)
+		if err != nil {
+			return err
+		}
+		var batch []struct {
+			Id primitive.ObjectID `bson:"_id"`
+		}
+		if err := cursor.All(messageService.ctx, &batch); err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+
+		ids := make([]primitive.ObjectID, 0, len(batch))
+		for _, message := range batch {
+			ids = append(ids, message.Id)
+		}
+		result, err := messageService.Collection.UpdateMany(messageService.ctx,
+			bson.M{"_id": bson.M{"$in": ids}}, bson.M{"$set": withRewrite(set)}, opts...)
+		if err != nil {
+			return err
+		}
+		// Stop rather than spin when another writer keeps the batch matching
+		if len(batch) < renameBatch || result.ModifiedCount == 0 {
+			return nil
+		}
+	}
+}
+
+// IsModerator reports whether the user may see moderation data
+func (u UserModel) IsModerator() bool {
+	return u.Role == RoleModerator || u.Role == RoleAdmin
+}
@@ -0,0 +1,120 @@
+// Package privacy turns network data into forms that can be stored without
+// keeping the raw values around.
+package privacy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Key is one HMAC key of the ring, Id is stored next to every hash made with it
+type Key struct {
+	Id     string
+	Secret []byte
+	// ephemeral keys are made up at start, see EphemeralKey
+	ephemeral bool
+}
+
+// IPHasher computes keyed hashes of IP addresses. The first key hashes new
+// values, the others are kept so values hashed before a rotation still match.
+type IPHasher struct {
+	keys []Key
+}
+
+// NewIPHasher creates a hasher from a key ring, current key first
+func NewIPHasher(keys ...Key) (*IPHasher, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("privacy: at least one ip hash key is required")
+	}
+
+	seen := map[string]bool{}
+	for _, key := range keys {
+		if key.Id == "" || strings.Contains(key.Id, ":") {
+			return nil, fmt.Errorf("privacy: invalid key id %q", key.Id)
+		}
+		if len(key.Secret) < 16 {
+			return nil, fmt.Errorf("privacy: key %s must be at least 16 bytes", key.Id)
+		}
+		if seen[key.Id] {
+			return nil, fmt.Errorf("privacy: duplicate key id %s", key.Id)
+		}
+		seen[key.Id] = true
+	}
+
+	return &IPHasher{keys: keys}, nil
+}
+
+// ParseIPHashKeys parses a key ring of the form "id:base64secret,id:base64secret"
+func ParseIPHashKeys(value string) ([]Key, error) {
+	var keys []Key
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		id, encoded, found := strings.Cut(entry, ":")
+		if !found {
+			return nil, fmt.Errorf("privacy: key %q is not of the form id:secret", entry)
+		}
+
+		secret, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("privacy: key %s is not valid base64: %w", id, err)
+		}
+		keys = append(keys, Key{Id: id, Secret: secret})
+	}
+
+	return keys, nil
+}
+
+// EphemeralKey returns a random key, hashes made with it do not survive a restart
+func EphemeralKey() Key {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return Key{Id: "ephemeral", Secret: secret, ephemeral: true}
+}
+
+// Hash returns the hash of ip under the current key, as "keyId:hex"
+func (h *IPHasher) Hash(ip string) string {
+	return hashWith(h.keys[0], ip)
+}
+
+// Candidates returns the hash of ip under every key of the ring, for
+// looking up values stored before the last rotation
+func (h *IPHasher) Candidates(ip string) []string {
+	candidates := make([]string, 0, len(h.keys))
+	for _, key := range h.keys {
+		candidates = append(candidates, hashWith(key, ip))
+	}
+	return candidates
+}
+
+// Ephemeral reports whether new hashes are made with a key that is lost on
+// restart, they cannot be matched against later
+func (h *IPHasher) Ephemeral() bool {
+	return h.keys[0].ephemeral
+}
+
+func hashWith(key Key, ip string) string {
+	mac := hmac.New(sha256.New, key.Secret)
+	mac.Write([]byte(normalizeIP(ip)))
+	return key.Id + ":" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// normalizeIP makes different spellings of one address hash the same
+func normalizeIP(ip string) string {
+	if parsed := net.ParseIP(strings.TrimSpace(ip)); parsed != nil {
+		return parsed.String()
+	}
+	return strings.TrimSpace(ip)
+}
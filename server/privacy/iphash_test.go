@@ -0,0 +1,43 @@
+package privacy
+
+import "testing"
+
+func TestOnlyEphemeralKeysAreEphemeral(t *testing.T) {
+	ephemeral, err := NewIPHasher(EphemeralKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ephemeral.Ephemeral() {
+		t.Fatal("hasher of an ephemeral key is not ephemeral")
+	}
+
+	// A configured key may well be called ephemeral
+	keys, err := ParseIPHashKeys("ephemeral:MDEyMzQ1Njc4OWFiY2RlZg==")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configured, err := NewIPHasher(keys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if configured.Ephemeral() {
+		t.Fatal("hasher of a configured key is ephemeral")
+	}
+}
+
+func TestHashesMatchAcrossRotation(t *testing.T) {
+	old := Key{Id: "k1", Secret: []byte("0123456789abcdef")}
+	current := Key{Id: "k2", Secret: []byte("fedcba9876543210")}
+
+	before, _ := NewIPHasher(old)
+	after, _ := NewIPHasher(current, old)
+
+	stored := before.Hash("2001:db8::1")
+	found := false
+	for _, candidate := range after.Candidates("2001:0db8:0:0:0:0:0:1") {
+		found = found || candidate == stored
+	}
+	if !found {
+		t.Fatalf("%s is not among the candidates after rotation", stored)
+	}
+}
@@ -0,0 +1,144 @@
+package push
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	authSecretSize = 16
+	saltSize       = 16
+	recordSize     = 4096
+	// MaxPayloadSize is the largest plaintext that fits the single record
+	// push services accept
+	MaxPayloadSize = 3993
+)
+
+var ErrPayloadTooLarge = errors.New("push: payload too large")
+
+// Keys are the keys of a browser subscription, base64url as handed out by
+// PushSubscription.toJSON()
+type Keys struct {
+	P256dh string `json:"p256dh"`
+	Auth   string `json:"auth"`
+}
+
+// Subscription is where and for whom a notification is encrypted
+type Subscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     Keys   `json:"keys"`
+}
+
+func decodeBase64(value string) ([]byte, error) {
+	for _, encoding := range []*base64.Encoding{base64.RawURLEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.StdEncoding} {
+		if decoded, err := encoding.DecodeString(value); err == nil {
+			return decoded, nil
+		}
+	}
+	return nil, errors.New("push: not base64")
+}
+
+// ValidateKeys checks the keys of a subscription before it is stored
+func ValidateKeys(keys Keys) error {
+	p256dh, err := decodeBase64(keys.P256dh)
+	if err != nil {
+		return errors.New("push: p256dh must be base64url")
+	}
+	if _, err := ecdh.P256().NewPublicKey(p256dh); err != nil {
+		return errors.New("push: p256dh is not a P-256 public key")
+	}
+
+	auth, err := decodeBase64(keys.Auth)
+	if err != nil || len(auth) != authSecretSize {
+		return errors.New("push: auth must be 16 base64url bytes")
+	}
+	return nil
+}
+
+func expand(secret []byte, salt []byte, info []byte, length int) ([]byte, error) {
+	out := make([]byte, length)
+	_, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, info), out)
+	return out, err
+}
+
+// Encrypt seals plaintext for a subscription as a single aes128gcm record
+func Encrypt(keys Keys, plaintext []byte) ([]byte, error) {
+	if len(plaintext) > MaxPayloadSize {
+		return nil, ErrPayloadTooLarge
+	}
+
+	uaPublicBytes, err := decodeBase64(keys.P256dh)
+	if err != nil {
+		return nil, err
+	}
+	uaPublic, err := ecdh.P256().NewPublicKey(uaPublicBytes)
+	if err != nil {
+		return nil, err
+	}
+	authSecret, err := decodeBase64(keys.Auth)
+	if err != nil {
+		return nil, err
+	}
+
+	asPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	asPublicBytes := asPrivate.PublicKey().Bytes()
+
+	sharedSecret, err := asPrivate.ECDH(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	// RFC 8291 section 3.4
+	keyInfo := append([]byte("WebPush: info\x00"), uaPublicBytes...)
+	keyInfo = append(keyInfo, asPublicBytes...)
+	ikm, err := expand(sharedSecret, authSecret, keyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	// RFC 8188 section 2.2 and 2.3
+	contentKey, err := expand(ikm, salt, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := expand(ikm, salt, []byte("Content-Encoding: nonce\x00"), 12)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(contentKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, saltSize+4+1+len(asPublicBytes))
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, recordSize)
+	header = append(header, byte(len(asPublicBytes)))
+	header = append(header, asPublicBytes...)
+
+	// 0x02 marks the last (and only) record
+	record := append(append([]byte{}, plaintext...), 0x02)
+	return gcm.Seal(header, nonce, record, nil), nil
+}
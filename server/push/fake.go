@@ -0,0 +1,200 @@
+package push
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Delivery is a notification received by a FakeEndpoint
+type Delivery struct {
+	Header  http.Header
+	Payload []byte // decrypted
+}
+
+// FakeEndpoint is a local push service for development and tests. It hands
+// out subscriptions, decrypts what is posted to them and can be told to
+// answer with an error.
+type FakeEndpoint struct {
+	// URL the endpoint is served at, e.g. of an httptest.Server
+	URL string
+
+	mutex      sync.Mutex
+	keys       map[string]*ecdh.PrivateKey
+	auth       map[string][]byte
+	deliveries []Delivery
+	status     int
+}
+
+// NewFakeEndpoint creates an endpoint that will be served at baseURL
+func NewFakeEndpoint(baseURL string) *FakeEndpoint {
+	return &FakeEndpoint{
+		URL:  strings.TrimRight(baseURL, "/"),
+		keys: map[string]*ecdh.PrivateKey{},
+		auth: map[string][]byte{},
+	}
+}
+
+// Sender returns a sender delivering to the fake endpoint over plain http
+func (f *FakeEndpoint) Sender(vapid *VAPID) *Sender {
+	target, _ := url.Parse(f.URL)
+	sender := NewSender(vapid, []string{target.Hostname()})
+	sender.allowInsecure = true
+	return sender
+}
+
+// Subscribe creates a subscription like a browser would
+func (f *FakeEndpoint) Subscribe() (Subscription, error) {
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return Subscription{}, err
+	}
+	auth := make([]byte, authSecretSize)
+	if _, err := rand.Read(auth); err != nil {
+		return Subscription{}, err
+	}
+
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return Subscription{}, err
+	}
+	id := base64.RawURLEncoding.EncodeToString(idBytes)
+	f.mutex.Lock()
+	f.keys[id] = key
+	f.auth[id] = auth
+	f.mutex.Unlock()
+
+	return Subscription{
+		Endpoint: f.URL + "/push/" + id,
+		Keys: Keys{
+			P256dh: base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes()),
+			Auth:   base64.RawURLEncoding.EncodeToString(auth),
+		},
+	}, nil
+}
+
+// Expire makes the endpoint answer 410 Gone for a subscription, like a
+// browser that unsubscribed
+func (f *FakeEndpoint) Expire(subscription Subscription) {
+	id := strings.TrimPrefix(subscription.Endpoint, f.URL+"/push/")
+	f.mutex.Lock()
+	delete(f.keys, id)
+	f.mutex.Unlock()
+}
+
+// FailWith makes every following request answer status, 0 restores success
+func (f *FakeEndpoint) FailWith(status int) {
+	f.mutex.Lock()
+	f.status = status
+	f.mutex.Unlock()
+}
+
+// Deliveries returns the notifications received so far
+func (f *FakeEndpoint) Deliveries() []Delivery {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]Delivery(nil), f.deliveries...)
+}
+
+func (f *FakeEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/push/")
+
+	f.mutex.Lock()
+	key, ok := f.keys[id]
+	auth := f.auth[id]
+	status := f.status
+	f.mutex.Unlock()
+
+	switch {
+	case status != 0:
+		w.WriteHeader(status)
+		return
+	case !ok:
+		w.WriteHeader(http.StatusGone)
+		return
+	case !strings.HasPrefix(r.Header.Get("Authorization"), "vapid t="):
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	payload, err := decrypt(key, auth, body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	f.mutex.Lock()
+	f.deliveries = append(f.deliveries, Delivery{Header: r.Header.Clone(), Payload: payload})
+	f.mutex.Unlock()
+	w.WriteHeader(http.StatusCreated)
+}
+
+// decrypt opens a single aes128gcm record, the user agent side of Encrypt
+func decrypt(uaPrivate *ecdh.PrivateKey, authSecret []byte, body []byte) ([]byte, error) {
+	if len(body) < saltSize+5 {
+		return nil, errors.New("push: record too short")
+	}
+	salt := body[:saltSize]
+	idLength := int(body[saltSize+4])
+	if len(body) < saltSize+5+idLength {
+		return nil, errors.New("push: record too short")
+	}
+	asPublicBytes := body[saltSize+5 : saltSize+5+idLength]
+	ciphertext := body[saltSize+5+idLength:]
+
+	asPublic, err := ecdh.P256().NewPublicKey(asPublicBytes)
+	if err != nil {
+		return nil, err
+	}
+	sharedSecret, err := uaPrivate.ECDH(asPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	keyInfo := append([]byte("WebPush: info\x00"), uaPrivate.PublicKey().Bytes()...)
+	keyInfo = append(keyInfo, asPublicBytes...)
+	ikm, err := expand(sharedSecret, authSecret, keyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	contentKey, err := expand(ikm, salt, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := expand(ikm, salt, []byte("Content-Encoding: nonce\x00"), 12)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(contentKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	record, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	end := strings.LastIndexByte(string(record), 0x02)
+	if end < 0 {
+		return nil, errors.New("push: missing record delimiter")
+	}
+	return record[:end], nil
+}
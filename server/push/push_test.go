@@ -0,0 +1,111 @@
+package push
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newFake serves a FakeEndpoint and returns it with a sender delivering to it
+func newFake(t *testing.T) (*FakeEndpoint, *Sender) {
+	t.Helper()
+
+	fake := NewFakeEndpoint("")
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	fake.URL = server.URL
+
+	key, err := GenerateVAPIDKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vapid, err := NewVAPID(key, "mailto:ops@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fake, fake.Sender(vapid)
+}
+
+func TestSentPayloadIsEncryptedForTheSubscription(t *testing.T) {
+	fake, sender := newFake(t)
+	subscription, err := fake.Subscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := []byte(`{"title":"hello"}`)
+	if err := sender.Send(context.Background(), subscription, payload, time.Hour, UrgencyHigh); err != nil {
+		t.Fatal(err)
+	}
+
+	deliveries := fake.Deliveries()
+	if len(deliveries) != 1 {
+		t.Fatalf("got %d deliveries, want 1", len(deliveries))
+	}
+	if !bytes.Equal(deliveries[0].Payload, payload) {
+		t.Fatalf("decrypted %q, want %q", deliveries[0].Payload, payload)
+	}
+	header := deliveries[0].Header
+	if header.Get("Content-Encoding") != "aes128gcm" || header.Get("TTL") != "3600" || header.Get("Urgency") != "high" {
+		t.Fatalf("unexpected headers %v", header)
+	}
+
+	// Another subscription cannot read it
+	other, _ := fake.Subscribe()
+	subscription.Keys = other.Keys
+	if err := sender.Send(context.Background(), subscription, payload, time.Hour, UrgencyHigh); err == nil {
+		t.Fatal("payload encrypted for other keys was accepted")
+	}
+}
+
+func TestExpiredSubscriptionIsGone(t *testing.T) {
+	fake, sender := newFake(t)
+	subscription, _ := fake.Subscribe()
+	fake.Expire(subscription)
+
+	err := sender.Send(context.Background(), subscription, []byte("{}"), time.Hour, UrgencyNormal)
+	if !errors.Is(err, ErrSubscriptionGone) {
+		t.Fatalf("got %v, want ErrSubscriptionGone", err)
+	}
+}
+
+func TestServiceErrorsTellWhetherToRetry(t *testing.T) {
+	fake, sender := newFake(t)
+	subscription, _ := fake.Subscribe()
+
+	for status, temporary := range map[int]bool{
+		http.StatusServiceUnavailable: true,
+		http.StatusTooManyRequests:    true,
+		http.StatusBadRequest:         false,
+	} {
+		fake.FailWith(status)
+		err := sender.Send(context.Background(), subscription, []byte("{}"), time.Hour, UrgencyNormal)
+		var statusErr *StatusError
+		if !errors.As(err, &statusErr) || statusErr.StatusCode != status || statusErr.Temporary() != temporary {
+			t.Errorf("status %d: got %v, want a StatusError temporary=%v", status, err, temporary)
+		}
+	}
+
+	fake.FailWith(0)
+	if err := sender.Send(context.Background(), subscription, []byte("{}"), time.Hour, UrgencyNormal); err != nil {
+		t.Fatalf("after recovering: %v", err)
+	}
+}
+
+func TestEndpointsOfUnknownServicesAreRefused(t *testing.T) {
+	_, sender := newFake(t)
+
+	for _, endpoint := range []string{
+		"http://169.254.169.254/latest/meta-data",
+		"https://evil.example/push/1",
+		"not a url",
+	} {
+		if err := sender.ValidateEndpoint(endpoint); err == nil {
+			t.Errorf("%s was accepted", endpoint)
+		}
+	}
+}
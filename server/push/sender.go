@@ -0,0 +1,141 @@
+package push
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Urgency hints how soon the push service should wake the device
+type Urgency string
+
+const (
+	UrgencyNormal Urgency = "normal"
+	UrgencyHigh   Urgency = "high"
+)
+
+// ErrSubscriptionGone is returned when the push service says the
+// subscription expired or was removed, it should be deleted
+var ErrSubscriptionGone = errors.New("push: subscription is gone")
+
+// StatusError is an unexpected answer of a push service
+type StatusError struct {
+	StatusCode int
+	// RetryAfter is set when the service asked to slow down
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("push: service answered %d", e.StatusCode)
+}
+
+// Temporary reports whether sending again later may succeed
+func (e *StatusError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// DefaultEndpointHosts are the push services of the major browsers,
+// subscriptions pointing anywhere else are refused
+var DefaultEndpointHosts = []string{
+	"fcm.googleapis.com",
+	"updates.push.services.mozilla.com",
+	"notify.windows.com",
+	"push.apple.com",
+}
+
+// Sender posts encrypted notifications to push services
+type Sender struct {
+	vapid *VAPID
+	http  *http.Client
+	hosts []string
+	// allowInsecure lets endpoints use http, for a local FakeEndpoint
+	allowInsecure bool
+}
+
+// NewSender creates a sender authenticating with vapid, endpoints must be
+// on one of hosts or their subdomains
+func NewSender(vapid *VAPID, hosts []string) *Sender {
+	return &Sender{
+		vapid: vapid,
+		http:  &http.Client{Timeout: 10 * time.Second},
+		hosts: hosts,
+	}
+}
+
+// PublicKey is the applicationServerKey of the sender
+func (s *Sender) PublicKey() string {
+	return s.vapid.PublicKey()
+}
+
+// ValidateEndpoint refuses endpoints that are not on an allowed push
+// service, so subscriptions cannot make the server call arbitrary URLs
+func (s *Sender) ValidateEndpoint(endpoint string) error {
+	target, err := url.Parse(endpoint)
+	if err != nil || target.Host == "" {
+		return errors.New("push: endpoint is not a URL")
+	}
+	if target.Scheme != "https" && !(s.allowInsecure && target.Scheme == "http") {
+		return errors.New("push: endpoint must use https")
+	}
+
+	host := strings.ToLower(target.Hostname())
+	for _, allowed := range s.hosts {
+		if host == allowed || strings.HasSuffix(host, "."+allowed) {
+			return nil
+		}
+	}
+	return errors.New("push: endpoint is not a known push service")
+}
+
+// Send encrypts payload for subscription and posts it. ttl is how long the
+// push service keeps it for an offline device.
+func (s *Sender) Send(ctx context.Context, subscription Subscription, payload []byte, ttl time.Duration, urgency Urgency) error {
+	if err := s.ValidateEndpoint(subscription.Endpoint); err != nil {
+		return err
+	}
+
+	body, err := Encrypt(subscription.Keys, payload)
+	if err != nil {
+		return err
+	}
+
+	authorization, err := s.vapid.authorization(subscription.Endpoint, time.Now())
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, subscription.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/octet-stream")
+	request.Header.Set("Content-Encoding", "aes128gcm")
+	request.Header.Set("TTL", strconv.Itoa(int(ttl.Seconds())))
+	request.Header.Set("Urgency", string(urgency))
+	request.Header.Set("Authorization", authorization)
+
+	response, err := s.http.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	switch {
+	case response.StatusCode >= 200 && response.StatusCode < 300:
+		return nil
+	case response.StatusCode == http.StatusNotFound || response.StatusCode == http.StatusGone:
+		return ErrSubscriptionGone
+	}
+
+	statusErr := &StatusError{StatusCode: response.StatusCode}
+	if seconds, err := strconv.Atoi(response.Header.Get("Retry-After")); err == nil {
+		statusErr.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return statusErr
+}
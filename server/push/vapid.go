@@ -0,0 +1,90 @@
+// Package push delivers Web Push notifications: VAPID authentication
+// (RFC 8292) and aes128gcm payload encryption (RFC 8291).
+package push
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"time"
+)
+
+// VAPID identifies the application server to push services
+type VAPID struct {
+	private   *ecdsa.PrivateKey
+	publicKey []byte // uncompressed point
+	// subject is a mailto: or https: contact for the push service operator
+	subject string
+}
+
+// GenerateVAPIDKey returns a new private key, base64url encoded, to put in
+// the configuration
+func GenerateVAPIDKey() (string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(key.D.FillBytes(make([]byte, 32))), nil
+}
+
+// NewVAPID loads a base64url encoded P-256 private key
+func NewVAPID(privateKey string, subject string) (*VAPID, error) {
+	if subject == "" {
+		return nil, errors.New("push: VAPID subject (mailto: or https: contact) is required")
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(privateKey)
+	if err != nil || len(raw) != 32 {
+		return nil, errors.New("push: VAPID private key must be 32 base64url bytes")
+	}
+
+	ecdhKey, err := ecdh.P256().NewPrivateKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("push: VAPID private key: %w", err)
+	}
+
+	key := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(raw)}
+	key.PublicKey.Curve = elliptic.P256()
+	key.PublicKey.X, key.PublicKey.Y = key.PublicKey.Curve.ScalarBaseMult(raw)
+
+	return &VAPID{private: key, publicKey: ecdhKey.PublicKey().Bytes(), subject: subject}, nil
+}
+
+// PublicKey is the applicationServerKey browsers subscribe with, base64url
+func (v *VAPID) PublicKey() string {
+	return base64.RawURLEncoding.EncodeToString(v.publicKey)
+}
+
+// authorization returns the Authorization header for a request to endpoint
+func (v *VAPID) authorization(endpoint string, now time.Time) (string, error) {
+	target, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	header, _ := json.Marshal(map[string]string{"typ": "JWT", "alg": "ES256"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"aud": target.Scheme + "://" + target.Host,
+		"exp": now.Add(12 * time.Hour).Unix(),
+		"sub": v.subject,
+	})
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, v.private, digest[:])
+	if err != nil {
+		return "", err
+	}
+	signature := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+
+	token := signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+	return fmt.Sprintf("vapid t=%s, k=%s", token, v.PublicKey()), nil
+}
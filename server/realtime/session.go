@@ -0,0 +1,262 @@
+// Package realtime delivers the events of the socket registry to clients.
+// Every transport (websocket, Server-Sent Events, long polling) reads a
+// Session, so events are numbered, buffered and resumed the same way.
+package realtime
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"server/db"
+	"server/dto"
+	"server/metrics"
+	"server/models"
+	"server/tracing"
+
+	"github.com/gofiber/websocket/v2"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// QueueSize is how many events a session keeps for clients resuming with
+// Last-Event-ID
+const QueueSize = 256
+
+var ErrSessionClosed = errors.New("realtime: session closed")
+
+// queued is an event and its sequence in the session
+type queued struct {
+	sequence uint64
+	event    dto.Event
+}
+
+// Session is the event stream of one connection. It outlives the HTTP
+// requests of Server-Sent Events and long polls until its socket is closed,
+// by the client or by models.ReapPresence once heartbeats stop.
+type Session struct {
+	Id     string
+	Socket *db.UserSocket
+
+	// delivered is the last sequence the client received, see Ack
+	delivered atomic.Uint64
+
+	mutex  sync.Mutex
+	events []queued
+	last   uint64
+	// wake is closed and replaced whenever an event is queued
+	wake chan struct{}
+}
+
+var (
+	sessionsMutex sync.Mutex
+	sessions      = make(map[string]*Session)
+)
+
+// Open registers a socket of user on site, conn is nil for transports other
+// than websockets. Its first event is a session event carrying the id.
+func Open(user *models.UserModel, site string, conn *websocket.Conn) *Session {
+	socket := db.NewUserSocket(user.Id, conn, site)
+	socket.Username = user.Username
+	socket.AvatarSeed = user.Author().AvatarSeed
+	socket.Invisible = user.Invisible
+
+	session := newSession(socket)
+	models.Connect(socket)
+	return session
+}
+
+// newSession registers a session reading socket, which is not connected yet
+func newSession(socket *db.UserSocket) *Session {
+	session := &Session{
+		Id:     uuid.New().String(),
+		Socket: socket,
+		wake:   make(chan struct{}),
+	}
+	session.push(dto.NewEvent(dto.EventSession, "", dto.Session{Id: session.Id}))
+
+	sessionsMutex.Lock()
+	sessions[session.Id] = session
+	sessionsMutex.Unlock()
+
+	go session.pump()
+	return session
+}
+
+// Resume finds the session of a Last-Event-ID sent by userId, along with
+// the sequence to continue after
+func Resume(lastEventId string, userId string) (*Session, uint64, bool) {
+	sessionId, sequence, ok := ParseEventId(lastEventId)
+	if !ok {
+		return nil, 0, false
+	}
+
+	session, ok := Find(sessionId, userId)
+	if !ok {
+		return nil, 0, false
+	}
+	return session, sequence, true
+}
+
+// Find returns an open session of userId
+func Find(sessionId string, userId string) (*Session, bool) {
+	sessionsMutex.Lock()
+	session, ok := sessions[sessionId]
+	sessionsMutex.Unlock()
+
+	if !ok || session.Socket.UserId != userId {
+		return nil, false
+	}
+	select {
+	case <-session.Socket.Done():
+		return nil, false
+	default:
+		return session, true
+	}
+}
+
+// ParseEventId splits an event id into its session and sequence
+func ParseEventId(eventId string) (string, uint64, bool) {
+	sessionId, sequence, ok := strings.Cut(eventId, ":")
+	if !ok || sessionId == "" {
+		return "", 0, false
+	}
+
+	parsed, err := strconv.ParseUint(sequence, 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return sessionId, parsed, true
+}
+
+// EventId returns the id of the event at sequence
+func (s *Session) EventId(sequence uint64) string {
+	return s.Id + ":" + strconv.FormatUint(sequence, 10)
+}
+
+// pump queues the events sent to the socket until it is closed
+func (s *Session) pump() {
+	defer func() {
+		sessionsMutex.Lock()
+		delete(sessions, s.Id)
+		sessionsMutex.Unlock()
+	}()
+
+	for {
+		select {
+		case event := <-s.Socket.Channel:
+			s.push(event)
+		case <-s.Socket.Done():
+			return
+		}
+	}
+}
+
+// push numbers event and queues it, dropping the oldest past QueueSize
+func (s *Session) push(event dto.Event) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.last++
+	event.Id = s.EventId(s.last)
+	s.events = append(s.events, queued{sequence: s.last, event: event})
+	if len(s.events) > QueueSize {
+		metrics.DroppedEvents.WithLabelValues("queue_full").Add(float64(len(s.events) - QueueSize))
+		s.events = append(s.events[:0:0], s.events[len(s.events)-QueueSize:]...)
+	}
+
+	close(s.wake)
+	s.wake = make(chan struct{})
+}
+
+// Next returns the events after sequence, waiting for one until ctx is done.
+// A reset event comes first when some of them were already dropped. It
+// returns the sequence to pass to the following call.
+func (s *Session) Next(ctx context.Context, after uint64) ([]dto.Event, uint64, error) {
+	for {
+		s.mutex.Lock()
+		if after > s.last {
+			// A sequence from the future, the client is confused, start over
+			after = s.last
+		}
+
+		var events []dto.Event
+		if len(s.events) > 0 && s.events[0].sequence > after+1 {
+			events = append(events, dto.NewEvent(dto.EventReset, "", nil))
+		}
+		for _, entry := range s.events {
+			if entry.sequence > after {
+				events = append(events, entry.event)
+			}
+		}
+		wake := s.wake
+		last := s.last
+		s.mutex.Unlock()
+
+		if len(events) > 0 {
+			return events, last, nil
+		}
+
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return nil, after, nil
+		case <-s.Socket.Done():
+			return nil, after, ErrSessionClosed
+		}
+	}
+}
+
+// Ack records that the client received the events up to sequence
+func (s *Session) Ack(sequence uint64) {
+	for {
+		current := s.delivered.Load()
+		if sequence <= current || s.delivered.CompareAndSwap(current, sequence) {
+			return
+		}
+	}
+}
+
+// Written records the delivery of events to the client over transport,
+// written from start until now. The fan-out latency of new messages is
+// measured from their insert and events of a traced change get a span.
+func (s *Session) Written(transport string, events []dto.Event, start time.Time) {
+	for _, event := range events {
+		if event.Type == dto.EventInsert {
+			if message, ok := event.Data.(dto.Message); ok && !message.CreatedAt.IsZero() {
+				metrics.FanoutLatency.Observe(metrics.Since(message.CreatedAt))
+			}
+		}
+
+		ctx := event.Context()
+		if !trace.SpanContextFromContext(ctx).IsValid() {
+			continue
+		}
+		_, span := tracing.Tracer.Start(ctx, "realtime.write", trace.WithTimestamp(start), trace.WithSpanKind(trace.SpanKindProducer))
+		span.SetAttributes(
+			attribute.String("realtime.transport", transport),
+			attribute.String("realtime.session", s.Id),
+			attribute.String("realtime.event_id", event.Id),
+		)
+		span.End()
+	}
+}
+
+// drained reports whether the client received every queued event
+func (s *Session) drained() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.delivered.Load() >= s.last
+}
+
+// Close unregisters the socket and ends the session
+func (s *Session) Close() {
+	models.Disconnect(s.Socket)
+	s.Socket.Close()
+}
@@ -0,0 +1,281 @@
+package realtime
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"server/db"
+	"server/dto"
+)
+
+// openTestSession opens a session of userId without connecting its socket,
+// so no presence is announced and Mongo is not needed
+func openTestSession(t *testing.T, userId string) *Session {
+	t.Helper()
+
+	session := newSession(db.NewUserSocket(userId, nil, ""))
+	t.Cleanup(session.Close)
+	return session
+}
+
+// pushEvents queues count typing events on session
+func pushEvents(session *Session, count int) {
+	for i := 0; i < count; i++ {
+		session.push(dto.NewEvent(dto.EventTyping, "session.example", nil))
+	}
+}
+
+// eventTypes returns the types of events in order
+func eventTypes(events []dto.Event) []string {
+	types := make([]string, 0, len(events))
+	for _, event := range events {
+		types = append(types, event.Type)
+	}
+	return types
+}
+
+func TestParseEventId(t *testing.T) {
+	tests := []struct {
+		eventId  string
+		session  string
+		sequence uint64
+		ok       bool
+	}{
+		{"abc:12", "abc", 12, true},
+		{"abc:0", "abc", 0, true},
+		{"a:b:1", "", 0, false},
+		{"abc", "", 0, false},
+		{":12", "", 0, false},
+		{"abc:", "", 0, false},
+		{"abc:-1", "", 0, false},
+		{"", "", 0, false},
+	}
+	for _, test := range tests {
+		session, sequence, ok := ParseEventId(test.eventId)
+		if session != test.session || sequence != test.sequence || ok != test.ok {
+			t.Errorf("ParseEventId(%q) = %q, %d, %v, want %q, %d, %v", test.eventId, session, sequence, ok, test.session, test.sequence, test.ok)
+		}
+	}
+}
+
+func TestNextResumesAfterSequence(t *testing.T) {
+	session := openTestSession(t, "next-user")
+	pushEvents(session, 3)
+
+	tests := []struct {
+		name  string
+		after uint64
+		types []string
+		last  uint64
+	}{
+		{"new session", 0, []string{dto.EventSession, dto.EventTyping, dto.EventTyping, dto.EventTyping}, 4},
+		{"resumed", 2, []string{dto.EventTyping, dto.EventTyping}, 4},
+		{"caught up", 4, []string{}, 4},
+		{"sequence from the future", 100, []string{}, 4},
+	}
+	for _, test := range tests {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		events, last, err := session.Next(ctx, test.after)
+		cancel()
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		got := eventTypes(events)
+		if len(got) != len(test.types) || (len(events) > 0 && last != test.last) {
+			t.Errorf("%s: got %v up to %d, want %v up to %d", test.name, got, last, test.types, test.last)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.types[i] {
+				t.Errorf("%s: got %v, want %v", test.name, got, test.types)
+				break
+			}
+		}
+		if len(events) > 0 && events[len(events)-1].Id != session.EventId(test.last) {
+			t.Errorf("%s: last event id %q, want %q", test.name, events[len(events)-1].Id, session.EventId(test.last))
+		}
+	}
+}
+
+func TestNextWaitsForAnEvent(t *testing.T) {
+	session := openTestSession(t, "waiting-user")
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		session.Socket.Send(dto.NewEvent(dto.EventTyping, "session.example", nil))
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	events, last, err := session.Next(ctx, 1)
+	if err != nil || len(events) != 1 || events[0].Type != dto.EventTyping || last != 2 {
+		t.Fatalf("got %v up to %d, %v, want the typing event sent to the socket", eventTypes(events), last, err)
+	}
+
+	session.Close()
+	if _, _, err := session.Next(context.Background(), last); err != ErrSessionClosed {
+		t.Fatalf("waiting on a closed session: got %v, want ErrSessionClosed", err)
+	}
+}
+
+func TestNextDeliversDeletes(t *testing.T) {
+	session := openTestSession(t, "delete-user")
+	deleted := dto.Message{Id: "gone", Channel: "session.example"}
+	session.Socket.Send(dto.NewEvent(dto.EventDelete, deleted.Channel, deleted))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	events, _, err := session.Next(ctx, 1)
+	if err != nil || len(events) != 1 || events[0].Type != dto.EventDelete {
+		t.Fatalf("got %v, %v, want the delete", eventTypes(events), err)
+	}
+	if data, ok := events[0].Data.(dto.Message); !ok || data.Id != deleted.Id {
+		t.Fatalf("got data %+v, want message %s", events[0].Data, deleted.Id)
+	}
+}
+
+func TestNextResetsAfterDroppedEvents(t *testing.T) {
+	session := openTestSession(t, "reset-user")
+	pushEvents(session, QueueSize+10)
+	last := uint64(QueueSize + 11)
+	oldest := last - QueueSize + 1
+
+	tests := []struct {
+		name  string
+		after uint64
+		reset bool
+		count int
+	}{
+		{"missed events", 0, true, QueueSize + 1},
+		{"missed one event", oldest - 2, true, QueueSize + 1},
+		{"nothing missed", oldest - 1, false, QueueSize},
+		{"resumed within the queue", last - 5, false, 5},
+	}
+	for _, test := range tests {
+		events, got, err := session.Next(context.Background(), test.after)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if got != last || len(events) != test.count {
+			t.Errorf("%s: got %d events up to %d, want %d up to %d", test.name, len(events), got, test.count, last)
+			continue
+		}
+		if reset := events[0].Type == dto.EventReset; reset != test.reset {
+			t.Errorf("%s: reset first = %v, want %v", test.name, reset, test.reset)
+		}
+	}
+}
+
+func TestResume(t *testing.T) {
+	session := openTestSession(t, "resume-user")
+	closed := openTestSession(t, "resume-user")
+	closed.Close()
+
+	tests := []struct {
+		name        string
+		lastEventId string
+		userId      string
+		ok          bool
+	}{
+		{"open session", session.EventId(1), "resume-user", true},
+		{"another user", session.EventId(1), "someone-else", false},
+		{"unknown session", "unknown:1", "resume-user", false},
+		{"expired session", closed.EventId(1), "resume-user", false},
+		{"malformed id", session.Id, "resume-user", false},
+	}
+	for _, test := range tests {
+		got, sequence, ok := Resume(test.lastEventId, test.userId)
+		if ok != test.ok {
+			t.Errorf("%s: ok = %v, want %v", test.name, ok, test.ok)
+			continue
+		}
+		if ok && (got != session || sequence != 1) {
+			t.Errorf("%s: resumed %s after %d, want %s after 1", test.name, got.Id, sequence, session.Id)
+		}
+	}
+}
+
+func TestShutdownDrainsSessions(t *testing.T) {
+	t.Cleanup(func() { draining.Store(false) })
+
+	// One client reads its events, the other went silent
+	reading := openTestSession(t, "reading-user")
+	silent := openTestSession(t, "silent-user")
+	received := make(chan []dto.Event, 1)
+	go func() {
+		var all []dto.Event
+		after := uint64(0)
+		for {
+			events, last, err := reading.Next(context.Background(), after)
+			if err != nil {
+				received <- all
+				return
+			}
+			all = append(all, events...)
+			after = last
+			reading.Ack(last)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	closed := Shutdown(ctx, 0)
+
+	if !Draining() {
+		t.Fatal("Shutdown did not start draining")
+	}
+	if closed < 2 {
+		t.Fatalf("closed %d sessions, want at least 2", closed)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Fatalf("returned after %s, before the silent session drained or the deadline passed", elapsed)
+	}
+
+	for _, session := range []*Session{reading, silent} {
+		select {
+		case <-session.Socket.Done():
+		default:
+			t.Fatalf("session %s was left open", session.Id)
+		}
+	}
+
+	select {
+	case events := <-received:
+		if types := eventTypes(events); len(types) == 0 || types[len(types)-1] != dto.EventRestarting {
+			t.Fatalf("reading client got %v, want the restarting event last", types)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the reading client was not ended")
+	}
+}
+
+func TestShutdownReturnsOnceDrained(t *testing.T) {
+	t.Cleanup(func() { draining.Store(false) })
+
+	session := openTestSession(t, "drained-user")
+	go func() {
+		after := uint64(0)
+		for {
+			events, last, err := session.Next(context.Background(), after)
+			if err != nil {
+				return
+			}
+			after = last
+			session.Ack(last)
+			if events[len(events)-1].Type == dto.EventRestarting {
+				return
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	Shutdown(ctx, 0)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("waited %s although every client received its events", elapsed)
+	}
+}
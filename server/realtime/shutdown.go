@@ -0,0 +1,86 @@
+package realtime
+
+import (
+	"context"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"server/dto"
+
+	"github.com/gofiber/websocket/v2"
+)
+
+// draining is set once Shutdown starts, new sessions are refused from then on
+var draining atomic.Bool
+
+// Draining reports whether the server is shutting down
+func Draining() bool {
+	return draining.Load()
+}
+
+// openSessions returns every session that is still open
+func openSessions() []*Session {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	result := make([]*Session, 0, len(sessions))
+	for _, session := range sessions {
+		result = append(result, session)
+	}
+	return result
+}
+
+// Shutdown tells every client to reconnect after reconnectIn plus up to as
+// much jitter, waits until they received their queued events or ctx is
+// done, and closes the sessions. It returns how many sessions were closed.
+func Shutdown(ctx context.Context, reconnectIn time.Duration) int {
+	draining.Store(true)
+
+	all := openSessions()
+	for _, session := range all {
+		delay := reconnectIn
+		if reconnectIn > 0 {
+			delay += time.Duration(rand.Int63n(int64(reconnectIn)))
+		}
+		session.push(dto.NewEvent(dto.EventRestarting, "", dto.Restarting{ReconnectInMs: delay.Milliseconds()}))
+	}
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+wait:
+	for !allDrained(all) {
+		select {
+		case <-ctx.Done():
+			break wait
+		case <-ticker.C:
+		}
+	}
+
+	for _, session := range all {
+		if conn := session.Socket.Conn; conn != nil {
+			conn.WriteControl(
+				websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseServiceRestart, "Server restarting"),
+				time.Now().Add(time.Second),
+			)
+		}
+		session.Close()
+	}
+	return len(all)
+}
+
+// allDrained reports whether every session delivered its queue, or closed
+func allDrained(sessions []*Session) bool {
+	for _, session := range sessions {
+		select {
+		case <-session.Socket.Done():
+			continue
+		default:
+		}
+		if !session.drained() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"server/db"
+	"server/models"
+	"server/realtime"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// closeMongo and drainRealtime are replaced by tests that check the order
+// of the steps
+var (
+	closeMongo    = db.MongoClose
+	drainRealtime = realtime.Shutdown
+)
+
+// shutdown stops the server in an order that lets clients reconnect cleanly
+// and loses no accepted write: the listener stops accepting requests, then
+// realtime clients are told to reconnect and drained, then in-flight
+// requests and the push notifications they started finish, then the change
+// stream and Mongo are closed, and the last spans are exported. The process
+// exits when timeout runs out regardless.
+func shutdown(app *fiber.App, pprofServer *http.Server, stopChanges context.CancelFunc, changesDone <-chan struct{}, stopTracing func(context.Context) error, timeout time.Duration, reconnectIn time.Duration) {
+	deadline := time.AfterFunc(timeout, func() {
+		slog.Error("Shutdown deadline exceeded, exiting")
+		os.Exit(1)
+	})
+	defer deadline.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// The listener closes at once, in-flight requests and event streams run
+	// on until they end, the streams once realtime is drained below
+	httpDone := make(chan error, 1)
+	go func() {
+		httpDone <- app.ShutdownWithContext(ctx)
+	}()
+
+	// Leave half of the time to the steps after draining
+	drainCtx, cancelDrain := context.WithTimeout(ctx, timeout/2)
+	closed := drainRealtime(drainCtx, reconnectIn)
+	cancelDrain()
+	slog.Info("Closed realtime sessions", "sessions", closed)
+
+	if err := <-httpDone; err != nil {
+		slog.Error("HTTP shutdown failed", "err", err)
+	}
+
+	if err := models.WaitForBackground(ctx); err != nil {
+		slog.Warn("Push notifications did not finish in time")
+	}
+
+	stopChanges()
+	select {
+	case <-changesDone:
+	case <-ctx.Done():
+		slog.Warn("Change stream did not stop in time")
+	}
+
+	if err := closeMongo(ctx); err != nil {
+		slog.Error("Mongo disconnect failed", "err", err)
+	}
+
+	if err := pprofServer.Shutdown(ctx); err != nil {
+		slog.Error("pprof shutdown failed", "err", err)
+	}
+
+	if err := stopTracing(ctx); err != nil {
+		slog.Error("Exporting the last spans failed", "err", err)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"server/models"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestShutdownOrder(t *testing.T) {
+	var mu sync.Mutex
+	var steps []string
+	record := func(step string) {
+		mu.Lock()
+		defer mu.Unlock()
+		steps = append(steps, step)
+	}
+
+	previous := closeMongo
+	closeMongo = func(context.Context) error {
+		record("mongo")
+		return nil
+	}
+	t.Cleanup(func() { closeMongo = previous })
+
+	// Realtime drains with the listener closed, so no new write is accepted
+	var address string
+	previousDrain := drainRealtime
+	drainRealtime = func(context.Context, time.Duration) int {
+		time.Sleep(20 * time.Millisecond)
+		if conn, err := net.Dial("tcp", address); err == nil {
+			conn.Close()
+			record("accepted while draining")
+		}
+		record("drain")
+		return 0
+	}
+	t.Cleanup(func() { drainRealtime = previousDrain })
+
+	// A slow request that starts a slower push notification
+	started := make(chan struct{})
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Get("/", func(ctx *fiber.Ctx) error {
+		models.Background(func() {
+			time.Sleep(300 * time.Millisecond)
+			record("push")
+		})
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		record("request")
+		return nil
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address = listener.Addr().String()
+	go app.Listener(listener)
+	go http.Get("http://" + listener.Addr().String() + "/")
+	<-started
+
+	changesCtx, stopChanges := context.WithCancel(context.Background())
+	changesDone := make(chan struct{})
+	go func() {
+		<-changesCtx.Done()
+		record("changes")
+		close(changesDone)
+	}()
+	stopTracing := func(context.Context) error {
+		record("tracing")
+		return nil
+	}
+
+	shutdown(app, &http.Server{}, stopChanges, changesDone, stopTracing, 5*time.Second, 0)
+
+	want := []string{"drain", "request", "push", "changes", "mongo", "tracing"}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(steps) != len(want) {
+		t.Fatalf("steps = %v, want %v", steps, want)
+	}
+	for i := range want {
+		if steps[i] != want[i] {
+			t.Fatalf("steps = %v, want %v", steps, want)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+// Package tracing sets up OpenTelemetry tracing. Spans follow a message
+// from the HTTP request that sends it, through its Mongo insert and the
+// change stream, to the fan-out and every socket write. The change stream
+// hop keeps the trace through the traceparent stored with sampled messages.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracer starts the spans of the server, it follows the provider set by
+// Setup
+var Tracer = otel.Tracer("server")
+
+// propagator carries trace context in W3C traceparent and tracestate
+var propagator = propagation.TraceContext{}
+
+// NewOTLPExporter exports spans to the OTLP/HTTP collector at endpoint, a
+// base URL such as http://localhost:4318
+func NewOTLPExporter(ctx context.Context, endpoint string) (sdktrace.SpanExporter, error) {
+	parsed, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("tracing: invalid endpoint: %w", err)
+	}
+	parsed.Path = strings.TrimRight(parsed.Path, "/") + "/v1/traces"
+
+	return otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(parsed.String()))
+}
+
+// Setup makes spans of serviceName sampled at ratio go to exporter, tests
+// pass a tracetest.InMemoryExporter. The returned function flushes and
+// stops the export.
+func Setup(exporter sdktrace.SpanExporter, serviceName string, ratio float64) func(context.Context) error {
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName))),
+	)
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagator)
+	return provider.Shutdown
+}
+
+// traceparentField is the W3C header that identifies the parent span
+const traceparentField = "traceparent"
+
+// TraceParent returns the traceparent of the span of ctx, to be stored with
+// a document. It is empty unless the span is recorded, so unsampled writes,
+// or ones made while tracing is off, store nothing.
+func TraceParent(ctx context.Context) string {
+	span := trace.SpanFromContext(ctx)
+	if !span.IsRecording() || !span.SpanContext().IsSampled() {
+		return ""
+	}
+
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	return carrier.Get(traceparentField)
+}
+
+// ContinueTrace returns ctx continuing the trace of traceparent, as
+// returned by TraceParent
+func ContinueTrace(ctx context.Context, traceparent string) context.Context {
+	if traceparent == "" {
+		return ctx
+	}
+	return propagator.Extract(ctx, propagation.MapCarrier{traceparentField: traceparent})
+}
+
+// ExtractHeaders returns ctx continuing the trace of the traceparent
+// header of a request, get reads a header
+func ExtractHeaders(ctx context.Context, get func(key string) string) context.Context {
+	carrier := propagation.MapCarrier{}
+	for _, key := range propagator.Fields() {
+		if value := get(key); value != "" {
+			carrier[key] = value
+		}
+	}
+	if len(carrier) == 0 {
+		return ctx
+	}
+	return propagator.Extract(ctx, carrier)
+}
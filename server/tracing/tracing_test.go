@@ -0,0 +1,55 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestTraceParentRoundTrip(t *testing.T) {
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSampler(sdktrace.AlwaysSample()))
+	defer provider.Shutdown(context.Background())
+
+	ctx, span := provider.Tracer("test").Start(context.Background(), "insert")
+	defer span.End()
+
+	traceparent := TraceParent(ctx)
+	if traceparent == "" {
+		t.Fatal("sampled span has no traceparent")
+	}
+
+	continued := trace.SpanContextFromContext(ContinueTrace(context.Background(), traceparent))
+	if continued.TraceID() != span.SpanContext().TraceID() || continued.SpanID() != span.SpanContext().SpanID() {
+		t.Fatalf("continued %v, want the span %v", continued, span.SpanContext())
+	}
+	if !continued.IsRemote() {
+		t.Fatal("continued span context is not remote")
+	}
+}
+
+func TestTraceParentIsEmptyUnlessRecorded(t *testing.T) {
+	unsampled := sdktrace.NewTracerProvider(sdktrace.WithSampler(sdktrace.NeverSample()))
+	defer unsampled.Shutdown(context.Background())
+
+	ctx, span := unsampled.Tracer("test").Start(context.Background(), "insert")
+	defer span.End()
+	if traceparent := TraceParent(ctx); traceparent != "" {
+		t.Fatalf("unsampled span stored %q", traceparent)
+	}
+
+	// A sampled traceparent sent by a client is not stored while tracing is
+	// off, the no-op span only carries it along
+	remote := ContinueTrace(context.Background(), "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, span = noop.NewTracerProvider().Tracer("test").Start(remote, "insert")
+	defer span.End()
+	if traceparent := TraceParent(ctx); traceparent != "" {
+		t.Fatalf("span of a disabled tracer stored %q", traceparent)
+	}
+
+	if ctx := ContinueTrace(context.Background(), ""); trace.SpanContextFromContext(ctx).IsValid() {
+		t.Fatal("empty traceparent started a trace")
+	}
+}
@@ -3,9 +3,8 @@ package utils
 import (
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"reflect"
-
-	"github.com/gofiber/fiber/v2/log"
 )
 
 func Convert_JSONStringToMap(jsonStr string) (interface{}, error) {
@@ -83,7 +82,7 @@ func Convert_StringToSlice(mp map[string]interface{}, key string) ([]string, boo
 	if ok {
 		err := json.Unmarshal([]byte(originalArray), &resultArray)
 		if err != nil {
-			log.Error("Error while unmarshalling ", key, " - ", err)
+			slog.Error("Unmarshalling failed", "key", key, "err", err)
 			return nil, false
 		}
 		return resultArray, true
@@ -95,7 +94,7 @@ func Convert_StringToSlice(mp map[string]interface{}, key string) ([]string, boo
 func Convert_SliceToString(jsonStr []string) string {
 	str, err := json.Marshal(jsonStr)
 	if err != nil {
-		log.Error("Error marshalling to JSON:", err)
+		slog.Error("Marshalling to JSON failed", "err", err)
 	}
 
 	return string(str)